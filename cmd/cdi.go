@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nvidia/sandbox-device-plugin/pkg/device_plugin"
+	"github.com/spf13/cobra"
+)
+
+func newCDICommand(opts *globalOptions) *cobra.Command {
+	cdi := &cobra.Command{
+		Use:   "cdi",
+		Short: "Manage CDI specs",
+	}
+	cdi.AddCommand(newCDIGenerateCommand(opts))
+	return cdi
+}
+
+// newCDIGenerateCommand returns "cdi generate", which discovers the devices
+// and writes their CDI specs without serving them, e.g. from an
+// initContainer. Given addresses, it instead writes a CDI spec for just those
+// PCI devices, without running discovery.
+func newCDIGenerateCommand(opts *globalOptions) *cobra.Command {
+	var addresses []string
+	var class, version, vendor, root string
+	var labelNode bool
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Write the CDI specs of the discovered devices, or of the given PCI devices",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(addresses) == 0 {
+				if err := configure(opts); err != nil {
+					return err
+				}
+				if err := device_plugin.ConfigureCDI(version, vendor, root); err != nil {
+					return fmt.Errorf("invalid CDI configuration: %w", err)
+				}
+				return runCDIOnly(labelNode)
+			}
+			if labelNode {
+				return fmt.Errorf("--label-node cannot be used with --address")
+			}
+			if err := device_plugin.ConfigureCDI(version, vendor, root); err != nil {
+				return fmt.Errorf("invalid CDI configuration: %w", err)
+			}
+			err := device_plugin.ConfigureContainerPaths(os.Getenv("VFIO_CONTROL_CONTAINER_PATH"),
+				os.Getenv("VFIO_GROUP_CONTAINER_PATH"), os.Getenv("VFIO_DEVICE_CONTAINER_PATH"))
+			if err != nil {
+				return fmt.Errorf("invalid VFIO container paths: %w", err)
+			}
+			if err := device_plugin.GenerateCDISpecForAddresses(class, addresses); err != nil {
+				return fmt.Errorf("CDI generation failed: %w", err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&addresses, "address", nil, "PCI address of a vfio-pci bound device (repeatable or comma separated)")
+	cmd.Flags().StringVar(&class, "class", "pgpu", "with --address, CDI class of the generated devices, e.g. pgpu for nvidia.com/pgpu")
+	cmd.Flags().StringVar(&version, "spec-version", os.Getenv("CDI_SPEC_VERSION"), "CDI spec version")
+	cmd.Flags().StringVar(&vendor, "vendor", os.Getenv("CDI_VENDOR"), "CDI vendor")
+	cmd.Flags().StringVar(&root, "cdi-root", os.Getenv("CDI_ROOT"), "comma separated directories the CDI spec is written to")
+	cmd.Flags().BoolVar(&labelNode, "label-node", false, "label the node once the CDI specs of the discovered devices are written")
+	return cmd
+}
+
+// runCDIOnly discovers the devices and writes their CDI specs
+func runCDIOnly(labelNode bool) error {
+	if err := device_plugin.RunCDIOnly(labelNode); err != nil {
+		return fmt.Errorf("CDI generation failed: %w", err)
+	}
+	return nil
+}
@@ -29,19 +29,194 @@
 package main
 
 import (
-	"github.com/nvidia/sandbox-device-plugin/pkg/device_plugin"
+	"context"
+	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nvidia/sandbox-device-plugin/pkg/device_plugin"
+	"github.com/spf13/cobra"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// globalOptions are the flags shared by every command. Flags default to their
+// environment variable, so a flag overrides the environment, and the config
+// file overrides the environment for the settings it contains.
+type globalOptions struct {
+	configFile   string
+	featureGates string
+}
+
 func main() {
-	var ok bool
-	device_plugin.PGPUAlias, ok = os.LookupEnv("P_GPU_ALIAS")
+	if err := newRootCommand().Execute(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newRootCommand returns the command line of the plugin. Without a
+// subcommand the device plugins are served.
+func newRootCommand() *cobra.Command {
+	opts := &globalOptions{}
+	var cdiOnly, labelNode bool
+	root := &cobra.Command{
+		Use:           "nvidia-sandbox-device-plugin",
+		Short:         "Advertise vfio-pci bound NVIDIA GPUs and NVSwitches to the kubelet for sandboxed workloads",
+		Version:       version,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cdiOnly {
+				if err := configure(opts); err != nil {
+					return err
+				}
+				return runCDIOnly(labelNode)
+			}
+			return runServe(opts)
+		},
+	}
+	root.PersistentFlags().StringVar(&opts.configFile, "config", os.Getenv("CONFIG_FILE"), "path of a config file that is watched and applied at runtime")
+	root.PersistentFlags().StringVar(&opts.featureGates, "feature-gates", os.Getenv("FEATURE_GATES"), "comma separated list of Feature=bool pairs, e.g. IOMMUFD=false,CDIInAllocate=true")
+	// --cdi-only and --label-node predate the cdi generate command
+	root.Flags().BoolVar(&cdiOnly, "cdi-only", false, "discover devices, write CDI specs and exit without serving devices")
+	root.Flags().BoolVar(&labelNode, "label-node", false, "with --cdi-only, label the node once CDI specs are written")
+	root.Flags().MarkDeprecated("cdi-only", "use \"cdi generate\" instead")
+	root.Flags().MarkDeprecated("label-node", "use \"cdi generate --label-node\" instead")
+
+	root.CompletionOptions.DisableDefaultCmd = true
+	root.AddCommand(
+		newServeCommand(opts),
+		newDiscoverCommand(opts),
+		newCDICommand(opts),
+		newValidateCommand(opts),
+		newVerifyAllocationCommand(opts),
+		newExtenderCommand(),
+		newInventoryCommand(),
+		newVersionCommand(),
+	)
+	return root
+}
+
+func newServeCommand(opts *globalOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "serve",
+		Short: "Discover the devices and serve them to the kubelet (the default)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runServe(opts)
+		},
+	}
+}
+
+// runServe serves the device plugins until SIGINT or SIGTERM, which cancel
+// the root context of the daemon and stop the plugins. SIGHUP rediscovers
+// the devices and restarts the plugins in place, and SIGUSR1 dumps a
+// snapshot of the plugin state.
+func runServe(opts *globalOptions) error {
+	if err := configure(opts); err != nil {
+		return err
+	}
+	// the root context of the daemon, canceled on SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager, err := device_plugin.StartDevicePlugins(ctx)
+	if err != nil {
+		return fmt.Errorf("device plugin failed: %w", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			manager.Reload()
+			continue
+		}
+		if sig == syscall.SIGUSR1 {
+			manager.DumpSnapshot()
+			continue
+		}
+		log.Printf("Received %v, stopping device plugins", sig)
+		cancel()
+		manager.Stop()
+		break
+	}
+	return nil
+}
+
+func newDiscoverCommand(opts *globalOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "discover",
+		Short: "Print the devices that would be advertised, without writing CDI specs",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := configure(opts); err != nil {
+				return err
+			}
+			return device_plugin.DiscoverDevices(cmd.OutOrStdout())
+		},
+	}
+}
+
+func newValidateCommand(opts *globalOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the config file and feature gates and run the preflight checks",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := device_plugin.SetFeatureGates(opts.featureGates); err != nil {
+				return fmt.Errorf("invalid feature gates: %w", err)
+			}
+			return device_plugin.Validate(cmd.OutOrStdout(), opts.configFile)
+		},
+	}
+}
+
+func newVersionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Print the version",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := fmt.Fprintln(cmd.OutOrStdout(), version)
+			return err
+		},
+	}
+}
+
+// configure applies the feature gates, aliases, config file, CDI settings and
+// VFIO container paths
+func configure(opts *globalOptions) error {
+	if err := device_plugin.SetFeatureGates(opts.featureGates); err != nil {
+		return fmt.Errorf("invalid feature gates: %w", err)
+	}
+	log.Printf("Feature gates: %s", device_plugin.FeatureGatesString())
+
+	pgpuAlias, ok := os.LookupEnv("P_GPU_ALIAS")
 	if !ok {
-		device_plugin.PGPUAlias = "pgpu"
+		pgpuAlias = "pgpu"
 	}
-	device_plugin.NVSwitchAlias, ok = os.LookupEnv("NVSWITCH_ALIAS")
+	nvSwitchAlias, ok := os.LookupEnv("NVSWITCH_ALIAS")
 	if !ok {
-		device_plugin.NVSwitchAlias = "nvswitch"
+		nvSwitchAlias = "nvswitch"
+	}
+	if err := device_plugin.SetAliases(pgpuAlias, nvSwitchAlias); err != nil {
+		return fmt.Errorf("invalid alias: %w", err)
+	}
+	if err := device_plugin.SetConfigFile(opts.configFile); err != nil {
+		return fmt.Errorf("invalid config file: %w", err)
+	}
+	err := device_plugin.ConfigureCDI(os.Getenv("CDI_SPEC_VERSION"), os.Getenv("CDI_VENDOR"), os.Getenv("CDI_ROOT"))
+	if err != nil {
+		return fmt.Errorf("invalid CDI configuration: %w", err)
+	}
+	err = device_plugin.ConfigureContainerPaths(os.Getenv("VFIO_CONTROL_CONTAINER_PATH"),
+		os.Getenv("VFIO_GROUP_CONTAINER_PATH"), os.Getenv("VFIO_DEVICE_CONTAINER_PATH"))
+	if err != nil {
+		return fmt.Errorf("invalid VFIO container paths: %w", err)
 	}
-	device_plugin.InitiateDevicePlugin()
+	return nil
 }
@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// adminSocket is the unix socket the device admin API is served on; empty
+// disables the API
+var adminSocket = getEnvString("ADMIN_SOCKET", "")
+
+// adminSocketMode restricts the admin API to the owner of the socket, i.e.
+// root on the node
+const adminSocketMode = 0600
+
+// DeviceAdminServer answers device queries of node local tooling
+type DeviceAdminServer interface {
+	// ListDevices returns the devices matching the model, health, allocated
+	// and maintenance filters of the request
+	ListDevices(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	// GetDevice returns the device with the pciAddress of the request
+	GetDevice(context.Context, *structpb.Struct) (*structpb.Struct, error)
+}
+
+// deviceAdminServer serves the metadata of the devices of the manager
+type deviceAdminServer struct {
+	metadata *metadataHandler
+}
+
+// deviceFilter selects devices by model, health, allocation and maintenance
+type deviceFilter struct {
+	model       string
+	health      string
+	allocated   *bool
+	maintenance *bool
+}
+
+// parseDeviceFilter reads the filters of a ListDevices request
+func parseDeviceFilter(req *structpb.Struct) (deviceFilter, error) {
+	var f deviceFilter
+	for name, value := range req.GetFields() {
+		switch name {
+		case "model":
+			s, ok := value.GetKind().(*structpb.Value_StringValue)
+			if !ok {
+				return f, fmt.Errorf("filter %s must be a string", name)
+			}
+			f.model = s.StringValue
+		case "health":
+			s, ok := value.GetKind().(*structpb.Value_StringValue)
+			if !ok {
+				return f, fmt.Errorf("filter %s must be a string", name)
+			}
+			f.health = s.StringValue
+		case "allocated":
+			b, ok := value.GetKind().(*structpb.Value_BoolValue)
+			if !ok {
+				return f, fmt.Errorf("filter %s must be a bool", name)
+			}
+			f.allocated = &b.BoolValue
+		case "maintenance":
+			b, ok := value.GetKind().(*structpb.Value_BoolValue)
+			if !ok {
+				return f, fmt.Errorf("filter %s must be a bool", name)
+			}
+			f.maintenance = &b.BoolValue
+		default:
+			return f, fmt.Errorf("unknown filter %s", name)
+		}
+	}
+	return f, nil
+}
+
+// matches returns true if the device passes the filter. Models match case
+// insensitively on a substring, e.g. "h100" matches "GH100 [H100 SXM5 80GB]".
+func (f deviceFilter) matches(dev DeviceMetadata) bool {
+	if f.model != "" && !strings.Contains(strings.ToLower(dev.Model), strings.ToLower(f.model)) {
+		return false
+	}
+	if f.health != "" && !strings.EqualFold(dev.Health, f.health) {
+		return false
+	}
+	if f.allocated != nil && dev.Allocated != *f.allocated {
+		return false
+	}
+	if f.maintenance != nil && (dev.Maintenance != nil) != *f.maintenance {
+		return false
+	}
+	return true
+}
+
+// deviceStruct renders the metadata of a device with the field names of the
+// metadata API
+func deviceStruct(dev DeviceMetadata) (*structpb.Struct, error) {
+	data, err := json.Marshal(dev)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return structpb.NewStruct(fields)
+}
+
+// ListDevices returns {"devices": [...]} sorted by PCI address
+func (s *deviceAdminServer) ListDevices(_ context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	filter, err := parseDeviceFilter(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	devices := []*structpb.Value{}
+	for _, dev := range s.metadata.deviceMetadata() {
+		if !filter.matches(dev) {
+			continue
+		}
+		st, err := deviceStruct(dev)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to render device %s: %v", dev.PCIAddress, err)
+		}
+		devices = append(devices, structpb.NewStructValue(st))
+	}
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"devices": structpb.NewListValue(&structpb.ListValue{Values: devices}),
+	}}, nil
+}
+
+// GetDevice returns the device with the requested PCI address
+func (s *deviceAdminServer) GetDevice(_ context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	address := req.GetFields()["pciAddress"].GetStringValue()
+	if address == "" {
+		return nil, status.Error(codes.InvalidArgument, "pciAddress is required")
+	}
+	for _, dev := range s.metadata.deviceMetadata() {
+		if dev.PCIAddress != address {
+			continue
+		}
+		st, err := deviceStruct(dev)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to render device %s: %v", address, err)
+		}
+		return st, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "device %s not found", address)
+}
+
+func _DeviceAdmin_ListDevices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(structpb.Struct)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceAdminServer).ListDevices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/v1alpha1.DeviceAdmin/ListDevices",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceAdminServer).ListDevices(ctx, req.(*structpb.Struct))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeviceAdmin_GetDevice_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(structpb.Struct)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceAdminServer).GetDevice(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/v1alpha1.DeviceAdmin/GetDevice",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceAdminServer).GetDevice(ctx, req.(*structpb.Struct))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// deviceAdminServiceDesc describes the v1alpha1.DeviceAdmin service. Requests
+// and devices are google.protobuf.Struct messages; devices have the fields of
+// the metadata API.
+var deviceAdminServiceDesc = grpc.ServiceDesc{
+	ServiceName: "v1alpha1.DeviceAdmin",
+	HandlerType: (*DeviceAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListDevices",
+			Handler:    _DeviceAdmin_ListDevices_Handler,
+		},
+		{
+			MethodName: "GetDevice",
+			Handler:    _DeviceAdmin_GetDevice_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "device_admin.proto",
+}
+
+// serveAdmin serves the device admin API on the unix socket until the daemon
+// context is canceled. The socket is only accessible by its owner.
+func serveAdmin(m *DevicePluginManager) {
+	if adminSocket == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(adminSocket), 0755); err != nil {
+		log.Printf("Error creating admin socket directory: %v", err)
+		return
+	}
+	if err := os.Remove(adminSocket); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing stale admin socket: %v", err)
+		return
+	}
+	listener, err := net.Listen("unix", adminSocket)
+	if err != nil {
+		log.Printf("Error listening on admin socket %s: %v", adminSocket, err)
+		return
+	}
+	if err := os.Chmod(adminSocket, adminSocketMode); err != nil {
+		log.Printf("Error restricting admin socket %s: %v", adminSocket, err)
+		listener.Close()
+		return
+	}
+
+	server := grpc.NewServer(auxGRPCServerOptions()...)
+	server.RegisterService(&deviceAdminServiceDesc, &deviceAdminServer{
+		metadata: &metadataHandler{manager: m, owners: listDeviceOwners},
+	})
+	go func() {
+		<-daemonCtx.Done()
+		server.Stop()
+	}()
+	log.Printf("Serving device admin API on %s", adminSocket)
+	if err := server.Serve(listener); err != nil {
+		log.Printf("Error serving device admin API: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"tags.cncf.io/container-device-interface/pkg/parser"
+)
+
+// maxAliasLength is the maximum length of the name part of an extended
+// resource name
+const maxAliasLength = 63
+
+// SetAliases validates and sets the resource names all GPUs and all
+// NVSwitches are advertised under. Empty aliases name the resources after the
+// device models.
+func SetAliases(pgpu, nvswitch string) error {
+	if err := validateAlias("P_GPU_ALIAS", pgpu); err != nil {
+		return err
+	}
+	if err := validateAlias("NVSWITCH_ALIAS", nvswitch); err != nil {
+		return err
+	}
+	PGPUAlias, NVSwitchAlias = pgpu, nvswitch
+	return nil
+}
+
+// validateAlias returns an error if the alias cannot be used both as the name
+// of an extended resource and as a CDI class, suggesting a sanitized
+// alternative when there is one
+func validateAlias(name, alias string) error {
+	if alias == "" {
+		return nil
+	}
+	problems := validation.IsQualifiedName(DeviceNamespace + "/" + alias)
+	if err := parser.ValidateClassName(alias); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%s %q is not a valid resource name and CDI class: %s", name, alias, strings.Join(problems, "; "))
+	if suggestion := sanitizeAlias(alias); suggestion != "" {
+		err = fmt.Errorf("%w (use %q instead)", err, suggestion)
+	}
+	return err
+}
+
+// sanitizeAlias returns the alias with the characters that are invalid in
+// resource names and CDI classes replaced by underscores, starting with a
+// letter and ending with a letter or digit, or an empty string if nothing
+// remains
+func sanitizeAlias(alias string) string {
+	var b strings.Builder
+	for _, c := range alias {
+		if parser.IsAlphaNumeric(c) || c == '_' || c == '-' || c == '.' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	s := b.String()
+	s = strings.TrimLeftFunc(s, func(c rune) bool { return !parser.IsLetter(c) })
+	if len(s) > maxAliasLength {
+		s = s[:maxAliasLength]
+	}
+	return strings.TrimRightFunc(s, func(c rune) bool { return !parser.IsAlphaNumeric(c) })
+}
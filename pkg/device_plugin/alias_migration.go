@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// aliasMigrationWindow is how long a resource renamed by an alias change is
+// still advertised under its previous name; 0 only reports the rename
+var aliasMigrationWindow = getEnvDuration("ALIAS_MIGRATION_WINDOW", 0)
+
+// resourceMigration records the rename of a resource, e.g. after P_GPU_ALIAS
+// was changed
+type resourceMigration struct {
+	To    string    `json:"to"`
+	Since time.Time `json:"since"`
+}
+
+// detectRenames returns the resources of the previous run that are no longer
+// served but whose devices are now advertised by another resource, by their
+// previous name. The first detection of a rename is kept across restarts, so
+// that the migration window does not start over.
+func (s *stateStore) detectRenames(current map[string][]string) map[string]resourceMigration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	owner := make(map[string]string)
+	for resource, ids := range current {
+		for _, id := range ids {
+			owner[id] = resource
+		}
+	}
+	migrations := make(map[string]resourceMigration)
+	for old, devs := range s.restored {
+		if _, ok := current[old]; ok {
+			continue
+		}
+		// the resource now serving most of the previous devices
+		overlap := make(map[string]int)
+		for id := range devs {
+			if resource, ok := owner[id]; ok {
+				overlap[resource]++
+			}
+		}
+		to := ""
+		for resource, n := range overlap {
+			if to == "" || n > overlap[to] || (n == overlap[to] && resource < to) {
+				to = resource
+			}
+		}
+		if to == "" {
+			continue
+		}
+		migration := resourceMigration{To: to, Since: clk.Now()}
+		if prev, ok := s.migrations[old]; ok && prev.To == to {
+			migration.Since = prev.Since
+		}
+		migrations[old] = migration
+	}
+	// written along with the state of the plugins
+	s.migrations = migrations
+	return migrations
+}
+
+// migrationPlugins returns the plugins advertising renamed resources under
+// their previous name for the migration window, with the devices of the
+// resource they were renamed to. Pods still requesting a previous name are
+// reported in any case.
+func migrationPlugins(plugins []*GenericDevicePlugin) []*GenericDevicePlugin {
+	byName := make(map[string]*GenericDevicePlugin, len(plugins))
+	current := make(map[string][]string, len(plugins))
+	for _, dp := range plugins {
+		byName[dp.deviceName] = dp
+		for _, dev := range dp.devs {
+			current[dp.deviceName] = append(current[dp.deviceName], dev.ID)
+		}
+	}
+	migrations := deviceStates.detectRenames(current)
+	olds := make([]string, 0, len(migrations))
+	for old := range migrations {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+
+	var migrated []*GenericDevicePlugin
+	for _, old := range olds {
+		migration := migrations[old]
+		target := byName[migration.To]
+		msg := fmt.Sprintf("Resource %s/%s was renamed to %s/%s", DeviceNamespace, old, DeviceNamespace, migration.To)
+		log.Print(msg)
+		events.warning("ResourceRenamed", msg)
+		go reportStrandedPods(podCorrelatorFunc, old)
+
+		remaining := aliasMigrationWindow - clk.Since(migration.Since)
+		if aliasMigrationWindow <= 0 || remaining <= 0 {
+			continue
+		}
+		log.Printf("Advertising the devices of %q as %q for another %s", migration.To, old, remaining.Round(time.Second))
+		devs := make([]*pluginapi.Device, 0, len(target.devs))
+		for _, dev := range target.devs {
+			devs = append(devs, &pluginapi.Device{ID: dev.ID, Health: dev.Health, Topology: dev.Topology})
+		}
+		dp := NewGenericDevicePlugin(old, target.devicePath, devs)
+		dp.migrationTwin = migration.To
+		target.migrationTwin = old
+		migrated = append(migrated, dp)
+	}
+	return migrated
+}
+
+// checkMigrationTwin rejects devices already allocated under the other name
+// of a resource being migrated, since the kubelet accounts both names
+// separately
+func (dpi *GenericDevicePlugin) checkMigrationTwin(deviceIDs []string) error {
+	if dpi.migrationTwin == "" {
+		return nil
+	}
+	owners, err := migrationOwners()
+	if err != nil {
+		log.Printf("Unable to check allocations of %q: %v", dpi.migrationTwin, err)
+		return nil
+	}
+	for _, id := range deviceIDs {
+		if owner, ok := owners[fmt.Sprintf("%s/%s/%s", DeviceNamespace, dpi.migrationTwin, id)]; ok {
+			return fmt.Errorf("device %s is allocated to %s as %s/%s", id, owner, DeviceNamespace, dpi.migrationTwin)
+		}
+	}
+	return nil
+}
+
+// migrationOwners returns the pod container of each allocated device (can be
+// set for testing)
+var migrationOwners = listDeviceOwners
+
+// strandedPods returns the pods of the node that have not terminated and
+// request the resource
+func strandedPods(correlatorFunc func() (*podCorrelator, error), resource string) ([]string, error) {
+	correlator, err := correlatorFunc()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+	pods, err := correlator.pods(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods: %w", err)
+	}
+	name := corev1.ResourceName(fmt.Sprintf("%s/%s", DeviceNamespace, resource))
+	var stranded []string
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		containers := append(append([]corev1.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			if _, ok := container.Resources.Limits[name]; ok {
+				stranded = append(stranded, pod.Namespace+"/"+pod.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(stranded)
+	return stranded, nil
+}
+
+// reportStrandedPods logs and records an event for the pods still requesting
+// the previous name of a renamed resource
+func reportStrandedPods(correlatorFunc func() (*podCorrelator, error), resource string) {
+	pods, err := strandedPods(correlatorFunc, resource)
+	if err != nil {
+		log.Printf("Unable to find the pods requesting %s/%s: %v", DeviceNamespace, resource, err)
+		return
+	}
+	if len(pods) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("%d pod(s) still request the renamed resource %s/%s: %s",
+		len(pods), DeviceNamespace, resource, strings.Join(pods, ", "))
+	log.Print(msg)
+	events.warning("StrandedPods", msg)
+}
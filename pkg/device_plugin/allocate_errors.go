@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons attached to failed Allocate calls, so that kubelet logs and
+// automated triage can classify failures without parsing messages
+const (
+	allocateReasonUnknownID      = "unknown-id"
+	allocateReasonUnhealthy      = "unhealthy"
+	allocateReasonMissingIommufd = "missing-iommufd"
+	allocateReasonSplitGroup     = "split-iommu-group"
+	allocateReasonPolicy         = "policy-denied"
+	allocateReasonQuota          = "quota-exceeded"
+	allocateReasonPowerState     = "power-state"
+	allocateReasonMigrated       = "allocated-as-renamed-resource"
+	allocateReasonClearing       = "clearing"
+	allocateReasonInternal       = "internal"
+
+	// allocateErrorDomain is the ErrorInfo domain of Allocate errors
+	allocateErrorDomain = "sandbox-device-plugin.nvidia.com"
+)
+
+// allocateError returns a gRPC status error with the given code whose details
+// carry the reason, resource and device ID of the failure
+func allocateError(code codes.Code, reason, resource, deviceID, format string, args ...interface{}) error {
+	st := status.New(code, fmt.Sprintf(format, args...))
+	metadata := map[string]string{"resource": resource}
+	if deviceID != "" {
+		metadata["deviceID"] = deviceID
+	}
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   allocateErrorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// allocateErrorReason returns the reason attached to an Allocate error, or ""
+// if it carries none
+func allocateErrorReason(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return ""
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == allocateErrorDomain {
+			return info.Reason
+		}
+	}
+	return ""
+}
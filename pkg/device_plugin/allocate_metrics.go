@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Phases of an allocation timed by allocateTrace
+const (
+	allocatePhaseQueue        = "queue"
+	allocatePhaseStateLock    = "state-lock"
+	allocatePhaseIommufdCheck = "iommufd-check"
+	allocatePhasePolicy       = "policy"
+	allocatePhaseMapLookup    = "map-lookup"
+	allocatePhaseWake         = "wake"
+	allocatePhaseDeviceNodes  = "device-nodes"
+	allocatePhaseCDI          = "cdi"
+
+	defaultAllocateSLO = time.Second
+)
+
+// allocateSLO is the latency above which an allocation is counted as an SLO
+// violation and logged with its timing breakdown; zero disables it
+var allocateSLO = getEnvDuration("ALLOCATE_SLO", defaultAllocateSLO)
+
+var (
+	// metricsRegistry holds the metrics served on /metrics
+	metricsRegistry = prometheus.NewRegistry()
+
+	allocateDuration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "sandbox_device_plugin_allocate_duration_seconds",
+		Help:       "Latency of successful Allocate calls per resource.",
+		Objectives: map[float64]float64{0.5: 0.05, 0.95: 0.01, 0.99: 0.001},
+	}, []string{"resource"})
+
+	allocateSLOViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sandbox_device_plugin_allocate_slo_violations_total",
+		Help: "Successful Allocate calls slower than ALLOCATE_SLO per resource.",
+	}, []string{"resource"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(allocateDuration, allocateSLOViolations)
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// allocateTrace times the phases of an allocation. Phases entered several
+// times, e.g. once per device, accumulate.
+type allocateTrace struct {
+	start  time.Time
+	last   time.Time
+	phases map[string]time.Duration
+	order  []string
+}
+
+func newAllocateTrace() *allocateTrace {
+	now := clk.Now()
+	return &allocateTrace{start: now, last: now, phases: make(map[string]time.Duration)}
+}
+
+// mark attributes the time since the previous mark to the phase
+func (t *allocateTrace) mark(phase string) {
+	now := clk.Now()
+	if _, ok := t.phases[phase]; !ok {
+		t.order = append(t.order, phase)
+	}
+	t.phases[phase] += now.Sub(t.last)
+	t.last = now
+}
+
+// total returns the time since the allocation started
+func (t *allocateTrace) total() time.Duration {
+	return clk.Since(t.start)
+}
+
+// String renders the phases in the order they were first entered
+func (t *allocateTrace) String() string {
+	parts := make([]string, 0, len(t.order))
+	for _, phase := range t.order {
+		parts = append(parts, fmt.Sprintf("%s=%s", phase, t.phases[phase]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// observeAllocate records the latency of a successful allocation of the
+// devices and logs allocations slower than the SLO with their breakdown
+func observeAllocate(resource string, deviceIDs []string, trace *allocateTrace) {
+	total := trace.total()
+	resourceName := DeviceNamespace + "/" + resource
+	allocateDuration.WithLabelValues(resourceName).Observe(total.Seconds())
+	if allocateSLO > 0 && total > allocateSLO {
+		allocateSLOViolations.WithLabelValues(resourceName).Inc()
+		log.Printf("Slow allocation of %s %v took %s, exceeding the SLO of %s: %s",
+			resourceName, deviceIDs, total, allocateSLO, trace)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultAllocateConcurrency = 1
+	defaultAllocateQueueLength = 32
+)
+
+var (
+	// allocateConcurrency bounds the Allocate calls processed at once per resource
+	allocateConcurrency = getEnvUint("ALLOCATE_CONCURRENCY", defaultAllocateConcurrency)
+	// allocateQueueLength bounds the Allocate calls waiting per resource
+	allocateQueueLength = getEnvUint("ALLOCATE_QUEUE_LENGTH", defaultAllocateQueueLength)
+)
+
+// allocateQueue bounds the Allocate calls of a device plugin. Up to
+// concurrency calls are processed at once and up to length calls wait for a
+// slot; calls beyond that are rejected so that a burst of pod admissions
+// cannot pile up behind a slow allocation.
+type allocateQueue struct {
+	lock    sync.Mutex
+	waiting uint32
+	length  uint32
+	slots   chan struct{}
+}
+
+func newAllocateQueue(concurrency, length uint32) *allocateQueue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &allocateQueue{
+		length: length,
+		slots:  make(chan struct{}, concurrency),
+	}
+}
+
+// acquire waits for a processing slot and returns the function releasing it.
+// A full queue fails with codes.Unavailable, which callers may retry.
+func (q *allocateQueue) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-q.slots }
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	q.lock.Lock()
+	if q.waiting >= q.length {
+		q.lock.Unlock()
+		return nil, status.Errorf(codes.Unavailable, "too many pending allocate requests (%d), retry later", q.waiting)
+	}
+	q.waiting++
+	q.lock.Unlock()
+	defer func() {
+		q.lock.Lock()
+		q.waiting--
+		q.lock.Unlock()
+	}()
+
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
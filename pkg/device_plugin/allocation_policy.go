@@ -0,0 +1,272 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+const (
+	// policyDenyNVSwitchOnly denies NVSwitches to pods that request no GPU
+	policyDenyNVSwitchOnly = "deny-nvswitch-only"
+	// policyNamespaceQuota limits the devices allocated to a namespace
+	policyNamespaceQuota = "namespace-quota"
+)
+
+var (
+	// allocationPolicies are the policies enforced at allocate time
+	allocationPolicies = parseAllocationPolicies(getEnvString("ALLOCATION_POLICIES", ""))
+	// namespaceQuotas is the maximum number of devices per namespace
+	namespaceQuotas = parseNamespaceQuotas(getEnvString("NAMESPACE_DEVICE_QUOTAS", ""))
+	// podCorrelatorFunc returns the correlator of allocations to pods
+	// (injectable for testing)
+	podCorrelatorFunc = inClusterPodCorrelator
+)
+
+// parseAllocationPolicies parses a comma separated list of policies,
+// ignoring unknown ones
+func parseAllocationPolicies(value string) map[string]bool {
+	policies := make(map[string]bool)
+	for _, policy := range strings.Split(value, ",") {
+		policy = strings.TrimSpace(policy)
+		switch policy {
+		case "":
+		case policyDenyNVSwitchOnly, policyNamespaceQuota:
+			policies[policy] = true
+		default:
+			log.Printf("Ignoring unknown allocation policy %q", policy)
+		}
+	}
+	return policies
+}
+
+// parseNamespaceQuotas parses "namespace=count" pairs, ignoring invalid ones
+func parseNamespaceQuotas(value string) map[string]int {
+	quotas := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		namespace, count, found := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if !found || err != nil || n < 0 {
+			log.Printf("Ignoring invalid namespace device quota %q", pair)
+			continue
+		}
+		quotas[strings.TrimSpace(namespace)] = n
+	}
+	return quotas
+}
+
+// podCorrelator recovers the pod container an allocate request is made for.
+// The kubelet does not pass the pod to Allocate and only reports a container
+// through the PodResources API once its allocation succeeded, so the request
+// is matched against the pending pods of the node that request the same
+// number of devices and have not been allocated devices yet.
+type podCorrelator struct {
+	// pods lists the pods of the node
+	pods func(ctx context.Context) ([]corev1.Pod, error)
+	// owners returns the pod container of each allocated device
+	owners func() (map[string]deviceOwner, error)
+}
+
+var (
+	inClusterCorrelatorOnce sync.Once
+	inClusterCorrelator     *podCorrelator
+	inClusterCorrelatorErr  error
+)
+
+// inClusterPodCorrelator returns a correlator listing the pods of the node
+// from the API server, created on first use
+func inClusterPodCorrelator() (*podCorrelator, error) {
+	inClusterCorrelatorOnce.Do(func() {
+		nodeName := os.Getenv("NODE_NAME")
+		if nodeName == "" {
+			inClusterCorrelatorErr = fmt.Errorf("NODE_NAME is not set")
+			return
+		}
+		clientset, err := newInClusterClientset()
+		if err != nil {
+			inClusterCorrelatorErr = err
+			return
+		}
+		inClusterCorrelator = &podCorrelator{
+			pods: func(ctx context.Context) ([]corev1.Pod, error) {
+				list, err := clientset.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+					FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+				})
+				if err != nil {
+					return nil, err
+				}
+				return list.Items, nil
+			},
+			owners: listDeviceOwners,
+		}
+	})
+	return inClusterCorrelator, inClusterCorrelatorErr
+}
+
+// correlate returns the pod and container that requested count devices of
+// the resource and wait for their allocation. When several containers match,
+// the container of the oldest pod is assumed, since the kubelet admits pods
+// in creation order.
+func (c *podCorrelator) correlate(resourceName string, count int) (*corev1.Pod, deviceOwner, error) {
+	owners, err := c.owners()
+	if err != nil {
+		return nil, deviceOwner{}, err
+	}
+	allocated := make(map[deviceOwner]bool)
+	for key, owner := range owners {
+		if strings.HasPrefix(key, resourceName+"/") {
+			allocated[owner] = true
+		}
+	}
+
+	ctx, cancel := apiContext()
+	defer cancel()
+	pods, err := c.pods(ctx)
+	if err != nil {
+		return nil, deviceOwner{}, fmt.Errorf("unable to list pods: %w", err)
+	}
+
+	type candidate struct {
+		pod   *corev1.Pod
+		owner deviceOwner
+	}
+	var candidates []candidate
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodPending {
+			continue
+		}
+		containers := append(append([]corev1.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			limit := container.Resources.Limits[corev1.ResourceName(resourceName)]
+			owner := deviceOwner{Namespace: pod.Namespace, Pod: pod.Name, Container: container.Name}
+			if limit.Value() == int64(count) && !allocated[owner] {
+				candidates = append(candidates, candidate{pod: pod, owner: owner})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, deviceOwner{}, fmt.Errorf("no pending pod requests %d %s", count, resourceName)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].pod, candidates[j].pod
+		if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(&b.CreationTimestamp)
+		}
+		return candidates[i].owner.String() < candidates[j].owner.String()
+	})
+	if len(candidates) > 1 {
+		log.Printf("%d pending containers request %d %s, assuming the oldest", len(candidates), count, resourceName)
+	}
+	return candidates[0].pod, candidates[0].owner, nil
+}
+
+// enforceAllocationPolicies checks the allocation of the devices against the
+// configured policies, using the pod identity recovered by correlation. When
+// the pod cannot be identified the allocation is allowed.
+func (dpi *GenericDevicePlugin) enforceAllocationPolicies(deviceIDs []string) error {
+	if len(allocationPolicies) == 0 {
+		return nil
+	}
+	resourceName := fmt.Sprintf("%s/%s", DeviceNamespace, dpi.deviceName)
+	correlator, err := podCorrelatorFunc()
+	if err != nil {
+		log.Printf("Not enforcing allocation policies: %v", err)
+		return nil
+	}
+	pod, owner, err := correlator.correlate(resourceName, len(deviceIDs))
+	if err != nil {
+		log.Printf("Unable to identify the pod of the allocation of %v, not enforcing allocation policies: %v", deviceIDs, err)
+		return nil
+	}
+	log.Printf("Allocation of %s %v is for %s", resourceName, deviceIDs, owner)
+
+	if allocationPolicies[policyDenyNVSwitchOnly] && dpi.servesNVSwitches() && !requestsGPUs(pod) {
+		return fmt.Errorf("%s requests NVSwitches without GPUs", owner)
+	}
+	if allocationPolicies[policyNamespaceQuota] {
+		quota, ok := namespaceQuota(pod.Namespace)
+		if !ok {
+			return nil
+		}
+		owners, err := correlator.owners()
+		if err != nil {
+			log.Printf("Unable to count the devices of namespace %s: %v", pod.Namespace, err)
+			return nil
+		}
+		used := 0
+		for _, o := range owners {
+			if o.Namespace == pod.Namespace {
+				used++
+			}
+		}
+		if used+len(deviceIDs) > quota {
+			return fmt.Errorf("%w: namespace %s uses %d device(s) and %s requests %d more, exceeding its quota of %d",
+				errQuotaExceeded, pod.Namespace, used, owner, len(deviceIDs), quota)
+		}
+	}
+	return nil
+}
+
+// servesNVSwitches returns whether the plugin advertises NVSwitches
+func (dpi *GenericDevicePlugin) servesNVSwitches() bool {
+	return nvSwitchResourceNames()[dpi.deviceName]
+}
+
+// requestsGPUs returns whether a container of the pod requests a device of
+// our namespace that is not an NVSwitch
+func requestsGPUs(pod *corev1.Pod) bool {
+	nvSwitchResources := make(map[string]bool)
+	for name := range nvSwitchResourceNames() {
+		nvSwitchResources[fmt.Sprintf("%s/%s", DeviceNamespace, name)] = true
+	}
+	containers := append(append([]corev1.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for name, quantity := range container.Resources.Limits {
+			if strings.HasPrefix(string(name), DeviceNamespace+"/") && !nvSwitchResources[string(name)] && !quantity.IsZero() {
+				return true
+			}
+		}
+	}
+	return false
+}
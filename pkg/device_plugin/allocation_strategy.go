@@ -0,0 +1,268 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"tags.cncf.io/container-device-interface/pkg/parser"
+)
+
+// allocationStrategy builds the container edits that give a container access
+// to an allocated device. The strategy of each resource can be selected in the
+// config file; by default iommufd is used when the host supports it.
+type allocationStrategy interface {
+	// allocate adds the edits of the device with the ID, IOMMU key and
+	// functions to the container allocation. Errors are allocate errors.
+	allocate(dpi *GenericDevicePlugin, c *containerAllocation, deviceID, iommuKey string, devs []NvidiaPCIDevice) error
+}
+
+// allocationStrategies are the strategies that can be selected by name
+var allocationStrategies = map[string]allocationStrategy{
+	"iommufd": iommufdStrategy{},
+	"group":   groupStrategy{},
+	"subtree": subtreeStrategy{},
+	"cdi":     cdiStrategy{},
+}
+
+// allocationStrategyNames returns the names of the strategies, sorted
+func allocationStrategyNames() []string {
+	names := make([]string, 0, len(allocationStrategies))
+	for name := range allocationStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resourceStrategyFor returns the name of the strategy configured for the
+// resource, empty when not configured
+func resourceStrategyFor(resource string) string {
+	deviceFilterLock.RLock()
+	defer deviceFilterLock.RUnlock()
+	return resourceStrategies[resource]
+}
+
+// allocationStrategy returns the strategy allocating the device with the
+// IOMMU key: the configured one, otherwise the subtree strategy for subtrees
+// and iommufd or legacy VFIO groups depending on host support
+func (dpi *GenericDevicePlugin) allocationStrategy(deviceID, iommuKey string, iommufdSupported bool) (allocationStrategy, error) {
+	name := resourceStrategyFor(dpi.deviceName)
+	switch {
+	case name == "iommufd" && !iommufdSupported:
+		return nil, allocateError(codes.FailedPrecondition, allocateReasonMissingIommufd, dpi.deviceName, deviceID,
+			"the iommufd allocation strategy is configured, but the host does not support iommufd")
+	case name != "":
+	case isSubtreeKey(iommuKey):
+		name = "subtree"
+	case iommufdSupported:
+		name = "iommufd"
+	default:
+		name = "group"
+	}
+	return allocationStrategies[name], nil
+}
+
+// qualifiedCDIName returns the fully qualified CDI device name of the device
+// with the IOMMU key
+func (dpi *GenericDevicePlugin) qualifiedCDIName(iommuKey string) string {
+	return parser.QualifiedName(cdiVendor, dpi.deviceName, cdiDeviceName(iommuKey))
+}
+
+// containerAllocation collects the edits of the devices allocated to a
+// container
+type containerAllocation struct {
+	iommufdSupported bool
+	devices          []*pluginapi.DeviceSpec
+	seenPaths        map[string]bool
+	mounts           []*pluginapi.Mount
+	cdiDevices       []*pluginapi.CDIDevice
+	// iommufdPaths are the container paths of the allocated iommufd nodes
+	iommufdPaths []string
+}
+
+func newContainerAllocation(iommufdSupported bool) *containerAllocation {
+	return &containerAllocation{
+		iommufdSupported: iommufdSupported,
+		devices:          make([]*pluginapi.DeviceSpec, 0),
+		seenPaths:        make(map[string]bool),
+	}
+}
+
+// addNode adds a VFIO node unless it was already added, e.g. the shared
+// /dev/vfio/vfio container node, first setting its configured owner and mode
+// when withPerms is set
+func (c *containerAllocation) addNode(dpi *GenericDevicePlugin, deviceID string, node vfioNode, withPerms bool) error {
+	if c.seenPaths[node.hostPath] {
+		return nil
+	}
+	if withPerms {
+		if err := dpi.applyVfioPerms(node.hostPath); err != nil {
+			return allocateError(codes.Internal, allocateReasonInternal, dpi.deviceName, deviceID,
+				"failed to set permissions of VFIO device: %v", err)
+		}
+	}
+	c.devices = appendDeviceSpec(c.devices, c.seenPaths, node.deviceSpec())
+	return nil
+}
+
+// addCDIDevice adds a reference to a CDI device unless it was already added
+func (c *containerAllocation) addCDIDevice(name string) {
+	for _, dev := range c.cdiDevices {
+		if dev.Name == name {
+			return
+		}
+	}
+	c.cdiDevices = append(c.cdiDevices, &pluginapi.CDIDevice{Name: name})
+}
+
+// addIommufdNode adds the iommufd node of a function
+func (c *containerAllocation) addIommufdNode(dpi *GenericDevicePlugin, deviceID string, dev NvidiaPCIDevice) error {
+	log.Printf("iommufd: allocating device %s (iommufd: %s%s)", dev.Address, dev.IommuFD, deviceSerials(dev))
+	node, err := containerPaths.iommufdNode(dev.IommuFD)
+	if err != nil {
+		return allocateError(codes.Internal, allocateReasonInternal, dpi.deviceName, deviceID, "%v", err)
+	}
+	if !c.seenPaths[node.hostPath] {
+		c.iommufdPaths = append(c.iommufdPaths, node.containerPath)
+	}
+	return c.addNode(dpi, deviceID, node, true)
+}
+
+// addGroupNodes adds the legacy VFIO container node and the group node of a
+// function
+func (c *containerAllocation) addGroupNodes(dpi *GenericDevicePlugin, deviceID, iommuKey string, dev NvidiaPCIDevice) error {
+	control, err := containerPaths.controlNode()
+	if err != nil {
+		return allocateError(codes.Internal, allocateReasonInternal, dpi.deviceName, deviceID, "%v", err)
+	}
+	if err := c.addNode(dpi, deviceID, control, false); err != nil {
+		return err
+	}
+	log.Printf("vfio: allocating device %s (IOMMU group: %d%s)", dev.Address, dev.IommuGroup, deviceSerials(dev))
+	group, err := containerPaths.groupNode(vfioGroupName(iommuKey, dev))
+	if err != nil {
+		return allocateError(codes.Internal, allocateReasonInternal, dpi.deviceName, deviceID, "%v", err)
+	}
+	return c.addNode(dpi, deviceID, group, true)
+}
+
+// addFunction adds a function through its iommufd device when iommufd is used
+// and the function has one, and through its VFIO group otherwise, since hosts
+// may only expose iommufd devices for some of their devices
+func (c *containerAllocation) addFunction(dpi *GenericDevicePlugin, deviceID, iommuKey string, dev NvidiaPCIDevice) error {
+	if c.iommufdSupported && dev.IommuFD != "" {
+		return c.addIommufdNode(dpi, deviceID, dev)
+	}
+	if c.iommufdSupported {
+		log.Printf("iommufd: device %s has no iommufd device, falling back to its VFIO group", dev.Address)
+	}
+	return c.addGroupNodes(dpi, deviceID, iommuKey, dev)
+}
+
+// addCompanion adds the NIC paired with the device for GPUDirect RDMA
+func (c *containerAllocation) addCompanion(dpi *GenericDevicePlugin, deviceID, iommuKey string, iommufd bool) error {
+	nodes, err := companionNodes(iommuKey, iommufd)
+	if err != nil {
+		return allocateError(codes.Internal, allocateReasonInternal, dpi.deviceName, deviceID, "%v", err)
+	}
+	for i, node := range nodes {
+		nic := i == len(nodes)-1
+		if nic {
+			log.Printf("Allocating NIC %s with device %s", node.hostPath, deviceID)
+		}
+		// the shared VFIO container node keeps its permissions
+		if err := c.addNode(dpi, deviceID, node, nic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iommufdStrategy injects the iommufd character device of every function,
+// falling back to the VFIO group of functions without one
+type iommufdStrategy struct{}
+
+func (iommufdStrategy) allocate(dpi *GenericDevicePlugin, c *containerAllocation, deviceID, iommuKey string, devs []NvidiaPCIDevice) error {
+	for _, dev := range devs {
+		if err := c.addFunction(dpi, deviceID, iommuKey, dev); err != nil {
+			return err
+		}
+	}
+	return c.addCompanion(dpi, deviceID, iommuKey, c.iommufdSupported)
+}
+
+// groupStrategy injects the legacy VFIO group nodes, even when the host
+// supports iommufd, for runtimes that do not
+type groupStrategy struct{}
+
+func (groupStrategy) allocate(dpi *GenericDevicePlugin, c *containerAllocation, deviceID, iommuKey string, devs []NvidiaPCIDevice) error {
+	for _, dev := range devs {
+		if err := c.addGroupNodes(dpi, deviceID, iommuKey, dev); err != nil {
+			return err
+		}
+	}
+	return c.addCompanion(dpi, deviceID, iommuKey, false)
+}
+
+// subtreeStrategy injects every function of a subtree, each through its
+// iommufd device when it has one and its VFIO group otherwise, matching the
+// nodes of the subtree's CDI device
+type subtreeStrategy struct{}
+
+func (subtreeStrategy) allocate(dpi *GenericDevicePlugin, c *containerAllocation, deviceID, iommuKey string, devs []NvidiaPCIDevice) error {
+	for _, dev := range devs {
+		if err := c.addFunction(dpi, deviceID, iommuKey, dev); err != nil {
+			return err
+		}
+	}
+	return c.addCompanion(dpi, deviceID, iommuKey, c.iommufdSupported)
+}
+
+// cdiStrategy only references the CDI device, leaving the injection of its
+// nodes to the runtime. The nodes still get their configured owner and mode.
+type cdiStrategy struct{}
+
+func (cdiStrategy) allocate(dpi *GenericDevicePlugin, c *containerAllocation, deviceID, iommuKey string, devs []NvidiaPCIDevice) error {
+	var nodes allocationStrategy = groupStrategy{}
+	if c.iommufdSupported {
+		nodes = iommufdStrategy{}
+	}
+	injected := newContainerAllocation(c.iommufdSupported)
+	if err := nodes.allocate(dpi, injected, deviceID, iommuKey, devs); err != nil {
+		return err
+	}
+	// the runtime injects the nodes, but still needs to know their mode
+	c.iommufdPaths = append(c.iommufdPaths, injected.iommufdPaths...)
+	c.addCDIDevice(dpi.qualifiedCDIName(iommuKey))
+	return nil
+}
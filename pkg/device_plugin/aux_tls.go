@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// auxTLS serves the auxiliary endpoints (readiness and metrics, metadata,
+// admin, health agent and device event APIs, scheduler extender) over TLS
+// when AUX_TLS_CERT_FILE and AUX_TLS_KEY_FILE are set, authenticating clients
+// by AUX_TLS_CLIENT_CA_FILE when set; nil serves them in plain text. The
+// kubelet device plugin sockets are never affected.
+var auxTLS = newCertReloader(
+	getEnvString("AUX_TLS_CERT_FILE", ""),
+	getEnvString("AUX_TLS_KEY_FILE", ""),
+	getEnvString("AUX_TLS_CLIENT_CA_FILE", ""))
+
+// certReloader loads the serving certificate and client CA, reloading them
+// when a file changes, e.g. after a cert-manager rotation
+type certReloader struct {
+	certFile, keyFile, clientCAFile string
+
+	lock  sync.Mutex
+	stamp string // modification times of the loaded files
+	cert  *tls.Certificate
+	pool  *x509.CertPool
+}
+
+// newCertReloader returns the reloader of the files, nil when no certificate
+// is configured
+func newCertReloader(certFile, keyFile, clientCAFile string) *certReloader {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			log.Printf("AUX_TLS_CLIENT_CA_FILE is set without a certificate, serving auxiliary endpoints in plain text")
+		}
+		return nil
+	}
+	return &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+}
+
+// mutual returns whether clients must present a certificate
+func (r *certReloader) mutual() bool {
+	return r != nil && r.clientCAFile != ""
+}
+
+// reload loads the files if any changed since they were last loaded. The
+// previous certificate is kept when loading fails.
+func (r *certReloader) reload() error {
+	if r == nil {
+		return nil
+	}
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	var stamps []string
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		stamps = append(stamps, info.ModTime().String())
+	}
+	stamp := strings.Join(stamps, ",")
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if stamp == r.stamp {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		data, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in the client CA %s", r.clientCAFile)
+		}
+	}
+	if r.stamp != "" {
+		log.Printf("Reloaded the TLS certificate of the auxiliary endpoints")
+	}
+	r.stamp, r.cert, r.pool = stamp, &cert, pool
+	return nil
+}
+
+// config returns the server TLS config negotiating the protocols. Clients
+// are authenticated with auth when a client CA is configured.
+func (r *certReloader) config(protos []string, auth tls.ClientAuthType) *tls.Config {
+	base := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: protos}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		if err := r.reload(); err != nil {
+			log.Printf("Error reloading the TLS certificate of the auxiliary endpoints: %v", err)
+		}
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.cert == nil {
+			return nil, fmt.Errorf("no TLS certificate loaded")
+		}
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.Certificates = []tls.Certificate{*r.cert}
+		if r.pool != nil {
+			c.ClientCAs = r.pool
+			c.ClientAuth = auth
+		}
+		return c, nil
+	}
+	return base
+}
+
+// auxGRPCServerOptions returns the options of the gRPC servers of the
+// auxiliary APIs
+func auxGRPCServerOptions() []grpc.ServerOption {
+	if auxTLS == nil {
+		return nil
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(auxTLS.config([]string{"h2"}, tls.RequireAndVerifyClientCert)))}
+}
+
+// serveAuxHTTP serves an auxiliary HTTP server on the listener, over TLS when
+// configured. Clients are authenticated with auth when a client CA is
+// configured.
+func serveAuxHTTP(server *http.Server, listener net.Listener, auth tls.ClientAuthType) error {
+	if auxTLS == nil {
+		return server.Serve(listener)
+	}
+	server.TLSConfig = auxTLS.config([]string{"http/1.1"}, auth)
+	return server.ServeTLS(listener, "", "")
+}
+
+// requireClientCert rejects requests without a verified client certificate
+// when clients are authenticated, for endpoints served next to probes that
+// cannot present one
+func requireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auxTLS.mutual() && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
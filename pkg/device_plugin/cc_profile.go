@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tags.cncf.io/container-device-interface/specs-go"
+)
+
+// ccPlatform is the confidential computing technology of the node
+type ccPlatform string
+
+const (
+	ccPlatformNone ccPlatform = "none"
+	ccPlatformSNP  ccPlatform = "snp"
+	ccPlatformTDX  ccPlatform = "tdx"
+)
+
+// ccPlatformOverride forces the CC platform of the CDI edit profile instead
+// of detecting it from the node labels
+var ccPlatformOverride = getEnvString("CC_PLATFORM", "")
+
+// ccEditProfiles are the host device nodes that sandboxes of each CC platform
+// need in addition to the VFIO nodes, e.g. for the launch of the confidential
+// guest
+var ccEditProfiles = map[ccPlatform][]string{
+	ccPlatformSNP: {"/dev/sev"},
+	ccPlatformTDX: {"/dev/tdx_guest"},
+}
+
+// cdiCCPlatform is the CC platform the CDI specs are generated for
+var cdiCCPlatform = ccPlatformNone
+
+// cdiRuntimeClassResolver returns the resolver of the runtime class of the
+// node the plugin runs on, or nil outside of a cluster (injectable for testing)
+var cdiRuntimeClassResolver = func() (*RuntimeClassResolver, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, nil
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		return nil, err
+	}
+	return NewRuntimeClassResolver(clientset, nodeName), nil
+}
+
+// ccPlatformForLabels returns the CC platform advertised in the node labels.
+// Nodes that are not CC ready have none.
+func ccPlatformForLabels(labels map[string]string) ccPlatform {
+	if !strings.EqualFold(labels[ccReadyLabel], "true") {
+		return ccPlatformNone
+	}
+	if strings.EqualFold(labels[snpLabel], "true") {
+		return ccPlatformSNP
+	}
+	if strings.EqualFold(labels[tdxLabel], "true") {
+		return ccPlatformTDX
+	}
+	return ccPlatformNone
+}
+
+// resolveCCPlatform sets the CC platform of the CDI specs from CC_PLATFORM,
+// or from the runtime class resolved for the node when it is not set, so that
+// the CC edits are only generated for nodes whose sandboxes run confidential
+func resolveCCPlatform() {
+	platform := ccPlatform(strings.ToLower(ccPlatformOverride))
+	switch platform {
+	case ccPlatformNone, ccPlatformSNP, ccPlatformTDX:
+	default:
+		if platform != "" {
+			log.Printf("Ignoring unknown CC_PLATFORM %q", ccPlatformOverride)
+		}
+		class := defaultRuntimeClass
+		resolver, err := cdiRuntimeClassResolver()
+		if err == nil && resolver != nil {
+			class, err = resolver.Resolve()
+		}
+		if err != nil {
+			log.Printf("Unable to resolve the runtime class, generating CDI specs without CC edits: %v", err)
+			class = defaultRuntimeClass
+		}
+		platform = ccPlatformForRuntimeClass(class)
+	}
+	if platform != cdiCCPlatform {
+		log.Printf("Generating CDI specs for CC platform %s", platform)
+	}
+	cdiCCPlatform = platform
+}
+
+// ccCompanionNodes returns the CDI device nodes of the CC edit profile of the
+// platform. Nodes missing on the host are left out, since they would fail
+// every container start.
+func ccCompanionNodes(platform ccPlatform) []*specs.DeviceNode {
+	var nodes []*specs.DeviceNode
+	for _, path := range ccEditProfiles[platform] {
+		if _, err := fsys.Stat(filepath.Join(rootPath, path)); err != nil {
+			log.Printf("Not adding CC device node %s for %s: %v", path, platform, err)
+			continue
+		}
+		nodes = append(nodes, &specs.DeviceNode{Path: path})
+	}
+	return nodes
+}
+
+// isCCCompanionNode returns true if the path is a device node of any CC edit
+// profile
+func isCCCompanionNode(path string) bool {
+	for _, paths := range ccEditProfiles {
+		for _, p := range paths {
+			if p == path {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -31,20 +31,70 @@ package device_plugin
 import (
 	"fmt"
 	"log"
-	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 
+	"sigs.k8s.io/yaml"
 	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
+	"tags.cncf.io/container-device-interface/pkg/parser"
 	"tags.cncf.io/container-device-interface/specs-go"
 )
 
 const (
 	kataCompatibleCDIVersion = "0.5.0"
+
+	// CDI device annotations describing the functions of an IOMMU group
+	cdiAddressesAnnotation = "nvidia.com/pci-addresses"
+	cdiModelAnnotation     = "nvidia.com/model"
+	cdiNumaNodeAnnotation  = "nvidia.com/numa-node"
+	cdiMemoryAnnotation    = "nvidia.com/memory-mib"
 )
 
+// ConfigureCDI overrides the CDI spec version, vendor and spec directories used
+// for generated specs. Empty values keep the defaults. The version is validated
+// against the spec versions supported by the CDI library. root is a comma
+// separated list of directories; specs are kept in sync across all of them.
+func ConfigureCDI(version, vendor, root string) error {
+	if version != "" {
+		if err := specs.ValidateVersion(&specs.Spec{Version: version}); err != nil {
+			return fmt.Errorf("unsupported CDI spec version: %w", err)
+		}
+		cdiVersion = version
+	}
+	if vendor != "" {
+		if err := parser.ValidateVendorName(vendor); err != nil {
+			return fmt.Errorf("invalid CDI vendor: %w", err)
+		}
+		cdiVendor = vendor
+	}
+	if root != "" {
+		var roots []string
+		seen := make(map[string]bool)
+		for _, dir := range strings.Split(root, ",") {
+			dir = strings.TrimSpace(dir)
+			if dir == "" {
+				continue
+			}
+			if !filepath.IsAbs(dir) {
+				return fmt.Errorf("CDI spec directory %q must be an absolute path", dir)
+			}
+			dir = filepath.Clean(dir)
+			if !seen[dir] {
+				seen[dir] = true
+				roots = append(roots, dir)
+			}
+		}
+		if len(roots) == 0 {
+			return fmt.Errorf("no CDI spec directory in %q", root)
+		}
+		setCdiRoots(roots)
+	}
+	log.Printf("CDI spec version: %s, vendor: %s, directories: %s", cdiVersion, cdiVendor, strings.Join(cdiRoots(), ", "))
+	return nil
+}
+
 // GenerateCDISpec generates CDI specifications for discovered VFIO devices.
 //
 // Both GPUs and NVSwitches follow the same alias logic:
@@ -58,15 +108,17 @@ const (
 // the formatted device name as the class — e.g., "nvidia.com/GH100_H100_SXM5_80GB",
 // "nvidia.com/GH100_H100_NVSWITCH".
 func GenerateCDISpec() error {
+	generatedCDIKinds = make(map[string]bool)
+	generatedCDIDevices = make(map[string]string)
 	if len(iommuMap) == 0 {
 		log.Printf("No devices discovered, skipping CDI spec generation")
 		return nil
 	}
 
-	// Ensure CDI directory exists
-	if err := os.MkdirAll(cdiRoot, 0755); err != nil {
-		return fmt.Errorf("failed to create CDI directory %s: %w", cdiRoot, err)
+	if err := createCDIRoots(); err != nil {
+		return err
 	}
+	resolveCCPlatform()
 
 	if PGPUAlias != "" {
 		// Homogeneous mode: all GPUs in one CDI spec under the alias
@@ -100,34 +152,44 @@ func GenerateCDISpec() error {
 		}
 	}
 
-	// Generate NVSwitch CDI specs — same logic as GPUs:
-	// alias set = all NVSwitches in one spec, alias unset = per device type
-	if NVSwitchAlias != "" {
-		var nvSwitchKeys []string
-		for deviceID, keys := range deviceMap {
-			if isNVSwitchDeviceID(deviceID) {
-				nvSwitchKeys = append(nvSwitchKeys, keys...)
-			}
+	// Generate a CDI spec for the subtrees of each subtree resource
+	subtreeNames := make([]string, 0, len(subtreeResources))
+	for resource := range subtreeResources {
+		subtreeNames = append(subtreeNames, resource)
+	}
+	sort.Strings(subtreeNames)
+	for _, resource := range subtreeNames {
+		if generatedCDIKinds[fmt.Sprintf("%s/%s", cdiVendor, resource)] {
+			log.Printf("Error: subtree resource %q is also used by other devices, not generating its CDI spec", resource)
+			continue
 		}
-		if len(nvSwitchKeys) > 0 {
-			if err := generateCDISpecForClass(NVSwitchAlias, nvSwitchKeys); err != nil {
-				log.Println(err.Error())
-				return fmt.Errorf("failed to generate NVSwitch CDI spec: %w", err)
-			}
+		if err := generateCDISpecForClass(resource, subtreeResources[resource]); err != nil {
+			return fmt.Errorf("failed to generate CDI spec for %s: %w", resource, err)
 		}
-	} else {
-		for deviceID, keys := range deviceMap {
-			if !isNVSwitchDeviceID(deviceID) {
-				continue
-			}
-			className := getDeviceNameForID(deviceID)
-			if className == "" {
-				className = deviceID
-			}
-			if err := generateCDISpecForClass(className, keys); err != nil {
-				log.Println(err.Error())
-				return fmt.Errorf("failed to generate CDI spec for %s: %w", className, err)
-			}
+	}
+
+	// Generate NVSwitch CDI specs — same logic as GPUs: alias set = all
+	// NVSwitches in one spec, alias unset = per device type. With
+	// NVSWITCH_PER_BASEBOARD each baseboard gets its own spec.
+	nvSwitchClasses := make(map[string][]string)
+	for deviceID, keys := range deviceMap {
+		if !isNVSwitchDeviceID(deviceID) {
+			continue
+		}
+		for _, key := range keys {
+			className := resourceNameForIommuKey(deviceID, key)
+			nvSwitchClasses[className] = append(nvSwitchClasses[className], key)
+		}
+	}
+	classNames := make([]string, 0, len(nvSwitchClasses))
+	for className := range nvSwitchClasses {
+		classNames = append(classNames, className)
+	}
+	sort.Strings(classNames)
+	for _, className := range classNames {
+		if err := generateCDISpecForClass(className, nvSwitchClasses[className]); err != nil {
+			log.Println(err.Error())
+			return fmt.Errorf("failed to generate NVSwitch CDI spec for %s: %w", className, err)
 		}
 	}
 
@@ -149,48 +211,86 @@ func generateCDISpecForClass(class string, scopedIommuKeys []string) error {
 	// Sort iommu keys to ensure deterministic device ordering in the CDI spec.
 	// Go maps have random iteration order, so without sorting the device names
 	// (0, 1, 2...) would not correspond to ascending VFIO device numbers.
-	// Keys can be either IOMMU group numbers ("8", "9", "10") or IOMMUFD device
-	// names ("vfio8", "vfio9", "vfio10"). We sort numerically by extracting the
-	// number, since lexicographic sort would put "10" before "8".
-	sortedKeys := make([]string, len(scopedIommuKeys))
-	copy(sortedKeys, scopedIommuKeys)
+	// Keys are either IOMMU groups ("group:8", "group:10") or IOMMUFD devices
+	// ("iommufd:vfio8", "iommufd:vfio10"). We sort numerically by extracting
+	// the number, since lexicographic sort would put "10" before "8".
+	sortedKeys := make([]string, 0, len(scopedIommuKeys))
+	for _, iommuKey := range scopedIommuKeys {
+		// devices gone from the host are left out until they recover
+		if cdiGC.isRemoved(iommuKey) {
+			log.Printf("Leaving out CDI device %s: gone from the host", cdiDeviceName(iommuKey))
+			continue
+		}
+		sortedKeys = append(sortedKeys, iommuKey)
+	}
 	sort.Slice(sortedKeys, func(i, j int) bool {
 		return extractNumber(sortedKeys[i]) < extractNumber(sortedKeys[j])
 	})
 
+	withAnnotations := cdiDeviceAnnotationsSupported()
+	withROM := romExposed(class)
 	for _, iommuKey := range sortedKeys {
 		devices := iommuMap[iommuKey]
+		var annotations map[string]string
+		if withAnnotations {
+			annotations = cdiDeviceAnnotations(devices)
+		}
+		// the functions sharing an IOMMU key, e.g. the GPUs of a multi-GPU
+		// board or the functions of a subtree, are injected together as one
+		// device, since a CDI spec must not repeat a device name
+		var deviceNodes []*specs.DeviceNode
 		for _, dev := range devices {
-			// Build the device node paths based on IOMMU mode:
+			// Build the device node paths based on the IOMMU mode of the
+			// device, since hosts may only expose iommufd devices for some:
 			// - IOMMUFD (modern): single device at /dev/vfio/devices/<fd>
 			// - Legacy VFIO: requires both /dev/vfio/vfio (control) and /dev/vfio/<group>
-			var deviceNodes []*specs.DeviceNode
+			var nodes []vfioNode
 			if iommufdSupported && dev.IommuFD != "" {
-				deviceNodes = append(deviceNodes, &specs.DeviceNode{
-					Path: filepath.Join(vfioDevicePath, "devices", dev.IommuFD),
-				})
+				node, err := containerPaths.iommufdNode(dev.IommuFD)
+				if err != nil {
+					return err
+				}
+				nodes = append(nodes, node)
 			} else {
-				deviceNodes = append(deviceNodes,
-					&specs.DeviceNode{
-						Path: filepath.Join(vfioDevicePath, "vfio"),
-					},
-					&specs.DeviceNode{
-						Path: filepath.Join(vfioDevicePath, iommuKey),
-					},
-				)
+				control, err := containerPaths.controlNode()
+				if err != nil {
+					return err
+				}
+				group, err := containerPaths.groupNode(vfioGroupName(iommuKey, dev))
+				if err != nil {
+					return err
+				}
+				nodes = append(nodes, control, group)
 			}
-
-			cedits := specs.ContainerEdits{
-				DeviceNodes: deviceNodes,
+			for _, node := range nodes {
+				// functions addressed by their group share the control node
+				deviceNodes = appendCDIDeviceNodes(deviceNodes, []*specs.DeviceNode{node.cdiDeviceNode()})
 			}
+		}
+		nics, err := companionNodes(iommuKey, iommufdSupported)
+		if err != nil {
+			return err
+		}
+		for _, node := range nics {
+			// a NIC addressed by its group shares the control node
+			deviceNodes = appendCDIDeviceNodes(deviceNodes, []*specs.DeviceNode{node.cdiDeviceNode()})
+		}
 
-			deviceSpecs = append(deviceSpecs, specs.Device{
-				Name:           iommuKey,
-				ContainerEdits: cedits,
-			})
-
+		cedits := specs.ContainerEdits{DeviceNodes: deviceNodes}
+		if withROM {
+			cedits.Mounts = cdiROMMounts(devices)
+		}
+		deviceSpecs = append(deviceSpecs, specs.Device{
+			Name:           cdiDeviceName(iommuKey),
+			Annotations:    annotations,
+			ContainerEdits: cedits,
+		})
+		if len(devices) == 1 {
 			log.Printf("Added CDI device %s: address=%s, class=%s",
-				iommuKey, dev.Address, class)
+				cdiDeviceName(iommuKey), devices[0].Address, class)
+		} else {
+			log.Printf("Added CDI device %s: %d function(s), class=%s",
+				cdiDeviceName(iommuKey), len(devices), class)
 		}
 	}
 
@@ -201,10 +301,14 @@ func generateCDISpecForClass(class string, scopedIommuKeys []string) error {
 
 	// Create the CDI spec with vendor/class format (e.g., "nvidia.com/pgpu")
 	spec := &specs.Spec{
-		Version: kataCompatibleCDIVersion,
+		Version: cdiVersion,
 		Kind:    fmt.Sprintf("%s/%s", cdiVendor, class),
 		Devices: deviceSpecs,
 	}
+	// the CC companion nodes are injected with any device of the spec
+	if nodes := ccCompanionNodes(cdiCCPlatform); len(nodes) > 0 {
+		spec.ContainerEdits.DeviceNodes = nodes
+	}
 
 	// Generate a unique spec name based on vendor and class
 	specName, err := cdiapi.GenerateNameForSpec(spec)
@@ -212,28 +316,202 @@ func generateCDISpecForClass(class string, scopedIommuKeys []string) error {
 		return fmt.Errorf("failed to generate CDI spec name: %w", err)
 	}
 
-	// Use CDI cache to write the spec - this handles file creation and formatting
-	cache, err := cdiapi.NewCache(cdiapi.WithSpecDirs(cdiRoot))
-	if err != nil {
-		return fmt.Errorf("failed to create CDI cache: %w", err)
-	}
-
-	if err := cache.WriteSpec(spec, specName); err != nil {
+	if err := writeCDISpec(spec, specName); err != nil {
 		return fmt.Errorf("failed to save CDI spec %s: %w", specName, err)
 	}
 
+	generatedCDIKinds[spec.Kind] = true
+	for _, iommuKey := range sortedKeys {
+		generatedCDIDevices[iommuKey] = parser.QualifiedName(cdiVendor, class, cdiDeviceName(iommuKey))
+	}
 	log.Printf("Generated CDI spec: %s with %d devices", specName, len(deviceSpecs))
 	return nil
 }
 
+// cdiDeviceAnnotationsSupported returns whether the configured CDI spec
+// version supports device annotations, which the Kata compatible default
+// version does not
+func cdiDeviceAnnotationsSupported() bool {
+	probe := &specs.Spec{
+		Version: cdiVersion,
+		Devices: []specs.Device{{Annotations: map[string]string{cdiModelAnnotation: ""}}},
+	}
+	return specs.ValidateVersion(probe) == nil
+}
+
+// cdiDeviceAnnotations describes the PCI addresses, model and NUMA node of
+// the functions of an IOMMU group, since the CDI device name is only the
+// opaque IOMMU key
+func cdiDeviceAnnotations(devices []NvidiaPCIDevice) map[string]string {
+	if len(devices) == 0 {
+		return nil
+	}
+	addresses := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		addresses = append(addresses, dev.Address)
+	}
+	annotations := map[string]string{
+		cdiAddressesAnnotation: strings.Join(addresses, ","),
+		cdiModelAnnotation:     devices[0].DeviceName,
+	}
+	if devices[0].NumaNode >= 0 {
+		annotations[cdiNumaNodeAnnotation] = strconv.Itoa(devices[0].NumaNode)
+	}
+	if devices[0].MemoryMiB > 0 {
+		annotations[cdiMemoryAnnotation] = strconv.Itoa(devices[0].MemoryMiB)
+	}
+	return annotations
+}
+
 // extractNumber extracts the numeric portion from an IOMMU key for sorting.
-// Handles both pure numbers ("8") and prefixed names ("vfio8").
+// Handles pure numbers ("8"), prefixed names ("vfio8") and namespaced keys
+// ("iommufd:vfio8").
 func extractNumber(s string) int {
 	// Strip any non-digit prefix (e.g., "vfio" from "vfio8")
-	numStr := strings.TrimLeft(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	numStr := strings.TrimLeft(iommuKeyName(s), "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 	n, err := strconv.Atoi(numStr)
 	if err != nil {
 		return 0
 	}
 	return n
 }
+
+// createCDIRoots ensures every CDI spec directory exists
+func createCDIRoots() error {
+	for _, root := range cdiRoots() {
+		if err := fsys.MkdirAll(root, 0755); err != nil {
+			return fmt.Errorf("failed to create CDI directory %s: %w", root, err)
+		}
+	}
+	return nil
+}
+
+// writeCDISpec validates the spec and writes it as YAML to
+// <root>/<specName>.yaml in every CDI spec directory. The spec is staged in
+// all directories before any of them is replaced, so a failed write leaves
+// every copy at its previous version. Staged copies are flushed to disk and
+// parsed back before the rename, so that a crash or a short write never
+// leaves a truncated spec for the runtime to read.
+func writeCDISpec(spec *specs.Spec, specName string) error {
+	if err := specs.ValidateVersion(spec); err != nil {
+		return err
+	}
+	vendor, class := parser.ParseQualifier(spec.Kind)
+	if err := parser.ValidateVendorName(vendor); err != nil {
+		return err
+	}
+	if err := parser.ValidateClassName(class); err != nil {
+		return err
+	}
+	for _, dev := range spec.Devices {
+		if err := parser.ValidateDeviceName(dev.Name); err != nil {
+			return err
+		}
+	}
+
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal CDI spec: %w", err)
+	}
+	data = append([]byte("---\n"), data...)
+
+	var staged []string
+	removeStaged := func(tmps []string) {
+		for _, tmp := range tmps {
+			fsys.Remove(tmp)
+		}
+	}
+	for _, root := range cdiRoots() {
+		tmp := filepath.Join(root, specName+".yaml.tmp")
+		if err := fsys.WriteFile(tmp, data, 0644); err != nil {
+			removeStaged(staged)
+			return err
+		}
+		staged = append(staged, tmp)
+		if err := fsys.Sync(tmp); err != nil {
+			removeStaged(staged)
+			return fmt.Errorf("failed to flush %s: %w", tmp, err)
+		}
+		if err := verifyStagedCDISpec(tmp, spec); err != nil {
+			removeStaged(staged)
+			return err
+		}
+	}
+	for i, tmp := range staged {
+		path := strings.TrimSuffix(tmp, ".tmp")
+		if err := fsys.Rename(tmp, path); err != nil {
+			removeStaged(staged[i:])
+			return err
+		}
+		// persist the rename itself
+		if err := fsys.Sync(filepath.Dir(path)); err != nil {
+			log.Printf("Unable to flush CDI directory %s: %v", filepath.Dir(path), err)
+		}
+		events.normal("CDISpecWritten", fmt.Sprintf("Wrote CDI spec %s for %s with %d device(s)", path, spec.Kind, len(spec.Devices)))
+	}
+	return nil
+}
+
+// loadableCDISpec returns the error the CDI cache of a container runtime
+// would reject the spec with when loading it. The library only validates specs
+// read from a file, so its checks are repeated here for the spec in memory.
+func loadableCDISpec(spec *specs.Spec) error {
+	if err := specs.ValidateVersion(spec); err != nil {
+		return err
+	}
+	vendor, class := parser.ParseQualifier(spec.Kind)
+	if err := parser.ValidateVendorName(vendor); err != nil {
+		return err
+	}
+	if err := parser.ValidateClassName(class); err != nil {
+		return err
+	}
+	if err := (&cdiapi.ContainerEdits{ContainerEdits: &spec.ContainerEdits}).Validate(); err != nil {
+		return err
+	}
+	if len(spec.Devices) == 0 {
+		return fmt.Errorf("invalid spec, no devices")
+	}
+	names := make(map[string]bool, len(spec.Devices))
+	for i := range spec.Devices {
+		dev := &spec.Devices[i]
+		if err := parser.ValidateDeviceName(dev.Name); err != nil {
+			return err
+		}
+		edits := &dev.ContainerEdits
+		if len(edits.Env) == 0 && len(edits.DeviceNodes) == 0 && len(edits.Hooks) == 0 &&
+			len(edits.Mounts) == 0 && edits.IntelRdt == nil && len(edits.AdditionalGIDs) == 0 &&
+			len(edits.NetDevices) == 0 {
+			return fmt.Errorf("invalid device %q, empty device edits", dev.Name)
+		}
+		if err := (&cdiapi.ContainerEdits{ContainerEdits: edits}).Validate(); err != nil {
+			return fmt.Errorf("invalid device %q: %w", dev.Name, err)
+		}
+		if names[dev.Name] {
+			return fmt.Errorf("invalid spec, multiple device %q", dev.Name)
+		}
+		names[dev.Name] = true
+	}
+	return nil
+}
+
+// verifyStagedCDISpec parses a staged spec back and checks that it describes
+// the devices of the spec written
+func verifyStagedCDISpec(tmp string, spec *specs.Spec) error {
+	data, err := fsys.ReadFile(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to read back %s: %w", tmp, err)
+	}
+	written, err := cdiapi.ParseSpec(data)
+	if err == nil {
+		err = loadableCDISpec(written)
+	}
+	if err != nil {
+		return fmt.Errorf("staged CDI spec %s is invalid: %w", tmp, err)
+	}
+	if written.Kind != spec.Kind || len(written.Devices) != len(spec.Devices) {
+		return fmt.Errorf("staged CDI spec %s has kind %s with %d device(s), expected %s with %d",
+			tmp, written.Kind, len(written.Devices), spec.Kind, len(spec.Devices))
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cdiGCGracePeriod is how long a device stays unhealthy with its device node
+// or PCI function gone before it is dropped from the CDI specs, so that
+// transient resets do not rewrite the specs; zero disables the collection
+var cdiGCGracePeriod = getEnvDuration("CDI_GC_GRACE_PERIOD", 30*time.Second)
+
+// cdiSpecLock serializes writing the CDI specs of the discovered devices
+var cdiSpecLock sync.Mutex
+
+// cdiCollector drops devices that disappeared from the host, e.g. GPUs that
+// were removed or powered off, from the CDI specs. Otherwise the runtime
+// would only fail when it injects their device nodes into a sandbox.
+type cdiCollector struct {
+	lock sync.Mutex
+	// unhealthySince maps the IOMMU keys of unhealthy devices to the time
+	// they became unhealthy
+	unhealthySince map[string]time.Time
+	// removed holds the IOMMU keys dropped from the CDI specs
+	removed map[string]bool
+	notify  chan struct{}
+}
+
+var cdiGC = newCDICollector()
+
+func newCDICollector() *cdiCollector {
+	return &cdiCollector{
+		unhealthySince: make(map[string]time.Time),
+		removed:        make(map[string]bool),
+		notify:         make(chan struct{}, 1),
+	}
+}
+
+// deviceUnhealthy starts the grace period of a device that became unhealthy
+func (c *cdiCollector) deviceUnhealthy(iommuKey string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.unhealthySince[iommuKey]; !ok {
+		c.unhealthySince[iommuKey] = clk.Now()
+	}
+}
+
+// deviceHealthy ends the grace period of a device, restoring it in the CDI
+// specs if it was dropped
+func (c *cdiCollector) deviceHealthy(iommuKey string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.unhealthySince, iommuKey)
+	if c.removed[iommuKey] {
+		delete(c.removed, iommuKey)
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// isRemoved returns whether the device was dropped from the CDI specs
+func (c *cdiCollector) isRemoved(iommuKey string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.removed[iommuKey]
+}
+
+// reset forgets all devices, since a rediscovery only finds present devices
+func (c *cdiCollector) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unhealthySince = make(map[string]time.Time)
+	c.removed = make(map[string]bool)
+}
+
+// sweep drops the devices that have been unhealthy for the grace period and
+// are gone from the host. It returns the IOMMU keys dropped.
+func (c *cdiCollector) sweep(grace time.Duration) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var dropped []string
+	for iommuKey, since := range c.unhealthySince {
+		if c.removed[iommuKey] || clk.Since(since) < grace || devicePresent(iommuKey) {
+			continue
+		}
+		c.removed[iommuKey] = true
+		dropped = append(dropped, iommuKey)
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
+// devicePresent returns whether the PCI functions and VFIO nodes of a device
+// still exist on the host
+func devicePresent(iommuKey string) bool {
+	devs := returnIommuMap()[iommuKey]
+	if len(devs) == 0 {
+		return false
+	}
+	exists := func(path string) bool {
+		_, err := fsys.Stat(filepath.Join(rootPath, path))
+		return err == nil
+	}
+	for _, dev := range devs {
+		if !exists(filepath.Join(pciDevicesPath, dev.Address)) {
+			return false
+		}
+		// either VFIO node of the function may be injected
+		group := exists(filepath.Join(vfioDevicePath, vfioGroupName(iommuKey, dev)))
+		if !group && (dev.IommuFD == "" || !exists(filepath.Join(vfioDevicePath, "devices", dev.IommuFD))) {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshCDISpecs rewrites the CDI specs of the discovered devices without the
+// dropped ones, removing specs left without devices
+func refreshCDISpecs() error {
+	cdiSpecLock.Lock()
+	defer cdiSpecLock.Unlock()
+	if err := GenerateCDISpec(); err != nil {
+		return err
+	}
+	return reconcileCDISpecs()
+}
+
+// runCDICollector drops devices that disappeared from the CDI specs and
+// restores them when they recover
+func runCDICollector() {
+	if cdiGCGracePeriod <= 0 {
+		return
+	}
+	ticker := clk.NewTicker(max(cdiGCGracePeriod/2, time.Second))
+	defer ticker.Stop()
+	for {
+		refresh := false
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-cdiGC.notify:
+			refresh = true
+		case <-ticker.C():
+		}
+		if dropped := cdiGC.sweep(cdiGCGracePeriod); len(dropped) > 0 {
+			msg := fmt.Sprintf("Dropping %s from the CDI specs: gone from the host for %s", strings.Join(dropped, ", "), cdiGCGracePeriod)
+			log.Print(msg)
+			events.warning("CDIDeviceRemoved", msg)
+			refresh = true
+		}
+		if !refresh {
+			continue
+		}
+		if err := refreshCDISpecs(); err != nil {
+			log.Printf("Error refreshing CDI specs: %v", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GenerateCDISpecForAddresses writes a CDI spec of the given class for the
+// PCI devices at addresses. Unlike GenerateCDISpec it does not rely on
+// discovery, so it can be used for any vfio-pci bound device on the host.
+func GenerateCDISpecForAddresses(class string, addresses []string) error {
+	if len(addresses) == 0 {
+		return fmt.Errorf("no PCI device addresses given")
+	}
+	iommufdSupported, err := supportsIOMMUFD()
+	if err != nil {
+		return fmt.Errorf("could not determine iommufd support: %w", err)
+	}
+
+	iommuMap = make(map[string][]NvidiaPCIDevice)
+	var keys []string
+	for _, address := range addresses {
+		dev, err := readPCIDevice(address)
+		if err != nil {
+			return err
+		}
+		if err := checkIommuGroupViable(dev.IommuGroup); err != nil {
+			return fmt.Errorf("device %s cannot be assigned: %w", address, err)
+		}
+		iommuKey := iommuKeyFor(dev.IommuGroup, dev.IommuFD, iommufdSupported)
+		if _, exists := iommuMap[iommuKey]; !exists {
+			keys = append(keys, iommuKey)
+		}
+		iommuMap[iommuKey] = append(iommuMap[iommuKey], dev)
+	}
+
+	if err := createCDIRoots(); err != nil {
+		return err
+	}
+	generatedCDIKinds = make(map[string]bool)
+	resolveCCPlatform()
+	return generateCDISpecForClass(class, keys)
+}
+
+// readPCIDevice reads the VFIO related attributes of any PCI device from sysfs
+func readPCIDevice(address string) (NvidiaPCIDevice, error) {
+	devPath := filepath.Join(rootPath, pciDevicesPath, address)
+	if _, err := fsys.Stat(devPath); err != nil {
+		return NvidiaPCIDevice{}, fmt.Errorf("PCI device %s not found: %w", address, err)
+	}
+
+	driver := ""
+	if link, err := fsys.Readlink(filepath.Join(devPath, "driver")); err == nil {
+		driver = filepath.Base(link)
+	}
+	if !isVfioDriver(driver) {
+		return NvidiaPCIDevice{}, fmt.Errorf("PCI device %s is bound to %q, not %s",
+			address, driver, strings.Join(vfioDrivers, " or "))
+	}
+
+	link, err := fsys.Readlink(filepath.Join(devPath, "iommu_group"))
+	if err != nil {
+		return NvidiaPCIDevice{}, fmt.Errorf("PCI device %s has no IOMMU group: %w", address, err)
+	}
+	group, err := strconv.Atoi(filepath.Base(link))
+	if err != nil {
+		return NvidiaPCIDevice{}, fmt.Errorf("invalid IOMMU group %q for %s: %w", link, address, err)
+	}
+
+	dev := NvidiaPCIDevice{
+		Address:    address,
+		Driver:     driver,
+		IommuGroup: group,
+	}
+	// The iommufd character device is listed under vfio-dev when the kernel
+	// supports it
+	entries, err := fsys.ReadDir(filepath.Join(devPath, "vfio-dev"))
+	if err == nil {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "vfio") {
+				dev.IommuFD = entry.Name()
+				break
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Unable to read iommufd device of %s: %v", address, err)
+	}
+	return dev, nil
+}
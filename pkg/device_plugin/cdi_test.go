@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkGenerateCDISpec measures the CDI spec generation of a node with 8
+// GPU models of 8 GPUs each, one spec per model
+func BenchmarkGenerateCDISpec(b *testing.B) {
+	root := b.TempDir()
+	oldRoot, oldCdiRoot, oldAlias := rootPath, cdiRoot, PGPUAlias
+	oldIommuMap, oldDeviceMap, oldSwitches := iommuMap, deviceMap, nvSwitchDeviceIDs
+	rootPath = root
+	setCdiRoot(filepath.Join(root, "cdi"))
+	PGPUAlias = ""
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		rootPath, PGPUAlias = oldRoot, oldAlias
+		setCdiRoot(oldCdiRoot)
+		iommuMap, deviceMap, nvSwitchDeviceIDs = oldIommuMap, oldDeviceMap, oldSwitches
+		log.SetOutput(os.Stderr)
+	})
+
+	iommuMap = make(map[string][]NvidiaPCIDevice)
+	deviceMap = make(map[string][]string)
+	nvSwitchDeviceIDs = map[string]bool{}
+	group := 0
+	for model := 0; model < 8; model++ {
+		deviceID := fmt.Sprintf("%04x", 0x2330+model)
+		for i := 0; i < 8; i++ {
+			group++
+			key := fmt.Sprint(group)
+			iommuMap[key] = []NvidiaPCIDevice{{
+				Address:    fmt.Sprintf("0000:%02x:00.0", group),
+				DeviceID:   uint16(0x2330 + model),
+				DeviceName: fmt.Sprintf("GPU model %d", model),
+				IommuGroup: group,
+			}}
+			deviceMap[deviceID] = append(deviceMap[deviceID], key)
+		}
+	}
+	if err := GenerateCDISpec(); err != nil {
+		b.Fatal(err)
+	}
+	if len(generatedCDIKinds) != 8 {
+		b.Fatalf("generated %d CDI kinds, expected 8", len(generatedCDIKinds))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := GenerateCDISpec(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the configuration read from the config file. Fields that are
+// not set keep the value from the environment. Every field can be changed
+// while the plugin runs; changes of the aliases, the allow and deny lists,
+// the reserved and spare devices, the subtrees and the ROM resources restart
+// the plugins of the affected resources.
+type Config struct {
+	// PGPUAlias and NVSwitchAlias override P_GPU_ALIAS and NVSWITCH_ALIAS
+	PGPUAlias     *string `json:"pgpuAlias,omitempty"`
+	NVSwitchAlias *string `json:"nvswitchAlias,omitempty"`
+	// RecoveryProbeInterval overrides RECOVERY_PROBE_INTERVAL
+	RecoveryProbeInterval *metav1.Duration `json:"recoveryProbeInterval,omitempty"`
+	// NVSwitchHealthInterval is the interval of NVSwitch fabric health checks
+	NVSwitchHealthInterval *metav1.Duration `json:"nvswitchHealthInterval,omitempty"`
+	// LogLevel is "info" or "debug"
+	LogLevel string `json:"logLevel,omitempty"`
+	// AllowDevices and DenyDevices list PCI device IDs (e.g. "2330") or PCI
+	// addresses (e.g. "0000:17:00.0"). When AllowDevices is not empty only
+	// matching devices are advertised; DenyDevices takes precedence.
+	AllowDevices []string `json:"allowDevices,omitempty"`
+	DenyDevices  []string `json:"denyDevices,omitempty"`
+	// ReservedDevices maps PCI device IDs (e.g. "2330") to the number of
+	// devices of that model held back from scheduling, e.g. for host
+	// administration or debugging. They remain in the inventory.
+	ReservedDevices map[string]int `json:"reservedDevices,omitempty"`
+	// SpareDevices maps PCI device IDs to the number of devices of that model
+	// kept as hot spares. Spares are not advertised until an advertised
+	// device of the same model fails, when one is promoted to replace it.
+	SpareDevices map[string]int `json:"spareDevices,omitempty"`
+	// Subtrees maps the PCI address of a bridge (e.g. the upstream port of a
+	// PCIe switch) to a resource name. All vfio-pci bound functions below the
+	// bridge are advertised together as a single device of that resource,
+	// instead of under their own resources.
+	Subtrees map[string]string `json:"subtrees,omitempty"`
+	// HostContainers maps resource names to the host container mode of
+	// their allocations, for privileged runc containers running userspace
+	// drivers (e.g. DPDK) rather than kata sandboxes
+	HostContainers map[string]HostContainerConfig `json:"hostContainers,omitempty"`
+	// AllocationStrategies maps resource names to the strategy building the
+	// container edits of their allocations: "iommufd", "group", "subtree" or
+	// "cdi". Resources not listed use iommufd when the host supports it.
+	AllocationStrategies map[string]string `json:"allocationStrategies,omitempty"`
+	// ROMResources overrides ROM_RESOURCES, the resources whose allocations
+	// mount the sysfs rom file of their functions, for guests that execute
+	// the expansion ROM to initialize the GPU
+	ROMResources []string `json:"romResources,omitempty"`
+}
+
+// HostContainerConfig configures the allocations of a resource served to host
+// containers. Each allocated function has its sysfs directory mounted, and
+// the VFIO nodes are given the owner and mode the consumer runs with. Unset
+// fields keep VFIO_DEVICE_UID, VFIO_DEVICE_GID and VFIO_DEVICE_MODE.
+type HostContainerConfig struct {
+	UID *int `json:"uid,omitempty"`
+	GID *int `json:"gid,omitempty"`
+	// Mode is an octal mode, e.g. "0660"
+	Mode string `json:"mode,omitempty"`
+}
+
+// runtimeSettings holds the settings a config file can change at runtime
+type runtimeSettings struct {
+	pgpuAlias              string
+	nvSwitchAlias          string
+	recoveryProbeInterval  time.Duration
+	nvSwitchHealthInterval time.Duration
+	debug                  bool
+	allowDevices           []string
+	denyDevices            []string
+	reservedDevices        map[string]int
+	spareDevices           map[string]int
+	subtrees               map[string]string
+	hostContainers         map[string]hostContainerMode
+	allocationStrategies   map[string]string
+	romResources           []string
+}
+
+// durationSetting is a duration that can be changed while it is in use
+type durationSetting struct {
+	value atomic.Int64
+}
+
+func newDurationSetting(d time.Duration) *durationSetting {
+	s := &durationSetting{}
+	s.set(d)
+	return s
+}
+
+func (s *durationSetting) get() time.Duration {
+	return time.Duration(s.value.Load())
+}
+
+func (s *durationSetting) set(d time.Duration) {
+	s.value.Store(int64(d))
+}
+
+var (
+	// configFile is the path of the config file, empty when not used
+	configFile string
+	// envSettings are the settings before any config file is applied
+	envSettings runtimeSettings
+
+	debugLogging atomic.Bool
+
+	deviceFilterLock sync.RWMutex
+	allowDevices     []string
+	denyDevices      []string
+	reservedCounts   map[string]int
+	spareCounts      map[string]int
+	subtreeBridges   map[string]string
+	hostContainers   map[string]hostContainerMode
+	// resourceStrategies maps resource names to allocation strategy names
+	resourceStrategies map[string]string
+
+	pciAddressRegexp = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+	pciDeviceRegexp  = regexp.MustCompile(`^[0-9a-f]{4}$`)
+	resourceRegexp   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+)
+
+// debugf logs only when the log level is debug
+func debugf(format string, args ...interface{}) {
+	if debugLogging.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// SetConfigFile loads the config file, applies it on top of the settings
+// from the environment and remembers it so that it is watched for changes
+func SetConfigFile(path string) error {
+	envSettings = currentSettings()
+	if path == "" {
+		return nil
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	configFile = path
+	applySettings(cfg.resolve(envSettings))
+	return nil
+}
+
+// currentSettings returns the settings in effect
+func currentSettings() runtimeSettings {
+	deviceFilterLock.RLock()
+	defer deviceFilterLock.RUnlock()
+	return runtimeSettings{
+		pgpuAlias:              PGPUAlias,
+		nvSwitchAlias:          NVSwitchAlias,
+		recoveryProbeInterval:  recoveryProbeInterval.get(),
+		nvSwitchHealthInterval: nvSwitchHealthInterval.get(),
+		debug:                  debugLogging.Load(),
+		allowDevices:           allowDevices,
+		denyDevices:            denyDevices,
+		reservedDevices:        reservedCounts,
+		spareDevices:           spareCounts,
+		subtrees:               subtreeBridges,
+		hostContainers:         hostContainers,
+		allocationStrategies:   resourceStrategies,
+		romResources:           romResources,
+	}
+}
+
+// loadConfig reads and validates the config file
+func loadConfig(path string) (*Config, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.PGPUAlias != nil {
+		if err := validateAlias("pgpuAlias", *cfg.PGPUAlias); err != nil {
+			return err
+		}
+	}
+	if cfg.NVSwitchAlias != nil {
+		if err := validateAlias("nvswitchAlias", *cfg.NVSwitchAlias); err != nil {
+			return err
+		}
+	}
+	switch cfg.LogLevel {
+	case "", "info", "debug":
+	default:
+		return fmt.Errorf("unknown log level %q", cfg.LogLevel)
+	}
+	for name, d := range map[string]*metav1.Duration{
+		"recoveryProbeInterval":  cfg.RecoveryProbeInterval,
+		"nvswitchHealthInterval": cfg.NVSwitchHealthInterval,
+	} {
+		if d != nil && d.Duration <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	for _, entry := range append(append([]string(nil), cfg.AllowDevices...), cfg.DenyDevices...) {
+		entry = strings.ToLower(entry)
+		if !pciAddressRegexp.MatchString(entry) && !pciDeviceRegexp.MatchString(entry) {
+			return fmt.Errorf("%q is neither a PCI device ID nor a PCI address", entry)
+		}
+	}
+	for deviceID, count := range cfg.ReservedDevices {
+		if !pciDeviceRegexp.MatchString(strings.ToLower(deviceID)) {
+			return fmt.Errorf("reserved device %q is not a PCI device ID", deviceID)
+		}
+		if count < 0 {
+			return fmt.Errorf("reserved device count of %s must not be negative", deviceID)
+		}
+	}
+	for deviceID, count := range cfg.SpareDevices {
+		if !pciDeviceRegexp.MatchString(strings.ToLower(deviceID)) {
+			return fmt.Errorf("spare device %q is not a PCI device ID", deviceID)
+		}
+		if count < 0 {
+			return fmt.Errorf("spare device count of %s must not be negative", deviceID)
+		}
+	}
+	for bridge, resource := range cfg.Subtrees {
+		if !pciAddressRegexp.MatchString(strings.ToLower(bridge)) {
+			return fmt.Errorf("subtree bridge %q is not a PCI address", bridge)
+		}
+		if !resourceRegexp.MatchString(resource) {
+			return fmt.Errorf("subtree resource name %q of %s is invalid", resource, bridge)
+		}
+	}
+	for resource, hc := range cfg.HostContainers {
+		if !resourceRegexp.MatchString(resource) {
+			return fmt.Errorf("host container resource name %q is invalid", resource)
+		}
+		if (hc.UID != nil && *hc.UID < 0) || (hc.GID != nil && *hc.GID < 0) {
+			return fmt.Errorf("host container owner of %s must not be negative", resource)
+		}
+		if _, err := parseFileMode(hc.Mode); err != nil {
+			return fmt.Errorf("host container mode of %s: %w", resource, err)
+		}
+	}
+	for _, resource := range cfg.ROMResources {
+		if !resourceRegexp.MatchString(resource) {
+			return fmt.Errorf("ROM resource name %q is invalid", resource)
+		}
+	}
+	for resource, strategy := range cfg.AllocationStrategies {
+		if !resourceRegexp.MatchString(resource) {
+			return fmt.Errorf("allocation strategy resource name %q is invalid", resource)
+		}
+		if _, ok := allocationStrategies[strategy]; !ok {
+			return fmt.Errorf("unknown allocation strategy %q of %s, must be one of %s",
+				strategy, resource, strings.Join(allocationStrategyNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// resolve returns the settings of the config applied on top of base
+func (cfg *Config) resolve(base runtimeSettings) runtimeSettings {
+	s := base
+	if cfg.PGPUAlias != nil {
+		s.pgpuAlias = *cfg.PGPUAlias
+	}
+	if cfg.NVSwitchAlias != nil {
+		s.nvSwitchAlias = *cfg.NVSwitchAlias
+	}
+	if cfg.RecoveryProbeInterval != nil {
+		s.recoveryProbeInterval = cfg.RecoveryProbeInterval.Duration
+	}
+	if cfg.NVSwitchHealthInterval != nil {
+		s.nvSwitchHealthInterval = cfg.NVSwitchHealthInterval.Duration
+	}
+	if cfg.LogLevel != "" {
+		s.debug = cfg.LogLevel == "debug"
+	}
+	if cfg.AllowDevices != nil {
+		s.allowDevices = lowerAll(cfg.AllowDevices)
+	}
+	if cfg.DenyDevices != nil {
+		s.denyDevices = lowerAll(cfg.DenyDevices)
+	}
+	if cfg.ReservedDevices != nil {
+		s.reservedDevices = make(map[string]int, len(cfg.ReservedDevices))
+		for deviceID, count := range cfg.ReservedDevices {
+			s.reservedDevices[strings.ToLower(deviceID)] = count
+		}
+	}
+	if cfg.SpareDevices != nil {
+		s.spareDevices = make(map[string]int, len(cfg.SpareDevices))
+		for deviceID, count := range cfg.SpareDevices {
+			s.spareDevices[strings.ToLower(deviceID)] = count
+		}
+	}
+	if cfg.Subtrees != nil {
+		s.subtrees = make(map[string]string, len(cfg.Subtrees))
+		for bridge, resource := range cfg.Subtrees {
+			s.subtrees[strings.ToLower(bridge)] = resource
+		}
+	}
+	if cfg.HostContainers != nil {
+		s.hostContainers = make(map[string]hostContainerMode, len(cfg.HostContainers))
+		for resource, hc := range cfg.HostContainers {
+			s.hostContainers[resource] = hc.resolve()
+		}
+	}
+	if cfg.AllocationStrategies != nil {
+		s.allocationStrategies = cfg.AllocationStrategies
+	}
+	if cfg.ROMResources != nil {
+		s.romResources = cfg.ROMResources
+	}
+	return s
+}
+
+func lowerAll(values []string) []string {
+	lower := make([]string, len(values))
+	for i, v := range values {
+		lower[i] = strings.ToLower(v)
+	}
+	return lower
+}
+
+// applySettings puts the settings in effect and returns whether the change
+// affects which devices are advertised under which resource or their CDI
+// specs, which requires the devices to be rediscovered
+func applySettings(s runtimeSettings) bool {
+	old := currentSettings()
+	recoveryProbeInterval.set(s.recoveryProbeInterval)
+	nvSwitchHealthInterval.set(s.nvSwitchHealthInterval)
+	debugLogging.Store(s.debug)
+
+	deviceFilterLock.Lock()
+	defer deviceFilterLock.Unlock()
+	PGPUAlias = s.pgpuAlias
+	NVSwitchAlias = s.nvSwitchAlias
+	allowDevices = s.allowDevices
+	denyDevices = s.denyDevices
+	reservedCounts = s.reservedDevices
+	spareCounts = s.spareDevices
+	subtreeBridges = s.subtrees
+	hostContainers = s.hostContainers
+	resourceStrategies = s.allocationStrategies
+	romResources = s.romResources
+
+	return old.pgpuAlias != s.pgpuAlias || old.nvSwitchAlias != s.nvSwitchAlias ||
+		!reflect.DeepEqual(old.allowDevices, s.allowDevices) || !reflect.DeepEqual(old.denyDevices, s.denyDevices) ||
+		!reflect.DeepEqual(old.reservedDevices, s.reservedDevices) || !reflect.DeepEqual(old.spareDevices, s.spareDevices) ||
+		!reflect.DeepEqual(old.subtrees, s.subtrees) || !reflect.DeepEqual(old.romResources, s.romResources)
+}
+
+// deviceAllowed returns whether the allow and deny lists permit advertising
+// the device with the given PCI address and device ID
+func deviceAllowed(address string, deviceID uint16) bool {
+	deviceFilterLock.RLock()
+	defer deviceFilterLock.RUnlock()
+	id := fmt.Sprintf("%04x", deviceID)
+	address = strings.ToLower(address)
+	matches := func(entries []string) bool {
+		for _, entry := range entries {
+			if entry == id || entry == address {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(denyDevices) {
+		return false
+	}
+	return len(allowDevices) == 0 || matches(allowDevices)
+}
+
+// reservedIommuKeys returns the IOMMU keys of the devices held back from
+// scheduling, which are the last devices of each model by IOMMU key
+func reservedIommuKeys() map[string]bool {
+	reserved, _ := heldBackIommuKeys()
+	return reserved
+}
+
+// spareIommuKeys returns the IOMMU keys of the hot spare devices, which are
+// the devices of each model preceding the reserved ones by IOMMU key
+func spareIommuKeys() map[string]bool {
+	_, spare := heldBackIommuKeys()
+	return spare
+}
+
+// heldBackIommuKeys returns the IOMMU keys of the reserved and of the spare
+// devices
+func heldBackIommuKeys() (map[string]bool, map[string]bool) {
+	deviceFilterLock.RLock()
+	defer deviceFilterLock.RUnlock()
+	reserved := make(map[string]bool)
+	spare := make(map[string]bool)
+	for deviceID, keys := range deviceMap {
+		sorted := append([]string(nil), keys...)
+		sort.Slice(sorted, func(i, j int) bool { return extractNumber(sorted[i]) < extractNumber(sorted[j]) })
+		end := len(sorted)
+		for _, held := range []struct {
+			keys  map[string]bool
+			count int
+		}{{reserved, reservedCounts[deviceID]}, {spare, spareCounts[deviceID]}} {
+			count := held.count
+			if count <= 0 {
+				continue
+			}
+			if count > end {
+				count = end
+			}
+			for _, key := range sorted[end-count : end] {
+				held.keys[key] = true
+			}
+			end -= count
+		}
+	}
+	return reserved, spare
+}
+
+// reloadDevicePlugins rediscovers the devices after a config change
+// (injectable for testing)
+var reloadDevicePlugins = (*DevicePluginManager).Reload
+
+// reloadConfig applies the config file again and restarts the device plugins
+// of the affected resources when needed. An invalid config is logged and the
+// current settings are kept.
+func reloadConfig(m *DevicePluginManager) {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.Printf("Not applying config change: %v", err)
+		return
+	}
+	s := cfg.resolve(envSettings)
+	if reflect.DeepEqual(s, currentSettings()) {
+		return
+	}
+	log.Printf("Applying changed config file %s", configFile)
+	if applySettings(s) {
+		reloadDevicePlugins(m)
+	}
+}
+
+// runConfigWatcher watches the config file and applies changes until the
+// daemon context is canceled. The directory is watched since a ConfigMap
+// mount replaces the file through a symlink swap.
+func runConfigWatcher(m *DevicePluginManager) {
+	if configFile == "" {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Unable to create config file watcher: %v", err)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		log.Printf("Unable to watch config file %s: %v", configFile, err)
+		return
+	}
+	log.Printf("Watching config file %s", configFile)
+
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case event := <-watcher.Events:
+			debugf("Config directory event: %v", event)
+			reloadConfig(m)
+		case err := <-watcher.Errors:
+			log.Printf("Config file watcher error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// The conformance suite runs the gRPC server of a device plugin against a
+// simulated kubelet, exercising the device plugin API the way the kubelet
+// device manager uses it, without any hardware.
+var _ = Describe("Device plugin conformance", func() {
+	const subtreeKey = "subtree:0000:40:00.0"
+	var workDir, oldDir, oldKubeletSocket string
+	var oldIommuMap map[string][]NvidiaPCIDevice
+	var kubelet *fakeKubelet
+	var dp *GenericDevicePlugin
+	var pluginStop context.CancelFunc
+	var client pluginapi.DevicePluginClient
+	var conn *grpc.ClientConn
+
+	conformanceIommuMap := func() map[string][]NvidiaPCIDevice {
+		return map[string][]NvidiaPCIDevice{
+			"group:1":  {{Address: "0000:01:00.0", DeviceID: 0x2330, IommuGroup: 1}},
+			"group:2":  {{Address: "0000:02:00.0", DeviceID: 0x2330, IommuGroup: 2}},
+			subtreeKey: {{Address: "0000:41:00.0", DeviceID: 0x2330, IommuGroup: 1}},
+		}
+	}
+
+	// watch opens a ListAndWatch stream and returns the first device list
+	watch := func(ctx context.Context) (pluginapi.DevicePlugin_ListAndWatchClient, []*pluginapi.Device) {
+		stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := stream.Recv()
+		Expect(err).ToNot(HaveOccurred())
+		return stream, resp.Devices
+	}
+
+	healthOf := func(devs []*pluginapi.Device) map[string]string {
+		health := make(map[string]string)
+		for _, dev := range devs {
+			health[dev.ID] = dev.Health
+		}
+		return health
+	}
+
+	BeforeEach(func() {
+		workDir = GinkgoT().TempDir()
+		rootPath = workDir
+		oldDir, oldKubeletSocket = devicePluginDir, kubeletSocket
+		devicePluginDir = filepath.Join(workDir, "device-plugins")
+		kubeletSocket = filepath.Join(devicePluginDir, "kubelet.sock")
+		Expect(os.MkdirAll(devicePluginDir, 0755)).To(Succeed())
+		oldIommuMap = iommuMap
+		iommuMap = conformanceIommuMap()
+		returnIommuMap = conformanceIommuMap
+		for _, node := range []string{"1", "2"} {
+			Expect(os.WriteFile(filepath.Join(workDir, node), nil, 0644)).To(Succeed())
+		}
+
+		var err error
+		kubelet, err = startFakeKubelet(kubeletSocket)
+		Expect(err).ToNot(HaveOccurred())
+
+		dp = NewGenericDevicePlugin("pgpu", workDir+"/", []*pluginapi.Device{
+			{ID: "group:1", Health: pluginapi.Healthy},
+			{ID: "group:2", Health: pluginapi.Healthy},
+			{ID: subtreeKey, Health: pluginapi.Healthy},
+		})
+		var pluginCtx context.Context
+		pluginCtx, pluginStop = context.WithCancel(context.Background())
+		Expect(dp.Start(pluginCtx)).To(Succeed())
+
+		var req *pluginapi.RegisterRequest
+		Eventually(kubelet.requests).Should(Receive(&req))
+		client, conn, err = kubelet.dial(req)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		pluginStop()
+		Expect(dp.Stop()).To(Succeed())
+		kubelet.stop()
+		devicePluginDir, kubeletSocket = oldDir, oldKubeletSocket
+		iommuMap, returnIommuMap = oldIommuMap, getIommuMap
+		rootPath = "/"
+	})
+
+	It("releases the socket of a plugin that fails to register", func() {
+		oldAttempts, oldTimeout, oldSocket := registrationAttempts, connectionTimeout, kubeletSocket
+		defer func() { registrationAttempts, connectionTimeout, kubeletSocket = oldAttempts, oldTimeout, oldSocket }()
+		registrationAttempts, connectionTimeout = 1, 100*time.Millisecond
+		kubeletSocket = filepath.Join(workDir, "missing.sock")
+
+		other := NewGenericDevicePlugin("other", workDir+"/", []*pluginapi.Device{{ID: "group:1", Health: pluginapi.Healthy}})
+		Expect(other.Start(context.Background())).ToNot(Succeed())
+		Expect(other.server).To(BeNil())
+		Expect(checkSocketAvailable(other.socketPath)).To(Succeed())
+	})
+
+	It("registers the API version, its endpoint and the resource name", func() {
+		// the registration was consumed in BeforeEach; register again to
+		// inspect the request
+		Expect(dp.Register()).To(Succeed())
+		var req *pluginapi.RegisterRequest
+		Eventually(kubelet.requests).Should(Receive(&req))
+		Expect(req.Version).To(Equal(pluginapi.Version))
+		Expect(req.Endpoint).To(Equal(filepath.Base(socketPathForResource("pgpu"))))
+		Expect(req.ResourceName).To(Equal("nvidia.com/pgpu"))
+
+		options, err := client.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(options.PreStartRequired).To(BeFalse())
+		Expect(options.GetPreferredAllocationAvailable).To(BeTrue())
+		_, err = client.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("streams the device list and its health changes", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream, devs := watch(ctx)
+		Expect(healthOf(devs)).To(Equal(map[string]string{
+			"group:1": pluginapi.Healthy, "group:2": pluginapi.Healthy, subtreeKey: pluginapi.Healthy,
+		}))
+
+		dp.setHealth("group:2", pluginapi.Unhealthy)
+		resp, err := stream.Recv()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(healthOf(resp.Devices)).To(HaveKeyWithValue("group:2", pluginapi.Unhealthy))
+		Expect(resp.Devices).To(HaveLen(3))
+
+		dp.setHealth("group:2", pluginapi.Healthy)
+		resp, err = stream.Recv()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(healthOf(resp.Devices)).To(HaveKeyWithValue("group:2", pluginapi.Healthy))
+	})
+
+	It("ends a stream superseded by a reconnecting kubelet", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		first, _ := watch(ctx)
+		second, devs := watch(ctx)
+		Expect(devs).To(HaveLen(3))
+		_, err := first.Recv()
+		Expect(err).To(Equal(io.EOF))
+
+		// health changes go to the newest stream
+		dp.setHealth("group:1", pluginapi.Unhealthy)
+		resp, err := second.Recv()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(healthOf(resp.Devices)).To(HaveKeyWithValue("group:1", pluginapi.Unhealthy))
+	})
+
+	It("registers again after a kubelet restart", func() {
+		kubelet.stop()
+		conn.Close()
+		Expect(os.Remove(socketPathForResource("pgpu"))).To(Succeed())
+
+		var err error
+		kubelet, err = startFakeKubelet(kubeletSocket)
+		Expect(err).ToNot(HaveOccurred())
+		var req *pluginapi.RegisterRequest
+		Eventually(kubelet.requests, 10*time.Second).Should(Receive(&req))
+		Expect(req.ResourceName).To(Equal("nvidia.com/pgpu"))
+
+		client, conn, err = kubelet.dial(req)
+		Expect(err).ToNot(HaveOccurred())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		_, devs := watch(ctx)
+		Expect(devs).To(HaveLen(3))
+	})
+
+	Context("Allocate", func() {
+		allocate := func(containers ...[]string) (*pluginapi.AllocateResponse, error) {
+			req := &pluginapi.AllocateRequest{}
+			for _, ids := range containers {
+				req.ContainerRequests = append(req.ContainerRequests, &pluginapi.ContainerAllocateRequest{DevicesIDs: ids})
+			}
+			return client.Allocate(context.Background(), req)
+		}
+		hostPaths := func(resp *pluginapi.ContainerAllocateResponse) []string {
+			var paths []string
+			for _, spec := range resp.Devices {
+				paths = append(paths, spec.HostPath)
+			}
+			return paths
+		}
+		expectReason := func(err error, code codes.Code, reason string) {
+			Expect(status.Code(err)).To(Equal(code))
+			Expect(allocateErrorReason(err)).To(Equal(reason))
+		}
+
+		It("answers each container request in order", func() {
+			resp, err := allocate([]string{"group:2"}, []string{"group:1"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.ContainerResponses).To(HaveLen(2))
+			Expect(hostPaths(resp.ContainerResponses[0])).To(Equal([]string{"/dev/vfio/vfio", "/dev/vfio/2"}))
+			Expect(hostPaths(resp.ContainerResponses[1])).To(Equal([]string{"/dev/vfio/vfio", "/dev/vfio/1"}))
+
+			resp, err = allocate()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.ContainerResponses).To(BeEmpty())
+
+			resp, err = allocate([]string{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.ContainerResponses).To(HaveLen(1))
+			Expect(resp.ContainerResponses[0].Devices).To(BeEmpty())
+		})
+
+		It("passes a shared VFIO node only once", func() {
+			resp, err := allocate([]string{"group:1", subtreeKey})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hostPaths(resp.ContainerResponses[0])).To(Equal([]string{"/dev/vfio/vfio", "/dev/vfio/1"}))
+		})
+
+		It("rejects unknown, unhealthy and split allocations", func() {
+			_, err := allocate([]string{"group:9"})
+			expectReason(err, codes.InvalidArgument, allocateReasonUnknownID)
+
+			_, err = allocate([]string{"group:1"}, []string{subtreeKey})
+			expectReason(err, codes.InvalidArgument, allocateReasonSplitGroup)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream, _ := watch(ctx)
+			dp.setHealth("group:2", pluginapi.Unhealthy)
+			_, err = stream.Recv()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = allocate([]string{"group:2"})
+			expectReason(err, codes.FailedPrecondition, allocateReasonUnhealthy)
+		})
+	})
+
+	It("prefers allocations within the request bounds", func() {
+		resp, err := client.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+				{AvailableDeviceIDs: []string{"group:2", "group:1"}, AllocationSize: 1},
+				{AvailableDeviceIDs: []string{"group:1", "group:2"}, MustIncludeDeviceIDs: []string{"group:2"}, AllocationSize: 2},
+				{AvailableDeviceIDs: []string{"group:1"}, MustIncludeDeviceIDs: []string{"group:1"}, AllocationSize: 1},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.ContainerResponses).To(HaveLen(3))
+		Expect(resp.ContainerResponses[0].DeviceIDs).To(HaveLen(1))
+		Expect(resp.ContainerResponses[0].DeviceIDs[0]).To(BeElementOf("group:1", "group:2"))
+		Expect(resp.ContainerResponses[1].DeviceIDs).To(ConsistOf("group:1", "group:2"))
+		Expect(resp.ContainerResponses[1].DeviceIDs[0]).To(Equal("group:2"))
+		Expect(resp.ContainerResponses[2].DeviceIDs).To(Equal([]string{"group:1"}))
+	})
+})
@@ -29,25 +29,45 @@
 package device_plugin
 
 import (
-	"time"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 const (
-	DeviceNamespace   = "nvidia.com"
-	connectionTimeout = 5 * time.Second
-	vfioDevicePath    = "/dev/vfio"
-	iommuDevicePath   = "/dev/iommu"
-	gpuPrefix         = "PCI_RESOURCE_NVIDIA_COM"
-	cdiVendor         = "nvidia.com"
+	DeviceNamespace = "nvidia.com"
+	vfioDevicePath  = "/dev/vfio"
+	iommuDevicePath = "/dev/iommu"
+	pciDevicesPath  = "sys/bus/pci/devices"
+	gpuPrefix       = "PCI_RESOURCE_NVIDIA_COM"
+	// cdiAnnotationPlugin names the plugin in cdi.k8s.io/ annotation keys
+	cdiAnnotationPlugin = "nvidia.sandbox"
 )
 
 var (
 	// rootPath can be set for testing to simplify testing
 	rootPath = "/"
+	// devicePluginDir can be set for testing to redirect device plugin sockets
+	devicePluginDir = pluginapi.DevicePluginPath
 	// cdiRoot can be set for testing to redirect CDI spec output
 	cdiRoot = "/var/run/cdi"
+	// cdiExtraRoots are further directories generated CDI specs are mirrored
+	// to, for runtimes that read specs from another directory
+	cdiExtraRoots []string
+	// cdiVendor is the vendor prefix of generated CDI kinds
+	cdiVendor = "nvidia.com"
+	// cdiVersion is the CDI spec version written to generated specs
+	cdiVersion = kataCompatibleCDIVersion
 )
 
 func setCdiRoot(path string) {
-	cdiRoot = path
+	setCdiRoots([]string{path})
+}
+
+func setCdiRoots(paths []string) {
+	cdiRoot = paths[0]
+	cdiExtraRoots = paths[1:]
+}
+
+// cdiRoots returns all directories generated CDI specs are written to
+func cdiRoots() []string {
+	return append([]string{cdiRoot}, cdiExtraRoots...)
 }
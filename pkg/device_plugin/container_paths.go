@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"tags.cncf.io/container-device-interface/specs-go"
+)
+
+// containerPathData is passed to the container path templates
+type containerPathData struct {
+	// HostPath is the path of the device node on the host
+	HostPath string
+	// Name is the base name of the device node, e.g. "vfio", "8" or "vfio8"
+	Name string
+}
+
+// containerPathTemplates map the host path of each kind of VFIO device node
+// to the path it is mounted at in the container. A nil template keeps the
+// host path.
+type containerPathTemplates struct {
+	control *template.Template
+	group   *template.Template
+	device  *template.Template
+}
+
+var containerPaths containerPathTemplates
+
+// vfioNode is a VFIO device node and the path it is mounted at
+type vfioNode struct {
+	hostPath      string
+	containerPath string
+}
+
+// ConfigureContainerPaths sets the templates of the container paths of the
+// VFIO control node (/dev/vfio/vfio), the VFIO group nodes (/dev/vfio/<group>)
+// and the iommufd device nodes (/dev/vfio/devices/vfio<N>). Templates are Go
+// templates over .HostPath and .Name; empty templates mount a node at its
+// host path.
+func ConfigureContainerPaths(control, group, device string) error {
+	var t containerPathTemplates
+	for _, c := range []struct {
+		name string
+		text string
+		tmpl **template.Template
+	}{
+		{"control", control, &t.control},
+		{"group", group, &t.group},
+		{"device", device, &t.device},
+	} {
+		if c.text == "" {
+			continue
+		}
+		tmpl, err := template.New(c.name).Option("missingkey=error").Parse(c.text)
+		if err != nil {
+			return fmt.Errorf("invalid %s container path template: %w", c.name, err)
+		}
+		*c.tmpl = tmpl
+	}
+	// render the templates once so that mistakes surface at startup
+	if _, err := t.controlNode(); err != nil {
+		return err
+	}
+	if _, err := t.groupNode("0"); err != nil {
+		return err
+	}
+	if _, err := t.iommufdNode("vfio0"); err != nil {
+		return err
+	}
+	containerPaths = t
+	if control != "" || group != "" || device != "" {
+		log.Printf("VFIO container path templates: control=%q group=%q device=%q", control, group, device)
+	}
+	return nil
+}
+
+// mapContainerPath renders the container path of a device node
+func mapContainerPath(tmpl *template.Template, hostPath string) (string, error) {
+	if tmpl == nil {
+		return hostPath, nil
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, containerPathData{HostPath: hostPath, Name: filepath.Base(hostPath)}); err != nil {
+		return "", fmt.Errorf("failed to render container path of %s: %w", hostPath, err)
+	}
+	containerPath := b.String()
+	if !filepath.IsAbs(containerPath) || filepath.Clean(containerPath) != containerPath {
+		return "", fmt.Errorf("container path %q of %s is not a clean absolute path", containerPath, hostPath)
+	}
+	return containerPath, nil
+}
+
+func newVfioNode(tmpl *template.Template, hostPath string) (vfioNode, error) {
+	containerPath, err := mapContainerPath(tmpl, hostPath)
+	if err != nil {
+		return vfioNode{}, err
+	}
+	return vfioNode{hostPath: hostPath, containerPath: containerPath}, nil
+}
+
+// controlNode returns the legacy VFIO container node
+func (t containerPathTemplates) controlNode() (vfioNode, error) {
+	return newVfioNode(t.control, filepath.Join(vfioDevicePath, "vfio"))
+}
+
+// groupNode returns the legacy VFIO node of an IOMMU group
+func (t containerPathTemplates) groupNode(group string) (vfioNode, error) {
+	return newVfioNode(t.group, filepath.Join(vfioDevicePath, group))
+}
+
+// iommufdNode returns the iommufd character device of a VFIO device
+func (t containerPathTemplates) iommufdNode(fd string) (vfioNode, error) {
+	return newVfioNode(t.device, filepath.Join(vfioDevicePath, "devices", fd))
+}
+
+// deviceSpec returns the device spec of the node for an allocate response
+func (n vfioNode) deviceSpec() *pluginapi.DeviceSpec {
+	return &pluginapi.DeviceSpec{
+		HostPath:      n.hostPath,
+		ContainerPath: n.containerPath,
+		Permissions:   "mrw",
+	}
+}
+
+// cdiDeviceNode returns the CDI device node, with the host path only set
+// when the node is mounted at a different path
+func (n vfioNode) cdiDeviceNode() *specs.DeviceNode {
+	node := &specs.DeviceNode{Path: n.containerPath}
+	if n.hostPath != n.containerPath {
+		node.HostPath = n.hostPath
+	}
+	return node
+}
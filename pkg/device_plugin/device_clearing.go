@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const defaultClearTimeout = 5 * time.Minute
+
+var (
+	// clearOnFree clears devices released by a pod before they can be
+	// allocated to another tenant
+	clearOnFree = getEnvBool("CLEAR_ON_FREE", false)
+	// clearCommand scrubs the memory of the freed devices, e.g. by booting
+	// them in a scrubbing VM. It is run with their PCI addresses as arguments.
+	clearCommand = getEnvString("CLEAR_COMMAND", "")
+	clearTimeout = getEnvDuration("CLEAR_TIMEOUT", defaultClearTimeout)
+
+	// clearDevice clears the functions of a freed device (injectable for
+	// testing)
+	clearDevice = resetAndScrub
+)
+
+// clearTarget is a freed device held out of service until it is cleared
+type clearTarget struct {
+	resource string
+	id       string
+	running  bool
+}
+
+// clearingSet holds the freed devices that are being cleared, or failed to be
+// and wait for a retry, by IOMMU key
+type clearingSet struct {
+	lock    sync.Mutex
+	targets map[string]*clearTarget
+}
+
+var clearing = &clearingSet{targets: make(map[string]*clearTarget)}
+
+// contains returns true if the device with the IOMMU key is not cleared yet
+func (s *clearingSet) contains(iommuKey string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.targets[iommuKey]
+	return ok
+}
+
+// start marks a clear of the device running and returns false if one already
+// is
+func (s *clearingSet) start(iommuKey, resource, id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t, ok := s.targets[iommuKey]; ok && t.running {
+		return false
+	}
+	s.targets[iommuKey] = &clearTarget{resource: resource, id: id, running: true}
+	return true
+}
+
+// finish releases a cleared device, or keeps a device that failed to be
+// cleared for a retry
+func (s *clearingSet) finish(iommuKey string, cleared bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cleared {
+		delete(s.targets, iommuKey)
+	} else if t, ok := s.targets[iommuKey]; ok {
+		t.running = false
+	}
+}
+
+// failed returns the devices waiting for a retry
+func (s *clearingSet) failed() []clearTarget {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var targets []clearTarget
+	for _, t := range s.targets {
+		if !t.running {
+			targets = append(targets, *t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].resource+"/"+targets[i].id < targets[j].resource+"/"+targets[j].id
+	})
+	return targets
+}
+
+// runClearCommand runs CLEAR_COMMAND on the functions within CLEAR_TIMEOUT
+func runClearCommand(devs []NvidiaPCIDevice) error {
+	args := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		args = append(args, dev.Address)
+	}
+	// not bound to the daemon context: a clear abandoned on shutdown would
+	// leave the device half scrubbed for the next instance to advertise
+	ctx, cancel := context.WithTimeout(context.Background(), clearTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, clearCommand, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", clearCommand, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// resetAndScrub resets the functions of a device and scrubs its memory with
+// CLEAR_COMMAND when set
+func resetAndScrub(devs []NvidiaPCIDevice) error {
+	if err := resetFunctions(devs); err != nil {
+		return err
+	}
+	if clearCommand == "" {
+		return nil
+	}
+	return runClearCommand(devs)
+}
+
+// pluginForResource returns the plugin of the fully qualified resource name
+func pluginForResource(plugins []*GenericDevicePlugin, resource string) *GenericDevicePlugin {
+	for _, dp := range plugins {
+		if DeviceNamespace+"/"+dp.deviceName == resource {
+			return dp
+		}
+	}
+	return nil
+}
+
+// startClear holds a freed device unhealthy and clears it in the background.
+// The device is advertised healthy again once it is cleared and passes the
+// recovery probe, and stays out of service when clearing fails.
+func startClear(plugins []*GenericDevicePlugin, resource, id string) {
+	iommuKey := iommuKeyForDeviceID(id)
+	if !clearing.start(iommuKey, resource, id) {
+		return
+	}
+	dp := pluginForResource(plugins, resource)
+	if dp != nil {
+		dp.setHealth(id, pluginapi.Unhealthy)
+	}
+	go func() {
+		start := clk.Now()
+		err := clearDevice(returnIommuMap()[iommuKey])
+		clearing.finish(iommuKey, err == nil)
+		if err != nil {
+			msg := fmt.Sprintf("Clearing device %s of %s failed, holding it out of service: %v", id, resource, err)
+			log.Print(msg)
+			events.warning("DeviceClearFailed", msg)
+			return
+		}
+		if dp != nil {
+			dp.reprobeHealth(id)
+		}
+		msg := fmt.Sprintf("Cleared device %s of %s in %v", id, resource, clk.Since(start).Round(time.Millisecond))
+		log.Print(msg)
+		events.normal("DeviceCleared", msg)
+	}()
+}
+
+// clearFreed clears the devices that had an owner in prev and have none in
+// cur, and retries the devices that failed to be cleared. A device already
+// allocated to another pod is never reset under it.
+func clearFreed(plugins []*GenericDevicePlugin, prev, cur map[string]deviceOwner) {
+	for _, key := range freedDevices(prev, cur) {
+		idx := strings.LastIndex(key, "/")
+		if owner, ok := cur[key]; ok {
+			msg := fmt.Sprintf("Device %s of %s was allocated to %s/%s before it could be cleared",
+				key[idx+1:], key[:idx], owner.Namespace, owner.Pod)
+			log.Print(msg)
+			events.warning("DeviceClearSkipped", msg)
+			continue
+		}
+		startClear(plugins, key[:idx], key[idx+1:])
+	}
+	for _, t := range clearing.failed() {
+		if _, ok := cur[t.resource+"/"+t.id]; !ok {
+			startClear(plugins, t.resource, t.id)
+		}
+	}
+}
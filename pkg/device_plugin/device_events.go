@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	deviceEventDiscovered = "discovered"
+	deviceEventAllocated  = "allocated"
+	deviceEventFreed      = "freed"
+	deviceEventHealth     = "health"
+
+	// deviceEventBufferSize is the number of events queued per subscriber
+	// before events are dropped for it
+	deviceEventBufferSize = 256
+
+	defaultDeviceEventsPollInterval = 10 * time.Second
+)
+
+var (
+	// deviceEventsSocket is the unix socket the device event stream is
+	// served on; empty disables the API
+	deviceEventsSocket = getEnvString("DEVICE_EVENTS_SOCKET", "")
+
+	// deviceEventsPollInterval is how often the kubelet is polled for freed
+	// devices, for the event stream and CLEAR_ON_FREE
+	deviceEventsPollInterval = getEnvDuration("DEVICE_EVENTS_POLL_INTERVAL", defaultDeviceEventsPollInterval)
+)
+
+// deviceEvent is a lifecycle event of an advertised device
+type deviceEvent struct {
+	eventType string
+	resource  string
+	device    string
+	health    string
+	owner     *deviceOwner
+	at        time.Time
+}
+
+// toStruct renders the event as the message streamed to subscribers
+func (e deviceEvent) toStruct() *structpb.Struct {
+	fields := map[string]*structpb.Value{
+		"type":     structpb.NewStringValue(e.eventType),
+		"resource": structpb.NewStringValue(e.resource),
+		"device":   structpb.NewStringValue(e.device),
+		"time":     structpb.NewStringValue(e.at.UTC().Format(time.RFC3339Nano)),
+	}
+	if e.health != "" {
+		fields["health"] = structpb.NewStringValue(e.health)
+	}
+	if e.owner != nil {
+		fields["namespace"] = structpb.NewStringValue(e.owner.Namespace)
+		fields["pod"] = structpb.NewStringValue(e.owner.Pod)
+		fields["container"] = structpb.NewStringValue(e.owner.Container)
+	}
+	return &structpb.Struct{Fields: fields}
+}
+
+// deviceEventBroadcaster fans device events out to the subscribers of the
+// event stream. Slow subscribers miss events rather than block the plugin.
+type deviceEventBroadcaster struct {
+	lock        sync.Mutex
+	subscribers map[chan deviceEvent]bool
+}
+
+var deviceEvents = newDeviceEventBroadcaster()
+
+func newDeviceEventBroadcaster() *deviceEventBroadcaster {
+	return &deviceEventBroadcaster{subscribers: make(map[chan deviceEvent]bool)}
+}
+
+// subscribe returns a channel receiving the events published from now on,
+// and a function to cancel the subscription
+func (b *deviceEventBroadcaster) subscribe() (<-chan deviceEvent, func()) {
+	ch := make(chan deviceEvent, deviceEventBufferSize)
+	b.lock.Lock()
+	b.subscribers[ch] = true
+	b.lock.Unlock()
+	return ch, func() {
+		b.lock.Lock()
+		delete(b.subscribers, ch)
+		b.lock.Unlock()
+	}
+}
+
+// publish sends an event of the device to every subscriber
+func (b *deviceEventBroadcaster) publish(eventType, resource, device, health string, owner *deviceOwner) {
+	event := deviceEvent{
+		eventType: eventType,
+		resource:  resource,
+		device:    device,
+		health:    health,
+		owner:     owner,
+		at:        clk.Now(),
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Dropping %s event of device %s for a slow subscriber", eventType, device)
+		}
+	}
+}
+
+// publishDiscovered publishes a discovered event for every device of the plugin
+func (dpi *GenericDevicePlugin) publishDiscovered() {
+	resource := DeviceNamespace + "/" + dpi.deviceName
+	for _, dev := range dpi.devices() {
+		deviceEvents.publish(deviceEventDiscovered, resource, dev.ID, dev.Health, nil)
+	}
+}
+
+// devices returns a snapshot of the devices of the plugin
+func (dpi *GenericDevicePlugin) devices() []pluginapi.Device {
+	dpi.healthLock.Lock()
+	defer dpi.healthLock.Unlock()
+	devs := make([]pluginapi.Device, 0, len(dpi.devs))
+	for _, dev := range dpi.devs {
+		devs = append(devs, pluginapi.Device{ID: dev.ID, Health: dev.Health})
+	}
+	return devs
+}
+
+// freedDevices returns the sorted keys of the devices that had an owner in
+// prev and have none, or another one, in cur. Both are keyed by
+// "<resource name>/<device ID>" as returned by listDeviceOwners.
+func freedDevices(prev, cur map[string]deviceOwner) []string {
+	keys := make([]string, 0, len(prev))
+	for key, owner := range prev {
+		if next, ok := cur[key]; !ok || next != owner {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// publishFreed publishes a freed event for every device freed between prev
+// and cur
+func publishFreed(prev, cur map[string]deviceOwner) {
+	for _, key := range freedDevices(prev, cur) {
+		owner := prev[key]
+		idx := strings.LastIndex(key, "/")
+		deviceEvents.publish(deviceEventFreed, key[:idx], key[idx+1:], "", &owner)
+	}
+}
+
+// watchFreedDevices polls the kubelet for the owners of our devices and
+// publishes and, with CLEAR_ON_FREE, clears the devices released by
+// terminated pods until the daemon context is canceled
+func watchFreedDevices(m *DevicePluginManager) {
+	if deviceEventsSocket == "" && !clearOnFree {
+		return
+	}
+	ticker := time.NewTicker(deviceEventsPollInterval)
+	defer ticker.Stop()
+	var prev map[string]deviceOwner
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		owners, err := listDeviceOwners()
+		if err != nil {
+			log.Printf("Unable to list device owners for the event stream: %v", err)
+			continue
+		}
+		if prev != nil {
+			publishFreed(prev, owners)
+			if clearOnFree {
+				clearFreed(m.Plugins(), prev, owners)
+			}
+		}
+		prev = owners
+	}
+}
+
+// DeviceEventsServer streams device lifecycle events to external consumers
+type DeviceEventsServer interface {
+	// Watch sends a discovered event for every advertised device, followed
+	// by the discovered, allocated, freed and health events as they happen
+	Watch(*pluginapi.Empty, grpc.ServerStream) error
+}
+
+// deviceEventsServer streams the events of the plugins of the manager
+type deviceEventsServer struct {
+	manager *DevicePluginManager
+}
+
+// Watch streams events until the client goes away or the daemon context is
+// canceled
+func (s *deviceEventsServer) Watch(_ *pluginapi.Empty, stream grpc.ServerStream) error {
+	// subscribe before taking the snapshot, so no event falls in between
+	ch, cancel := deviceEvents.subscribe()
+	defer cancel()
+
+	now := clk.Now()
+	for _, dp := range s.manager.Plugins() {
+		resource := DeviceNamespace + "/" + dp.deviceName
+		for _, dev := range dp.devices() {
+			event := deviceEvent{eventType: deviceEventDiscovered, resource: resource, device: dev.ID, health: dev.Health, at: now}
+			if err := stream.SendMsg(event.toStruct()); err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		case event := <-ch:
+			if err := stream.SendMsg(event.toStruct()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func _DeviceEvents_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	in := new(pluginapi.Empty)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(DeviceEventsServer).Watch(in, stream)
+}
+
+// deviceEventsServiceDesc describes the v1alpha1.DeviceEvents service. Events
+// are google.protobuf.Struct messages with the string fields type, resource,
+// device and time, plus health for discovered and health events and
+// namespace, pod and container for freed events.
+var deviceEventsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "v1alpha1.DeviceEvents",
+	HandlerType: (*DeviceEventsServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _DeviceEvents_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "device_events.proto",
+}
+
+// serveDeviceEvents serves the device event stream on the unix socket until
+// the daemon context is canceled
+func serveDeviceEvents(m *DevicePluginManager) {
+	if deviceEventsSocket == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(deviceEventsSocket), 0755); err != nil {
+		log.Printf("Error creating device events socket directory: %v", err)
+		return
+	}
+	if err := os.Remove(deviceEventsSocket); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing stale device events socket: %v", err)
+		return
+	}
+	listener, err := net.Listen("unix", deviceEventsSocket)
+	if err != nil {
+		log.Printf("Error listening on device events socket %s: %v", deviceEventsSocket, err)
+		return
+	}
+
+	server := grpc.NewServer(auxGRPCServerOptions()...)
+	server.RegisterService(&deviceEventsServiceDesc, &deviceEventsServer{manager: m})
+	go func() {
+		<-daemonCtx.Done()
+		server.Stop()
+	}()
+	log.Printf("Serving device events API on %s", deviceEventsSocket)
+	if err := server.Serve(listener); err != nil {
+		log.Printf("Error serving device events API: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+)
+
+const (
+	// pciExtCapDSN is the PCIe Device Serial Number extended capability ID
+	pciExtCapDSN = 0x0003
+)
+
+// stableIDMap maps stable device IDs advertised to kubelet to the current IOMMU group/fd key
+var stableIDMap map[string]string
+
+// iommuKeyToStableID maps the current IOMMU group/fd key to its stable device ID
+var iommuKeyToStableID map[string]string
+
+// readDeviceSerial returns the PCIe Device Serial Number of the device as a
+// hex string, or an empty string if the capability is not available
+func readDeviceSerial(dev *nvpci.NvidiaPCIDevice) string {
+	if dev.Config == nil {
+		return ""
+	}
+	cfg, err := dev.Config.Read()
+	if err != nil {
+		return ""
+	}
+	caps, err := cfg.GetPCICapabilities()
+	if err != nil {
+		return ""
+	}
+	dsn, ok := caps.Extended[pciExtCapDSN]
+	if !ok || dsn.Len() < 12 {
+		return ""
+	}
+	return fmt.Sprintf("%016x", dsn.LittleEndian().Read64(4))
+}
+
+// buildStableDeviceIDs derives a stable ID for every IOMMU group/fd key in
+// iommuMap. IOMMU group numbers can change across kernel updates, so the ID is
+// built from the lowest PCI address in the group, suffixed with the device
+// serial number when the device exposes one.
+func buildStableDeviceIDs() {
+	stableIDMap = make(map[string]string)
+	iommuKeyToStableID = make(map[string]string)
+
+	for iommuKey, devices := range iommuMap {
+		if len(devices) == 0 {
+			continue
+		}
+		sorted := make([]NvidiaPCIDevice, len(devices))
+		copy(sorted, devices)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Address < sorted[j].Address
+		})
+
+		stableID := sorted[0].Address
+		if sorted[0].Serial != "" {
+			stableID = fmt.Sprintf("%s-%s", stableID, sorted[0].Serial)
+		}
+		if existing, ok := stableIDMap[stableID]; ok {
+			log.Printf("Error: stable device ID %s collides for iommu keys %s and %s, using iommu key",
+				stableID, existing, iommuKey)
+			stableID = iommuKey
+		}
+		stableIDMap[stableID] = iommuKey
+		iommuKeyToStableID[iommuKey] = stableID
+	}
+}
+
+// stableIDForIommuKey returns the stable device ID for an IOMMU group/fd key.
+// The key itself is returned when no stable ID has been derived.
+func stableIDForIommuKey(iommuKey string) string {
+	if id, ok := iommuKeyToStableID[iommuKey]; ok {
+		return id
+	}
+	return iommuKey
+}
+
+// iommuKeyForDeviceID translates a device ID advertised to kubelet back to the
+// current IOMMU group/fd key. IDs without a translation are assumed to already
+// be IOMMU keys; bare numbers advertised before the keys were namespaced are
+// migrated to the key of the discovered device, preferring iommufd.
+func iommuKeyForDeviceID(id string) string {
+	if iommuKey, ok := stableIDMap[id]; ok {
+		return iommuKey
+	}
+	if _, err := strconv.Atoi(id); err == nil {
+		for _, iommuKey := range []string{iommufdKeyPrefix + "vfio" + id, iommuGroupKeyPrefix + id} {
+			if _, ok := iommuMap[iommuKey]; ok {
+				return iommuKey
+			}
+		}
+	}
+	return id
+}
@@ -29,11 +29,17 @@
 package device_plugin
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -41,12 +47,20 @@ import (
 
 // NvidiaPCIDevice holds details about an NVIDIA PCI device (GPU or NVSwitch)
 type NvidiaPCIDevice struct {
-	Address    string // PCI address of device
-	DeviceID   uint16 // PCI device ID
-	DeviceName string // Human-readable device name
-	IommuGroup int    // IOMMU group number
-	IommuFD    string // IOMMUFD device handle (if available)
-	IsNVSwitch bool   // True if this is an NVSwitch device
+	Address      string   // PCI address of device
+	DeviceID     uint16   // PCI device ID
+	DeviceName   string   // Human-readable device name
+	Driver       string   // vfio-pci or the variant driver the device is bound to
+	IommuGroup   int      // IOMMU group number
+	IommuFD      string   // IOMMUFD device handle (if available)
+	IsNVSwitch   bool     // True if this is an NVSwitch device
+	Serial       string   // PCIe device serial number (if available)
+	BoardSerial  string   // Board serial number from the VPD (if available)
+	Baseboard    string   // Baseboard (topmost PCIe switch) the device sits on
+	NumaNode     int      // NUMA node of the device (-1 if unknown)
+	MemoryMiB    int      // GPU memory size in MiB (0 if unknown)
+	P2PGroup     string   // PCIe switch shared with P2P capable peers (empty if none)
+	ResetMethods []string // Kernel reset methods of the function (nil if it cannot be reset)
 }
 
 // iommuMap maps IOMMU group/fd key to list of devices in that group
@@ -62,60 +76,272 @@ var nvSwitchDeviceIDs map[string]bool
 var nvpciLib nvpci.Interface
 
 var startDevicePlugin = startDevicePluginFunc
-var stop = make(chan struct{})
+
+// daemonCtx is the root context of the daemon, handed over by main. The
+// plugins, controllers and auxiliary servers stop, and in-flight API calls
+// are abandoned, when it is canceled.
+var daemonCtx = context.Background()
+
 var PGPUAlias string
 var NVSwitchAlias string
 
-func InitiateDevicePlugin() {
+// nvSwitchPerBaseboard advertises the NVSwitches of each baseboard as their
+// own resource, so that a VM only gets the switches of its GPUs' baseboard
+var nvSwitchPerBaseboard = getEnvBool("NVSWITCH_PER_BASEBOARD", false)
+
+// apiContext returns the context of a single Kubernetes or kubelet API call,
+// which times out after ctxTimeout and is canceled with the daemon
+func apiContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(daemonCtx, ctxTimeout)
+}
+
+// StartDevicePlugins validates the environment, discovers the devices and
+// starts a device plugin for each resource. It returns once every plugin has
+// been started, with a handle to stop or reload the plugins. Canceling ctx
+// stops the controllers and servers started with the plugins.
+func StartDevicePlugins(ctx context.Context) (*DevicePluginManager, error) {
+	daemonCtx = ctx
 	// Initialize nvpci library if not already set (allows injection for testing)
 	if nvpciLib == nil {
 		nvpciLib = nvpci.New()
 	}
-	// Discover NVIDIA devices bound to vfio-pci driver
-	createIommuDeviceMap()
-	GenerateCDISpec()
-	createDevicePlugins()
+	// Wait for a previous instance to exit before touching the sockets and
+	// CDI specs
+	if err := lockInstance(); err != nil {
+		return nil, err
+	}
+	// Validate the environment before advertising any devices
+	results, ok := runPreflightChecks(preflightChecks)
+	log.Println(formatPreflightReport(results))
+	if !ok {
+		return nil, fmt.Errorf("critical preflight checks failed, refusing to advertise devices")
+	}
+	if err := auxTLS.reload(); err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration of the auxiliary endpoints: %w", err)
+	}
+	discoveryErr := discoverDevices()
+	if err := checkDiscoveryError(); err != nil {
+		return nil, err
+	}
+	if err := deviceStates.load(); err != nil {
+		log.Printf("Error restoring device state: %v", err)
+	}
+
+	m := newDevicePluginManager()
+	m.start()
+	m.runControllers()
+	liftStartupTaint(m, discoveryErr)
+	go serveReadiness(m)
+	go runConfigWatcher(m)
+	go serveMetadata(m)
+	go serveHealthAgent(m)
+	go serveDeviceEvents(m)
+	go serveAdmin(m)
+	go labelIommuMode()
+	return m, nil
 }
 
-// createDevicePlugins starts a device plugin for each distinct NVIDIA device type
-func createDevicePlugins() {
+// discoverDevices discovers NVIDIA devices bound to the vfio-pci driver and
+// writes their CDI specs, returning an error if discovery failed or the CDI
+// specs were not written
+func discoverDevices() error {
+	cdiSpecLock.Lock()
+	defer cdiSpecLock.Unlock()
+	scanErr := createIommuDeviceMap()
+	discoveryState.set(scanErr)
+	cdiGC.reset()
+	cdiErr := GenerateCDISpec()
+	if cdiErr != nil {
+		log.Printf("Error generating CDI specs: %v", cdiErr)
+	}
+	if len(iommuMap) > 0 {
+		log.Printf("Discovered devices:\n%s", deviceMappingTable())
+	}
+	// Clean up CDI specs and sockets left over from a previous boot before
+	// registering, so that nothing references vfio nodes that no longer exist
+	if err := reconcileCDISpecs(); err != nil {
+		log.Printf("Error reconciling CDI specs: %v", err)
+	}
+	if err := cleanupStaleSockets(); err != nil {
+		log.Printf("Error cleaning up stale sockets: %v", err)
+	}
+	return errors.Join(scanErr, cdiErr)
+}
+
+// deviceMappingTable lists the CDI device, PCI address, model, NUMA node and
+// driver of every discovered function, sorted by IOMMU key
+func deviceMappingTable() string {
+	keys := make([]string, 0, len(iommuMap))
+	for iommuKey := range iommuMap {
+		keys = append(keys, iommuKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return extractNumber(keys[i]) < extractNumber(keys[j]) })
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IOMMU\tCDI DEVICE\tPCI ADDRESS\tMODEL\tNUMA\tDRIVER")
+	for _, iommuKey := range keys {
+		cdiDevice := generatedCDIDevices[iommuKey]
+		if cdiDevice == "" {
+			cdiDevice = "-"
+		}
+		for _, dev := range iommuMap[iommuKey] {
+			numa := "-"
+			if dev.NumaNode >= 0 {
+				numa = strconv.Itoa(dev.NumaNode)
+			}
+			driver := dev.Driver
+			if driver == "" {
+				driver = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", iommuKey, cdiDevice, dev.Address, dev.DeviceName, numa, driver)
+		}
+	}
+	w.Flush()
+	return b.String()
+}
+
+// RunCDIOnly discovers devices, writes their CDI specs and optionally labels
+// the node, without serving devices to kubelet. It is meant to run as an
+// initContainer or a one-shot systemd unit.
+func RunCDIOnly(labelNode bool) error {
+	if nvpciLib == nil {
+		nvpciLib = nvpci.New()
+	}
+	if err := lockInstance(); err != nil {
+		return err
+	}
+	results, ok := runPreflightChecks(oneShotPreflightChecks())
+	log.Println(formatPreflightReport(results))
+	if !ok {
+		return fmt.Errorf("critical preflight checks failed, refusing to generate CDI specs")
+	}
+	discoveryState.set(createIommuDeviceMap())
+	if err := checkDiscoveryError(); err != nil {
+		return err
+	}
+	if err := GenerateCDISpec(); err != nil {
+		return err
+	}
+	if err := reconcileCDISpecs(); err != nil {
+		return err
+	}
+	if !labelNode {
+		return nil
+	}
+
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return fmt.Errorf("NODE_NAME environment variable is required for labeling the node")
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		return err
+	}
+	ready := "true"
+	mode, _ := detectIommuMode()
+	iommu := string(mode)
+	return patchNodeLabels(clientset, nodeName, map[string]*string{cdiReadyLabel: &ready, iommuModeLabel: &iommu})
+}
+
+// DiscoverDevices discovers the devices and prints the CDI device, PCI
+// address, model and NUMA node of each, without writing CDI specs or serving
+// devices
+func DiscoverDevices(w io.Writer) error {
+	if nvpciLib == nil {
+		nvpciLib = nvpci.New()
+	}
+	discoveryState.set(createIommuDeviceMap())
+	if err := checkDiscoveryError(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, deviceMappingTable())
+	return err
+}
+
+// Validate checks the config file and runs the preflight checks relevant
+// without serving devices, printing their report. An error is returned if the
+// config file is invalid or a critical check failed.
+func Validate(w io.Writer, configPath string) error {
+	if configPath != "" {
+		if _, err := loadConfig(configPath); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Config file %s is valid\n", configPath)
+	}
+	results, ok := runPreflightChecks(oneShotPreflightChecks())
+	fmt.Fprintln(w, formatPreflightReport(results))
+	if !ok {
+		return fmt.Errorf("critical preflight checks failed")
+	}
+	return nil
+}
+
+// newDevicePlugins creates, without starting them, a device plugin for each
+// resource of the discovered devices
+func newDevicePlugins() ([]*GenericDevicePlugin, error) {
 	var devicePlugins []*GenericDevicePlugin
 	var devs []*pluginapi.Device
 	iommufdSupported, err := supportsIOMMUFD()
 	if err != nil {
-		log.Printf("Could not find if IOMMU FD is supported: %v", err)
-		return
+		return nil, fmt.Errorf("could not find if IOMMU FD is supported: %w", err)
 	}
 	log.Printf("iommufd supported: %v", iommufdSupported)
 	log.Printf("Device map: %v", deviceMap)
 
-	// Iterate over deviceMap to create device plugin for each type of device on the host
+	// Group the devices by resource name, since aliases map several device
+	// types to the same resource and each resource must have a single plugin
+	resources := make(map[string][]string)
 	for deviceID, iommuKeys := range deviceMap {
-		devs = nil
 		for _, iommuKey := range iommuKeys {
-			devs = append(devs, &pluginapi.Device{
-				ID:     iommuKey,
-				Health: pluginapi.Healthy,
-			})
+			deviceName := resourceNameForIommuKey(deviceID, iommuKey)
+			resources[deviceName] = append(resources[deviceName], iommuKey)
 		}
-
-		// Determine device name - use alias if set, otherwise use actual device name
-		var deviceName string
-		if isNVSwitchDeviceID(deviceID) {
-			if NVSwitchAlias != "" {
-				deviceName = NVSwitchAlias
-			} else {
-				deviceName = getDeviceNameForID(deviceID)
-			}
-		} else if PGPUAlias != "" {
-			deviceName = PGPUAlias
-		} else {
-			deviceName = getDeviceNameForID(deviceID)
+	}
+	for deviceName, iommuKeys := range subtreeResources {
+		resources[deviceName] = append(resources[deviceName], iommuKeys...)
+	}
+	deviceNames := make([]string, 0, len(resources))
+	for deviceName := range resources {
+		deviceNames = append(deviceNames, deviceName)
+	}
+	sort.Strings(deviceNames)
+
+	// Create a device plugin for each resource on the host
+	reserved, spare := heldBackIommuKeys()
+	sockets := make(map[string]string)
+	for _, deviceName := range deviceNames {
+		socketPath := socketPathForResource(deviceName)
+		if other, ok := sockets[socketPath]; ok {
+			log.Printf("Error: resources %q and %q would share socket %s, not registering %q; "+
+				"check P_GPU_ALIAS/NVSWITCH_ALIAS", other, deviceName, socketPath, deviceName)
+			continue
 		}
+		sockets[socketPath] = deviceName
 
-		if deviceName == "" {
-			log.Printf("Error: Could not find device name for device id: %s", deviceID)
-			deviceName = deviceID
+		devs = nil
+		for _, iommuKey := range resources[deviceName] {
+			if reserved[iommuKey] {
+				log.Printf("Not advertising reserved device %s of %q", iommuKey, deviceName)
+				continue
+			}
+			if spare[iommuKey] && !spares.isPromoted(iommuKey) {
+				log.Printf("Not advertising spare device %s of %q", iommuKey, deviceName)
+				continue
+			}
+			// devices disabled or under maintenance before a reload stay
+			// unhealthy, as do all devices until the kata runtime is ready,
+			// NVSwitches until the fabric manager is and devices on a
+			// degraded NVLink fabric until it recovers
+			health := pluginapi.Healthy
+			if outOfService(iommuKey) || runtimeGated() || fabricGated(iommuKey) || fabricDegraded.contains(iommuKey) {
+				health = pluginapi.Unhealthy
+			}
+			devs = append(devs, &pluginapi.Device{
+				ID:       stableIDForIommuKey(iommuKey),
+				Health:   health,
+				Topology: topologyForIommuKey(iommuKey),
+			})
 		}
 
 		log.Printf("Registering device plugin %q with %d device(s)", deviceName, len(devs))
@@ -124,76 +350,83 @@ func createDevicePlugins() {
 			devicePath = "/dev/vfio/devices/"
 		}
 		dp := NewGenericDevicePlugin(deviceName, devicePath, devs)
-		err := startDevicePlugin(dp)
-		if err != nil {
-			log.Printf("Error starting %s device plugin: %v", dp.deviceName, err)
-		} else {
-			devicePlugins = append(devicePlugins, dp)
-		}
-	}
-
-	// run GFD job
-	go runGFD()
-
-	<-stop
-
-	log.Printf("Shutting down device plugin controller")
-	for _, v := range devicePlugins {
-		v.Stop()
+		deviceStates.restoreHealth(dp)
+		devicePlugins = append(devicePlugins, dp)
 	}
+	devicePlugins = append(devicePlugins, migrationPlugins(devicePlugins)...)
+	return devicePlugins, nil
 }
 
+// startDevicePluginFunc starts the plugin until the context assigned to it by
+// the device plugin manager is canceled
 func startDevicePluginFunc(dp *GenericDevicePlugin) error {
-	return dp.Start(stop)
+	return dp.Start(dp.ctx)
 }
 
-// createIommuDeviceMap discovers all NVIDIA GPUs and NVSwitches bound to vfio-pci driver
-func createIommuDeviceMap() {
+// createIommuDeviceMap discovers all NVIDIA GPUs and NVSwitches bound to
+// vfio-pci driver. The maps hold the devices that were discovered even when
+// an error is returned.
+func createIommuDeviceMap() error {
 	iommufdSupported, err := supportsIOMMUFD()
 	if err != nil {
 		log.Printf("Could not find if IOMMU FD is supported: %v", err)
-		return
+		return fmt.Errorf("could not find if IOMMU FD is supported: %w", err)
 	}
 	iommuMap = make(map[string][]NvidiaPCIDevice)
 	deviceMap = make(map[string][]string)
 	nvSwitchDeviceIDs = make(map[string]bool)
 
-	// Get all NVIDIA devices (GPUs and NVSwitches)
-	devices, err := nvpciLib.GetAllDevices()
-	if err != nil {
-		log.Printf("Error discovering NVIDIA devices: %v", err)
-		return
+	// Get all NVIDIA devices (GPUs and NVSwitches), reusing the previous
+	// scan if the PCI bus has not changed
+	snapshot := sysfsSnapshots.current()
+	devices, scanErr := snapshot.scan()
+	if scanErr != nil {
+		log.Printf("Error discovering NVIDIA devices: %v", scanErr)
+		if len(devices) == 0 {
+			return fmt.Errorf("error discovering NVIDIA devices: %w", scanErr)
+		}
 	}
 
+	var candidates, gpus, nvSwitches int
 	for _, dev := range devices {
 		// Only process GPUs and NVSwitches
 		if !dev.IsGPU() && !dev.IsNVSwitch() {
 			continue
 		}
+		candidates++
+
+		if !deviceAllowed(dev.Address, dev.Device) {
+			discoverySkips.skip(dev.Address, "config",
+				fmt.Sprintf("Skipping %s device %s: excluded by the allow/deny lists of the config file",
+					getDeviceType(dev), dev.Address))
+			continue
+		}
 
-		// Only process devices bound to vfio-pci driver
-		if dev.Driver != "vfio-pci" {
-			log.Printf("Skipping %s device %s: driver is %q, not vfio-pci",
-				getDeviceType(dev), dev.Address, dev.Driver)
+		// Only process devices bound to vfio-pci or a variant driver
+		if !isVfioDriver(dev.Driver) {
+			discoverySkips.skip(dev.Address, "driver:"+dev.Driver,
+				fmt.Sprintf("Skipping %s device %s: driver is %q, not %s",
+					getDeviceType(dev), dev.Address, dev.Driver, strings.Join(vfioDrivers, " or ")))
 			continue
 		}
 
-		// Determine IOMMU key (either IOMMU group or IOMMUFD device number).
-		// dev.IommuFD is "vfio<NUM>" but we strip the prefix so the key is
-		// just the number, consistent with the legacy IOMMU group key and
-		// the VFIO device paths used in CDI specs and allocation.
-		iommuKey := strconv.Itoa(dev.IommuGroup)
-		if iommufdSupported && dev.IommuFD != "" {
-			iommuKey = strings.TrimPrefix(dev.IommuFD, "vfio")
+		// Only advertise devices whose whole IOMMU group can be assigned
+		if groupErr := snapshot.groupViable(dev.IommuGroup); groupErr != nil {
+			discoverySkips.skip(dev.Address, "iommu-group",
+				fmt.Sprintf("Skipping %s device %s: %v", getDeviceType(dev), dev.Address, groupErr))
+			continue
 		}
 
+		// Determine IOMMU key (either IOMMU group or IOMMUFD device)
+		iommuKey := iommuKeyFor(dev.IommuGroup, dev.IommuFD, iommufdSupported)
+
 		deviceID := fmt.Sprintf("%04x", dev.Device)
 		if iommufdSupported {
-			log.Printf("Found %s %s [%s] at %s (iommufd: %s)",
-				getDeviceType(dev), dev.DeviceName, deviceID, dev.Address, dev.IommuFD)
+			log.Printf("Found %s %s [%s] at %s (iommufd: %s, driver: %s)",
+				getDeviceType(dev), dev.DeviceName, deviceID, dev.Address, dev.IommuFD, dev.Driver)
 		} else {
-			log.Printf("Found %s %s [%s] at %s (vfio group: %d)",
-				getDeviceType(dev), dev.DeviceName, deviceID, dev.Address, dev.IommuGroup)
+			log.Printf("Found %s %s [%s] at %s (vfio group: %d, driver: %s)",
+				getDeviceType(dev), dev.DeviceName, deviceID, dev.Address, dev.IommuGroup, dev.Driver)
 		}
 
 		// Add to device map only for new IOMMU groups
@@ -205,17 +438,46 @@ func createIommuDeviceMap() {
 		isSwitch := dev.IsNVSwitch()
 		if isSwitch {
 			nvSwitchDeviceIDs[deviceID] = true
+			nvSwitches++
+		} else {
+			gpus++
 		}
 
 		// Add device to IOMMU map
-		iommuMap[iommuKey] = append(iommuMap[iommuKey], NvidiaPCIDevice{
-			Address:    dev.Address,
-			DeviceID:   dev.Device,
-			DeviceName: dev.DeviceName,
-			IommuGroup: dev.IommuGroup,
-			IommuFD:    dev.IommuFD,
-			IsNVSwitch: isSwitch,
-		})
+		iommuMap[iommuKey] = append(iommuMap[iommuKey], snapshot.device(dev))
+	}
+	mergeSharedIommuGroups()
+	discoverNICCompanions()
+	buildSubtrees()
+	discoverySkips.flush()
+	events.normal("DevicesDiscovered", fmt.Sprintf("Discovered %d GPU(s) and %d NVSwitch(es) bound to vfio-pci, skipped %d device(s)",
+		gpus, nvSwitches, candidates-gpus-nvSwitches))
+
+	buildStableDeviceIDs()
+	if scanErr != nil {
+		return fmt.Errorf("error discovering NVIDIA devices: %w", scanErr)
+	}
+	return nil
+}
+
+// newNvidiaPCIDevice reads the attributes of a discovered PCI function from
+// sysfs
+func newNvidiaPCIDevice(dev *nvpci.NvidiaPCIDevice) NvidiaPCIDevice {
+	return NvidiaPCIDevice{
+		Address:      dev.Address,
+		DeviceID:     dev.Device,
+		DeviceName:   dev.DeviceName,
+		Driver:       dev.Driver,
+		IommuGroup:   dev.IommuGroup,
+		IommuFD:      dev.IommuFD,
+		IsNVSwitch:   dev.IsNVSwitch(),
+		Serial:       readDeviceSerial(dev),
+		BoardSerial:  readBoardSerial(dev.Address),
+		Baseboard:    getBaseboardID(dev.Address, dev.Path),
+		NumaNode:     dev.NumaNode,
+		MemoryMiB:    getGPUMemoryMiB(dev),
+		P2PGroup:     getP2PGroup(dev.Path),
+		ResetMethods: readResetMethods(dev.Address),
 	}
 }
 
@@ -236,6 +498,59 @@ func getIommuMap() map[string][]NvidiaPCIDevice {
 	return iommuMap
 }
 
+// resourceNameForDeviceID returns the resource name advertised for a device
+// type - the alias if set, otherwise the actual device name
+func resourceNameForDeviceID(deviceID string) string {
+	var deviceName string
+	if isNVSwitchDeviceID(deviceID) {
+		if NVSwitchAlias != "" {
+			deviceName = NVSwitchAlias
+		} else {
+			deviceName = getDeviceNameForID(deviceID)
+		}
+	} else if PGPUAlias != "" {
+		deviceName = PGPUAlias
+	} else {
+		deviceName = getDeviceNameForID(deviceID)
+	}
+
+	if deviceName == "" {
+		log.Printf("Error: Could not find device name for device id: %s", deviceID)
+		deviceName = deviceID
+	}
+	return deviceName
+}
+
+// resourceNameForIommuKey returns the resource name advertised for the given
+// IOMMU key of a device type. With NVSWITCH_PER_BASEBOARD the baseboard is
+// appended to the NVSwitch resource name, e.g. "nvswitch-0000-41-00.0".
+func resourceNameForIommuKey(deviceID, iommuKey string) string {
+	deviceName := resourceNameForDeviceID(deviceID)
+	if !nvSwitchPerBaseboard || !isNVSwitchDeviceID(deviceID) {
+		return deviceName
+	}
+	devs := iommuMap[iommuKey]
+	if len(devs) == 0 || devs[0].Baseboard == "" {
+		return deviceName
+	}
+	return deviceName + "-" + strings.ToLower(strings.ReplaceAll(devs[0].Baseboard, ":", "-"))
+}
+
+// nvSwitchResourceNames returns the resource names NVSwitches are advertised as
+func nvSwitchResourceNames() map[string]bool {
+	names := make(map[string]bool)
+	for deviceID := range nvSwitchDeviceIDs {
+		if !nvSwitchPerBaseboard {
+			names[resourceNameForDeviceID(deviceID)] = true
+			continue
+		}
+		for _, iommuKey := range deviceMap[deviceID] {
+			names[resourceNameForIommuKey(deviceID, iommuKey)] = true
+		}
+	}
+	return names
+}
+
 // getDeviceNameForID finds the device name for a given device ID from the discovered devices
 func getDeviceNameForID(deviceID string) string {
 	// Find the first device with this device ID in the iommu map
@@ -243,7 +558,13 @@ func getDeviceNameForID(deviceID string) string {
 		for _, dev := range devices {
 			devIDStr := fmt.Sprintf("%04x", dev.DeviceID)
 			if devIDStr == deviceID {
-				return formatDeviceName(dev.DeviceName)
+				name := dev.DeviceName
+				if name == "" {
+					// Device IDs newer than the PCI database are looked up in
+					// the optional pci.ids override
+					name = lookupDeviceName(dev.DeviceID)
+				}
+				return formatDeviceName(name)
 			}
 		}
 	}
@@ -29,12 +29,51 @@
 package device_plugin
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	corev1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
+	"tags.cncf.io/container-device-interface/specs-go"
 )
 
 func fakeStartDevicePluginFunc(dp *GenericDevicePlugin) error {
@@ -83,14 +122,14 @@ var _ = Describe("Device Plugin", func() {
 			createIommuDeviceMap()
 
 			Expect(iommuMap).To(HaveLen(2))
-			Expect(iommuMap["1"]).To(HaveLen(1))
-			Expect(iommuMap["1"][0].Address).To(Equal("0000:01:00.0"))
-			Expect(iommuMap["2"]).To(HaveLen(1))
-			Expect(iommuMap["2"][0].Address).To(Equal("0000:02:00.0"))
+			Expect(iommuMap["group:1"]).To(HaveLen(1))
+			Expect(iommuMap["group:1"][0].Address).To(Equal("0000:01:00.0"))
+			Expect(iommuMap["group:2"]).To(HaveLen(1))
+			Expect(iommuMap["group:2"][0].Address).To(Equal("0000:02:00.0"))
 
 			Expect(deviceMap).To(HaveLen(2))
-			Expect(deviceMap["1b80"]).To(ContainElement("1"))
-			Expect(deviceMap["1b81"]).To(ContainElement("2"))
+			Expect(deviceMap["1b80"]).To(ContainElement("group:1"))
+			Expect(deviceMap["1b81"]).To(ContainElement("group:2"))
 		})
 
 		It("discovers NVSwitches bound to vfio-pci driver", func() {
@@ -113,9 +152,9 @@ var _ = Describe("Device Plugin", func() {
 			createIommuDeviceMap()
 
 			Expect(iommuMap).To(HaveLen(1))
-			Expect(iommuMap["3"]).To(HaveLen(1))
-			Expect(iommuMap["3"][0].Address).To(Equal("0000:03:00.0"))
-			Expect(deviceMap["2000"]).To(ContainElement("3"))
+			Expect(iommuMap["group:3"]).To(HaveLen(1))
+			Expect(iommuMap["group:3"][0].Address).To(Equal("0000:03:00.0"))
+			Expect(deviceMap["2000"]).To(ContainElement("group:3"))
 		})
 
 		It("skips devices not bound to vfio-pci driver", func() {
@@ -184,9 +223,42 @@ var _ = Describe("Device Plugin", func() {
 
 			createIommuDeviceMap()
 
-			go createDevicePlugins()
-			time.Sleep(100 * time.Millisecond)
-			stop <- struct{}{}
+			m := newDevicePluginManager()
+			m.start()
+			defer m.Stop()
+			Expect(m.Plugins()).To(HaveLen(1))
+			Expect(m.Ready()).To(BeTrue())
+		})
+
+		It("creates a single device plugin for device types sharing an alias", func() {
+			oldAlias := PGPUAlias
+			PGPUAlias = "pgpu"
+			defer func() { PGPUAlias = oldAlias }()
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return []*nvpci.NvidiaPCIDevice{
+						{Address: "0000:01:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b80, DeviceName: "GeForce GTX 1080", Driver: "vfio-pci", IommuGroup: 1},
+						{Address: "0000:02:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b81, DeviceName: "GeForce GTX 1070", Driver: "vfio-pci", IommuGroup: 2},
+					}, nil
+				},
+			}
+			started := make(chan *GenericDevicePlugin, 2)
+			startDevicePlugin = func(dp *GenericDevicePlugin) error {
+				started <- dp
+				return nil
+			}
+
+			createIommuDeviceMap()
+
+			m := newDevicePluginManager()
+			m.start()
+			defer m.Stop()
+			var dp *GenericDevicePlugin
+			Expect(started).To(Receive(&dp))
+			Expect(dp.deviceName).To(Equal("pgpu"))
+			Expect(dp.devs).To(HaveLen(2))
+			Expect(started).ToNot(Receive())
+			Expect(m.Plugins()).To(HaveLen(1))
 		})
 
 		It("tracks NVSwitch device IDs separately", func() {
@@ -222,8 +294,204 @@ var _ = Describe("Device Plugin", func() {
 			// NVSwitch should be tracked
 			Expect(isNVSwitchDeviceID("2000")).To(BeTrue())
 			// Device in iommuMap should have IsNVSwitch set correctly
-			Expect(iommuMap["1"][0].IsNVSwitch).To(BeFalse())
-			Expect(iommuMap["3"][0].IsNVSwitch).To(BeTrue())
+			Expect(iommuMap["group:1"][0].IsNVSwitch).To(BeFalse())
+			Expect(iommuMap["group:3"][0].IsNVSwitch).To(BeTrue())
+		})
+
+		It("derives stable device IDs from the PCI address", func() {
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return []*nvpci.NvidiaPCIDevice{
+						{
+							Address:    "0000:41:00.0",
+							Vendor:     0x10de,
+							Class:      nvpci.PCI3dControllerClass,
+							Device:     0x2330,
+							DeviceName: "H100",
+							Driver:     "vfio-pci",
+							IommuGroup: 17,
+						},
+					}, nil
+				},
+			}
+
+			createIommuDeviceMap()
+
+			Expect(stableIDForIommuKey("group:17")).To(Equal("0000:41:00.0"))
+			Expect(iommuKeyForDeviceID("0000:41:00.0")).To(Equal("group:17"))
+			// Unknown IDs are treated as IOMMU keys
+			Expect(iommuKeyForDeviceID("18")).To(Equal("18"))
+		})
+
+		It("discovers devices bound to the configured vfio variant drivers", func() {
+			oldDrivers := vfioDrivers
+			DeferCleanup(func() { vfioDrivers = oldDrivers })
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return []*nvpci.NvidiaPCIDevice{
+						{Address: "0000:01:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x2342, DeviceName: "GH100", Driver: "nvgrace-gpu-vfio-pci", IommuGroup: 1},
+						{Address: "0000:02:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x2342, DeviceName: "GH100", Driver: "vfio-pci", IommuGroup: 2},
+					}, nil
+				},
+			}
+
+			Expect(createIommuDeviceMap()).To(Succeed())
+			Expect(iommuMap).To(HaveLen(1))
+			Expect(iommuMap["group:2"][0].Driver).To(Equal("vfio-pci"))
+
+			vfioDrivers = parseVfioDrivers("vfio-pci,nvgrace-gpu-vfio-pci")
+			Expect(createIommuDeviceMap()).To(Succeed())
+			Expect(iommuMap).To(HaveLen(2))
+			Expect(iommuMap["group:1"][0].Driver).To(Equal("nvgrace-gpu-vfio-pci"))
+		})
+
+		It("reuses the scan of an unchanged PCI bus", func() {
+			workDir := GinkgoT().TempDir()
+			rootPath = workDir
+			DeferCleanup(func() {
+				rootPath = "/"
+				sysfsSnapshots.reset()
+			})
+			devPath := filepath.Join(workDir, pciDevicesPath, "0000:01:00.0")
+			driversPath := filepath.Join(workDir, "sys/bus/pci/drivers")
+			for _, dir := range []string{devPath, filepath.Join(driversPath, "vfio-pci"), filepath.Join(driversPath, "nvidia")} {
+				Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+			}
+			Expect(os.Symlink(filepath.Join(driversPath, "vfio-pci"), filepath.Join(devPath, "driver"))).To(Succeed())
+			scans := 0
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					scans++
+					return []*nvpci.NvidiaPCIDevice{
+						{Address: "0000:01:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b80, DeviceName: "GeForce GTX 1080", Driver: "vfio-pci", IommuGroup: 1},
+					}, nil
+				},
+			}
+
+			Expect(createIommuDeviceMap()).To(Succeed())
+			Expect(createIommuDeviceMap()).To(Succeed())
+			Expect(scans).To(Equal(1))
+			Expect(iommuMap["group:1"]).To(HaveLen(1))
+
+			// rebinding the function changes the bus
+			Expect(os.Remove(filepath.Join(devPath, "driver"))).To(Succeed())
+			Expect(os.Symlink(filepath.Join(driversPath, "nvidia"), filepath.Join(devPath, "driver"))).To(Succeed())
+			Expect(createIommuDeviceMap()).To(Succeed())
+			Expect(scans).To(Equal(2))
+
+			discoveryCache = false
+			DeferCleanup(func() { discoveryCache = true })
+			Expect(createIommuDeviceMap()).To(Succeed())
+			Expect(scans).To(Equal(3))
+		})
+	})
+
+	Context("discovery error policy Tests", func() {
+		var oldPolicy string
+		var oldState *discoveryStatus
+
+		BeforeEach(func() {
+			iommuMap = nil
+			deviceMap = nil
+			oldPolicy, oldState = discoveryErrorPolicy, discoveryState
+			discoveryState = &discoveryStatus{}
+			rootPath = GinkgoT().TempDir()
+			for _, address := range []string{"0000:01:00.0", "0000:02:00.0"} {
+				Expect(os.MkdirAll(filepath.Join(rootPath, pciDevicesPath, address), 0755)).To(Succeed())
+			}
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return nil, errors.New("error constructing NVIDIA PCI device 0000:02:00.0")
+				},
+				GetGPUByPciBusIDFunc: func(address string) (*nvpci.NvidiaPCIDevice, error) {
+					if address == "0000:02:00.0" {
+						return nil, errors.New("unable to read config")
+					}
+					return &nvpci.NvidiaPCIDevice{
+						Address:    address,
+						Vendor:     0x10de,
+						Class:      nvpci.PCI3dControllerClass,
+						Device:     0x1b80,
+						DeviceName: "GeForce GTX 1080",
+						Driver:     "vfio-pci",
+						IommuGroup: 1,
+					}, nil
+				},
+			}
+		})
+
+		AfterEach(func() {
+			discoveryErrorPolicy, discoveryState = oldPolicy, oldState
+			rootPath = "/"
+		})
+
+		It("advertises the devices that were read in degrade mode", func() {
+			discoveryErrorPolicy = discoveryDegrade
+			err := createIommuDeviceMap()
+			Expect(err).To(MatchError(ContainSubstring("device 0000:02:00.0: unable to read config")))
+			Expect(iommuMap).To(HaveLen(1))
+			Expect(deviceMap["1b80"]).To(ConsistOf("group:1"))
+
+			discoveryState.set(err)
+			Expect(checkDiscoveryError()).To(Succeed())
+			rec := httptest.NewRecorder()
+			serveHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring("[-]discovery degraded: error discovering NVIDIA devices"))
+		})
+
+		It("fails in fail-fast mode", func() {
+			discoveryErrorPolicy = discoveryFailFast
+			err := createIommuDeviceMap()
+			Expect(err).To(MatchError(ContainSubstring("error constructing NVIDIA PCI device")))
+			Expect(iommuMap).To(BeEmpty())
+
+			discoveryState.set(err)
+			Expect(checkDiscoveryError()).To(MatchError(err))
+		})
+
+		It("reports a clean discovery", func() {
+			rec := httptest.NewRecorder()
+			serveHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+			Expect(rec.Body.String()).To(Equal("[+]discovery ok\nhealthz check passed\n"))
+		})
+	})
+
+	Context("parseVPDKeyword() Tests", func() {
+		It("reads the board serial from the read-only VPD fields", func() {
+			vpd := []byte{0x82, 0x05, 0x00}
+			vpd = append(vpd, "Board"...)
+			fields := []byte("PN\x04P123SN\x0d1652021000123RV\x01\x00")
+			vpd = append(vpd, 0x90, byte(len(fields)), 0x00)
+			vpd = append(vpd, fields...)
+			vpd = append(vpd, 0x78)
+
+			Expect(parseVPDKeyword(vpd, vpdKeywordSerial)).To(Equal("1652021000123"))
+			Expect(parseVPDKeyword(vpd, "EC")).To(BeEmpty())
+			// truncated VPD
+			Expect(parseVPDKeyword(vpd[:10], vpdKeywordSerial)).To(BeEmpty())
+		})
+
+		It("describes the serials of a device", func() {
+			Expect(deviceSerials(NvidiaPCIDevice{})).To(BeEmpty())
+			Expect(deviceSerials(NvidiaPCIDevice{Serial: "0123456789abcdef", BoardSerial: "1652021000123"})).
+				To(Equal(", board serial: 1652021000123, serial: 0123456789abcdef"))
+		})
+	})
+
+	Context("buildStableDeviceIDs() Tests", func() {
+		It("uses the lowest PCI address and serial of a group", func() {
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"5": {
+					{Address: "0000:06:00.0", Serial: "00000000deadbeef"},
+					{Address: "0000:05:00.0", Serial: "0123456789abcdef"},
+				},
+			}
+
+			buildStableDeviceIDs()
+
+			Expect(stableIDForIommuKey("5")).To(Equal("0000:05:00.0-0123456789abcdef"))
+			Expect(iommuKeyForDeviceID("0000:05:00.0-0123456789abcdef")).To(Equal("5"))
 		})
 	})
 
@@ -308,4 +576,2972 @@ var _ = Describe("Device Plugin", func() {
 			Expect(result).To(Equal(""))
 		})
 	})
+
+	Context("NVSwitch health Tests", func() {
+		AfterEach(func() {
+			nvSwitchProbe = probeNVSwitch
+			rootPath = "/"
+		})
+
+		It("falls back to the PCI domain for the baseboard", func() {
+			Expect(getBaseboardID("0001:41:00.0", "")).To(Equal("pci0001"))
+		})
+
+		It("probes the PCIe link state of an NVSwitch", func() {
+			workDir, err := os.MkdirTemp("", "nvswitch-test")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(workDir)
+			rootPath = workDir
+
+			dev := NvidiaPCIDevice{Address: "0000:07:00.0", IsNVSwitch: true}
+			Expect(probeNVSwitch(dev)).ToNot(Succeed())
+
+			devPath := filepath.Join(workDir, pciDevicesPath, dev.Address)
+			Expect(os.MkdirAll(devPath, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(devPath, "current_link_width"), []byte("0\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(devPath, "current_link_speed"), []byte("Unknown\n"), 0644)).To(Succeed())
+			Expect(probeNVSwitch(dev)).ToNot(Succeed())
+
+			Expect(os.WriteFile(filepath.Join(devPath, "current_link_width"), []byte("2\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(devPath, "current_link_speed"), []byte("16.0 GT/s PCIe\n"), 0644)).To(Succeed())
+			Expect(probeNVSwitch(dev)).To(Succeed())
+		})
+
+		It("marks GPUs on a baseboard with an unhealthy NVSwitch as unhealthy", func() {
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", Baseboard: "pci0000:00"}},
+				"2": {{Address: "0000:81:00.0", Baseboard: "pci0000:80"}},
+				"3": {{Address: "0000:05:00.0", Baseboard: "pci0000:00", IsNVSwitch: true}},
+				"4": {{Address: "0000:85:00.0", Baseboard: "pci0000:80", IsNVSwitch: true}},
+			}
+			nvSwitchProbe = func(dev NvidiaPCIDevice) error {
+				if dev.Address == "0000:05:00.0" {
+					return errors.New("PCIe link is down")
+				}
+				return nil
+			}
+
+			health := evaluateFabricHealth()
+			Expect(health).To(Equal(map[string]string{
+				"1": pluginapi.Unhealthy,
+				"2": pluginapi.Healthy,
+				"3": pluginapi.Unhealthy,
+				"4": pluginapi.Healthy,
+			}))
+		})
+		It("groups the GPUs and NVSwitches of an HGX baseboard by the switch of the board", func() {
+			workDir, err := os.MkdirTemp("", "baseboard-test")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(workDir)
+
+			// the GPUs and NVSwitches of a board sit on different buses below
+			// the switch of the board, and both boards share a root complex
+			layout := map[string]string{
+				"0000:05:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:00.0/0000:03:00.0/0000:04:00.0/0000:05:00.0",
+				"0000:0a:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:08.0/0000:0a:00.0",
+				"0000:45:00.0": "pci0000:00/0000:00:02.0/0000:41:00.0/0000:42:00.0/0000:43:00.0/0000:44:00.0/0000:45:00.0",
+				"0000:4a:00.0": "pci0000:00/0000:00:02.0/0000:41:00.0/0000:42:08.0/0000:4a:00.0",
+				"0000:81:00.0": "pci0000:80/0000:80:01.0/0000:81:00.0",
+			}
+			boards := make(map[string]string)
+			for address, path := range layout {
+				Expect(os.MkdirAll(filepath.Join(workDir, "devices", path), 0755)).To(Succeed())
+				link := filepath.Join(workDir, address)
+				Expect(os.Symlink(filepath.Join(workDir, "devices", path), link)).To(Succeed())
+				boards[address] = getBaseboardID(address, link)
+			}
+			Expect(boards).To(Equal(map[string]string{
+				"0000:05:00.0": "0000:01:00.0",
+				"0000:0a:00.0": "0000:01:00.0",
+				"0000:45:00.0": "0000:41:00.0",
+				"0000:4a:00.0": "0000:41:00.0",
+				"0000:81:00.0": "pci0000:80",
+			}))
+
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:05:00.0", Baseboard: boards["0000:05:00.0"]}},
+				"2": {{Address: "0000:45:00.0", Baseboard: boards["0000:45:00.0"]}},
+				"3": {{Address: "0000:0a:00.0", Baseboard: boards["0000:0a:00.0"], IsNVSwitch: true}},
+				"4": {{Address: "0000:4a:00.0", Baseboard: boards["0000:4a:00.0"], IsNVSwitch: true}},
+			}
+			nvSwitchProbe = func(dev NvidiaPCIDevice) error {
+				if dev.Address == "0000:4a:00.0" {
+					return errors.New("PCIe link is down")
+				}
+				return nil
+			}
+			Expect(evaluateFabricHealth()).To(Equal(map[string]string{
+				"1": pluginapi.Healthy,
+				"2": pluginapi.Unhealthy,
+				"3": pluginapi.Healthy,
+				"4": pluginapi.Unhealthy,
+			}))
+		})
+
+		It("marks GPUs on a baseboard with a missing NVSwitch as unhealthy", func() {
+			oldExpected := expectedNVSwitchesPerBaseboard
+			defer func() { expectedNVSwitchesPerBaseboard = oldExpected }()
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", Baseboard: "0000:00:01.0"}},
+				"2": {{Address: "0000:81:00.0", Baseboard: "0000:80:01.0"}},
+				"3": {{Address: "0000:05:00.0", Baseboard: "0000:00:01.0", IsNVSwitch: true}},
+				"4": {{Address: "0000:06:00.0", Baseboard: "0000:00:01.0", IsNVSwitch: true}},
+				"5": {{Address: "0000:85:00.0", Baseboard: "0000:80:01.0", IsNVSwitch: true}},
+			}
+			nvSwitchProbe = func(dev NvidiaPCIDevice) error { return nil }
+
+			// missing switches are only detected with a configured count
+			expectedNVSwitchesPerBaseboard = 0
+			delete(iommuMap, "4")
+			Expect(evaluateFabricHealth()).To(HaveKeyWithValue("1", pluginapi.Healthy))
+
+			expectedNVSwitchesPerBaseboard = 2
+			health := evaluateFabricHealth()
+			Expect(health).To(HaveKeyWithValue("1", pluginapi.Unhealthy))
+			Expect(health).To(HaveKeyWithValue("2", pluginapi.Unhealthy))
+
+			// including boards whose switches are missing from the start
+			delete(iommuMap, "5")
+			iommuMap["4"] = []NvidiaPCIDevice{{Address: "0000:06:00.0", Baseboard: "0000:00:01.0", IsNVSwitch: true}}
+			health = evaluateFabricHealth()
+			Expect(health).To(HaveKeyWithValue("1", pluginapi.Healthy))
+			Expect(health).To(HaveKeyWithValue("2", pluginapi.Unhealthy))
+		})
+
+		It("advertises the NVSwitches of each baseboard as their own resource", func() {
+			oldIDs, oldAlias, oldPerBaseboard := nvSwitchDeviceIDs, NVSwitchAlias, nvSwitchPerBaseboard
+			defer func() { nvSwitchDeviceIDs, NVSwitchAlias, nvSwitchPerBaseboard = oldIDs, oldAlias, oldPerBaseboard }()
+			workDir, err := os.MkdirTemp("", "baseboard-test")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(workDir)
+
+			// two boards below one root complex, each with its GPUs and
+			// NVSwitches behind the upstream switch of the board
+			layout := map[string]string{
+				"0000:05:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:00.0/0000:05:00.0",
+				"0000:0a:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:08.0/0000:0a:00.0",
+				"0000:45:00.0": "pci0000:00/0000:00:02.0/0000:41:00.0/0000:42:00.0/0000:45:00.0",
+				"0000:4a:00.0": "pci0000:00/0000:00:02.0/0000:41:00.0/0000:42:08.0/0000:4a:00.0",
+			}
+			board := func(address string) string {
+				Expect(os.MkdirAll(filepath.Join(workDir, "devices", layout[address]), 0755)).To(Succeed())
+				link := filepath.Join(workDir, address)
+				Expect(os.Symlink(filepath.Join(workDir, "devices", layout[address]), link)).To(Succeed())
+				return getBaseboardID(address, link)
+			}
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"group:1": {{Address: "0000:05:00.0", Baseboard: board("0000:05:00.0")}},
+				"group:2": {{Address: "0000:45:00.0", Baseboard: board("0000:45:00.0")}},
+				"group:3": {{Address: "0000:0a:00.0", Baseboard: board("0000:0a:00.0"), IsNVSwitch: true}},
+				"group:4": {{Address: "0000:4a:00.0", Baseboard: board("0000:4a:00.0"), IsNVSwitch: true}},
+			}
+			Expect(iommuMap["group:1"][0].Baseboard).To(Equal(iommuMap["group:3"][0].Baseboard))
+			Expect(iommuMap["group:2"][0].Baseboard).To(Equal(iommuMap["group:4"][0].Baseboard))
+			deviceMap = map[string][]string{"2330": {"group:1", "group:2"}, "22a3": {"group:3", "group:4"}}
+			nvSwitchDeviceIDs, NVSwitchAlias = map[string]bool{"22a3": true}, "nvswitch"
+
+			nvSwitchPerBaseboard = false
+			Expect(resourceNameForIommuKey("22a3", "group:4")).To(Equal("nvswitch"))
+			Expect(nvSwitchResourceNames()).To(Equal(map[string]bool{"nvswitch": true}))
+
+			nvSwitchPerBaseboard = true
+			Expect(resourceNameForIommuKey("22a3", "group:3")).To(Equal("nvswitch-0000-01-00.0"))
+			Expect(resourceNameForIommuKey("22a3", "group:4")).To(Equal("nvswitch-0000-41-00.0"))
+			Expect(nvSwitchResourceNames()).To(Equal(map[string]bool{"nvswitch-0000-01-00.0": true, "nvswitch-0000-41-00.0": true}))
+		})
+	})
+
+	Context("ConfigureCDI() Tests", func() {
+		var oldVersion, oldVendor, oldRoot string
+
+		BeforeEach(func() {
+			oldVersion, oldVendor, oldRoot = cdiVersion, cdiVendor, cdiRoot
+		})
+
+		AfterEach(func() {
+			cdiVersion, cdiVendor, cdiRoot = oldVersion, oldVendor, oldRoot
+		})
+
+		It("keeps defaults for empty values", func() {
+			Expect(ConfigureCDI("", "", "")).To(Succeed())
+			Expect(cdiVersion).To(Equal(kataCompatibleCDIVersion))
+			Expect(cdiVendor).To(Equal("nvidia.com"))
+		})
+
+		It("accepts supported versions and vendors", func() {
+			Expect(ConfigureCDI("0.7.0", "example.com", "/etc/cdi")).To(Succeed())
+			Expect(cdiVersion).To(Equal("0.7.0"))
+			Expect(cdiVendor).To(Equal("example.com"))
+			Expect(cdiRoot).To(Equal("/etc/cdi"))
+		})
+
+		It("accepts a list of spec directories", func() {
+			defer setCdiRoot(oldRoot)
+			Expect(ConfigureCDI("", "", "/etc/cdi, /var/run/cdi,/etc/cdi/")).To(Succeed())
+			Expect(cdiRoots()).To(Equal([]string{"/etc/cdi", "/var/run/cdi"}))
+			Expect(ConfigureCDI("", "", "/etc/cdi,relative/dir")).ToNot(Succeed())
+		})
+
+		It("rejects unsupported values", func() {
+			Expect(ConfigureCDI("9.9.9", "", "")).ToNot(Succeed())
+			Expect(ConfigureCDI("", "bad vendor!", "")).ToNot(Succeed())
+			Expect(ConfigureCDI("", "", "relative/dir")).ToNot(Succeed())
+			Expect(cdiVersion).To(Equal(oldVersion))
+		})
+	})
+
+	Context("reconcileCDISpecs() Tests", func() {
+		var workDir, oldCdiRoot, oldAlias string
+
+		BeforeEach(func() {
+			var err error
+			workDir, err = os.MkdirTemp("", "reconcile-test")
+			Expect(err).ToNot(HaveOccurred())
+			rootPath = workDir
+			oldCdiRoot, oldAlias = cdiRoot, PGPUAlias
+			setCdiRoot(filepath.Join(workDir, "cdi"))
+			PGPUAlias = "pgpu"
+		})
+
+		AfterEach(func() {
+			setCdiRoot(oldCdiRoot)
+			PGPUAlias = oldAlias
+			rootPath = "/"
+			os.RemoveAll(workDir)
+		})
+
+		It("removes stale vfio specs of our vendor only", func() {
+			Expect(os.MkdirAll(cdiRoot, 0755)).To(Succeed())
+			stale := "cdiVersion: 0.5.0\nkind: nvidia.com/oldgpu\ndevices:\n- name: \"9\"\n  containerEdits:\n    deviceNodes:\n    - path: /dev/vfio/9\n"
+			toolkit := "cdiVersion: 0.5.0\nkind: nvidia.com/gpu\ndevices:\n- name: \"0\"\n  containerEdits:\n    deviceNodes:\n    - path: /dev/nvidia0\n"
+			Expect(os.WriteFile(filepath.Join(cdiRoot, "nvidia.com-oldgpu.yaml"), []byte(stale), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(cdiRoot, "nvidia.com-gpu.yaml"), []byte(toolkit), 0644)).To(Succeed())
+
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+			}
+			deviceMap = map[string][]string{"1b80": {"1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(GenerateCDISpec()).To(Succeed())
+
+			Expect(reconcileCDISpecs()).To(Succeed())
+			Expect(filepath.Join(cdiRoot, "nvidia.com-oldgpu.yaml")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(cdiRoot, "nvidia.com-gpu.yaml")).To(BeAnExistingFile())
+			Expect(filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml")).To(BeAnExistingFile())
+		})
+
+		It("keeps every spec directory in sync", func() {
+			mirror := filepath.Join(workDir, "kata-cdi")
+			setCdiRoots([]string{cdiRoot, mirror})
+			Expect(os.MkdirAll(mirror, 0755)).To(Succeed())
+			stale := "cdiVersion: 0.5.0\nkind: nvidia.com/oldgpu\ndevices:\n- name: \"9\"\n  containerEdits:\n    deviceNodes:\n    - path: /dev/vfio/9\n"
+			Expect(os.WriteFile(filepath.Join(mirror, "nvidia.com-oldgpu.yaml"), []byte(stale), 0644)).To(Succeed())
+
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"group:1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+			}
+			deviceMap = map[string][]string{"1b80": {"group:1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(GenerateCDISpec()).To(Succeed())
+			Expect(reconcileCDISpecs()).To(Succeed())
+
+			primary, err := os.ReadFile(filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml"))
+			Expect(err).ToNot(HaveOccurred())
+			mirrored, err := os.ReadFile(filepath.Join(mirror, "nvidia.com-pgpu.yaml"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mirrored).To(Equal(primary))
+			Expect(filepath.Join(mirror, "nvidia.com-pgpu.yaml.tmp")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(mirror, "nvidia.com-oldgpu.yaml")).ToNot(BeAnExistingFile())
+		})
+
+		It("repairs and validates the specs of regenerated kinds", func() {
+			Expect(os.MkdirAll(cdiRoot, 0755)).To(Succeed())
+			duplicate := "cdiVersion: 0.5.0\nkind: nvidia.com/pgpu\ndevices:\n- name: \"1\"\n  containerEdits:\n    deviceNodes:\n    - path: /dev/vfio/1\n"
+			Expect(os.WriteFile(filepath.Join(cdiRoot, "pgpu-old.yaml"), []byte(duplicate), 0644)).To(Succeed())
+
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"group:1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+			}
+			deviceMap = map[string][]string{"1b80": {"group:1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(GenerateCDISpec()).To(Succeed())
+			Expect(reconcileCDISpecs()).To(Succeed())
+			Expect(filepath.Join(cdiRoot, "pgpu-old.yaml")).ToNot(BeAnExistingFile())
+
+			specPath := filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml")
+			data, err := os.ReadFile(specPath)
+			Expect(err).ToNot(HaveOccurred())
+			spec, err := cdiapi.ParseSpec(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validateCDISpec(specPath, spec)).To(Equal([]string{
+				specPath + ": device node /dev/vfio/1 does not exist",
+				specPath + ": device node /dev/vfio/vfio does not exist",
+			}))
+
+			Expect(os.MkdirAll(filepath.Join(workDir, "dev/vfio"), 0755)).To(Succeed())
+			for _, node := range []string{"vfio", "1"} {
+				Expect(os.WriteFile(filepath.Join(workDir, "dev/vfio", node), nil, 0644)).To(Succeed())
+			}
+			Expect(validateCDISpec(specPath, spec)).To(BeEmpty())
+			spec.Devices[0].Name = "7"
+			Expect(validateCDISpec(specPath, spec)).To(ConsistOf(
+				specPath+": device 7 was not discovered",
+				specPath+": discovered device 1 is missing",
+			))
+		})
+
+		It("emits one loadable device for the GPUs sharing an IOMMU group", func() {
+			Expect(os.MkdirAll(filepath.Join(workDir, "dev"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(workDir, "dev/iommu"), nil, 0644)).To(Succeed())
+
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"group:5": {
+					{Address: "0000:05:00.0", DeviceID: 0x2330, DeviceName: "GH100 [H100 SXM5 80GB]", IommuGroup: 5, IommuFD: "vfio8"},
+					{Address: "0000:06:00.0", DeviceID: 0x2330, DeviceName: "GH100 [H100 SXM5 80GB]", IommuGroup: 5, IommuFD: "vfio9"},
+				},
+			}
+			deviceMap = map[string][]string{"2330": {"group:5"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(GenerateCDISpec()).To(Succeed())
+
+			cache, err := cdiapi.NewCache(cdiapi.WithSpecDirs(cdiRoot), cdiapi.WithAutoRefresh(false))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.GetErrors()).To(BeEmpty())
+			device := cache.GetDevice("nvidia.com/pgpu=5")
+			Expect(device).ToNot(BeNil())
+			var paths []string
+			for _, node := range device.ContainerEdits.DeviceNodes {
+				paths = append(paths, node.Path)
+			}
+			Expect(paths).To(ConsistOf("/dev/vfio/devices/vfio8", "/dev/vfio/devices/vfio9"))
+		})
+
+		It("refuses to publish a spec the CDI cache would reject", func() {
+			Expect(os.MkdirAll(cdiRoot, 0755)).To(Succeed())
+			edits := specs.ContainerEdits{DeviceNodes: []*specs.DeviceNode{{Path: "/dev/vfio/5"}}}
+			spec := &specs.Spec{
+				Version: cdiVersion,
+				Kind:    "nvidia.com/pgpu",
+				Devices: []specs.Device{{Name: "5", ContainerEdits: edits}, {Name: "5", ContainerEdits: edits}},
+			}
+			err := writeCDISpec(spec, "nvidia.com-pgpu")
+			Expect(err).To(MatchError(ContainSubstring(`multiple device "5"`)))
+			Expect(filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml.tmp")).ToNot(BeAnExistingFile())
+
+			spec.Devices = spec.Devices[:1]
+			Expect(writeCDISpec(spec, "nvidia.com-pgpu")).To(Succeed())
+			_, err = cdiapi.ReadSpec(filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml"), 0)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("adds the companion nodes of the CC platform of the node", func() {
+			oldResolver := cdiRuntimeClassResolver
+			defer func() { cdiRuntimeClassResolver, cdiCCPlatform = oldResolver, ccPlatformNone }()
+			labels := map[string]string{ccReadyLabel: "true", snpLabel: "true"}
+			classes := map[string]bool{snpRuntimeClass: true, tdxRuntimeClass: true}
+			cdiRuntimeClassResolver = func() (*RuntimeClassResolver, error) {
+				return &RuntimeClassResolver{
+					labels:      func() (map[string]string, error) { return labels, nil },
+					classExists: func(name string) (bool, error) { return classes[name], nil },
+				}, nil
+			}
+			Expect(os.MkdirAll(filepath.Join(workDir, "dev"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(workDir, "dev/sev"), nil, 0644)).To(Succeed())
+
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"group:1": {{Address: "0000:01:00.0", DeviceID: 0x2330, DeviceName: "GH100 [H100 SXM5 80GB]", IommuGroup: 1}},
+			}
+			deviceMap = map[string][]string{"2330": {"group:1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			readSpec := func() *specs.Spec {
+				data, err := os.ReadFile(filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml"))
+				Expect(err).ToNot(HaveOccurred())
+				spec, err := cdiapi.ParseSpec(data)
+				Expect(err).ToNot(HaveOccurred())
+				return spec
+			}
+
+			Expect(GenerateCDISpec()).To(Succeed())
+			spec := readSpec()
+			Expect(spec.ContainerEdits.DeviceNodes).To(HaveLen(1))
+			Expect(spec.ContainerEdits.DeviceNodes[0].Path).To(Equal("/dev/sev"))
+			Expect(isVfioSpec(spec)).To(BeTrue())
+
+			// the tdx guest node does not exist on this host
+			labels = map[string]string{ccReadyLabel: "true", tdxLabel: "true"}
+			Expect(GenerateCDISpec()).To(Succeed())
+			Expect(cdiCCPlatform).To(Equal(ccPlatformTDX))
+			Expect(readSpec().ContainerEdits.DeviceNodes).To(BeEmpty())
+
+			labels = map[string]string{snpLabel: "true"}
+			Expect(GenerateCDISpec()).To(Succeed())
+			Expect(cdiCCPlatform).To(Equal(ccPlatformNone))
+
+			// sandboxes of a node without the CC runtime class run
+			// non-confidential
+			labels = map[string]string{ccReadyLabel: "true", snpLabel: "true"}
+			delete(classes, snpRuntimeClass)
+			Expect(GenerateCDISpec()).To(Succeed())
+			Expect(cdiCCPlatform).To(Equal(ccPlatformNone))
+			Expect(readSpec().ContainerEdits.DeviceNodes).To(BeEmpty())
+		})
+
+		It("verifies an allocation without changing the host", func() {
+			oldMap := returnIommuMap
+			defer func() { returnIommuMap = oldMap }()
+			returnIommuMap = getIommuMap
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"group:1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+			}
+			deviceMap = map[string][]string{"1b80": {"group:1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(GenerateCDISpec()).To(Succeed())
+			dpi := NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{{ID: "group:1", Health: pluginapi.Healthy}})
+			dpi.dryRun = true
+
+			var out strings.Builder
+			err := verifyAllocation(&out, []*GenericDevicePlugin{dpi}, []string{"1", "7"})
+			Expect(err).To(MatchError("found 3 problem(s)"))
+			Expect(out.String()).To(ContainSubstring("nvidia.com/pgpu=1"))
+			Expect(out.String()).To(ContainSubstring("unknown device id 7"))
+			Expect(out.String()).To(ContainSubstring("device node /dev/vfio/1"))
+
+			Expect(os.MkdirAll(filepath.Join(workDir, "dev/vfio"), 0755)).To(Succeed())
+			for _, node := range []string{"vfio", "1"} {
+				Expect(os.WriteFile(filepath.Join(workDir, "dev/vfio", node), nil, 0644)).To(Succeed())
+			}
+			out.Reset()
+			Expect(verifyAllocation(&out, []*GenericDevicePlugin{dpi}, []string{"group:1"})).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("/dev/vfio/1 -> /dev/vfio/1"))
+			Expect(out.String()).To(ContainSubstring("No problems found"))
+
+			// a spec the runtime cannot load is a problem of its own
+			broken := filepath.Join(cdiRoot, "broken.yaml")
+			Expect(os.WriteFile(broken, []byte("cdiVersion: 0.5.0\nkind: nvidia.com/broken\ndevices: []\n"), 0644)).To(Succeed())
+			out.Reset()
+			Expect(verifyAllocation(&out, []*GenericDevicePlugin{dpi}, []string{"group:1"})).To(MatchError("found 1 problem(s)"))
+			Expect(out.String()).To(ContainSubstring("CDI spec " + broken))
+		})
+
+		It("removes stale device plugin sockets", func() {
+			oldDir := devicePluginDir
+			defer func() { devicePluginDir = oldDir }()
+			devicePluginDir = workDir
+			sock := filepath.Join(workDir, "sandbox-oldgpu.sock")
+			Expect(os.WriteFile(sock, nil, 0644)).To(Succeed())
+			kubelet := filepath.Join(workDir, "kubelet.sock")
+			Expect(os.WriteFile(kubelet, nil, 0644)).To(Succeed())
+
+			Expect(cleanupStaleSockets()).To(Succeed())
+			Expect(sock).ToNot(BeAnExistingFile())
+			Expect(kubelet).To(BeAnExistingFile())
+		})
+	})
+
+	Context("buildInventory() Tests", func() {
+		var oldAlias string
+
+		BeforeEach(func() {
+			oldAlias = PGPUAlias
+			PGPUAlias = "pgpu"
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"2": {{Address: "0000:02:00.0", DeviceID: 0x2330, DeviceName: "GH100 [H100 SXM5 80GB]", IommuGroup: 2, NumaNode: 1}},
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GP104 [GeForce GTX 1080]", IommuGroup: 1}},
+			}
+			nvSwitchDeviceIDs = map[string]bool{}
+			buildStableDeviceIDs()
+		})
+
+		AfterEach(func() {
+			PGPUAlias = oldAlias
+		})
+
+		It("reports devices sorted by PCI address with their owners", func() {
+			owners := map[string]deviceOwner{
+				"nvidia.com/pgpu/0000:02:00.0": {Namespace: "default", Pod: "vm", Container: "main"},
+			}
+			inventory := buildInventory(owners, nil)
+			Expect(inventory).To(HaveLen(2))
+			Expect(inventory[0].PCIAddress).To(Equal("0000:01:00.0"))
+			Expect(inventory[0].CCCapable).To(BeFalse())
+			Expect(inventory[0].AllocatedTo).To(BeEmpty())
+			Expect(inventory[1].ResourceName).To(Equal("nvidia.com/pgpu"))
+			Expect(inventory[1].NumaNode).To(Equal(1))
+			Expect(inventory[1].CCCapable).To(BeTrue())
+			Expect(inventory[1].AllocatedTo).To(Equal("default/vm/main"))
+		})
+
+		It("reports the advertised health of the devices and why they are unhealthy", func() {
+			defer disabledDevices.update(map[string]bool{})
+			disabledDevices.update(map[string]bool{"1": true})
+			id1, id2 := stableIDForIommuKey("1"), stableIDForIommuKey("2")
+			dp := NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{
+				{ID: id1, Health: pluginapi.Unhealthy},
+				{ID: id2, Health: pluginapi.Unhealthy},
+			})
+			inventory := buildInventory(nil, []*GenericDevicePlugin{dp})
+			Expect(inventory[0].Health).To(Equal(pluginapi.Unhealthy))
+			Expect(inventory[0].UnhealthyReason).To(Equal(unhealthyReasonDisabled))
+			Expect(inventory[1].UnhealthyReason).To(Equal(unhealthyReasonHealthCheck))
+
+			dp.updateHealth(id2, pluginapi.Healthy)
+			inventory = buildInventory(nil, []*GenericDevicePlugin{dp})
+			Expect(inventory[1].Health).To(Equal(pluginapi.Healthy))
+			Expect(inventory[1].UnhealthyReason).To(BeEmpty())
+
+			Expect(buildInventory(nil, nil)[0].Health).To(Equal(healthUnknown))
+		})
+	})
+
+	Context("summarizeInventories() Tests", func() {
+		It("aggregates the inventories of the nodes per model", func() {
+			h100, l40 := "GH100 [H100 SXM5 80GB]", "AD102GL [L40]"
+			inventories := map[string]InventoryStatus{
+				"node-b": {Devices: []InventoryDevice{
+					{ID: "b1", Model: h100, PCIAddress: "0000:01:00.0", Health: pluginapi.Healthy, AllocatedTo: "default/vm/main"},
+					{ID: "b2", Model: h100, PCIAddress: "0000:02:00.0", Health: pluginapi.Unhealthy, UnhealthyReason: unhealthyReasonFlapping},
+					{ID: "b3", Model: l40, PCIAddress: "0000:03:00.0", Health: healthUnknown, Spare: true},
+				}},
+				"node-a": {Devices: []InventoryDevice{
+					{ID: "a1", Model: h100, PCIAddress: "0000:01:00.0", Health: pluginapi.Healthy},
+					{ID: "a2", Model: h100, PCIAddress: "0000:02:00.0", Health: pluginapi.Unhealthy, UnhealthyReason: unhealthyReasonDisabled, AllocatedTo: "default/vm/main"},
+				}},
+				"node-c": {},
+			}
+			summary := summarizeInventories(inventories)
+			Expect(summary.Nodes).To(Equal(3))
+			Expect(summary.Models).To(Equal([]InventoryModelSummary{
+				{Model: l40, Nodes: 1, Total: 1, HeldBack: 1},
+				{Model: h100, Nodes: 2, Total: 4, Allocated: 2, Free: 1, Unhealthy: 2},
+			}))
+			Expect(summary.Unhealthy).To(HaveLen(2))
+			Expect(summary.Unhealthy[0]).To(Equal(UnhealthyInventoryDevice{
+				Node: "node-a", ID: "a2", PCIAddress: "0000:02:00.0", Model: h100, Reason: unhealthyReasonDisabled,
+			}))
+			Expect(summary.Unhealthy[1].Reason).To(Equal(unhealthyReasonFlapping))
+
+			table := inventorySummaryTable(summary)
+			Expect(table).To(ContainSubstring("MODEL"))
+			Expect(table).To(MatchRegexp(`GH100 \[H100 SXM5 80GB\]\s+2\s+4\s+2\s+1\s+0\s+2`))
+			Expect(table).To(MatchRegexp(`node-b\s+b2\s+0000:02:00.0\s+GH100 \[H100 SXM5 80GB\]\s+flapping`))
+		})
+	})
+
+	Context("checkIommuGroupViable() Tests", func() {
+		var workDir string
+
+		BeforeEach(func() {
+			var err error
+			workDir, err = os.MkdirTemp("", "iommu-group-test")
+			Expect(err).ToNot(HaveOccurred())
+			rootPath = workDir
+		})
+
+		AfterEach(func() {
+			rootPath = "/"
+			os.RemoveAll(workDir)
+		})
+
+		addMember := func(group, address, driver string) {
+			devDir := filepath.Join(workDir, iommuGroupsPath, group, "devices", address)
+			Expect(os.MkdirAll(devDir, 0755)).To(Succeed())
+			if driver != "" {
+				Expect(os.Symlink(filepath.Join("/sys/bus/pci/drivers", driver), filepath.Join(devDir, "driver"))).To(Succeed())
+			}
+		}
+
+		It("accepts groups bound to vfio-pci, bridges and unbound functions", func() {
+			addMember("5", "0000:05:00.0", "vfio-pci")
+			addMember("5", "0000:04:00.0", "pcieport")
+			addMember("5", "0000:05:00.1", "")
+			Expect(checkIommuGroupViable(5)).To(Succeed())
+		})
+
+		It("rejects groups containing functions bound to host drivers", func() {
+			addMember("6", "0000:06:00.0", "vfio-pci")
+			addMember("6", "0000:06:00.1", "snd_hda_intel")
+			err := checkIommuGroupViable(6)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("0000:06:00.1 (snd_hda_intel)"))
+		})
+
+		It("does not reject groups that cannot be inspected", func() {
+			Expect(checkIommuGroupViable(7)).To(Succeed())
+		})
+	})
+
+	Context("skipLogger Tests", func() {
+		It("logs each skipped device once per interval", func() {
+			now := time.Now()
+			logger := newSkipLogger(time.Minute)
+			logger.now = func() time.Time { return now }
+
+			logger.skip("0000:01:00.0", "driver:nouveau", "skip 1")
+			logger.skip("0000:02:00.0", "driver:nouveau", "skip 2")
+			Expect(logger.flush()).To(Equal(2))
+
+			logger.skip("0000:01:00.0", "driver:nouveau", "skip 1")
+			logger.skip("0000:01:00.0", "iommu-group", "skip 1 group")
+			Expect(logger.flush()).To(Equal(1))
+
+			now = now.Add(2 * time.Minute)
+			logger.skip("0000:01:00.0", "driver:nouveau", "skip 1")
+			Expect(logger.flush()).To(Equal(1))
+		})
+
+		It("logs a device again after it stops being skipped", func() {
+			logger := newSkipLogger(time.Hour)
+			logger.skip("0000:01:00.0", "driver:nouveau", "skip 1")
+			Expect(logger.flush()).To(Equal(1))
+			Expect(logger.flush()).To(Equal(0))
+			logger.skip("0000:01:00.0", "driver:nouveau", "skip 1")
+			Expect(logger.flush()).To(Equal(1))
+		})
+	})
+
+	Context("GenerateCDISpecForAddresses() Tests", func() {
+		var workDir, oldCdiRoot string
+
+		BeforeEach(func() {
+			var err error
+			workDir, err = os.MkdirTemp("", "cdi-generate-test")
+			Expect(err).ToNot(HaveOccurred())
+			rootPath = workDir
+			oldCdiRoot = cdiRoot
+			setCdiRoot(filepath.Join(workDir, "cdi"))
+		})
+
+		AfterEach(func() {
+			setCdiRoot(oldCdiRoot)
+			rootPath = "/"
+			os.RemoveAll(workDir)
+		})
+
+		addDevice := func(address, group, driver string) {
+			devDir := filepath.Join(workDir, pciDevicesPath, address)
+			Expect(os.MkdirAll(devDir, 0755)).To(Succeed())
+			Expect(os.Symlink(filepath.Join("/sys/kernel/iommu_groups", group), filepath.Join(devDir, "iommu_group"))).To(Succeed())
+			Expect(os.Symlink(filepath.Join("/sys/bus/pci/drivers", driver), filepath.Join(devDir, "driver"))).To(Succeed())
+		}
+
+		It("writes a spec for vfio-pci bound devices", func() {
+			addDevice("0000:17:00.0", "12", "vfio-pci")
+			Expect(GenerateCDISpecForAddresses("nic", []string{"0000:17:00.0"})).To(Succeed())
+
+			data, err := os.ReadFile(filepath.Join(cdiRoot, "nvidia.com-nic.yaml"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("/dev/vfio/12"))
+		})
+
+		It("passes all vfio-pci bound functions below a bridge as one device", func() {
+			oldAlias, oldBridges, oldMap := PGPUAlias, subtreeBridges, returnIommuMap
+			defer func() {
+				PGPUAlias, subtreeBridges, subtreeResources, returnIommuMap = oldAlias, oldBridges, nil, oldMap
+			}()
+			returnIommuMap = getIommuMap
+			PGPUAlias = "pgpu"
+			subtreeBridges = map[string]string{"0000:40:00.0": "pgpu-switch0"}
+
+			// root port 00:01.0 > switch 40:00.0 > ports 41:00.0 (vfio-pci) and 41:01.0 (pcieport)
+			addFunction := func(path, group, driver string) {
+				devDir := filepath.Join(workDir, "devices", path)
+				Expect(os.MkdirAll(devDir, 0755)).To(Succeed())
+				Expect(os.Symlink(filepath.Join("/sys/kernel/iommu_groups", group), filepath.Join(devDir, "iommu_group"))).To(Succeed())
+				Expect(os.Symlink(filepath.Join("/sys/bus/pci/drivers", driver), filepath.Join(devDir, "driver"))).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(workDir, pciDevicesPath), 0755)).To(Succeed())
+				Expect(os.Symlink(devDir, filepath.Join(workDir, pciDevicesPath, filepath.Base(path)))).To(Succeed())
+			}
+			addFunction("pci0000:00/0000:00:01.0", "1", "pcieport")
+			addFunction("pci0000:00/0000:00:01.0/0000:40:00.0", "1", "pcieport")
+			addFunction("pci0000:00/0000:00:01.0/0000:40:00.0/0000:41:00.0", "20", "vfio-pci")
+			addFunction("pci0000:00/0000:00:01.0/0000:40:00.0/0000:41:00.0/0000:42:00.0", "21", "vfio-pci")
+			addFunction("pci0000:00/0000:00:01.0/0000:40:00.0/0000:41:01.0", "1", "pcieport")
+			addFunction("pci0000:00/0000:00:01.0/0000:40:00.0/0000:41:01.0/0000:43:00.0", "22", "vfio-pci")
+			addFunction("pci0000:00/0000:00:02.0/0000:50:00.0", "30", "vfio-pci")
+
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"group:21": {{Address: "0000:42:00.0", DeviceID: 0x2330, IommuGroup: 21}},
+				"group:22": {{Address: "0000:43:00.0", DeviceID: 0x2330, IommuGroup: 22}},
+				"group:30": {{Address: "0000:50:00.0", DeviceID: 0x2330, IommuGroup: 30}},
+			}
+			deviceMap = map[string][]string{"2330": {"group:21", "group:22", "group:30"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+
+			buildSubtrees()
+			Expect(deviceMap).To(Equal(map[string][]string{"2330": {"group:30"}}))
+			Expect(subtreeResources).To(Equal(map[string][]string{"pgpu-switch0": {"subtree:0000:40:00.0"}}))
+			functions := iommuMap["subtree:0000:40:00.0"]
+			Expect(functions).To(HaveLen(3))
+			Expect(functions[0].Address).To(Equal("0000:41:00.0"))
+			Expect(healthNodePath("/dev/vfio/", "subtree:0000:40:00.0")).To(Equal("/dev/vfio/20"))
+
+			Expect(GenerateCDISpec()).To(Succeed())
+			data, err := os.ReadFile(filepath.Join(cdiRoot, "nvidia.com-pgpu-switch0.yaml"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("name: subtree-0000:40:00.0"))
+			Expect(strings.Count(string(data), "name: ")).To(Equal(1))
+			for _, node := range []string{"/dev/vfio/20", "/dev/vfio/21", "/dev/vfio/22"} {
+				Expect(string(data)).To(ContainSubstring(node))
+			}
+			Expect(strings.Count(string(data), "path: /dev/vfio/vfio\n")).To(Equal(1))
+			data, err = os.ReadFile(filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("/dev/vfio/30"))
+			Expect(string(data)).ToNot(ContainSubstring("/dev/vfio/21"))
+
+			buildStableDeviceIDs()
+			plugins, err := newDevicePlugins()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plugins).To(HaveLen(2))
+			Expect(plugins[1].deviceName).To(Equal("pgpu-switch0"))
+			Expect(plugins[1].devs).To(HaveLen(1))
+		})
+
+		It("rejects devices not bound to vfio-pci", func() {
+			addDevice("0000:18:00.0", "13", "mlx5_core")
+			err := GenerateCDISpecForAddresses("nic", []string{"0000:18:00.0"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not vfio-pci"))
+		})
+	})
+
+	Context("runtimeClassForLabels() Tests", func() {
+		It("uses the default class unless the node is CC ready", func() {
+			Expect(runtimeClassForLabels(nil)).To(Equal(defaultRuntimeClass))
+			Expect(runtimeClassForLabels(map[string]string{snpLabel: "true"})).To(Equal(defaultRuntimeClass))
+		})
+
+		It("selects the SNP or TDX class on CC ready nodes", func() {
+			Expect(runtimeClassForLabels(map[string]string{ccReadyLabel: "true", snpLabel: "true"})).To(Equal(snpRuntimeClass))
+			Expect(runtimeClassForLabels(map[string]string{ccReadyLabel: "True", tdxLabel: "true"})).To(Equal(tdxRuntimeClass))
+			Expect(runtimeClassForLabels(map[string]string{ccReadyLabel: "true"})).To(Equal(defaultRuntimeClass))
+		})
+	})
+
+	Context("registrationBackoff() Tests", func() {
+		It("makes at least one jittered attempt", func() {
+			old := registrationAttempts
+			defer func() { registrationAttempts = old }()
+
+			registrationAttempts = 0
+			backoff := registrationBackoff()
+			Expect(backoff.Steps).To(Equal(1))
+			Expect(backoff.Jitter).To(BeNumerically(">", 0))
+
+			registrationAttempts = 7
+			Expect(registrationBackoff().Steps).To(Equal(7))
+		})
+	})
+
+	Context("getDeviceNameForID() pci.ids fallback Tests", func() {
+		var workDir, oldPath string
+
+		BeforeEach(func() {
+			var err error
+			workDir, err = os.MkdirTemp("", "pciids-test")
+			Expect(err).ToNot(HaveOccurred())
+			oldPath = pciIDsPath
+			pciIDsPath = filepath.Join(workDir, "pci.ids")
+		})
+
+		AfterEach(func() {
+			pciIDsPath = oldPath
+			os.RemoveAll(workDir)
+		})
+
+		It("names devices missing from the PCI database", func() {
+			ids := "10de  NVIDIA Corporation\n\t2999  GB999 [Future GPU]\n"
+			Expect(os.WriteFile(pciIDsPath, []byte(ids), 0644)).To(Succeed())
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x2999, IommuGroup: 1}},
+			}
+			Expect(getDeviceNameForID("2999")).To(Equal("GB999_FUTURE_GPU"))
+		})
+
+		It("returns an empty name without an override file", func() {
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x2999, IommuGroup: 1}},
+			}
+			Expect(getDeviceNameForID("2999")).To(BeEmpty())
+		})
+	})
+
+	Context("nodeFailureCoordinator Tests", func() {
+		It("fences the node while any resource has failed completely", func() {
+			var calls []bool
+			c := newNodeFailureCoordinator()
+			c.apply = func(fenced bool, resources []string) error {
+				calls = append(calls, fenced)
+				return nil
+			}
+
+			c.report("pgpu", false)
+			Expect(c.reconcile()).To(Succeed())
+			c.report("pgpu", true)
+			c.report("nvswitch", true)
+			Expect(c.reconcile()).To(Succeed())
+			c.report("pgpu", false)
+			Expect(c.reconcile()).To(Succeed())
+			c.report("nvswitch", false)
+			Expect(c.reconcile()).To(Succeed())
+			Expect(calls).To(Equal([]bool{true, false}))
+		})
+
+		It("retries a failed node update", func() {
+			fail := true
+			c := newNodeFailureCoordinator()
+			c.apply = func(fenced bool, resources []string) error {
+				if fail {
+					return errors.New("conflict")
+				}
+				return nil
+			}
+			c.report("pgpu", true)
+			Expect(c.reconcile()).ToNot(Succeed())
+			fail = false
+			Expect(c.reconcile()).To(Succeed())
+			Expect(c.applied).To(BeTrue())
+		})
+
+		It("adds and removes only the device failure taint", func() {
+			other := corev1.Taint{Key: "example.com/maintenance", Effect: corev1.TaintEffectNoSchedule}
+			taints, changed := updateTaints([]corev1.Taint{other}, true, []string{"pgpu"})
+			Expect(changed).To(BeTrue())
+			Expect(taints).To(HaveLen(2))
+			Expect(taints[1].Value).To(Equal("pgpu"))
+
+			taints, changed = updateTaints(taints, false, nil)
+			Expect(changed).To(BeTrue())
+			Expect(taints).To(Equal([]corev1.Taint{other}))
+
+			_, changed = updateTaints(taints, false, nil)
+			Expect(changed).To(BeFalse())
+		})
+	})
+
+	Context("GFD pod Tests", func() {
+		It("reads the GFD pod configuration from the environment", func() {
+			GinkgoT().Setenv("POD_NAMESPACE", "sandbox")
+			GinkgoT().Setenv("GFD_IMAGE_PULL_SECRETS", "")
+			cfg := loadGFDPodConfig()
+			Expect(cfg).To(Equal(gfdPodConfig{namespace: "sandbox", serviceAccount: defaultGFDServiceAccount}))
+
+			GinkgoT().Setenv("GFD_NAMESPACE", "gfd")
+			GinkgoT().Setenv("GFD_SERVICE_ACCOUNT", "gfd-sa")
+			GinkgoT().Setenv("GFD_IMAGE_PULL_SECRETS", "registry-a, registry-b,")
+			GinkgoT().Setenv("GFD_PRIORITY_CLASS", "system-node-critical")
+			cfg = loadGFDPodConfig()
+			Expect(cfg.namespace).To(Equal("gfd"))
+			Expect(cfg.serviceAccount).To(Equal("gfd-sa"))
+			Expect(cfg.imagePullSecrets).To(Equal([]string{"registry-a", "registry-b"}))
+			Expect(cfg.priorityClass).To(Equal("system-node-critical"))
+		})
+
+		It("applies the configuration to the GFD pod", func() {
+			cfg := gfdPodConfig{
+				namespace:        "gfd",
+				serviceAccount:   "gfd-sa",
+				imagePullSecrets: []string{"registry-a"},
+				priorityClass:    "system-node-critical",
+			}
+			pod := createGFDPod("node1", "gfd:latest", "kata", cfg)
+			Expect(pod.Spec.ServiceAccountName).To(Equal("gfd-sa"))
+			Expect(pod.Spec.PriorityClassName).To(Equal("system-node-critical"))
+			Expect(pod.Spec.ImagePullSecrets).To(Equal([]corev1.LocalObjectReference{{Name: "registry-a"}}))
+			Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "NAMESPACE", Value: "gfd"}))
+		})
+		It("limits concurrent GFD launches with lease slots", func() {
+			defer func() { clk = clock.RealClock{} }()
+			fake := clocktesting.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			clk = fake
+			leases := newFakeLeases()
+			node1 := newGFDSemaphore(leases, "node1", 1)
+			node2 := newGFDSemaphore(leases, "node2", 1)
+
+			release, err := node1.acquire(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			name, holders, err := node2.tryAcquire(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(name).To(BeEmpty())
+			Expect(holders).To(Equal([]string{"node1"}))
+
+			release()
+			name, _, err = node2.tryAcquire(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(name).To(Equal(gfdSlotLeasePrefix + "0"))
+			Expect(*leases.leases[name].Spec.HolderIdentity).To(Equal("node2"))
+
+			By("taking over the slot of a node that stopped renewing it")
+			fake.Step(defaultGFDSlotLeaseDuration + time.Second)
+			name, _, err = node1.tryAcquire(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(name).To(Equal(gfdSlotLeasePrefix + "0"))
+			Expect(*leases.leases[name].Spec.HolderIdentity).To(Equal("node1"))
+		})
+
+		It("requests a relabeling when the advertised devices change", func() {
+			defer func(v bool) { gfdRelabelOnDeviceChange = v }(gfdRelabelOnDeviceChange)
+			gfdRelabelOnDeviceChange = true
+			trigger := &gfdRelabelTrigger{ch: make(chan struct{}, 1)}
+			plugin := func(ids ...string) *GenericDevicePlugin {
+				var devs []*pluginapi.Device
+				for _, id := range ids {
+					devs = append(devs, &pluginapi.Device{ID: id, Health: pluginapi.Healthy})
+				}
+				return NewGenericDevicePlugin("pgpu", "/dev/vfio/", devs)
+			}
+
+			trigger.observe([]*GenericDevicePlugin{plugin("1", "2")})
+			Expect(trigger.ch).ToNot(Receive())
+			trigger.observe([]*GenericDevicePlugin{plugin("2", "1")})
+			Expect(trigger.ch).ToNot(Receive())
+
+			trigger.observe([]*GenericDevicePlugin{plugin("1")})
+			trigger.observe([]*GenericDevicePlugin{plugin("1", "3")})
+			Expect(trigger.ch).To(Receive())
+			Expect(trigger.ch).ToNot(Receive())
+
+			gfdRelabelOnDeviceChange = false
+			trigger.observe(nil)
+			Expect(trigger.ch).ToNot(Receive())
+		})
+
+		It("requires no GFD permissions when GFD is disabled", func() {
+			defer func(v bool) { gfdEnabled = v }(gfdEnabled)
+			gfdEnabled = false
+			Expect(gfdRBACRequirements()).To(BeEmpty())
+		})
+	})
+
+	Context("startup taint Tests", func() {
+		It("removes only the startup taint", func() {
+			other := corev1.Taint{Key: startupTaintKey, Effect: corev1.TaintEffectNoExecute}
+			startup := corev1.Taint{Key: startupTaintKey, Effect: corev1.TaintEffectNoSchedule}
+			taints, found := withoutStartupTaint([]corev1.Taint{other, startup})
+			Expect(found).To(BeTrue())
+			Expect(taints).To(Equal([]corev1.Taint{other}))
+
+			_, found = withoutStartupTaint(taints)
+			Expect(found).To(BeFalse())
+		})
+
+		It("requires discovery and registration to succeed", func() {
+			m := newDevicePluginManager()
+			Expect(initializationError(m, nil)).To(MatchError("device plugins were not started"))
+
+			m.running = true
+			m.ready["pgpu"] = false
+			m.ready["nvswitch"] = true
+			Expect(initializationError(m, nil)).To(MatchError("device plugins not registered: [pgpu]"))
+
+			m.ready["pgpu"] = true
+			Expect(initializationError(m, nil)).To(Succeed())
+			Expect(initializationError(m, errors.New("failed to create CDI directory"))).To(HaveOccurred())
+		})
+	})
+
+	Context("device plugin socket Tests", func() {
+		var workDir, oldDir string
+
+		BeforeEach(func() {
+			var err error
+			workDir, err = os.MkdirTemp("", "socket-test")
+			Expect(err).ToNot(HaveOccurred())
+			oldDir = devicePluginDir
+			devicePluginDir = workDir
+		})
+
+		AfterEach(func() {
+			devicePluginDir = oldDir
+			os.RemoveAll(workDir)
+		})
+
+		It("derives distinct socket names from resource names", func() {
+			pgpu := socketPathForResource("pgpu")
+			Expect(filepath.Dir(pgpu)).To(Equal(workDir))
+			Expect(filepath.Base(pgpu)).To(MatchRegexp(`^sandbox-pgpu-[0-9a-f]{8}\.sock$`))
+			Expect(socketPathForResource("pgpu")).To(Equal(pgpu))
+			Expect(socketPathForResource("nvswitch")).ToNot(Equal(pgpu))
+		})
+
+		It("applies the configured socket owner and mode", func() {
+			oldPerms := socketPerms
+			defer func() { socketPerms = oldPerms }()
+			socketPerms = socketPermissions{uid: os.Getuid(), gid: os.Getgid(), mode: 0600}
+
+			sock, err := listenSocket(socketPathForResource("pgpu"))
+			Expect(err).ToNot(HaveOccurred())
+			defer sock.Close()
+			info, err := os.Stat(socketPathForResource("pgpu"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+			_, err = listenSocket(filepath.Join(workDir, "missing", "sandbox.sock"))
+			Expect(err).To(MatchError(ContainSubstring("mount the kubelet device plugin directory")))
+			_, err = listenSocket(filepath.Join(workDir, strings.Repeat("x", 120)+".sock"))
+			Expect(err).To(MatchError(ContainSubstring("longer than the 107 characters")))
+		})
+
+		It("detects sockets served by another process and keeps them", func() {
+			sock := socketPathForResource("pgpu")
+			listener, err := net.Listen("unix", sock)
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+
+			err = checkSocketAvailable(sock)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("was not created by this plugin"))
+			Expect(cleanupStaleSockets()).To(Succeed())
+			Expect(sock).To(BeAnExistingFile())
+
+			listener.Close()
+			Expect(checkSocketAvailable(sock)).To(Succeed())
+		})
+
+		It("does not treat sockets this process listens on as taken", func() {
+			sock := socketPathForResource("pgpu")
+			listener, err := listenSocket(sock)
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+
+			Expect(checkSocketAvailable(sock)).To(Succeed())
+			dpi := &GenericDevicePlugin{socketPath: sock}
+			Expect(dpi.cleanup()).To(Succeed())
+			Expect(socketOwned(sock)).To(BeFalse())
+		})
+	})
+
+	Context("vfioPermissions Tests", func() {
+		var workDir string
+
+		BeforeEach(func() {
+			var err error
+			workDir, err = os.MkdirTemp("", "vfio-perms-test")
+			Expect(err).ToNot(HaveOccurred())
+			rootPath = workDir
+			Expect(os.MkdirAll(filepath.Join(workDir, vfioDevicePath), 0755)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			rootPath = "/"
+			os.RemoveAll(workDir)
+		})
+
+		It("applies the configured mode and restores it after drift", func() {
+			node := filepath.Join(workDir, vfioDevicePath, "5")
+			Expect(os.WriteFile(node, nil, 0600)).To(Succeed())
+			perms := &vfioPermissions{uid: -1, gid: os.Getgid(), mode: 0660, allocated: make(map[string]bool)}
+
+			Expect(perms.apply(filepath.Join(vfioDevicePath, "5"))).To(Succeed())
+			info, err := os.Stat(node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0660)))
+
+			Expect(os.Chmod(node, 0600)).To(Succeed())
+			perms.reconcileAll()
+			info, err = os.Stat(node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0660)))
+
+			Expect(os.Remove(node)).To(Succeed())
+			perms.reconcileAll()
+			Expect(perms.allocated).To(BeEmpty())
+		})
+
+		It("does nothing when not configured", func() {
+			perms := &vfioPermissions{uid: -1, gid: -1, allocated: make(map[string]bool)}
+			Expect(perms.apply(filepath.Join(vfioDevicePath, "missing"))).To(Succeed())
+			Expect(perms.allocated).To(BeEmpty())
+		})
+	})
+
+	Context("instance lock Tests", func() {
+		It("waits for the previous instance and takes over after the timeout", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "lock", "instance.lock")
+			previous, takenOver, err := acquireInstanceLock(path, time.Second)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(takenOver).To(BeFalse())
+			Expect(lockHolder(previous)).To(Equal(strconv.Itoa(os.Getpid())))
+
+			start := time.Now()
+			current, takenOver, err := acquireInstanceLock(path, 200*time.Millisecond)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(takenOver).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+			defer current.Close()
+
+			// the lock is taken once the previous instance exits
+			Expect(previous.Close()).To(Succeed())
+			Eventually(func() error {
+				f, err := os.OpenFile(path, os.O_RDWR, 0)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				return tryInstanceLock(f)
+			}, 5*time.Second, 100*time.Millisecond).Should(MatchError(errInstanceLocked))
+		})
+	})
+
+	Context("alias validation Tests", func() {
+		It("accepts resource names that are also CDI classes", func() {
+			for _, alias := range []string{"", "pgpu", "H100_80GB", "gpu-a.b"} {
+				Expect(validateAlias("P_GPU_ALIAS", alias)).To(Succeed())
+			}
+		})
+
+		It("rejects invalid aliases with a sanitized suggestion", func() {
+			err := validateAlias("P_GPU_ALIAS", "nvidia/h100 80gb")
+			Expect(err).To(MatchError(ContainSubstring(`P_GPU_ALIAS "nvidia/h100 80gb" is not a valid resource name and CDI class`)))
+			Expect(err).To(MatchError(HaveSuffix(`(use "nvidia_h100_80gb" instead)`)))
+
+			// CDI classes must start with a letter
+			Expect(validateAlias("NVSWITCH_ALIAS", "1nvswitch")).To(MatchError(HaveSuffix(`(use "nvswitch" instead)`)))
+			Expect(validateAlias("NVSWITCH_ALIAS", "gpu-")).To(MatchError(HaveSuffix(`(use "gpu" instead)`)))
+			Expect(sanitizeAlias(strings.Repeat("a", 70))).To(HaveLen(maxAliasLength))
+			Expect(validateAlias("P_GPU_ALIAS", "???")).ToNot(MatchError(ContainSubstring("instead")))
+		})
+
+		It("keeps the aliases when one is invalid", func() {
+			defer func(pgpu, nvswitch string) { PGPUAlias, NVSwitchAlias = pgpu, nvswitch }(PGPUAlias, NVSwitchAlias)
+			PGPUAlias, NVSwitchAlias = "pgpu", "nvswitch"
+			Expect(SetAliases("gpu", "nv switch")).ToNot(Succeed())
+			Expect(PGPUAlias).To(Equal("pgpu"))
+			Expect(SetAliases("gpu", "")).To(Succeed())
+			Expect(PGPUAlias).To(Equal("gpu"))
+			Expect(NVSwitchAlias).To(BeEmpty())
+		})
+	})
+
+	Context("featureGates Tests", func() {
+		It("uses the registered defaults", func() {
+			g := newFeatureGates(defaultFeatureGates)
+			Expect(g.Enabled(IOMMUFD)).To(BeTrue())
+			Expect(g.Enabled(CDIInAllocate)).To(BeFalse())
+			Expect(g.Enabled(CDIAnnotations)).To(BeFalse())
+			Expect(g.Enabled(IOMMUFDAnnotations)).To(BeFalse())
+			Expect(g.String()).To(Equal("CDIAnnotations=false,CDIInAllocate=false,IOMMUFD=true,IOMMUFDAnnotations=false"))
+		})
+
+		It("parses feature gate lists", func() {
+			g := newFeatureGates(defaultFeatureGates)
+			Expect(g.Set("IOMMUFD=false, CDIInAllocate=true")).To(Succeed())
+			Expect(g.Enabled(IOMMUFD)).To(BeFalse())
+			Expect(g.Enabled(CDIInAllocate)).To(BeTrue())
+			Expect(g.Set("")).To(Succeed())
+		})
+
+		It("rejects invalid lists without applying them", func() {
+			g := newFeatureGates(defaultFeatureGates)
+			Expect(g.Set("CDIInAllocate=true,HotPlug=true")).To(MatchError(ContainSubstring("unknown feature gate")))
+			Expect(g.Set("CDIInAllocate=yes")).ToNot(Succeed())
+			Expect(g.Set("CDIInAllocate")).ToNot(Succeed())
+			Expect(g.Enabled(CDIInAllocate)).To(BeFalse())
+		})
+	})
+
+	Context("in-memory file system and fake clock Tests", func() {
+		var mem *memFS
+		var oldCdiRoot, oldAlias string
+
+		BeforeEach(func() {
+			mem = newMemFS()
+			fsys = mem
+			rootPath = "/host"
+			oldCdiRoot, oldAlias = cdiRoot, PGPUAlias
+			setCdiRoot("/var/run/cdi")
+			PGPUAlias = "pgpu"
+		})
+
+		AfterEach(func() {
+			fsys = osFS{}
+			clk = clock.RealClock{}
+			rootPath = "/"
+			setCdiRoot(oldCdiRoot)
+			PGPUAlias = oldAlias
+		})
+
+		It("persists and restores device health", func() {
+			oldStateFile, oldStates := stateFile, deviceStates
+			defer func() { stateFile, deviceStates = oldStateFile, oldStates }()
+			stateFile = "/var/lib/sandbox-device-plugin/state.json"
+			deviceStates = &stateStore{resources: make(map[string][]deviceState)}
+			fake := clocktesting.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			clk = fake
+
+			newDevs := func() []*pluginapi.Device {
+				return []*pluginapi.Device{
+					{ID: "1", Health: pluginapi.Healthy},
+					{ID: "2", Health: pluginapi.Healthy},
+				}
+			}
+			dp := NewGenericDevicePlugin("foo", "/dev/vfio/", newDevs())
+			dp.updateHealth("1", pluginapi.Unhealthy)
+			data, err := mem.ReadFile(stateFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"id": "1"`))
+			_, err = mem.Stat(stateFile + ".tmp")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			// a new process restores the health of rediscovered devices
+			deviceStates = &stateStore{resources: make(map[string][]deviceState)}
+			Expect(deviceStates.load()).To(Succeed())
+			restarted := NewGenericDevicePlugin("foo", "/dev/vfio/", newDevs()[1:])
+			deviceStates.restoreHealth(restarted)
+			Expect(restarted.devs[0].Health).To(Equal(pluginapi.Healthy))
+			restarted = NewGenericDevicePlugin("foo", "/dev/vfio/", newDevs())
+			deviceStates.restoreHealth(restarted)
+			Expect(restarted.devs[0].Health).To(Equal(pluginapi.Unhealthy))
+			Expect(restarted.devs[1].Health).To(Equal(pluginapi.Healthy))
+			Expect(restarted.transitions["1"].at.Equal(fake.Now())).To(BeTrue())
+			Expect(restarted.checkAllocatable("1")).To(MatchError(ContainSubstring("unhealthy since 2024-01-01")))
+
+			// resources that are no longer served are dropped
+			deviceStates.record(restarted)
+			deviceStates.prune(map[string]bool{})
+			data, err = mem.ReadFile(stateFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).ToNot(ContainSubstring("foo"))
+
+			Expect(mem.WriteFile(stateFile, []byte("{"), 0644)).To(Succeed())
+			Expect(deviceStates.load()).To(MatchError(ContainSubstring("failed to parse state file")))
+		})
+
+		It("migrates a resource renamed by an alias change", func() {
+			oldStateFile, oldStates, oldWindow, oldOwners := stateFile, deviceStates, aliasMigrationWindow, migrationOwners
+			defer func() {
+				stateFile, deviceStates, aliasMigrationWindow, migrationOwners = oldStateFile, oldStates, oldWindow, oldOwners
+			}()
+			stateFile = "/var/lib/sandbox-device-plugin/state.json"
+			aliasMigrationWindow = time.Hour
+			fake := clocktesting.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			clk = fake
+
+			newDevs := func() []*pluginapi.Device {
+				return []*pluginapi.Device{{ID: "1", Health: pluginapi.Healthy}, {ID: "2", Health: pluginapi.Healthy}}
+			}
+			deviceStates = &stateStore{resources: make(map[string][]deviceState)}
+			deviceStates.record(NewGenericDevicePlugin("oldgpu", "/dev/vfio/", newDevs()))
+
+			// the next run serves the devices under the new alias
+			restart := func() []*GenericDevicePlugin {
+				deviceStates = &stateStore{resources: make(map[string][]deviceState)}
+				Expect(deviceStates.load()).To(Succeed())
+				return []*GenericDevicePlugin{NewGenericDevicePlugin("pgpu", "/dev/vfio/", newDevs())}
+			}
+			plugins := restart()
+			migrated := migrationPlugins(plugins)
+			Expect(migrated).To(HaveLen(1))
+			Expect(migrated[0].deviceName).To(Equal("oldgpu"))
+			Expect(migrated[0].devs).To(HaveLen(2))
+			Expect(migrated[0].migrationTwin).To(Equal("pgpu"))
+			Expect(plugins[0].migrationTwin).To(Equal("oldgpu"))
+
+			// devices allocated under one name cannot be allocated under the other
+			migrationOwners = func() (map[string]deviceOwner, error) {
+				return map[string]deviceOwner{"nvidia.com/oldgpu/1": {Namespace: "default", Pod: "vm", Container: "compute"}}, nil
+			}
+			Expect(plugins[0].checkMigrationTwin([]string{"2"})).To(Succeed())
+			Expect(plugins[0].checkMigrationTwin([]string{"1"})).To(MatchError(ContainSubstring("allocated to default/vm/compute")))
+
+			// the window is kept across restarts and the previous name is
+			// dropped once it ends
+			for _, dp := range append(plugins, migrated...) {
+				deviceStates.record(dp)
+			}
+			fake.Step(30 * time.Minute)
+			plugins = restart()
+			migrated = migrationPlugins(plugins)
+			Expect(migrated).To(HaveLen(1))
+			for _, dp := range append(plugins, migrated...) {
+				deviceStates.record(dp)
+			}
+			fake.Step(time.Hour)
+			Expect(migrationPlugins(restart())).To(BeEmpty())
+			Expect(deviceStates.migrations).To(HaveKeyWithValue("oldgpu", resourceMigration{To: "pgpu", Since: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}))
+		})
+
+		It("reports the pods still requesting a renamed resource", func() {
+			correlator := &podCorrelator{pods: func(context.Context) ([]corev1.Pod, error) {
+				pod := func(name string, phase corev1.PodPhase, resourceName string) corev1.Pod {
+					return corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+						Spec: corev1.PodSpec{Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+							Limits: corev1.ResourceList{corev1.ResourceName(resourceName): resource.MustParse("1")},
+						}}}},
+						Status: corev1.PodStatus{Phase: phase},
+					}
+				}
+				return []corev1.Pod{
+					pod("vm-b", corev1.PodRunning, "nvidia.com/oldgpu"),
+					pod("vm-a", corev1.PodPending, "nvidia.com/oldgpu"),
+					pod("done", corev1.PodSucceeded, "nvidia.com/oldgpu"),
+					pod("new", corev1.PodRunning, "nvidia.com/pgpu"),
+				}, nil
+			}}
+			pods, err := strandedPods(func() (*podCorrelator, error) { return correlator, nil }, "oldgpu")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pods).To(Equal([]string{"default/vm-a", "default/vm-b"}))
+		})
+
+		It("probes device recovery on the file system", func() {
+			oldMap, oldReturn := iommuMap, returnIommuMap
+			defer func() { iommuMap, returnIommuMap = oldMap, oldReturn }()
+			iommuMap = map[string][]NvidiaPCIDevice{"3": {{Address: "0000:01:00.0", IommuGroup: 3}}}
+			returnIommuMap = getIommuMap
+			devPath := filepath.Join("/host", pciDevicesPath, "0000:01:00.0")
+
+			_, err := probeDeviceRecovery("/host/dev/vfio", "3")
+			Expect(err).To(MatchError(ContainSubstring("device node not present")))
+			Expect(mem.MkdirAll("/host/dev/vfio", 0755)).To(Succeed())
+			Expect(mem.WriteFile("/host/dev/vfio/3", nil, 0666)).To(Succeed())
+			_, err = probeDeviceRecovery("/host/dev/vfio", "3")
+			Expect(err).To(MatchError(ContainSubstring("not bound to a vfio driver")))
+
+			mem.Symlink("../../../bus/pci/drivers/vfio-pci", filepath.Join(devPath, "driver"))
+			Expect(mem.MkdirAll(devPath, 0755)).To(Succeed())
+			Expect(mem.WriteFile(filepath.Join(devPath, "aer_dev_fatal"), []byte("Undefined 0\nTOTAL_ERR_FATAL 2\n"), 0444)).To(Succeed())
+			Expect(mem.WriteFile(filepath.Join(devPath, "aer_dev_nonfatal"), []byte("TOTAL_ERR_NONFATAL 3\n"), 0444)).To(Succeed())
+			Expect(probeDeviceRecovery("/host/dev/vfio", "3")).To(Equal(uint64(5)))
+
+			// NVSwitches are probed on the same file system
+			Expect(probeNVSwitch(NvidiaPCIDevice{Address: "0000:07:00.0"})).To(MatchError(ContainSubstring("device not present")))
+			Expect(mem.WriteFile(filepath.Join(devPath, "current_link_width"), []byte("16\n"), 0444)).To(Succeed())
+			Expect(mem.WriteFile(filepath.Join(devPath, "current_link_speed"), []byte("32.0 GT/s PCIe\n"), 0444)).To(Succeed())
+			Expect(probeNVSwitch(NvidiaPCIDevice{Address: "0000:01:00.0"})).To(Succeed())
+		})
+
+		It("keeps group and iommufd keys with the same number apart", func() {
+			Expect(mem.MkdirAll("/host/dev", 0755)).To(Succeed())
+			Expect(mem.WriteFile("/host/dev/iommu", nil, 0666)).To(Succeed())
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return []*nvpci.NvidiaPCIDevice{
+						{Address: "0000:01:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x2330,
+							Driver: "vfio-pci", IommuGroup: 3, IommuFD: "vfio8"},
+						{Address: "0000:02:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x2330,
+							Driver: "vfio-pci", IommuGroup: 8},
+					}, nil
+				},
+			}
+			Expect(createIommuDeviceMap()).To(Succeed())
+			Expect(iommuMap).To(HaveKey("iommufd:vfio8"))
+			Expect(iommuMap).To(HaveKey("group:8"))
+			Expect(deviceMap["2330"]).To(ConsistOf("iommufd:vfio8", "group:8"))
+			Expect(cdiDeviceName("iommufd:vfio8")).To(Equal("8"))
+			Expect(cdiDeviceName("group:8")).To(Equal("group8"))
+			Expect(iommuKeyName("group:8")).To(Equal("8"))
+			Expect(extractNumber("iommufd:vfio10")).To(Equal(10))
+
+			// external IDs stay the PCI addresses, bare numbers prefer iommufd
+			Expect(stableIDForIommuKey("group:8")).To(Equal("0000:02:00.0"))
+			Expect(iommuKeyForDeviceID("0000:02:00.0")).To(Equal("group:8"))
+			Expect(iommuKeyForDeviceID("8")).To(Equal("iommufd:vfio8"))
+		})
+
+		It("advertises multi-GPU boards by their IOMMU group topology", func() {
+			// a board whose GPUs share group 5 and one with ACS between its
+			// GPUs, putting each in a group of its own
+			var pciDevs []*nvpci.NvidiaPCIDevice
+			for i := 0; i < 4; i++ {
+				pciDevs = append(pciDevs,
+					&nvpci.NvidiaPCIDevice{Address: fmt.Sprintf("0000:0%d:00.0", i+1), Vendor: 0x10de, Class: nvpci.PCI3dControllerClass,
+						Device: 0x25b6, Driver: "vfio-pci", IommuGroup: 5, IommuFD: fmt.Sprintf("vfio%d", i)},
+					&nvpci.NvidiaPCIDevice{Address: fmt.Sprintf("0000:8%d:00.0", i+1), Vendor: 0x10de, Class: nvpci.PCI3dControllerClass,
+						Device: 0x25b6, Driver: "vfio-pci", IommuGroup: 10 + i, IommuFD: fmt.Sprintf("vfio%d", 10+i)})
+			}
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) { return pciDevs, nil },
+			}
+			expectLayout := func(sharedKey string) {
+				Expect(iommuMap).To(HaveLen(5))
+				Expect(deviceMap["25b6"]).To(HaveLen(5))
+				Expect(deviceMap["25b6"]).To(ContainElement(sharedKey))
+				Expect(iommuMap[sharedKey]).To(HaveLen(4))
+				for _, dev := range iommuMap[sharedKey] {
+					Expect(dev.IommuGroup).To(Equal(5))
+				}
+			}
+
+			Expect(createIommuDeviceMap()).To(Succeed())
+			expectLayout("group:5")
+			Expect(iommuMap).To(HaveKey("group:10"))
+
+			Expect(mem.MkdirAll("/host/dev", 0755)).To(Succeed())
+			Expect(mem.WriteFile("/host/dev/iommu", nil, 0666)).To(Succeed())
+			Expect(createIommuDeviceMap()).To(Succeed())
+			expectLayout("group:5")
+			Expect(iommuMap).To(HaveKey("iommufd:vfio10"))
+			Expect(stableIDForIommuKey("group:5")).To(Equal("0000:01:00.0"))
+			Expect(iommuMap["group:5"][3].IommuFD).To(Equal("vfio3"))
+		})
+
+		It("detects iommufd support", func() {
+			supported, err := supportsIOMMUFD()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(supported).To(BeFalse())
+
+			Expect(mem.MkdirAll("/host/dev", 0755)).To(Succeed())
+			Expect(mem.WriteFile("/host/dev/iommu", nil, 0666)).To(Succeed())
+			supported, err = supportsIOMMUFD()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(supported).To(BeTrue())
+		})
+
+		It("writes and reconciles CDI specs in memory", func() {
+			Expect(mem.MkdirAll(cdiRoot, 0755)).To(Succeed())
+			stale := "cdiVersion: 0.5.0\nkind: nvidia.com/oldgpu\ndevices:\n- name: \"9\"\n  containerEdits:\n    deviceNodes:\n    - path: /dev/vfio/9\n"
+			Expect(mem.WriteFile("/var/run/cdi/nvidia.com-oldgpu.yaml", []byte(stale), 0644)).To(Succeed())
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+			}
+			deviceMap = map[string][]string{"1b80": {"1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+
+			Expect(GenerateCDISpec()).To(Succeed())
+			Expect(reconcileCDISpecs()).To(Succeed())
+
+			data, err := mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("kind: nvidia.com/pgpu"))
+			Expect(string(data)).To(ContainSubstring("/dev/vfio/1"))
+			_, err = mem.Stat("/var/run/cdi/nvidia.com-oldgpu.yaml")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("flushes CDI specs and never replaces them with a partial write", func() {
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+				"2": {{Address: "0000:02:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 2}},
+			}
+			deviceMap = map[string][]string{"1b80": {"1", "2"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(GenerateCDISpec()).To(Succeed())
+			Expect(mem.synced).To(Equal([]string{"/var/run/cdi/nvidia.com-pgpu.yaml.tmp", "/var/run/cdi"}))
+			written, err := mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+
+			fsys = shortWriteFS{mem}
+			Expect(GenerateCDISpec()).To(MatchError(ContainSubstring("nvidia.com-pgpu.yaml.tmp")))
+			data, err := mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal(written))
+			_, err = mem.Stat("/var/run/cdi/nvidia.com-pgpu.yaml.tmp")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("annotates CDI devices with their functions when the spec version allows", func() {
+			oldVersion := cdiVersion
+			defer func() { cdiVersion = oldVersion }()
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {
+					{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1, NumaNode: 1, MemoryMiB: 8192},
+					{Address: "0000:01:00.1", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1, NumaNode: 1},
+				},
+			}
+			deviceMap = map[string][]string{"1b80": {"1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+
+			Expect(GenerateCDISpec()).To(Succeed())
+			data, err := mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).ToNot(ContainSubstring("annotations"))
+
+			cdiVersion = "0.6.0"
+			Expect(GenerateCDISpec()).To(Succeed())
+			data, err = mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("nvidia.com/pci-addresses: 0000:01:00.0,0000:01:00.1"))
+			Expect(string(data)).To(ContainSubstring("nvidia.com/model: GeForce GTX 1080"))
+			Expect(string(data)).To(ContainSubstring(`nvidia.com/numa-node: "1"`))
+			Expect(string(data)).To(ContainSubstring(`nvidia.com/memory-mib: "8192"`))
+
+			lines := strings.Split(strings.TrimSpace(deviceMappingTable()), "\n")
+			Expect(lines).To(HaveLen(3))
+			Expect(strings.Fields(lines[0])).To(Equal([]string{"IOMMU", "CDI", "DEVICE", "PCI", "ADDRESS", "MODEL", "NUMA", "DRIVER"}))
+			Expect(strings.Fields(lines[2])).To(Equal([]string{"1", "nvidia.com/pgpu=1", "0000:01:00.1", "GeForce", "GTX", "1080", "1", "-"}))
+		})
+
+		It("mounts the ROM files of the resources exposing them in the CDI spec", func() {
+			oldROM := romResources
+			defer func() { romResources = oldROM }()
+			romResources = parseResourceList("pgpu")
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+			}
+			deviceMap = map[string][]string{"1b80": {"1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(mem.MkdirAll("/host/sys/bus/pci/devices/0000:01:00.0", 0755)).To(Succeed())
+			Expect(mem.WriteFile("/host/sys/bus/pci/devices/0000:01:00.0/rom", nil, 0600)).To(Succeed())
+
+			Expect(GenerateCDISpec()).To(Succeed())
+			data, err := mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("hostPath: /sys/bus/pci/devices/0000:01:00.0/rom"))
+		})
+
+		It("mounts VFIO nodes at the configured container paths", func() {
+			defer ConfigureContainerPaths("", "", "")
+			Expect(ConfigureContainerPaths("/dev/vfio-host/{{.Name}}", "", "")).To(Succeed())
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+			}
+			deviceMap = map[string][]string{"1b80": {"1"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+
+			Expect(GenerateCDISpec()).To(Succeed())
+			data, err := mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("- hostPath: /dev/vfio/vfio\n      path: /dev/vfio-host/vfio"))
+			Expect(string(data)).To(ContainSubstring("- path: /dev/vfio/1"))
+
+			control, err := containerPaths.controlNode()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(control.deviceSpec()).To(Equal(&pluginapi.DeviceSpec{HostPath: "/dev/vfio/vfio", ContainerPath: "/dev/vfio-host/vfio", Permissions: "mrw"}))
+		})
+
+		It("rejects invalid container path templates", func() {
+			defer ConfigureContainerPaths("", "", "")
+			Expect(ConfigureContainerPaths("{{.Missing}}", "", "")).ToNot(Succeed())
+			Expect(ConfigureContainerPaths("", "relative/{{.Name}}", "")).ToNot(Succeed())
+			Expect(ConfigureContainerPaths("", "", "/dev/{{.Name")).ToNot(Succeed())
+			Expect(ConfigureContainerPaths("", "", "/dev/vfio/../{{.Name}}")).ToNot(Succeed())
+		})
+
+		It("drops devices gone from the host from the CDI specs", func() {
+			oldGC := cdiGC
+			defer func() { cdiGC = oldGC }()
+			cdiGC = newCDICollector()
+			fake := clocktesting.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			clk = fake
+			Expect(mem.MkdirAll(cdiRoot, 0755)).To(Succeed())
+			for _, path := range []string{"/host/sys/bus/pci/devices/0000:01:00.0", "/host/sys/bus/pci/devices/0000:02:00.0", "/host/dev/vfio"} {
+				Expect(mem.MkdirAll(path, 0755)).To(Succeed())
+			}
+			Expect(mem.WriteFile("/host/dev/vfio/1", nil, 0666)).To(Succeed())
+			Expect(mem.WriteFile("/host/dev/vfio/2", nil, 0666)).To(Succeed())
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 1}},
+				"2": {{Address: "0000:02:00.0", DeviceID: 0x1b80, DeviceName: "GeForce GTX 1080", IommuGroup: 2}},
+			}
+			deviceMap = map[string][]string{"1b80": {"1", "2"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(refreshCDISpecs()).To(Succeed())
+
+			dpi := NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{
+				{ID: "1", Health: pluginapi.Healthy},
+				{ID: "2", Health: pluginapi.Healthy},
+			})
+			dpi.updateHealth("2", pluginapi.Unhealthy)
+			Expect(mem.Remove("/host/dev/vfio/2")).To(Succeed())
+			Expect(cdiGC.sweep(30 * time.Second)).To(BeEmpty())
+
+			// a device that is back within the grace period is kept
+			fake.Step(31 * time.Second)
+			Expect(mem.WriteFile("/host/dev/vfio/2", nil, 0666)).To(Succeed())
+			Expect(cdiGC.sweep(30 * time.Second)).To(BeEmpty())
+
+			Expect(mem.Remove("/host/dev/vfio/2")).To(Succeed())
+			Expect(cdiGC.sweep(30 * time.Second)).To(Equal([]string{"2"}))
+			Expect(refreshCDISpecs()).To(Succeed())
+			data, err := mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("/dev/vfio/1"))
+			Expect(string(data)).ToNot(ContainSubstring("/dev/vfio/2"))
+
+			// a recovered device is restored
+			Expect(mem.WriteFile("/host/dev/vfio/2", nil, 0666)).To(Succeed())
+			dpi.updateHealth("2", pluginapi.Healthy)
+			Expect(cdiGC.notify).To(Receive())
+			Expect(refreshCDISpecs()).To(Succeed())
+			data, err = mem.ReadFile("/var/run/cdi/nvidia.com-pgpu.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("/dev/vfio/2"))
+		})
+
+		It("reports how long a device has been unhealthy", func() {
+			fake := clocktesting.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			clk = fake
+			dpi := NewGenericDevicePlugin("foo", "/dev/vfio/", []*pluginapi.Device{{ID: "1", Health: pluginapi.Healthy}})
+			dpi.updateHealth("1", pluginapi.Unhealthy)
+			fake.Step(90 * time.Second)
+
+			err := dpi.checkAllocatable("1")
+			Expect(err).To(MatchError("device 1 is unhealthy since 2025-01-01T00:00:00Z (1m30s ago)"))
+		})
+	})
+
+	Context("DevicePluginManager Tests", func() {
+		var oldStart func(*GenericDevicePlugin) error
+
+		BeforeEach(func() {
+			oldStart = startDevicePlugin
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return []*nvpci.NvidiaPCIDevice{
+						{Address: "0000:01:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b80, DeviceName: "GeForce GTX 1080", Driver: "vfio-pci", IommuGroup: 1},
+						{Address: "0000:02:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b81, DeviceName: "GeForce GTX 1070", Driver: "vfio-pci", IommuGroup: 2},
+					}, nil
+				},
+			}
+			createIommuDeviceMap()
+		})
+
+		AfterEach(func() {
+			startDevicePlugin = oldStart
+		})
+
+		It("starts the device plugins concurrently", func() {
+			entered := make(chan string, 2)
+			release := make(chan struct{})
+			startDevicePlugin = func(dp *GenericDevicePlugin) error {
+				entered <- dp.deviceName
+				<-release
+				return nil
+			}
+
+			m := newDevicePluginManager()
+			done := make(chan struct{})
+			go func() {
+				m.start()
+				close(done)
+			}()
+			Eventually(entered).Should(Receive())
+			Eventually(entered).Should(Receive())
+			Expect(m.Ready()).To(BeFalse())
+			close(release)
+			Eventually(done).Should(BeClosed())
+
+			Expect(m.Ready()).To(BeTrue())
+			Expect(m.Plugins()).To(HaveLen(2))
+		})
+
+		It("pauses advertisement while the vfio modules are reloaded", func() {
+			startDevicePlugin = func(dp *GenericDevicePlugin) error { return nil }
+			rootPath = GinkgoT().TempDir()
+			defer func() { rootPath = "/" }()
+			for _, path := range vfioModulePaths {
+				Expect(os.MkdirAll(filepath.Join(rootPath, path), 0755)).To(Succeed())
+			}
+
+			m := newDevicePluginManager()
+			m.start()
+			Expect(m.Plugins()).To(HaveLen(2))
+			resumed := 0
+			r := newVfioReloadMonitor(m)
+			r.resume = func() {
+				resumed++
+				m.lock.Lock()
+				m.paused = false
+				m.lock.Unlock()
+				m.start()
+			}
+
+			r.check()
+			Expect(m.Plugins()).To(HaveLen(2))
+
+			// the module is unloaded and loaded again
+			modPath := filepath.Join(rootPath, vfioPCIModulePath)
+			Expect(os.Remove(modPath)).To(Succeed())
+			r.check()
+			Expect(m.Plugins()).To(BeEmpty())
+			m.start()
+			Expect(m.Plugins()).To(BeEmpty())
+
+			Expect(os.Mkdir(modPath, 0755)).To(Succeed())
+			r.check()
+			Expect(resumed).To(Equal(0))
+			r.check()
+			Expect(resumed).To(Equal(1))
+			Expect(m.Plugins()).To(HaveLen(2))
+		})
+
+		It("reports readiness per resource on /readyz", func() {
+			var started []*GenericDevicePlugin
+			var startedLock sync.Mutex
+			startDevicePlugin = func(dp *GenericDevicePlugin) error {
+				startedLock.Lock()
+				started = append(started, dp)
+				startedLock.Unlock()
+				if dp.deviceName == "GEFORCE_GTX_1080" {
+					return errors.New("registration failed")
+				}
+				return nil
+			}
+			m := newDevicePluginManager()
+			m.start()
+
+			Expect(m.Status()).To(Equal(map[string]bool{"GEFORCE_GTX_1080": false, "GEFORCE_GTX_1070": true}))
+			Expect(m.Ready()).To(BeFalse())
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rec.Body.String()).To(ContainSubstring("[-]GEFORCE_GTX_1080 not ready"))
+			Expect(rec.Body.String()).To(ContainSubstring("[+]GEFORCE_GTX_1070 ok"))
+
+			// the plugin that failed to start is stopped
+			for _, dp := range started {
+				if dp.deviceName == "GEFORCE_GTX_1080" {
+					Expect(dp.ctx.Done()).To(BeClosed())
+				}
+			}
+
+			startDevicePlugin = func(dp *GenericDevicePlugin) error { return nil }
+			m.Stop()
+			m.start()
+			rec = httptest.NewRecorder()
+			m.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+			Expect(rec.Code).To(Equal(http.StatusOK))
+		})
+
+		It("stops the health checks of stopped plugins", func() {
+			startDevicePlugin = func(dp *GenericDevicePlugin) error { return nil }
+			m := newDevicePluginManager()
+			m.start()
+			plugins := m.Plugins()
+			Expect(plugins).To(HaveLen(2))
+
+			m.Stop()
+			Expect(m.Ready()).To(BeFalse())
+			Expect(m.Plugins()).To(BeEmpty())
+			for _, dp := range plugins {
+				Expect(dp.ctx.Done()).To(BeClosed())
+			}
+		})
+
+		It("cancels the plugins and API calls with the daemon context", func() {
+			ctx, shutdown := context.WithCancel(context.Background())
+			daemonCtx = ctx
+			DeferCleanup(func() { daemonCtx = context.Background() })
+			startDevicePlugin = func(dp *GenericDevicePlugin) error { return nil }
+			m := newDevicePluginManager()
+			m.start()
+			plugins := m.Plugins()
+			Expect(plugins).To(HaveLen(2))
+			apiCtx, cancel := apiContext()
+			defer cancel()
+
+			shutdown()
+			for _, dp := range plugins {
+				Expect(dp.ctx.Done()).To(BeClosed())
+			}
+			Expect(apiCtx.Err()).To(Equal(context.Canceled))
+		})
+	})
+
+	Context("config file Tests", func() {
+		var saved runtimeSettings
+		var oldStart func(*GenericDevicePlugin) error
+
+		BeforeEach(func() {
+			saved = currentSettings()
+			oldStart = startDevicePlugin
+			fsys = newMemFS()
+		})
+
+		AfterEach(func() {
+			applySettings(saved)
+			startDevicePlugin = oldStart
+			fsys = osFS{}
+		})
+
+		It("loads and validates the config file", func() {
+			Expect(fsys.WriteFile("/config.yaml", []byte("pgpuAlias: gpu\nrecoveryProbeInterval: 10s\nlogLevel: debug\ndenyDevices: [\"0000:17:00.0\", \"20B5\"]\n"), 0644)).To(Succeed())
+			cfg, err := loadConfig("/config.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			s := cfg.resolve(saved)
+			Expect(s.pgpuAlias).To(Equal("gpu"))
+			Expect(s.nvSwitchAlias).To(Equal(saved.nvSwitchAlias))
+			Expect(s.recoveryProbeInterval).To(Equal(10 * time.Second))
+			Expect(s.debug).To(BeTrue())
+			Expect(s.denyDevices).To(Equal([]string{"0000:17:00.0", "20b5"}))
+
+			for _, bad := range []string{"logLevel: trace\n", "nvswitchHealthInterval: 0s\n", "allowDevices: [gpu0]\n", "allocationStrategies:\n  pgpu: bundle\n", "pgpuAlias: gpu\nunknown: 1\n"} {
+				Expect(fsys.WriteFile("/config.yaml", []byte(bad), 0644)).To(Succeed())
+				_, err := loadConfig("/config.yaml")
+				Expect(err).To(HaveOccurred(), bad)
+			}
+		})
+
+		It("requires re-registration only for alias and device list changes", func() {
+			s := saved
+			s.recoveryProbeInterval = time.Minute
+			s.debug = true
+			Expect(applySettings(s)).To(BeFalse())
+			Expect(recoveryProbeInterval.get()).To(Equal(time.Minute))
+
+			s.pgpuAlias = "gpu"
+			Expect(applySettings(s)).To(BeTrue())
+			Expect(PGPUAlias).To(Equal("gpu"))
+		})
+
+		It("reloads the device plugins only for changes that require it", func() {
+			oldFile, oldEnv, oldReload := configFile, envSettings, reloadDevicePlugins
+			defer func() { configFile, envSettings, reloadDevicePlugins = oldFile, oldEnv, oldReload }()
+			configFile, envSettings = "/config.yaml", saved
+			reloads := 0
+			reloadDevicePlugins = func(*DevicePluginManager) { reloads++ }
+			m := newDevicePluginManager()
+
+			Expect(fsys.WriteFile(configFile, []byte("hostContainers:\n  pgpu:\n    mode: \"0666\"\n"), 0644)).To(Succeed())
+			reloadConfig(m)
+			Expect(fsys.WriteFile(configFile, []byte("allocationStrategies:\n  pgpu: cdi\n"), 0644)).To(Succeed())
+			reloadConfig(m)
+			Expect(reloads).To(BeZero())
+			Expect(currentSettings().allocationStrategies).To(HaveKeyWithValue("pgpu", "cdi"))
+
+			Expect(fsys.WriteFile(configFile, []byte("pgpuAlias: gpu\n"), 0644)).To(Succeed())
+			reloadConfig(m)
+			Expect(reloads).To(Equal(1))
+		})
+
+		It("filters devices with the allow and deny lists", func() {
+			s := saved
+			s.allowDevices = []string{"1b80", "0000:03:00.0"}
+			s.denyDevices = []string{"0000:01:00.0"}
+			applySettings(s)
+
+			Expect(deviceAllowed("0000:01:00.0", 0x1b80)).To(BeFalse())
+			Expect(deviceAllowed("0000:02:00.0", 0x1b80)).To(BeTrue())
+			Expect(deviceAllowed("0000:03:00.0", 0x1b81)).To(BeTrue())
+			Expect(deviceAllowed("0000:04:00.0", 0x1b81)).To(BeFalse())
+		})
+
+		It("validates subtree bridges and resource names", func() {
+			Expect(fsys.WriteFile("/config.yaml", []byte("subtrees:\n  0000:40:00.0: pgpu-switch0\n"), 0644)).To(Succeed())
+			cfg, err := loadConfig("/config.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			s := cfg.resolve(saved)
+			Expect(s.subtrees).To(Equal(map[string]string{"0000:40:00.0": "pgpu-switch0"}))
+			Expect(applySettings(s)).To(BeTrue())
+
+			for _, bad := range []string{"subtrees:\n  40:00.0: pgpu-switch0\n", "subtrees:\n  0000:40:00.0: pgpu/switch0\n"} {
+				Expect(fsys.WriteFile("/config.yaml", []byte(bad), 0644)).To(Succeed())
+				_, err := loadConfig("/config.yaml")
+				Expect(err).To(HaveOccurred(), bad)
+			}
+		})
+
+		It("serves host container resources with their own permissions", func() {
+			Expect(fsys.WriteFile("/config.yaml", []byte("hostContainers:\n  pgpu:\n    mode: \"0666\"\n"), 0644)).To(Succeed())
+			cfg, err := loadConfig("/config.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			s := cfg.resolve(saved)
+			Expect(applySettings(s)).To(BeFalse())
+
+			_, ok := hostContainerModeFor("nvswitch")
+			Expect(ok).To(BeFalse())
+			mode, ok := hostContainerModeFor("pgpu")
+			Expect(ok).To(BeTrue())
+			Expect(mode.permissions().mode).To(Equal(os.FileMode(0666)))
+
+			workDir := GinkgoT().TempDir()
+			rootPath = workDir
+			defer func() { rootPath = "/" }()
+			node := filepath.Join(workDir, vfioDevicePath, "7")
+			Expect(os.MkdirAll(filepath.Dir(node), 0755)).To(Succeed())
+			Expect(os.WriteFile(node, nil, 0600)).To(Succeed())
+			dpi := &GenericDevicePlugin{deviceName: "pgpu"}
+			Expect(dpi.applyVfioPerms(filepath.Join(vfioDevicePath, "7"))).To(Succeed())
+			info, err := os.Stat(node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0666)))
+
+			Expect(*sysfsMount("0000:01:00.0")).To(Equal(pluginapi.Mount{
+				ContainerPath: "/sys/bus/pci/devices/0000:01:00.0",
+				HostPath:      "/sys/bus/pci/devices/0000:01:00.0",
+				ReadOnly:      true,
+			}))
+
+			for _, bad := range []string{"hostContainers:\n  pgpu/x: {}\n", "hostContainers:\n  pgpu:\n    mode: rw\n", "hostContainers:\n  pgpu:\n    uid: -2\n"} {
+				Expect(fsys.WriteFile("/config.yaml", []byte(bad), 0644)).To(Succeed())
+				_, err := loadConfig("/config.yaml")
+				Expect(err).To(HaveOccurred(), bad)
+			}
+		})
+
+		It("mounts the ROM of the functions of the configured resources", func() {
+			Expect(fsys.WriteFile("/config.yaml", []byte("romResources:\n  - pgpu\n"), 0644)).To(Succeed())
+			cfg, err := loadConfig("/config.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			s := cfg.resolve(saved)
+			Expect(applySettings(s)).To(BeTrue())
+			Expect(romExposed("pgpu")).To(BeTrue())
+			Expect(romExposed("nvswitch")).To(BeFalse())
+
+			rom := filepath.Join("/", pciDevicesPath, "0000:01:00.0", "rom")
+			Expect(fsys.MkdirAll(filepath.Dir(rom), 0755)).To(Succeed())
+			Expect(fsys.WriteFile(rom, nil, 0600)).To(Succeed())
+			devs := []NvidiaPCIDevice{{Address: "0000:01:00.0"}, {Address: "0000:02:00.0"}}
+			Expect(romMounts(devs)).To(Equal([]*pluginapi.Mount{{
+				ContainerPath: "/sys/bus/pci/devices/0000:01:00.0/rom",
+				HostPath:      "/sys/bus/pci/devices/0000:01:00.0/rom",
+			}}))
+			Expect(cdiROMMounts(devs)).To(HaveLen(1))
+
+			Expect(fsys.WriteFile("/config.yaml", []byte("romResources:\n  - pgpu/x\n"), 0644)).To(Succeed())
+			_, err = loadConfig("/config.yaml")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("holds back reserved devices from scheduling", func() {
+			Expect(fsys.WriteFile("/config.yaml", []byte("reservedDevices:\n  1B80: 2\n"), 0644)).To(Succeed())
+			cfg, err := loadConfig("/config.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			s := cfg.resolve(saved)
+			Expect(s.reservedDevices).To(Equal(map[string]int{"1b80": 2}))
+			Expect(applySettings(s)).To(BeTrue())
+
+			for _, bad := range []string{"reservedDevices:\n  gpu: 1\n", "reservedDevices:\n  1b80: -1\n"} {
+				Expect(fsys.WriteFile("/config.yaml", []byte(bad), 0644)).To(Succeed())
+				_, err := loadConfig("/config.yaml")
+				Expect(err).To(HaveOccurred(), bad)
+			}
+
+			PGPUAlias = "pgpu"
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"2":  {{Address: "0000:02:00.0", DeviceID: 0x1b80}},
+				"9":  {{Address: "0000:09:00.0", DeviceID: 0x1b80}},
+				"10": {{Address: "0000:0a:00.0", DeviceID: 0x1b80}},
+			}
+			deviceMap = map[string][]string{"1b80": {"10", "2", "9"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			Expect(reservedIommuKeys()).To(Equal(map[string]bool{"9": true, "10": true}))
+
+			plugins, err := newDevicePlugins()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plugins).To(HaveLen(1))
+			Expect(plugins[0].devs).To(HaveLen(1))
+			Expect(plugins[0].devs[0].ID).To(Equal(stableIDForIommuKey("2")))
+
+			inventory := buildInventory(nil, nil)
+			Expect(inventory).To(HaveLen(3))
+			Expect(inventory[0].Reserved).To(BeFalse())
+			Expect(inventory[1].Reserved).To(BeTrue())
+			Expect(inventory[2].Reserved).To(BeTrue())
+		})
+
+		It("promotes hot spares to replace failed devices", func() {
+			defer func() { spares = newSparePool() }()
+			Expect(fsys.WriteFile("/config.yaml", []byte("reservedDevices:\n  1b80: 1\nspareDevices:\n  1B80: 1\n"), 0644)).To(Succeed())
+			cfg, err := loadConfig("/config.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			s := cfg.resolve(saved)
+			Expect(s.spareDevices).To(Equal(map[string]int{"1b80": 1}))
+			Expect(applySettings(s)).To(BeTrue())
+			Expect(fsys.WriteFile("/config.yaml", []byte("spareDevices:\n  1b80: -1\n"), 0644)).To(Succeed())
+			_, err = loadConfig("/config.yaml")
+			Expect(err).To(HaveOccurred())
+
+			PGPUAlias = "pgpu"
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"2":  {{Address: "0000:02:00.0", DeviceID: 0x1b80}},
+				"9":  {{Address: "0000:09:00.0", DeviceID: 0x1b80}},
+				"10": {{Address: "0000:0a:00.0", DeviceID: 0x1b80}},
+			}
+			deviceMap = map[string][]string{"1b80": {"10", "2", "9"}}
+			nvSwitchDeviceIDs = map[string]bool{}
+			reserved, spare := heldBackIommuKeys()
+			Expect(reserved).To(Equal(map[string]bool{"10": true}))
+			Expect(spare).To(Equal(map[string]bool{"9": true}))
+
+			plugins, err := newDevicePlugins()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plugins[0].devs).To(HaveLen(1))
+			Expect(buildInventory(nil, nil)[1].Spare).To(BeTrue())
+
+			plugins[0].updateHealth(stableIDForIommuKey("2"), pluginapi.Unhealthy)
+			failed := failedIommuKeys(plugins)
+			Expect(failed).To(Equal([]string{"2"}))
+			Expect(spares.promote(failed)).To(ConsistOf(ContainSubstring("to replace failed device")))
+			Expect(spares.promote(failed)).To(BeEmpty())
+
+			plugins, err = newDevicePlugins()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plugins[0].devs).To(HaveLen(2))
+			Expect(plugins[0].devs[1].ID).To(Equal(stableIDForIommuKey("9")))
+			Expect(buildInventory(nil, nil)[1].Spare).To(BeFalse())
+		})
+
+		It("restarts only the device plugins of affected resources", func() {
+			PGPUAlias = ""
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return []*nvpci.NvidiaPCIDevice{
+						{Address: "0000:01:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b80, DeviceName: "GeForce GTX 1080", Driver: "vfio-pci", IommuGroup: 1},
+						{Address: "0000:02:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b81, DeviceName: "GeForce GTX 1070", Driver: "vfio-pci", IommuGroup: 2},
+					}, nil
+				},
+			}
+			startDevicePlugin = func(dp *GenericDevicePlugin) error { return nil }
+			createIommuDeviceMap()
+			m := newDevicePluginManager()
+			m.start()
+			before := m.Plugins()
+			Expect(before).To(HaveLen(2))
+
+			s := currentSettings()
+			s.denyDevices = []string{"0000:02:00.0"}
+			Expect(applySettings(s)).To(BeTrue())
+			createIommuDeviceMap()
+			m.start()
+
+			after := m.Plugins()
+			Expect(after).To(HaveLen(1))
+			Expect(after[0]).To(BeIdenticalTo(before[1]))
+			Expect(after[0].deviceName).To(Equal("GEFORCE_GTX_1080"))
+			Expect(after[0].ctx.Done()).ToNot(BeClosed())
+			Expect(before[0].ctx.Done()).To(BeClosed())
+			Expect(m.Status()).To(Equal(map[string]bool{"GEFORCE_GTX_1080": true}))
+		})
+	})
+
+	Context("event recorder Tests", func() {
+		var oldEvents *eventRecorder
+
+		BeforeEach(func() {
+			oldEvents = events
+			events = newEventRecorder()
+		})
+
+		AfterEach(func() {
+			events = oldEvents
+		})
+
+		It("drops events when the queue is full", func() {
+			r := &eventRecorder{queue: make(chan nodeEvent, 1)}
+			r.normal("First", "first")
+			r.warning("Second", "second")
+			Expect(r.queue).To(HaveLen(1))
+			Expect(<-r.queue).To(Equal(nodeEvent{eventType: corev1.EventTypeNormal, reason: "First", message: "first"}))
+		})
+
+		It("records device health transitions", func() {
+			dpi := NewGenericDevicePlugin("foo", "/dev/vfio/", []*pluginapi.Device{{ID: "1", Health: pluginapi.Healthy}})
+			dpi.updateHealth("1", pluginapi.Unhealthy)
+			dpi.updateHealth("1", pluginapi.Unhealthy)
+			dpi.updateHealth("1", pluginapi.Healthy)
+
+			Expect(events.queue).To(HaveLen(2))
+			event := <-events.queue
+			Expect(event.eventType).To(Equal(corev1.EventTypeWarning))
+			Expect(event.reason).To(Equal("DeviceUnhealthy"))
+			Expect(event.message).To(Equal("Device 1 of nvidia.com/foo changed to Unhealthy"))
+			Expect((<-events.queue).reason).To(Equal("DeviceHealthy"))
+		})
+
+		It("records a discovery summary", func() {
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return []*nvpci.NvidiaPCIDevice{
+						{Address: "0000:01:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b80, DeviceName: "GeForce GTX 1080", Driver: "vfio-pci", IommuGroup: 1},
+						{Address: "0000:02:00.0", Vendor: 0x10de, Class: nvpci.PCI3dControllerClass, Device: 0x1b80, DeviceName: "GeForce GTX 1080", Driver: "nvidia", IommuGroup: 2},
+					}, nil
+				},
+			}
+			createIommuDeviceMap()
+
+			Expect(events.queue).To(HaveLen(1))
+			event := <-events.queue
+			Expect(event.reason).To(Equal("DevicesDiscovered"))
+			Expect(event.message).To(Equal("Discovered 1 GPU(s) and 0 NVSwitch(es) bound to vfio-pci, skipped 1 device(s)"))
+		})
+	})
+
+	Context("device metadata API Tests", func() {
+		var handler *metadataHandler
+		var oldAlias string
+		var id1, id2 string
+
+		BeforeEach(func() {
+			oldAlias = PGPUAlias
+			PGPUAlias = "pgpu"
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x2330, DeviceName: "GH100 [H100 SXM5 80GB]", IommuGroup: 1, Serial: "1650923000001", NumaNode: 0}},
+				"2": {{Address: "0000:02:00.0", DeviceID: 0x2330, DeviceName: "GH100 [H100 SXM5 80GB]", IommuGroup: 2, NumaNode: 1}},
+			}
+			buildStableDeviceIDs()
+			id1, id2 = stableIDForIommuKey("1"), stableIDForIommuKey("2")
+
+			m := newDevicePluginManager()
+			m.plugins["pgpu"] = NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{
+				{ID: id1, Health: pluginapi.Healthy},
+				{ID: id2, Health: pluginapi.Unhealthy},
+			})
+			handler = &metadataHandler{
+				manager: m,
+				owners: func() (map[string]deviceOwner, error) {
+					return map[string]deviceOwner{"nvidia.com/pgpu/" + id1: {Namespace: "default", Pod: "vm", Container: "compute"}}, nil
+				},
+			}
+		})
+
+		AfterEach(func() {
+			PGPUAlias = oldAlias
+		})
+
+		get := func(path string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			return rec
+		}
+
+		It("lists the metadata of all devices", func() {
+			rec := get("/v1/devices")
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			var devices []DeviceMetadata
+			Expect(json.Unmarshal(rec.Body.Bytes(), &devices)).To(Succeed())
+			Expect(devices).To(HaveLen(2))
+			Expect(devices[0].PCIAddress).To(Equal("0000:01:00.0"))
+			Expect(devices[0].VendorID).To(Equal("10de"))
+			Expect(devices[0].DeviceID).To(Equal("2330"))
+			Expect(devices[0].Serial).To(Equal("1650923000001"))
+			Expect(devices[0].CCCapable).To(BeTrue())
+			Expect(devices[0].Health).To(Equal(pluginapi.Healthy))
+			Expect(devices[0].Allocated).To(BeTrue())
+			Expect(devices[0].AllocatedTo).To(Equal("default/vm/compute"))
+			Expect(devices[1].Health).To(Equal(pluginapi.Unhealthy))
+			Expect(devices[1].Allocated).To(BeFalse())
+		})
+
+		It("returns a single device by ID or PCI address", func() {
+			for _, key := range []string{id2, "0000:02:00.0"} {
+				rec := get("/v1/devices/" + key)
+				Expect(rec.Code).To(Equal(http.StatusOK))
+				var dev DeviceMetadata
+				Expect(json.Unmarshal(rec.Body.Bytes(), &dev)).To(Succeed())
+				Expect(dev.IommuGroup).To(Equal(2))
+				Expect(dev.NumaNode).To(Equal(1))
+			}
+			Expect(get("/v1/devices/0000:ff:00.0").Code).To(Equal(http.StatusNotFound))
+			Expect(get("/v1/other").Code).To(Equal(http.StatusNotFound))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/devices", nil))
+			Expect(rec.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+
+	Context("snapshot Tests", func() {
+		var workDir, oldCdiRoot, oldAlias, oldSnapshotFile string
+
+		BeforeEach(func() {
+			var err error
+			workDir, err = os.MkdirTemp("", "snapshot-test")
+			Expect(err).ToNot(HaveOccurred())
+			oldCdiRoot, oldAlias, oldSnapshotFile = cdiRoot, PGPUAlias, snapshotFile
+			setCdiRoot(filepath.Join(workDir, "cdi"))
+			PGPUAlias = "pgpu"
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x2330, IommuGroup: 1}},
+			}
+			buildStableDeviceIDs()
+		})
+
+		AfterEach(func() {
+			setCdiRoot(oldCdiRoot)
+			PGPUAlias, snapshotFile = oldAlias, oldSnapshotFile
+			os.RemoveAll(workDir)
+		})
+
+		It("dumps the devices, pending health transitions and CDI specs", func() {
+			Expect(os.MkdirAll(cdiRoot, 0755)).To(Succeed())
+			spec := "cdiVersion: 0.5.0\nkind: nvidia.com/pgpu\n"
+			Expect(os.WriteFile(filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml"), []byte(spec), 0644)).To(Succeed())
+
+			id := stableIDForIommuKey("1")
+			m := newDevicePluginManager()
+			dp := NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{{ID: id, Health: pluginapi.Healthy}})
+			dp.queue.push(id, pluginapi.Unhealthy)
+			m.plugins["pgpu"] = dp
+
+			s := m.snapshot(func() (map[string]deviceOwner, error) {
+				return nil, fmt.Errorf("no kubelet")
+			})
+			Expect(s.Devices).To(HaveLen(1))
+			Expect(s.Devices[0].PCIAddress).To(Equal("0000:01:00.0"))
+			Expect(s.Devices[0].Health).To(Equal(pluginapi.Healthy))
+			Expect(s.OwnersError).To(Equal("no kubelet"))
+			Expect(s.PendingHealth).To(Equal(map[string][]PendingHealth{"pgpu": {{Device: id, Health: pluginapi.Unhealthy}}}))
+			Expect(s.CDISpecs).To(Equal(map[string]string{filepath.Join(cdiRoot, "nvidia.com-pgpu.yaml"): spec}))
+			// peeking does not consume the pending transitions
+			Expect(dp.queue.drain()).To(HaveLen(1))
+
+			snapshotFile = filepath.Join(workDir, "out", "snapshot.json")
+			Expect(writeSnapshotFile([]byte("{}"))).To(Succeed())
+			data, err := os.ReadFile(snapshotFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("{}"))
+			_, err = os.Stat(snapshotFile + ".tmp")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("scheduler extender Tests", func() {
+		gpu := func(addr, p2p string, numa int, allocatedTo string) InventoryDevice {
+			return InventoryDevice{ResourceName: "nvidia.com/pgpu", PCIAddress: addr, P2PGroup: p2p, NumaNode: numa, AllocatedTo: allocatedTo}
+		}
+		inventories := map[string]InventoryStatus{
+			// four free GPUs on one NVLink domain and NUMA node
+			"packed": {Devices: []InventoryDevice{
+				gpu("0000:01:00.0", "nvlink0", 0, ""), gpu("0000:02:00.0", "nvlink0", 0, ""),
+				gpu("0000:03:00.0", "nvlink0", 0, ""), gpu("0000:04:00.0", "nvlink0", 0, ""),
+			}},
+			// four free GPUs split across domains and NUMA nodes
+			"split": {Devices: []InventoryDevice{
+				gpu("0000:01:00.0", "nvlink0", 0, ""), gpu("0000:02:00.0", "nvlink0", 0, ""),
+				gpu("0000:81:00.0", "nvlink1", 1, ""), gpu("0000:82:00.0", "nvlink1", 1, ""),
+			}},
+			// only one free GPU
+			"busy": {Devices: []InventoryDevice{
+				gpu("0000:01:00.0", "nvlink0", 0, ""), gpu("0000:02:00.0", "nvlink0", 0, "default/vm/compute"),
+			}},
+		}
+		extender := &schedulerExtender{inventories: func() (map[string]InventoryStatus, error) {
+			return inventories, nil
+		}}
+		prioritize := func(gpus int64, nodes ...string) map[string]int64 {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+					"nvidia.com/pgpu": *resource.NewQuantity(gpus, resource.DecimalSI),
+				}},
+			}}}}
+			body, err := json.Marshal(ExtenderArgs{Pod: pod, NodeNames: &nodes})
+			Expect(err).ToNot(HaveOccurred())
+			rec := httptest.NewRecorder()
+			extender.ServeHTTP(rec, httptest.NewRequest("POST", "/prioritize", strings.NewReader(string(body))))
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			var priorities []HostPriority
+			Expect(json.Unmarshal(rec.Body.Bytes(), &priorities)).To(Succeed())
+			scores := make(map[string]int64)
+			for _, p := range priorities {
+				scores[p.Host] = p.Score
+			}
+			return scores
+		}
+
+		It("prefers nodes with free fabric connected GPUs on one NUMA node", func() {
+			Expect(prioritize(4, "packed", "split", "busy", "unknown")).To(Equal(map[string]int64{
+				"packed": 10, "split": 5, "busy": 0, "unknown": 0,
+			}))
+			Expect(prioritize(2, "packed", "split")).To(Equal(map[string]int64{"packed": 10, "split": 10}))
+		})
+
+		It("scores nodes 0 for pods without passthrough devices", func() {
+			Expect(prioritize(0, "packed")).To(Equal(map[string]int64{"packed": 0}))
+
+			rec := httptest.NewRecorder()
+			extender.ServeHTTP(rec, httptest.NewRequest("GET", "/prioritize", nil))
+			Expect(rec.Code).To(Equal(http.StatusMethodNotAllowed))
+			rec = httptest.NewRecorder()
+			extender.ServeHTTP(rec, httptest.NewRequest("POST", "/prioritize", strings.NewReader("{")))
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("device admin API Tests", func() {
+		var conn *grpc.ClientConn
+		var server *grpc.Server
+		var oldAlias string
+
+		BeforeEach(func() {
+			oldAlias = PGPUAlias
+			PGPUAlias = "pgpu"
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x2330, DeviceName: "GH100 [H100 SXM5 80GB]", IommuGroup: 1}},
+				"2": {{Address: "0000:02:00.0", DeviceID: 0x2330, DeviceName: "GH100 [H100 SXM5 80GB]", IommuGroup: 2}},
+				"3": {{Address: "0000:03:00.0", DeviceID: 0x20b5, DeviceName: "GA100 [A100 PCIe 80GB]", IommuGroup: 3}},
+			}
+			buildStableDeviceIDs()
+			id1 := stableIDForIommuKey("1")
+
+			m := newDevicePluginManager()
+			m.plugins["pgpu"] = NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{
+				{ID: id1, Health: pluginapi.Healthy},
+				{ID: stableIDForIommuKey("2"), Health: pluginapi.Unhealthy},
+				{ID: stableIDForIommuKey("3"), Health: pluginapi.Healthy},
+			})
+
+			socketPath := filepath.Join(GinkgoT().TempDir(), "admin.sock")
+			listener, err := net.Listen("unix", socketPath)
+			Expect(err).ToNot(HaveOccurred())
+			server = grpc.NewServer()
+			server.RegisterService(&deviceAdminServiceDesc, &deviceAdminServer{metadata: &metadataHandler{
+				manager: m,
+				owners: func() (map[string]deviceOwner, error) {
+					return map[string]deviceOwner{"nvidia.com/pgpu/" + id1: {Namespace: "default", Pod: "vm", Container: "compute"}}, nil
+				},
+			}})
+			go server.Serve(listener)
+			conn, err = connect(socketPath, 5*time.Second)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			conn.Close()
+			server.Stop()
+			PGPUAlias = oldAlias
+		})
+
+		list := func(filters map[string]interface{}) ([]string, error) {
+			req, err := structpb.NewStruct(filters)
+			Expect(err).ToNot(HaveOccurred())
+			resp := &structpb.Struct{}
+			if err := conn.Invoke(context.Background(), "/v1alpha1.DeviceAdmin/ListDevices", req, resp); err != nil {
+				return nil, err
+			}
+			var addresses []string
+			for _, dev := range resp.Fields["devices"].GetListValue().GetValues() {
+				addresses = append(addresses, dev.GetStructValue().Fields["pciAddress"].GetStringValue())
+			}
+			return addresses, nil
+		}
+
+		It("lists the devices matching the filters", func() {
+			Expect(list(nil)).To(Equal([]string{"0000:01:00.0", "0000:02:00.0", "0000:03:00.0"}))
+			Expect(list(map[string]interface{}{"model": "h100"})).To(Equal([]string{"0000:01:00.0", "0000:02:00.0"}))
+			Expect(list(map[string]interface{}{"health": "Healthy"})).To(Equal([]string{"0000:01:00.0", "0000:03:00.0"}))
+			Expect(list(map[string]interface{}{"model": "H100", "allocated": false})).To(Equal([]string{"0000:02:00.0"}))
+
+			defer maintenance.update(map[string]MaintenanceReservation{})
+			maintenance.update(map[string]MaintenanceReservation{"3": {Job: "fw-flash"}})
+			Expect(list(map[string]interface{}{"maintenance": true})).To(Equal([]string{"0000:03:00.0"}))
+
+			_, err := list(map[string]interface{}{"allocated": "yes"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			_, err = list(map[string]interface{}{"serial": "1"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+
+		It("returns a single device by PCI address", func() {
+			get := func(address string) (*structpb.Struct, error) {
+				resp := &structpb.Struct{}
+				req := &structpb.Struct{Fields: map[string]*structpb.Value{"pciAddress": structpb.NewStringValue(address)}}
+				return resp, conn.Invoke(context.Background(), "/v1alpha1.DeviceAdmin/GetDevice", req, resp)
+			}
+			dev, err := get("0000:01:00.0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dev.Fields["allocatedTo"].GetStringValue()).To(Equal("default/vm/compute"))
+			Expect(dev.Fields["iommuGroup"].GetNumberValue()).To(BeEquivalentTo(1))
+
+			_, err = get("0000:ff:00.0")
+			Expect(status.Code(err)).To(Equal(codes.NotFound))
+			_, err = get("")
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+	})
+
+	Context("health agent API Tests", func() {
+		var dp *GenericDevicePlugin
+		var conn *grpc.ClientConn
+		var server *grpc.Server
+
+		BeforeEach(func() {
+			iommuMap = map[string][]NvidiaPCIDevice{
+				"1": {{Address: "0000:01:00.0", DeviceID: 0x2330, IommuGroup: 1}},
+			}
+			dp = NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{{ID: "1", Health: pluginapi.Healthy}})
+			m := newDevicePluginManager()
+			m.plugins["pgpu"] = dp
+
+			socketPath := filepath.Join(GinkgoT().TempDir(), "health.sock")
+			listener, err := net.Listen("unix", socketPath)
+			Expect(err).ToNot(HaveOccurred())
+			server = grpc.NewServer()
+			server.RegisterService(&healthAgentServiceDesc, &healthAgentServer{manager: m})
+			go server.Serve(listener)
+			conn, err = connect(socketPath, 5*time.Second)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			conn.Close()
+			server.Stop()
+			externalHealth = newExternalHealthSet()
+		})
+
+		report := func(source string, devs ...*pluginapi.Device) error {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), healthAgentSourceKey, source)
+			return conn.Invoke(ctx, "/v1alpha1.HealthAgent/ReportHealth", &pluginapi.ListAndWatchResponse{Devices: devs}, &pluginapi.Empty{})
+		}
+
+		It("keeps a device unhealthy while any agent reports it unhealthy", func() {
+			Expect(report("bmc", &pluginapi.Device{ID: "0000:01:00.0", Health: pluginapi.Unhealthy})).To(Succeed())
+			Expect(report("fabric", &pluginapi.Device{ID: "0000:01:00.0", Health: pluginapi.Healthy})).To(Succeed())
+			Expect(externalHealth.unhealthy("1")).To(BeTrue())
+			// the internal verdict is re-delivered and merged worst-of
+			Expect(dp.queue.drain()).To(Equal([]healthUpdate{{id: "1", health: pluginapi.Healthy}}))
+			go dp.deliverHealth("1", pluginapi.Healthy)
+			Eventually(dp.unhealthy).Should(Receive(Equal("1")))
+
+			Expect(report("bmc", &pluginapi.Device{ID: "0000:01:00.0"})).To(Succeed())
+			Expect(externalHealth.unhealthy("1")).To(BeFalse())
+			Expect(dp.queue.drain()).To(Equal([]healthUpdate{{id: "1", health: pluginapi.Healthy}}))
+			go dp.deliverHealth("1", pluginapi.Healthy)
+			Eventually(dp.healthy).Should(Receive(Equal("1")))
+		})
+
+		It("pins a flapping device unhealthy for a cool-down", func() {
+			defer func(threshold uint32) { clk, healthFlapThreshold = clock.RealClock{}, threshold }(healthFlapThreshold)
+			fake := clocktesting.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			clk = fake
+			healthFlapThreshold = 4
+
+			deliver := func(health string) string {
+				go dp.deliverHealth("1", health)
+				select {
+				case <-dp.healthy:
+					return pluginapi.Healthy
+				case <-dp.unhealthy:
+					return pluginapi.Unhealthy
+				case <-time.After(5 * time.Second):
+					return ""
+				}
+			}
+			Expect(deliver(pluginapi.Healthy)).To(Equal(pluginapi.Healthy))
+			Expect(deliver(pluginapi.Unhealthy)).To(Equal(pluginapi.Unhealthy))
+			Expect(deliver(pluginapi.Healthy)).To(Equal(pluginapi.Healthy))
+			Expect(deliver(pluginapi.Unhealthy)).To(Equal(pluginapi.Unhealthy))
+			// the fourth transition pins the device
+			Expect(deliver(pluginapi.Healthy)).To(Equal(pluginapi.Unhealthy))
+			Eventually(fake.HasWaiters).Should(BeTrue())
+			Expect(deliver(pluginapi.Healthy)).To(Equal(pluginapi.Unhealthy))
+
+			// the pin ends after the cool-down and the health is re-delivered
+			fake.Step(healthFlapCooldown - time.Second)
+			Expect(dp.queue.drain()).To(BeEmpty())
+			fake.Step(time.Second)
+			Eventually(dp.queue.drain).Should(Equal([]healthUpdate{{id: "1", health: pluginapi.Healthy}}))
+			Expect(deliver(pluginapi.Healthy)).To(Equal(pluginapi.Healthy))
+		})
+
+		It("does not override an internal unhealthy verdict", func() {
+			go dp.deliverHealth("1", pluginapi.Unhealthy)
+			Eventually(dp.unhealthy).Should(Receive(Equal("1")))
+			Expect(report("bmc", &pluginapi.Device{ID: "0000:01:00.0", Health: pluginapi.Healthy})).To(Succeed())
+			Expect(dp.queue.drain()).To(Equal([]healthUpdate{{id: "1", health: pluginapi.Unhealthy}}))
+		})
+
+		It("rejects invalid verdicts", func() {
+			err := report("bmc", &pluginapi.Device{ID: "01:00.0", Health: pluginapi.Unhealthy})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			err = report("bmc", &pluginapi.Device{ID: "0000:01:00.0", Health: "Degraded"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(externalHealth.unhealthy("1")).To(BeFalse())
+		})
+	})
+
+	Context("allocate metrics Tests", func() {
+		It("times the phases of allocations and counts SLO violations", func() {
+			defer func() { clk = clock.RealClock{} }()
+			fake := clocktesting.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			clk = fake
+
+			trace := newAllocateTrace()
+			fake.Step(300 * time.Millisecond)
+			trace.mark(allocatePhaseQueue)
+			fake.Step(time.Second)
+			trace.mark(allocatePhaseMapLookup)
+			fake.Step(100 * time.Millisecond)
+			trace.mark(allocatePhaseWake)
+			fake.Step(200 * time.Millisecond)
+			trace.mark(allocatePhaseMapLookup)
+			Expect(trace.String()).To(Equal("queue=300ms map-lookup=1.2s wake=100ms"))
+			Expect(trace.total()).To(Equal(1600 * time.Millisecond))
+
+			violations := func() float64 {
+				var m dto.Metric
+				Expect(allocateSLOViolations.WithLabelValues("nvidia.com/slo-test").Write(&m)).To(Succeed())
+				return m.GetCounter().GetValue()
+			}
+			observeAllocate("slo-test", []string{"1"}, trace)
+			Expect(violations()).To(Equal(1.0))
+			fast := newAllocateTrace()
+			fake.Step(10 * time.Millisecond)
+			observeAllocate("slo-test", []string{"1"}, fast)
+			Expect(violations()).To(Equal(1.0))
+
+			rec := httptest.NewRecorder()
+			metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(rec.Body.String()).To(ContainSubstring(`sandbox_device_plugin_allocate_duration_seconds_count{resource="nvidia.com/slo-test"} 2`))
+			Expect(rec.Body.String()).To(ContainSubstring(`sandbox_device_plugin_allocate_duration_seconds{resource="nvidia.com/slo-test",quantile="0.99"}`))
+		})
+	})
+
+	Context("power state Tests", func() {
+		var devPath string
+
+		BeforeEach(func() {
+			rootPath = GinkgoT().TempDir()
+			devPath = filepath.Join(rootPath, pciDevicesPath, "0000:01:00.0")
+			Expect(os.MkdirAll(filepath.Join(devPath, "power"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(devPath, "power", "control"), []byte("auto\n"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			rootPath = "/"
+		})
+
+		It("leaves awake devices alone", func() {
+			Expect(os.WriteFile(filepath.Join(devPath, "power_state"), []byte("D0\n"), 0644)).To(Succeed())
+			Expect(wakeDevice("0000:01:00.0", time.Second)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(devPath, "power", "control"))).To(Equal([]byte("auto\n")))
+		})
+
+		It("wakes devices in D3cold", func() {
+			Expect(os.WriteFile(filepath.Join(devPath, "power_state"), []byte("D3cold\n"), 0644)).To(Succeed())
+			err := wakeDevice("0000:01:00.0", 300*time.Millisecond)
+			Expect(err).To(MatchError(ContainSubstring("did not leave power state D3cold")))
+			Expect(os.ReadFile(filepath.Join(devPath, "power", "control"))).To(Equal([]byte("on")))
+
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(200 * time.Millisecond)
+				Expect(os.WriteFile(filepath.Join(devPath, "power_state"), []byte("D0\n"), 0644)).To(Succeed())
+			}()
+			Expect(wakeDevice("0000:01:00.0", 5*time.Second)).To(Succeed())
+		})
+
+		It("ignores kernels that do not report the power state", func() {
+			Expect(wakeDevice("0000:01:00.0", time.Second)).To(Succeed())
+		})
+	})
+
+	Context("vfio cdev discovery Tests", func() {
+		BeforeEach(func() {
+			rootPath = GinkgoT().TempDir()
+			origLib, origSource := nvpciLib, discoverySource
+			DeferCleanup(func() { rootPath, nvpciLib, discoverySource = "/", origLib, origSource })
+		})
+
+		cdev := func(name, address, vendor string, node bool) {
+			devPath := filepath.Join(rootPath, pciDevicesPath, address)
+			Expect(os.MkdirAll(devPath, 0755)).To(Succeed())
+			for attr, value := range map[string]string{"vendor": vendor, "device": "0x2330", "class": "0x030200", "numa_node": "1"} {
+				Expect(os.WriteFile(filepath.Join(devPath, attr), []byte(value+"\n"), 0644)).To(Succeed())
+			}
+			Expect(os.Symlink("/sys/bus/pci/drivers/vfio-pci", filepath.Join(devPath, "driver"))).To(Succeed())
+			Expect(os.Symlink("../../../kernel/iommu_groups/7", filepath.Join(devPath, "iommu_group"))).To(Succeed())
+			classPath := filepath.Join(rootPath, vfioDevClassPath, name)
+			Expect(os.MkdirAll(classPath, 0755)).To(Succeed())
+			Expect(os.Symlink(devPath, filepath.Join(classPath, "device"))).To(Succeed())
+			if node {
+				Expect(os.MkdirAll(filepath.Join(rootPath, vfioDevicePath, "devices"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(rootPath, vfioDevicePath, "devices", name), nil, 0644)).To(Succeed())
+			}
+		}
+
+		It("builds the devices from the vfio device cdevs", func() {
+			cdev("vfio0", "0000:01:00.0", "0x10de", true)
+			cdev("vfio1", "0000:02:00.0", "0x15b3", true)
+			cdev("vfio2", "0000:03:00.0", "0x10de", false)
+
+			devices, err := getVfioCdevDevices()
+			Expect(err).To(MatchError(ContainSubstring("vfio device vfio2: cdev of 0000:03:00.0 missing")))
+			Expect(devices).To(HaveLen(1))
+			dev := devices[0]
+			Expect(dev.Address).To(Equal("0000:01:00.0"))
+			Expect(dev.Device).To(Equal(uint16(0x2330)))
+			Expect(dev.IsGPU()).To(BeTrue())
+			Expect(dev.Driver).To(Equal("vfio-pci"))
+			Expect(dev.IommuGroup).To(Equal(7))
+			Expect(dev.IommuFD).To(Equal("vfio0"))
+			Expect(dev.NumaNode).To(Equal(1))
+		})
+
+		It("falls back to the vfio device cdevs when the PCI scan fails", func() {
+			cdev("vfio0", "0000:01:00.0", "0x10de", true)
+			nvpciLib = &nvpci.InterfaceMock{
+				GetAllDevicesFunc: func() ([]*nvpci.NvidiaPCIDevice, error) {
+					return nil, errors.New("unexpected sysfs layout")
+				},
+			}
+			discoverySource = discoverySourceNvpci
+			_, err := scanDevices()
+			Expect(err).To(HaveOccurred())
+			discoverySource = discoverySourceAuto
+			devices, err := scanDevices()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(devices).To(HaveLen(1))
+			Expect(devices[0].IommuFD).To(Equal("vfio0"))
+		})
+	})
+
+	Context("device clearing Tests", func() {
+		var cleared chan error
+
+		BeforeEach(func() {
+			origClear, origClearing := clearDevice, clearing
+			DeferCleanup(func() { clearDevice, clearing = origClear, origClearing })
+			clearing = &clearingSet{targets: make(map[string]*clearTarget)}
+			cleared = make(chan error)
+			clearDevice = func([]NvidiaPCIDevice) error { return <-cleared }
+		})
+
+		It("picks the reset by the reset methods of the functions", func() {
+			rootPath = GinkgoT().TempDir()
+			defer func() { rootPath = "/" }()
+			function := func(address, methods string) string {
+				devPath := filepath.Join(rootPath, pciDevicesPath, address)
+				Expect(os.MkdirAll(devPath, 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(devPath, "reset"), nil, 0644)).To(Succeed())
+				if methods != "" {
+					Expect(os.WriteFile(filepath.Join(devPath, "reset_method"), []byte(methods+"\n"), 0644)).To(Succeed())
+				}
+				return filepath.Join(devPath, "reset")
+			}
+			member := func(group, address, driver string) {
+				devPath := filepath.Join(rootPath, iommuGroupsPath, group, "devices", address)
+				Expect(os.MkdirAll(devPath, 0755)).To(Succeed())
+				if driver != "" {
+					Expect(os.Symlink("/sys/bus/pci/drivers/"+driver, filepath.Join(devPath, "driver"))).To(Succeed())
+				}
+			}
+
+			flr := function("0000:01:00.0", "flr bus")
+			Expect(readResetMethods("0000:01:00.0")).To(Equal([]string{"flr", "bus"}))
+			Expect(resetScope(readResetMethods("0000:01:00.0"))).To(Equal(resetScopeFunction))
+			Expect(resetScope(readResetMethods("0000:09:00.0"))).To(Equal(resetScopeNone))
+			Expect(resetFunctions([]NvidiaPCIDevice{{Address: "0000:01:00.0"}, {Address: "0000:09:00.0"}})).To(Succeed())
+			Expect(os.ReadFile(flr)).To(Equal([]byte("1")))
+
+			// functions reset with their bus only when nobody else is in the group
+			bus := function("0000:02:00.0", "bus")
+			member("5", "0000:00:01.0", "pcieport")
+			member("5", "0000:02:00.0", "vfio-pci")
+			member("5", "0000:02:00.1", "vfio-pci")
+			dev := NvidiaPCIDevice{Address: "0000:02:00.0", IommuGroup: 5}
+			Expect(resetFunctions([]NvidiaPCIDevice{dev})).To(MatchError(ContainSubstring("would also reset 0000:02:00.1")))
+			Expect(os.ReadFile(bus)).To(BeEmpty())
+			function("0000:02:00.1", "")
+			Expect(resetScope(readResetMethods("0000:02:00.1"))).To(Equal(resetScopeGroup))
+			Expect(resetFunctions([]NvidiaPCIDevice{dev, {Address: "0000:02:00.1", IommuGroup: 5}})).To(Succeed())
+			Expect(os.ReadFile(bus)).To(Equal([]byte("1")))
+		})
+
+		It("holds freed devices out of service until they are cleared", func() {
+			dp := NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{
+				{ID: "1", Health: pluginapi.Healthy}, {ID: "2", Health: pluginapi.Healthy},
+			})
+			plugins := []*GenericDevicePlugin{dp}
+			owner := deviceOwner{Namespace: "default", Pod: "vm", Container: "compute"}
+			other := deviceOwner{Namespace: "default", Pod: "vm2", Container: "compute"}
+			prev := map[string]deviceOwner{"nvidia.com/pgpu/1": owner, "nvidia.com/pgpu/2": owner}
+			cur := map[string]deviceOwner{"nvidia.com/pgpu/2": other}
+
+			clearFreed(plugins, prev, cur)
+			// device 2 was reallocated and must not be reset under its new owner
+			Expect(outOfService(iommuKeyForDeviceID("2"))).To(BeFalse())
+			Expect(outOfService(iommuKeyForDeviceID("1"))).To(BeTrue())
+			_, err := dp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"1"}}},
+			})
+			Expect(allocateErrorReason(err)).To(Equal(allocateReasonClearing))
+
+			cleared <- errors.New("scrub failed")
+			Eventually(clearing.failed).Should(HaveLen(1))
+			Expect(outOfService(iommuKeyForDeviceID("1"))).To(BeTrue())
+
+			clearFreed(plugins, cur, cur)
+			cleared <- nil
+			Eventually(func() bool { return clearing.contains(iommuKeyForDeviceID("1")) }).Should(BeFalse())
+		})
+	})
+
+	Context("device events API Tests", func() {
+		It("streams the lifecycle events of the devices", func() {
+			dp := NewGenericDevicePlugin("pgpu", "/dev/vfio/", []*pluginapi.Device{{ID: "1", Health: pluginapi.Healthy}})
+			m := newDevicePluginManager()
+			m.plugins["pgpu"] = dp
+
+			socketPath := filepath.Join(GinkgoT().TempDir(), "events.sock")
+			listener, err := net.Listen("unix", socketPath)
+			Expect(err).ToNot(HaveOccurred())
+			server := grpc.NewServer()
+			server.RegisterService(&deviceEventsServiceDesc, &deviceEventsServer{manager: m})
+			go server.Serve(listener)
+			defer server.Stop()
+			conn, err := connect(socketPath, 5*time.Second)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream, err := conn.NewStream(ctx, &deviceEventsServiceDesc.Streams[0], "/v1alpha1.DeviceEvents/Watch")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stream.SendMsg(&pluginapi.Empty{})).To(Succeed())
+			Expect(stream.CloseSend()).To(Succeed())
+			recv := func() map[string]interface{} {
+				event := &structpb.Struct{}
+				Expect(stream.RecvMsg(event)).To(Succeed())
+				fields := event.AsMap()
+				delete(fields, "time")
+				return fields
+			}
+
+			Expect(recv()).To(Equal(map[string]interface{}{
+				"type": "discovered", "resource": "nvidia.com/pgpu", "device": "1", "health": pluginapi.Healthy,
+			}))
+			dp.updateHealth("1", pluginapi.Unhealthy)
+			Expect(recv()).To(Equal(map[string]interface{}{
+				"type": "health", "resource": "nvidia.com/pgpu", "device": "1", "health": pluginapi.Unhealthy,
+			}))
+			owner := deviceOwner{Namespace: "default", Pod: "vm", Container: "compute"}
+			publishFreed(map[string]deviceOwner{"nvidia.com/pgpu/1": owner}, map[string]deviceOwner{})
+			Expect(recv()).To(Equal(map[string]interface{}{
+				"type": "freed", "resource": "nvidia.com/pgpu", "device": "1",
+				"namespace": "default", "pod": "vm", "container": "compute",
+			}))
+		})
+	})
+
+	Context("auxiliary TLS Tests", func() {
+		var dir string
+		var ca *x509.Certificate
+		var caKey *ecdsa.PrivateKey
+		var serial int64
+
+		// issue writes a certificate signed by the CA, self-signed when ca is nil
+		issue := func(name string, usage x509.ExtKeyUsage) (string, string) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serial++
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				Subject:      pkix.Name{CommonName: name},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+				IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			}
+			parent, signer := template, key
+			if ca == nil {
+				template.IsCA = true
+				template.BasicConstraintsValid = true
+				template.KeyUsage = x509.KeyUsageCertSign
+			} else {
+				parent, signer = ca, caKey
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+			Expect(err).ToNot(HaveOccurred())
+			if ca == nil {
+				ca, err = x509.ParseCertificate(der)
+				Expect(err).ToNot(HaveOccurred())
+				caKey = key
+			}
+			keyDER, err := x509.MarshalECPrivateKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			certFile := filepath.Join(dir, name+".crt")
+			keyFile := filepath.Join(dir, name+".key")
+			Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+			Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+			return certFile, keyFile
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "aux-tls")
+			Expect(err).ToNot(HaveOccurred())
+			ca, caKey = nil, nil
+			origTLS := auxTLS
+			DeferCleanup(func() {
+				auxTLS = origTLS
+				os.RemoveAll(dir)
+			})
+		})
+
+		It("authenticates clients and reloads a rotated certificate", func() {
+			caFile, _ := issue("ca", x509.ExtKeyUsageAny)
+			certFile, keyFile := issue("server", x509.ExtKeyUsageServerAuth)
+			clientCert, clientKey := issue("client", x509.ExtKeyUsageClientAuth)
+			auxTLS = newCertReloader(certFile, keyFile, caFile)
+			Expect(auxTLS.reload()).To(Succeed())
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			mux := http.NewServeMux()
+			mux.HandleFunc("/healthz", serveHealthz)
+			mux.Handle("/metrics", requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			server := &http.Server{Handler: mux}
+			go serveAuxHTTP(server, listener, tls.VerifyClientCertIfGiven)
+			defer server.Close()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca)
+			get := func(path string, certs ...tls.Certificate) (*http.Response, error) {
+				transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}
+				defer transport.CloseIdleConnections()
+				client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+				return client.Get("https://" + listener.Addr().String() + path)
+			}
+			pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := get("/healthz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			resp, err = get("/metrics")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			resp, err = get("/metrics", pair)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			served := resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+
+			// rotate the server certificate in place
+			issue("server", x509.ExtKeyUsageServerAuth)
+			later := time.Now().Add(time.Minute)
+			Expect(os.Chtimes(certFile, later, later)).To(Succeed())
+			resp, err = get("/metrics", pair)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.TLS.PeerCertificates[0].SerialNumber.Int64()).ToNot(Equal(served))
+		})
+
+		It("requires a client certificate on the gRPC APIs", func() {
+			caFile, _ := issue("ca", x509.ExtKeyUsageAny)
+			certFile, keyFile := issue("server", x509.ExtKeyUsageServerAuth)
+			auxTLS = newCertReloader(certFile, keyFile, caFile)
+			Expect(auxTLS.reload()).To(Succeed())
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			server := grpc.NewServer(auxGRPCServerOptions()...)
+			go server.Serve(listener)
+			defer server.Stop()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca)
+			conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, NextProtos: []string{"h2"}})
+			if err == nil {
+				// TLS 1.3 reports the rejected client certificate on the first read
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err = conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("serves plain text without a certificate", func() {
+			Expect(newCertReloader("", "", "ca.crt")).To(BeNil())
+			auxTLS = nil
+			Expect(auxGRPCServerOptions()).To(BeEmpty())
+			Expect(auxTLS.reload()).To(Succeed())
+		})
+	})
+
+	Context("node watcher Tests", func() {
+		It("merges the NodeFeature labels under the node labels", func() {
+			w := newNodeWatcher()
+			w.setNode(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"a": "node"}}})
+			feature := &unstructured.Unstructured{Object: map[string]interface{}{
+				"metadata": map[string]interface{}{"namespace": "nfd", "name": "node1"},
+				"spec":     map[string]interface{}{"labels": map[string]interface{}{"a": "feature", "b": "feature"}},
+			}}
+			key, labels, ok := nodeFeatureLabels(cache.DeletedFinalStateUnknown{Obj: feature})
+			Expect(ok).To(BeTrue())
+			Expect(key).To(Equal("nfd/node1"))
+			w.setFeature(key, labels)
+
+			merged, _ := w.labels()
+			Expect(merged).To(Equal(map[string]string{"a": "node", "b": "feature"}))
+			w.setFeature(key, nil)
+			merged, _ = w.labels()
+			Expect(merged).To(Equal(map[string]string{"a": "node"}))
+		})
+
+		It("wakes label waiters on changes", func() {
+			w := newNodeWatcher()
+			ready := func(labels map[string]string) bool {
+				return labels[kataRuntimeLabelKey] == kataRuntimeLabelValue
+			}
+			done := make(chan error)
+			go func() { done <- w.waitForLabels(context.Background(), ready) }()
+			w.setNode(&corev1.Node{})
+			Consistently(done).ShouldNot(Receive())
+			w.setFeature("nfd/node1", map[string]string{kataRuntimeLabelKey: kataRuntimeLabelValue})
+			Eventually(done).Should(Receive(BeNil()))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(w.waitForLabels(ctx, func(map[string]string) bool { return false })).To(MatchError(context.Canceled))
+		})
+
+		It("requires the kata runtime label and RuntimeClass", func() {
+			kata := map[string]string{kataRuntimeLabelKey: kataRuntimeLabelValue}
+			Expect(kataRuntimeError(map[string]string{}, map[string]bool{defaultRuntimeClass: true})).To(
+				MatchError(ContainSubstring("node label " + kataRuntimeLabelKey)))
+			Expect(kataRuntimeError(kata, map[string]bool{})).To(
+				MatchError("RuntimeClass " + defaultRuntimeClass + " does not exist"))
+			Expect(kataRuntimeError(kata, map[string]bool{defaultRuntimeClass: true})).To(Succeed())
+
+			cond := kataRuntimeCondition(errors.New("RuntimeClass kata does not exist"), time.Now())
+			Expect(cond.Type).To(Equal(kataRuntimeDegradedCondition))
+			Expect(cond.Status).To(Equal(corev1.ConditionTrue))
+			Expect(cond.Message).To(ContainSubstring("RuntimeClass kata does not exist"))
+			Expect(kataRuntimeCondition(nil, time.Now()).Status).To(Equal(corev1.ConditionFalse))
+		})
+
+		It("wakes kata runtime waiters on RuntimeClass changes", func() {
+			k := &kataRuntimeWatch{node: newNodeWatcher(), classes: newRuntimeClassWatcher()}
+			k.node.setNode(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{kataRuntimeLabelKey: kataRuntimeLabelValue}}})
+			done := make(chan error)
+			go func() { done <- k.wait(context.Background()) }()
+			Consistently(done).ShouldNot(Receive())
+
+			name, ok := runtimeClassName(cache.DeletedFinalStateUnknown{Obj: &nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: defaultRuntimeClass}}})
+			Expect(ok).To(BeTrue())
+			k.classes.set(name, true)
+			Eventually(done).Should(Receive(BeNil()))
+
+			notReady, _, changed := k.status()
+			Expect(notReady).ToNot(HaveOccurred())
+			k.classes.set(defaultRuntimeClass, false)
+			Expect(changed).To(BeClosed())
+			notReady, _, _ = k.status()
+			Expect(notReady).To(MatchError("RuntimeClass " + defaultRuntimeClass + " does not exist"))
+		})
+	})
+
+	Context("device failure cordon Tests", func() {
+		var node *corev1.Node
+		var patches []string
+		var clientset kubernetes.Interface
+
+		BeforeEach(func() {
+			node = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+			patches = nil
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPatch {
+					body, _ := io.ReadAll(r.Body)
+					patches = append(patches, string(body))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(node)
+			}))
+			DeferCleanup(server.Close)
+			var err error
+			clientset, err = kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("cordons the node and uncordons it once the devices recover", func() {
+			Expect(setDeviceFailureCordon(clientset, "node1", true, []string{"pgpu"})).To(Succeed())
+			Expect(patches).To(HaveLen(1))
+			Expect(patches[0]).To(ContainSubstring(`"unschedulable":true`))
+
+			node.Spec.Unschedulable = true
+			node.Annotations = map[string]string{cordonedAnnotation: "true"}
+			Expect(setDeviceFailureCordon(clientset, "node1", false, nil)).To(Succeed())
+			Expect(patches).To(HaveLen(2))
+			Expect(patches[1]).To(ContainSubstring(`"unschedulable":false`))
+		})
+
+		It("leaves a node cordoned by an administrator alone", func() {
+			node.Spec.Unschedulable = true
+			Expect(setDeviceFailureCordon(clientset, "node1", true, []string{"pgpu"})).To(Succeed())
+			Expect(setDeviceFailureCordon(clientset, "node1", false, nil)).To(Succeed())
+			Expect(patches).To(BeEmpty())
+		})
+	})
 })
@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// disabledDevicesAnnotation lists PCI addresses, comma separated, that an
+	// admin has taken out of service on the node
+	disabledDevicesAnnotation = "nvidia.com/sandbox-device-plugin.disabled-devices"
+
+	defaultDisabledDevicesInterval = 30 * time.Second
+)
+
+// disabledDeviceSet holds the IOMMU keys of administratively disabled devices
+type disabledDeviceSet struct {
+	lock sync.RWMutex
+	keys map[string]bool
+}
+
+var disabledDevices = &disabledDeviceSet{keys: make(map[string]bool)}
+
+// contains returns true if the device with the IOMMU key is disabled
+func (d *disabledDeviceSet) contains(iommuKey string) bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.keys[iommuKey]
+}
+
+// update replaces the disabled devices and returns the keys that were newly
+// disabled and re-enabled
+func (d *disabledDeviceSet) update(keys map[string]bool) (disabled, enabled []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key := range keys {
+		if !d.keys[key] {
+			disabled = append(disabled, key)
+		}
+	}
+	for key := range d.keys {
+		if !keys[key] {
+			enabled = append(enabled, key)
+		}
+	}
+	d.keys = keys
+	sort.Strings(disabled)
+	sort.Strings(enabled)
+	return disabled, enabled
+}
+
+// disabledIommuKeys maps the PCI addresses of the annotation to the IOMMU keys
+// of the discovered devices. A key is disabled if any of its functions is.
+func disabledIommuKeys(annotation string) map[string]bool {
+	addresses := make(map[string]bool)
+	for _, address := range strings.Split(annotation, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses[address] = true
+		}
+	}
+	keys := make(map[string]bool)
+	for iommuKey, devs := range iommuMap {
+		for _, dev := range devs {
+			if addresses[dev.Address] {
+				keys[iommuKey] = true
+			}
+		}
+	}
+	return keys
+}
+
+// applyDisabledDevices marks newly disabled devices unhealthy and re-enabled
+// devices healthy once they pass the recovery probe, and returns a
+// description of each change
+func applyDisabledDevices(plugins []*GenericDevicePlugin, annotation string) []string {
+	disabled, enabled := disabledDevices.update(disabledIommuKeys(annotation))
+	var changes []string
+	for _, dp := range plugins {
+		for _, dev := range dp.devs {
+			iommuKey := iommuKeyForDeviceID(dev.ID)
+			for _, key := range disabled {
+				if key == iommuKey {
+					dp.setHealth(dev.ID, pluginapi.Unhealthy)
+					changes = append(changes, fmt.Sprintf("Device %s of %s/%s disabled by administrator", dev.ID, DeviceNamespace, dp.deviceName))
+				}
+			}
+			for _, key := range enabled {
+				if key == iommuKey {
+					dp.reprobeHealth(dev.ID)
+					changes = append(changes, fmt.Sprintf("Device %s of %s/%s re-enabled by administrator", dev.ID, DeviceNamespace, dp.deviceName))
+				}
+			}
+		}
+	}
+	return changes
+}
+
+// emitNodeEvent records an event on the node
+func emitNodeEvent(clientset kubernetes.Interface, nodeName, eventType, reason, message string) error {
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: nodeName + ".",
+			Namespace:    metav1.NamespaceDefault,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: "nvidia-sandbox-device-plugin", Host: nodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+	_, err := clientset.CoreV1().Events(metav1.NamespaceDefault).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// runDisabledDeviceWatcher applies the disabled devices and maintenance
+// annotations of the watched node to the plugins of the manager whenever the
+// node changes, and periodically for plugins recreated by a reload, until the
+// daemon context is canceled
+func runDisabledDeviceWatcher(m *DevicePluginManager) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		log.Printf("NODE_NAME is not set, administrative device disabling is not available")
+		return
+	}
+	w, err := watchNode(nodeName)
+	if err != nil {
+		log.Printf("Error watching node %s for disabled devices: %v", nodeName, err)
+		return
+	}
+
+	ticker := time.NewTicker(getEnvDuration("DISABLED_DEVICES_INTERVAL", defaultDisabledDevicesInterval))
+	defer ticker.Stop()
+	for {
+		node, changed := w.current()
+		if node != nil {
+			for _, change := range applyDisabledDevices(m.Plugins(), node.Annotations[disabledDevicesAnnotation]) {
+				log.Print(change)
+				events.normal("DeviceAdministrativeState", change)
+			}
+			for _, change := range applyMaintenance(m.Plugins(), node.Annotations[maintenanceAnnotation]) {
+				log.Print(change)
+				events.normal("DeviceMaintenance", change)
+			}
+		}
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
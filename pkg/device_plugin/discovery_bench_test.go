@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+)
+
+// quietNvpciLogger drops the warnings of nvpci, e.g. for functions without a
+// vfio cdev
+type quietNvpciLogger struct{}
+
+func (quietNvpciLogger) Warningf(string, ...interface{}) {}
+
+// fakePCIFunction is a PCI function of the fake sysfs tree
+type fakePCIFunction struct {
+	address string
+	vendor  uint16
+	device  uint16
+	class   uint32
+	driver  string
+	group   int
+	physfn  string
+	numVFs  int
+}
+
+// writeLargeNodeSysfs writes the sysfs tree of a large node below root: 8
+// GPUs and 4 NVSwitches bound to vfio-pci, 4 NICs with 32 VFs each and 100
+// bridges, each function in an IOMMU group of its own
+func writeLargeNodeSysfs(tb testing.TB, root string) {
+	var functions []fakePCIFunction
+	group := 0
+	add := func(bus, fn int, f fakePCIFunction) {
+		f.address = fmt.Sprintf("0000:%02x:%02x.%d", bus, fn/8, fn%8)
+		f.group = group
+		group++
+		functions = append(functions, f)
+	}
+	for i := 0; i < 8; i++ {
+		add(0x10+i, 0, fakePCIFunction{vendor: 0x10de, device: 0x2330, class: 0x030200, driver: "vfio-pci"})
+	}
+	for i := 0; i < 4; i++ {
+		add(0x20+i, 0, fakePCIFunction{vendor: 0x10de, device: 0x22a3, class: 0x068000, driver: "vfio-pci"})
+	}
+	for i := 0; i < 4; i++ {
+		add(0x30+i, 0, fakePCIFunction{vendor: 0x15b3, device: 0x101d, class: 0x020000, driver: "mlx5_core", numVFs: 32})
+		pf := functions[len(functions)-1].address
+		for vf := 1; vf <= 32; vf++ {
+			add(0x30+i, vf, fakePCIFunction{vendor: 0x15b3, device: 0x101e, class: 0x020000, driver: "mlx5_core", physfn: pf})
+		}
+	}
+	for i := 0; i < 100; i++ {
+		add(0x80+i, 0, fakePCIFunction{vendor: 0x8086, device: 0x2030, class: 0x060400, driver: "pcieport"})
+	}
+
+	write := func(path, data string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	link := func(target, path string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for _, driver := range []string{"vfio-pci", "mlx5_core", "pcieport"} {
+		if err := os.MkdirAll(filepath.Join(root, "sys/bus/pci/drivers", driver), 0755); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	resource := "0x00000000fa000000 0x00000000faffffff 0x0000000000040200\n" +
+		"0x0000020000000000 0x00000207ffffffff 0x000000000014220c\n"
+	for i, f := range functions {
+		devPath := filepath.Join(root, "sys/devices", fmt.Sprintf("pci%s", f.address[:7]), f.address)
+		write(filepath.Join(devPath, "vendor"), fmt.Sprintf("0x%04x\n", f.vendor))
+		write(filepath.Join(devPath, "device"), fmt.Sprintf("0x%04x\n", f.device))
+		write(filepath.Join(devPath, "class"), fmt.Sprintf("0x%06x\n", f.class))
+		write(filepath.Join(devPath, "numa_node"), strconv.Itoa(i%2)+"\n")
+		write(filepath.Join(devPath, "resource"), resource)
+		write(filepath.Join(devPath, "config"), string(make([]byte, 256)))
+		write(filepath.Join(devPath, "reset_method"), "flr bus\n")
+		write(filepath.Join(devPath, "reset"), "")
+		if f.numVFs > 0 {
+			write(filepath.Join(devPath, "sriov_totalvfs"), strconv.Itoa(f.numVFs)+"\n")
+			write(filepath.Join(devPath, "sriov_numvfs"), strconv.Itoa(f.numVFs)+"\n")
+		}
+		if f.physfn != "" {
+			link(filepath.Join(root, pciDevicesPath, f.physfn), filepath.Join(devPath, "physfn"))
+		}
+		if f.driver == "vfio-pci" {
+			if err := os.MkdirAll(filepath.Join(devPath, "vfio-dev", fmt.Sprintf("vfio%d", i)), 0755); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		groupPath := filepath.Join(root, iommuGroupsPath, strconv.Itoa(f.group))
+		link(filepath.Join(root, "sys/bus/pci/drivers", f.driver), filepath.Join(devPath, "driver"))
+		link(groupPath, filepath.Join(devPath, "iommu_group"))
+		link(devPath, filepath.Join(groupPath, "devices", f.address))
+		link(devPath, filepath.Join(root, pciDevicesPath, f.address))
+	}
+}
+
+// setupLargeNodeDiscovery points the discovery at the sysfs tree of a large
+// node, restoring the globals when the benchmark ends
+func setupLargeNodeDiscovery(b *testing.B) {
+	root := b.TempDir()
+	writeLargeNodeSysfs(b, root)
+
+	oldRoot, oldLib, oldCache := rootPath, nvpciLib, discoveryCache
+	rootPath = root
+	nvpciLib = nvpci.New(nvpci.WithPCIDevicesRoot(filepath.Join(root, pciDevicesPath)), nvpci.WithLogger(quietNvpciLogger{}))
+	log.SetOutput(io.Discard)
+	sysfsSnapshots.reset()
+	b.Cleanup(func() {
+		rootPath, nvpciLib, discoveryCache = oldRoot, oldLib, oldCache
+		log.SetOutput(os.Stderr)
+		sysfsSnapshots.reset()
+	})
+}
+
+// BenchmarkDiscovery measures a rescan of a node with 8 GPUs, 4 NVSwitches
+// and 128 NIC VFs, reading sysfs on every pass or reusing the snapshot of an
+// unchanged PCI bus
+func BenchmarkDiscovery(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%v", cached), func(b *testing.B) {
+			setupLargeNodeDiscovery(b)
+			discoveryCache = cached
+			if err := createIommuDeviceMap(); err != nil {
+				b.Fatal(err)
+			}
+			if len(iommuMap) != 12 {
+				b.Fatalf("discovered %d devices, expected 12", len(iommuMap))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := createIommuDeviceMap(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPCIBusFingerprint measures the check of whether the PCI bus of a
+// large node changed since the last discovery
+func BenchmarkPCIBusFingerprint(b *testing.B) {
+	setupLargeNodeDiscovery(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pciBusFingerprint(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
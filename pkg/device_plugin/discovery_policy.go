@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+)
+
+const (
+	// discoveryDegrade advertises the devices that were discovered despite
+	// errors and reports the errors on /healthz
+	discoveryDegrade = "degrade"
+	// discoveryFailFast exits on discovery errors so that the pod restarts
+	discoveryFailFast = "fail-fast"
+)
+
+// discoveryErrorPolicy selects how device discovery errors are handled
+var discoveryErrorPolicy = getEnvString("DISCOVERY_ERROR_POLICY", discoveryDegrade)
+
+// discoveryStatus holds the error of the last device discovery
+type discoveryStatus struct {
+	lock sync.Mutex
+	err  error
+}
+
+var discoveryState = &discoveryStatus{}
+
+func (s *discoveryStatus) set(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+}
+
+func (s *discoveryStatus) get() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// exitOnDiscoveryError ends the process; replaced in tests
+var exitOnDiscoveryError = func(err error) {
+	log.Fatalf("Device discovery failed with DISCOVERY_ERROR_POLICY=%s: %v", discoveryFailFast, err)
+}
+
+// checkDiscoveryError returns the error of the last discovery when it must
+// stop the plugin, and logs it otherwise
+func checkDiscoveryError() error {
+	err := discoveryState.get()
+	if err == nil {
+		return nil
+	}
+	switch discoveryErrorPolicy {
+	case discoveryFailFast:
+		return err
+	case discoveryDegrade:
+	default:
+		log.Printf("Unknown DISCOVERY_ERROR_POLICY %q, using %s", discoveryErrorPolicy, discoveryDegrade)
+	}
+	log.Printf("Advertising the devices discovered despite errors: %v", err)
+	return nil
+}
+
+// getAllDevices returns the NVIDIA PCI devices. When the bus cannot be read
+// in one pass, the degrade policy reads the devices one by one, so that a
+// single unreadable device does not hide the others; the errors are returned
+// along with the devices that were read. Enumerating the vfio device cdevs
+// returns the devices that were read along with the errors as well.
+func getAllDevices() ([]*nvpci.NvidiaPCIDevice, error) {
+	devices, err := scanDevices()
+	if err == nil || discoveryErrorPolicy == discoveryFailFast || discoverySource != discoverySourceNvpci {
+		return devices, err
+	}
+	log.Printf("Error discovering NVIDIA devices: %v, discovering them one by one", err)
+	entries, dirErr := fsys.ReadDir(filepath.Join(rootPath, pciDevicesPath))
+	if dirErr != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, entry := range entries {
+		dev, devErr := nvpciLib.GetGPUByPciBusID(entry.Name())
+		if devErr != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", entry.Name(), devErr))
+			continue
+		}
+		if dev != nil {
+			devices = append(devices, dev)
+		}
+	}
+	return devices, errors.Join(errs...)
+}
+
+// serveHealthz reports the error of the last device discovery. Discovery
+// errors do not fail the check, since the discovered devices keep being
+// served under the degrade policy.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := discoveryState.get(); err != nil {
+		fmt.Fprintf(w, "[-]discovery degraded: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "[+]discovery ok\n")
+	}
+	fmt.Fprintf(w, "healthz check passed\n")
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// eventQueueSize bounds the events waiting to be sent, so that recording an
+// event never blocks device plugin operations when the API is slow
+const eventQueueSize = 128
+
+// nodeEvent is an event to be recorded on the node
+type nodeEvent struct {
+	eventType string
+	reason    string
+	message   string
+}
+
+// eventRecorder records lifecycle milestones as events on the node, so that
+// kubectl describe node gives operators a timeline of the plugin
+type eventRecorder struct {
+	queue chan nodeEvent
+}
+
+// events records the lifecycle events of the device plugin
+var events = newEventRecorder()
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{queue: make(chan nodeEvent, eventQueueSize)}
+}
+
+// record queues an event, dropping it when the queue is full
+func (r *eventRecorder) record(eventType, reason, message string) {
+	select {
+	case r.queue <- nodeEvent{eventType: eventType, reason: reason, message: message}:
+	default:
+		log.Printf("Dropping event %s: %s", reason, message)
+	}
+}
+
+// normal queues an event of type Normal
+func (r *eventRecorder) normal(reason, message string) {
+	r.record(corev1.EventTypeNormal, reason, message)
+}
+
+// warning queues an event of type Warning
+func (r *eventRecorder) warning(reason, message string) {
+	r.record(corev1.EventTypeWarning, reason, message)
+}
+
+// run sends the queued events until the daemon context is canceled
+func (r *eventRecorder) run(send func(nodeEvent) error) {
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case event := <-r.queue:
+			if err := send(event); err != nil {
+				log.Printf("Error emitting event %s: %v", event.reason, err)
+			}
+		}
+	}
+}
+
+// runEventRecorder sends the lifecycle events to the API server
+func runEventRecorder() {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		log.Printf("NODE_NAME is not set, not emitting events")
+		return
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		log.Printf("Error authenticating for events: %v", err)
+		return
+	}
+	events.run(func(event nodeEvent) error {
+		return emitNodeEvent(clientset, nodeName, event.eventType, event.reason, event.message)
+	})
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const defaultFabricManagerCheckInterval = 30 * time.Second
+
+var (
+	// fabricManagerReadyFile is a host file whose presence indicates that
+	// the fabric manager has set up the NVSwitch fabric
+	fabricManagerReadyFile = getEnvString("FABRIC_MANAGER_READY_FILE", "")
+	// fabricManagerReadyURL is an HTTP endpoint answering with a 2xx status
+	// while the fabric is ready
+	fabricManagerReadyURL = getEnvString("FABRIC_MANAGER_READY_URL", "")
+)
+
+// fabricManagerReady records whether the fabric manager reported readiness
+var fabricManagerReady atomic.Bool
+
+// requireFabricManager returns true if a fabric manager readiness indicator
+// is configured
+func requireFabricManager() bool {
+	return fabricManagerReadyFile != "" || fabricManagerReadyURL != ""
+}
+
+// fabricGated returns true while the NVSwitch with the IOMMU key must be held
+// unhealthy because the fabric manager is not ready. The guest needs the full
+// switch set with a configured fabric, so no switch is advertised before.
+func fabricGated(iommuKey string) bool {
+	return requireFabricManager() && !fabricManagerReady.Load() && isNVSwitchIommuKey(iommuKey)
+}
+
+// fabricHTTPClient queries the readiness URL
+var fabricHTTPClient = &http.Client{Timeout: connectionTimeout}
+
+// checkFabricManager returns nil if every configured readiness indicator
+// reports the fabric ready
+func checkFabricManager() error {
+	if fabricManagerReadyFile != "" {
+		path := filepath.Join(rootPath, fabricManagerReadyFile)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("readiness file %s not found: %w", fabricManagerReadyFile, err)
+		}
+	}
+	if fabricManagerReadyURL != "" {
+		resp, err := fabricHTTPClient.Get(fabricManagerReadyURL)
+		if err != nil {
+			return fmt.Errorf("error querying %s: %w", fabricManagerReadyURL, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("%s answered %s", fabricManagerReadyURL, resp.Status)
+		}
+	}
+	return nil
+}
+
+// applyFabricGate records the fabric manager readiness and, when it changed,
+// marks the NVSwitches healthy or unhealthy accordingly. It returns true if
+// the readiness changed.
+func applyFabricGate(plugins []*GenericDevicePlugin, ready bool) bool {
+	if fabricManagerReady.Swap(ready) == ready {
+		return false
+	}
+	health := pluginapi.Unhealthy
+	if ready {
+		health = pluginapi.Healthy
+	}
+	for _, dp := range plugins {
+		for _, dev := range dp.devs {
+			if isNVSwitchIommuKey(iommuKeyForDeviceID(dev.ID)) {
+				dp.setHealth(dev.ID, health)
+			}
+		}
+	}
+	return true
+}
+
+// isNVSwitchIommuKey returns true if the IOMMU key holds an NVSwitch
+func isNVSwitchIommuKey(iommuKey string) bool {
+	for _, dev := range iommuMap[iommuKey] {
+		if dev.IsNVSwitch {
+			return true
+		}
+	}
+	return false
+}
+
+// runFabricManagerGate polls the fabric manager readiness indicators and
+// opens or closes the gate on the NVSwitches of the manager until the daemon
+// context is canceled
+func runFabricManagerGate(m *DevicePluginManager) {
+	if !requireFabricManager() || len(nvSwitchDeviceIDs) == 0 {
+		return
+	}
+	ticker := time.NewTicker(getEnvDuration("FABRIC_MANAGER_CHECK_INTERVAL", defaultFabricManagerCheckInterval))
+	defer ticker.Stop()
+	for {
+		err := checkFabricManager()
+		if applyFabricGate(m.Plugins(), err == nil) {
+			if err == nil {
+				log.Printf("Fabric manager is ready, advertising NVSwitches as healthy")
+				events.normal("FabricManagerReady", "Fabric manager is ready, NVSwitches are advertised")
+			} else {
+				log.Printf("Fabric manager is not ready, advertising NVSwitches as unhealthy: %v", err)
+				events.warning("FabricManagerNotReady", fmt.Sprintf("NVSwitches are held unhealthy: %v", err))
+			}
+		} else if err != nil {
+			log.Printf("Waiting for the fabric manager: %v", err)
+		}
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,325 @@
+/*
+ * Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// memFS is an in-memory fileSystem for tests
+type memFS struct {
+	lock  sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	// links maps symlinks to their targets
+	links map[string]string
+	// synced lists the paths flushed with Sync
+	synced []string
+}
+
+func newMemFS() *memFS {
+	return &memFS{
+		files: make(map[string][]byte),
+		dirs:  map[string]bool{"/": true},
+		links: make(map[string]string),
+	}
+}
+
+// memFileInfo describes a file or directory of a memFS
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+func (i memFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) stat(name string) (os.FileInfo, bool) {
+	name = filepath.Clean(name)
+	if data, ok := m.files[name]; ok {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(data))}, true
+	}
+	if m.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, true
+	}
+	return nil, false
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if info, ok := m.stat(name); ok {
+		return info, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = filepath.Clean(name)
+	if !m.dirs[name] {
+		return nil, notExist("readdir", name)
+	}
+	var entries []os.DirEntry
+	for path := range m.files {
+		if filepath.Dir(path) == name {
+			info, _ := m.stat(path)
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+	}
+	for path := range m.dirs {
+		if path != name && filepath.Dir(path) == name {
+			info, _ := m.stat(path)
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (m *memFS) Readlink(name string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	target, ok := m.links[filepath.Clean(name)]
+	if !ok {
+		return "", notExist("readlink", name)
+	}
+	return target, nil
+}
+
+// Symlink creates the symlink name pointing to target
+func (m *memFS) Symlink(target, name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.links[filepath.Clean(name)] = target
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = filepath.Clean(name)
+	if !m.dirs[filepath.Dir(name)] {
+		return notExist("open", name)
+	}
+	m.files[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for path = filepath.Clean(path); !m.dirs[path]; path = filepath.Dir(path) {
+		m.dirs[path] = true
+	}
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.files[filepath.Clean(oldpath)]
+	if !ok {
+		return notExist("rename", oldpath)
+	}
+	delete(m.files, filepath.Clean(oldpath))
+	m.files[filepath.Clean(newpath)] = data
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if m.dirs[name] {
+		delete(m.dirs, name)
+		return nil
+	}
+	return notExist("remove", name)
+}
+
+func (m *memFS) Sync(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.stat(name); !ok {
+		return notExist("sync", name)
+	}
+	m.synced = append(m.synced, filepath.Clean(name))
+	return nil
+}
+
+// shortWriteFS is a memFS whose writes only store the first half of the data,
+// like a write interrupted by a crash
+type shortWriteFS struct {
+	*memFS
+}
+
+func (m shortWriteFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return m.memFS.WriteFile(name, data[:len(data)/2], perm)
+}
+
+// fakeLeases is an in-memory LeaseInterface supporting Get, Create and Update
+// with resource version conflicts
+type fakeLeases struct {
+	coordinationv1client.LeaseInterface
+	lock    sync.Mutex
+	leases  map[string]*coordinationv1.Lease
+	version int
+}
+
+func newFakeLeases() *fakeLeases {
+	return &fakeLeases{leases: make(map[string]*coordinationv1.Lease)}
+}
+
+var leaseResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+
+func (f *fakeLeases) Get(_ context.Context, name string, _ metav1.GetOptions) (*coordinationv1.Lease, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	lease, ok := f.leases[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leaseResource, name)
+	}
+	return lease.DeepCopy(), nil
+}
+
+func (f *fakeLeases) Create(_ context.Context, lease *coordinationv1.Lease, _ metav1.CreateOptions) (*coordinationv1.Lease, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.leases[lease.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(leaseResource, lease.Name)
+	}
+	return f.store(lease), nil
+}
+
+func (f *fakeLeases) Update(_ context.Context, lease *coordinationv1.Lease, _ metav1.UpdateOptions) (*coordinationv1.Lease, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	existing, ok := f.leases[lease.Name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leaseResource, lease.Name)
+	}
+	if existing.ResourceVersion != lease.ResourceVersion {
+		return nil, apierrors.NewConflict(leaseResource, lease.Name, nil)
+	}
+	return f.store(lease), nil
+}
+
+func (f *fakeLeases) store(lease *coordinationv1.Lease) *coordinationv1.Lease {
+	f.version++
+	lease = lease.DeepCopy()
+	lease.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Name] = lease
+	return lease.DeepCopy()
+}
+
+// fakeKubelet serves the kubelet registration service and connects to the
+// device plugins registered with it, like the kubelet device manager does
+type fakeKubelet struct {
+	server   *grpc.Server
+	requests chan *pluginapi.RegisterRequest
+}
+
+func startFakeKubelet(socketPath string) (*fakeKubelet, error) {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	k := &fakeKubelet{
+		server:   grpc.NewServer(),
+		requests: make(chan *pluginapi.RegisterRequest, 16),
+	}
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(listener)
+	return k, nil
+}
+
+func (k *fakeKubelet) Register(_ context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.requests <- req
+	return &pluginapi.Empty{}, nil
+}
+
+// stop stops serving and removes the registration socket
+func (k *fakeKubelet) stop() {
+	k.server.Stop()
+}
+
+// dial connects to the endpoint of a registration request, which is relative
+// to the device plugin directory
+func (k *fakeKubelet) dial(req *pluginapi.RegisterRequest) (pluginapi.DevicePluginClient, *grpc.ClientConn, error) {
+	conn, err := connect(filepath.Join(devicePluginDir, req.Endpoint), 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pluginapi.NewDevicePluginClient(conn), conn, nil
+}
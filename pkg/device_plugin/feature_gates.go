@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Feature is the name of an optional behavior of the device plugin
+type Feature string
+
+const (
+	// IOMMUFD advertises and allocates iommufd character devices when the
+	// host supports them, instead of legacy VFIO group devices
+	IOMMUFD Feature = "IOMMUFD"
+	// CDIInAllocate returns the fully qualified CDI device names in the
+	// allocate response, for runtimes that consume CDI from the kubelet
+	CDIInAllocate Feature = "CDIInAllocate"
+	// CDIAnnotations adds cdi.k8s.io/ annotations naming the allocated CDI
+	// devices to the allocate response, for runtimes that consume CDI from
+	// container annotations
+	CDIAnnotations Feature = "CDIAnnotations"
+	// IOMMUFDAnnotations adds annotations announcing the iommufd mode and
+	// the allocated iommufd device paths to the allocate response, for Kata
+	// versions that need them to select the guest vfio cdev hotplug path
+	IOMMUFDAnnotations Feature = "IOMMUFDAnnotations"
+)
+
+// featureStage is the maturity of a feature
+type featureStage string
+
+const (
+	alpha featureStage = "ALPHA"
+	beta  featureStage = "BETA"
+	ga    featureStage = "GA"
+)
+
+// featureSpec is the default state and maturity of a feature
+type featureSpec struct {
+	Default bool
+	Stage   featureStage
+}
+
+// defaultFeatureGates is the central registry of known features
+var defaultFeatureGates = map[Feature]featureSpec{
+	IOMMUFD:            {Default: true, Stage: beta},
+	CDIInAllocate:      {Default: false, Stage: alpha},
+	CDIAnnotations:     {Default: false, Stage: alpha},
+	IOMMUFDAnnotations: {Default: false, Stage: alpha},
+}
+
+// featureGates holds the enabled state of the known features
+type featureGates struct {
+	lock    sync.RWMutex
+	known   map[Feature]featureSpec
+	enabled map[Feature]bool
+}
+
+var gates = newFeatureGates(defaultFeatureGates)
+
+func newFeatureGates(known map[Feature]featureSpec) *featureGates {
+	g := &featureGates{
+		known:   known,
+		enabled: make(map[Feature]bool, len(known)),
+	}
+	for feature, spec := range known {
+		g.enabled[feature] = spec.Default
+	}
+	return g
+}
+
+// Set parses a comma separated list of Feature=bool pairs, e.g.
+// "IOMMUFD=false,CDIInAllocate=true". Nothing is changed if any pair is invalid.
+func (g *featureGates) Set(value string) error {
+	updates := make(map[Feature]bool)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, enabled, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("missing bool value for feature gate %q", pair)
+		}
+		feature := Feature(strings.TrimSpace(name))
+		if _, ok := g.known[feature]; !ok {
+			return fmt.Errorf("unknown feature gate %q (known: %s)", feature, g.knownNames())
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(enabled))
+		if err != nil {
+			return fmt.Errorf("invalid value %q for feature gate %s: %w", enabled, feature, err)
+		}
+		updates[feature] = b
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for feature, enabled := range updates {
+		g.enabled[feature] = enabled
+	}
+	return nil
+}
+
+// Enabled returns whether the feature is enabled
+func (g *featureGates) Enabled(feature Feature) bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.enabled[feature]
+}
+
+// setEnabled enables or disables a feature and returns a function restoring
+// the previous state, for tests
+func (g *featureGates) setEnabled(feature Feature, enabled bool) func() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	previous := g.enabled[feature]
+	g.enabled[feature] = enabled
+	return func() {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		g.enabled[feature] = previous
+	}
+}
+
+// String returns the state of all features in --feature-gates format
+func (g *featureGates) String() string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	pairs := make([]string, 0, len(g.enabled))
+	for feature, enabled := range g.enabled {
+		pairs = append(pairs, fmt.Sprintf("%s=%t", feature, enabled))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (g *featureGates) knownNames() string {
+	names := make([]string, 0, len(g.known))
+	for feature, spec := range g.known {
+		names = append(names, fmt.Sprintf("%s (%s)", feature, spec.Stage))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// SetFeatureGates applies a --feature-gates value to the device plugin
+func SetFeatureGates(value string) error {
+	return gates.Set(value)
+}
+
+// FeatureGatesString returns the effective feature gates
+func FeatureGatesString() string {
+	return gates.String()
+}
@@ -38,42 +38,78 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/apimachinery/pkg/util/wait"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
 )
 
 var returnIommuMap = getIommuMap
 
 // Implements the kubernetes device plugin API
 type GenericDevicePlugin struct {
-	devs       []*pluginapi.Device
-	server     *grpc.Server
-	socketPath string
-	stop       chan struct{} // this channel signals to stop the DP
-	term       chan bool     // this channel detects kubelet restarts
-	healthy    chan string
-	unhealthy  chan string
-	devicePath string
-	deviceName string
-	devsHealth []*pluginapi.Device
+	devs        []*pluginapi.Device
+	server      *grpc.Server
+	socketPath  string
+	ctx         context.Context    // canceled to stop the DP
+	cancel      context.CancelFunc // cancels ctx, set by the device plugin manager
+	serveCtx    context.Context    // canceled when the gRPC server stops, e.g. on a restart
+	endServe    context.CancelFunc // cancels serveCtx
+	healthy     chan string
+	unhealthy   chan string
+	devicePath  string
+	deviceName  string
+	devsHealth  []*pluginapi.Device
+	healthLock  sync.Mutex                  // protects Health of devs and transitions
+	transitions map[string]healthTransition // last health transition per device ID
+	queue       *healthQueue                // coalesces health transitions for ListAndWatch
+	allocations *allocateQueue              // bounds concurrent and pending Allocate calls
+	reported    map[string]string           // last health reported by internal probes per device ID
+	stateLock   sync.RWMutex                // serializes allocations against health updates
+	listener    net.Listener                // socket the gRPC server currently serves on
+	streamLock  sync.Mutex                  // protects streamDone
+	streamDone  chan struct{}               // closed when a newer ListAndWatch stream starts
+	dryRun      bool                        // simulate allocations without changing the host
+	flaps       *flapDetector               // pins devices unhealthy that flap
+	// migrationTwin is the other name of a resource renamed by an alias
+	// change while both names are advertised
+	migrationTwin string
+}
+
+// healthTransition records when a device last changed health
+type healthTransition struct {
+	health string
+	at     time.Time
 }
 
 // Returns an initialized instance of GenericDevicePlugin
 func NewGenericDevicePlugin(deviceName string, devicePath string, devices []*pluginapi.Device) *GenericDevicePlugin {
 	log.Println("Devicename " + deviceName)
-	serverSock := fmt.Sprintf(pluginapi.DevicePluginPath+"sandbox-%s.sock", deviceName)
+	serverSock := socketPathForResource(deviceName)
 	dpi := &GenericDevicePlugin{
-		devs:       devices,
-		socketPath: serverSock,
-		term:       make(chan bool, 1),
-		healthy:    make(chan string),
-		unhealthy:  make(chan string),
-		deviceName: deviceName,
-		devicePath: devicePath,
+		devs:        devices,
+		socketPath:  serverSock,
+		ctx:         context.Background(),
+		serveCtx:    context.Background(),
+		healthy:     make(chan string),
+		unhealthy:   make(chan string),
+		deviceName:  deviceName,
+		devicePath:  devicePath,
+		transitions: make(map[string]healthTransition),
+		queue:       newHealthQueue(),
+		allocations: newAllocateQueue(allocateConcurrency, allocateQueueLength),
+		reported:    make(map[string]string),
+		flaps:       newFlapDetector(),
+	}
+	for _, dev := range devices {
+		dpi.reported[dev.ID] = dev.Health
 	}
 	return dpi
 }
@@ -89,7 +125,7 @@ func waitForGrpcServer(socketPath string, timeout time.Duration) error {
 
 // dial establishes the gRPC communication with the registered device plugin.
 func connect(socketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(daemonCtx, timeout)
 	defer cancel()
 	c, err := grpc.DialContext(ctx, socketPath,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -109,40 +145,53 @@ func connect(socketPath string, timeout time.Duration) (*grpc.ClientConn, error)
 }
 
 // Start starts the gRPC server of the device plugin
-func (dpi *GenericDevicePlugin) Start(stop chan struct{}) error {
+func (dpi *GenericDevicePlugin) Start(ctx context.Context) error {
 	if dpi.server != nil {
 		return fmt.Errorf("gRPC server already started")
 	}
 
-	dpi.stop = stop
+	dpi.ctx = ctx
+	dpi.serveCtx, dpi.endServe = context.WithCancel(ctx)
+
+	if err := checkSocketAvailable(dpi.socketPath); err != nil {
+		log.Printf("[%s] %v", dpi.deviceName, err)
+		return err
+	}
 
 	err := dpi.cleanup()
 	if err != nil {
 		return err
 	}
 
-	sock, err := net.Listen("unix", dpi.socketPath)
+	sock, err := listenSocket(dpi.socketPath)
 	if err != nil {
 		log.Printf("[%s] Error creating GRPC server socket: %v", dpi.deviceName, err)
 		return err
 	}
 
-	dpi.server = grpc.NewServer([]grpc.ServerOption{}...)
+	dpi.server = grpc.NewServer(loadGrpcServerConfig().serverOptions()...)
 	pluginapi.RegisterDevicePluginServer(dpi.server, dpi)
 
+	dpi.listener = sock
 	go dpi.server.Serve(sock)
 
-	err = waitForGrpcServer(dpi.socketPath, connectionTimeout)
+	// a plugin failing to start must not keep serving its socket
+	err = waitForGrpcServer(dpi.socketPath, serverReadyTimeout)
 	if err != nil {
-		// this err is returned at the end of the Start function
 		log.Printf("[%s] Error connecting to GRPC server: %v", dpi.deviceName, err)
+		dpi.Stop()
+		return err
 	}
 
-	err = dpi.Register()
+	err = dpi.registerWithRetry()
 	if err != nil {
 		log.Printf("[%s] Error registering with device plugin manager: %v", dpi.deviceName, err)
+		events.warning("DevicePluginRegistrationFailed", fmt.Sprintf("Registering %s/%s with the kubelet failed: %v", DeviceNamespace, dpi.deviceName, err))
+		dpi.Stop()
 		return err
 	}
+	events.normal("DevicePluginRegistered", fmt.Sprintf("Registered %s/%s with %d device(s)", DeviceNamespace, dpi.deviceName, len(dpi.devs)))
+	dpi.publishDiscovered()
 
 	go dpi.healthCheck()
 
@@ -157,11 +206,12 @@ func (dpi *GenericDevicePlugin) Stop() error {
 		return nil
 	}
 
-	// Send terminate signal to ListAndWatch()
-	dpi.term <- true
+	// End ListAndWatch()
+	dpi.endServe()
 
 	dpi.server.Stop()
 	dpi.server = nil
+	dpi.listener = nil
 
 	return dpi.cleanup()
 }
@@ -173,16 +223,63 @@ func (dpi *GenericDevicePlugin) restart() error {
 		return fmt.Errorf("grpc server instance not found for %s", dpi.deviceName)
 	}
 
+	// the plugin was stopped by its manager, which removed the socket
+	select {
+	case <-dpi.ctx.Done():
+		return nil
+	default:
+	}
+
 	dpi.Stop()
 
 	// Create new instance of a grpc server
-	var stop = make(chan struct{})
-	return dpi.Start(stop)
+	return dpi.Start(dpi.ctx)
+}
+
+// reregister serves the running gRPC server on a new socket and registers it
+// with the kubelet again. A restarted kubelet removes the plugin sockets but
+// not the plugins, so the server, its health checks and the device state are
+// kept, avoiding the capacity flap of a full restart.
+func (dpi *GenericDevicePlugin) reregister() error {
+	if dpi.server == nil {
+		return fmt.Errorf("grpc server instance not found for %s", dpi.deviceName)
+	}
+	select {
+	case <-dpi.ctx.Done():
+		return nil
+	default:
+	}
+
+	// the previous socket was unlinked, nothing can connect to it anymore.
+	// Close it before listening again, since closing a unix listener
+	// unlinks its path, which would remove the new socket.
+	if dpi.listener != nil {
+		dpi.listener.Close()
+	}
+	if err := dpi.cleanup(); err != nil {
+		return err
+	}
+	sock, err := listenSocket(dpi.socketPath)
+	if err != nil {
+		return fmt.Errorf("error creating GRPC server socket: %w", err)
+	}
+	go dpi.server.Serve(sock)
+	dpi.listener = sock
+
+	if err := waitForGrpcServer(dpi.socketPath, serverReadyTimeout); err != nil {
+		log.Printf("[%s] Error connecting to GRPC server: %v", dpi.deviceName, err)
+	}
+	if err := dpi.registerWithRetry(); err != nil {
+		events.warning("DevicePluginRegistrationFailed", fmt.Sprintf("Registering %s/%s with the kubelet failed: %v", DeviceNamespace, dpi.deviceName, err))
+		return err
+	}
+	events.normal("DevicePluginRegistered", fmt.Sprintf("Re-registered %s/%s with %d device(s)", DeviceNamespace, dpi.deviceName, len(dpi.devs)))
+	return nil
 }
 
 // Register registers the device plugin for the given resourceName with Kubelet.
 func (dpi *GenericDevicePlugin) Register() error {
-	conn, err := connect(pluginapi.KubeletSocket, connectionTimeout)
+	conn, err := connect(kubeletSocket, connectionTimeout)
 	if err != nil {
 		return err
 	}
@@ -195,111 +292,397 @@ func (dpi *GenericDevicePlugin) Register() error {
 		ResourceName: fmt.Sprintf("%s/%s", DeviceNamespace, dpi.deviceName),
 	}
 
-	_, err = client.Register(context.Background(), reqt)
+	ctx, cancel := context.WithTimeout(dpi.ctx, registrationTimeout)
+	defer cancel()
+	_, err = client.Register(ctx, reqt)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// registerWithRetry registers with the kubelet, retrying with a jittered
+// backoff since a loaded kubelet may not answer within the timeout
+func (dpi *GenericDevicePlugin) registerWithRetry() error {
+	var lastErr error
+	err := wait.ExponentialBackoff(registrationBackoff(), func() (bool, error) {
+		lastErr = dpi.Register()
+		if lastErr != nil {
+			log.Printf("[%s] Registration attempt failed: %v", dpi.deviceName, lastErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
+
 // ListAndWatch lists devices and update that list according to the health status
 func (dpi *GenericDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	superseded := dpi.beginStream()
+	serving := dpi.serveCtx.Done()
+	started := streams.connect(dpi.deviceName)
+	cause := streamEndKubeletEOF
+	defer func() { streams.disconnect(dpi.deviceName, started, cause) }()
 
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
+	s.Send(dpi.listResponse())
 
 	for {
 		select {
 		case unhealthy := <-dpi.unhealthy:
-			log.Printf("In watch unhealthy")
-			for _, dev := range dpi.devs {
-				if unhealthy == dev.ID {
-					dev.Health = pluginapi.Unhealthy
-				}
-			}
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
+			debugf("In watch unhealthy")
+			dpi.updateHealth(unhealthy, pluginapi.Unhealthy)
+			dpi.reportNodeFailure()
+			s.Send(dpi.listResponse())
 		case healthy := <-dpi.healthy:
-			log.Printf("In watch healthy")
-			for _, dev := range dpi.devs {
-				if healthy == dev.ID {
-					dev.Health = pluginapi.Healthy
-				}
+			debugf("In watch healthy")
+			dpi.updateHealth(healthy, pluginapi.Healthy)
+			dpi.reportNodeFailure()
+			s.Send(dpi.listResponse())
+		case <-dpi.ctx.Done():
+			cause = streamEndStop
+			return nil
+		case <-serving:
+			// the server context derives from the plugin context
+			cause = streamEndTerm
+			if dpi.ctx.Err() != nil {
+				cause = streamEndStop
 			}
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
-		case <-dpi.stop:
 			return nil
-		case <-dpi.term:
+		case <-superseded:
+			cause = streamEndSuperseded
+			return nil
+		case <-s.Context().Done():
 			return nil
 		}
 	}
 }
 
-// Allocate performs allocation of devices based on the request
+// listResponse returns the devices ordered by their IOMMU group or iommufd
+// number, so that kubelet sees the same order after every restart and on
+// every node
+func (dpi *GenericDevicePlugin) listResponse() *pluginapi.ListAndWatchResponse {
+	dpi.healthLock.Lock()
+	devs := make([]*pluginapi.Device, 0, len(dpi.devs))
+	for _, dev := range dpi.devs {
+		devs = append(devs, &pluginapi.Device{ID: dev.ID, Health: dev.Health, Topology: dev.Topology})
+	}
+	dpi.healthLock.Unlock()
+	sort.SliceStable(devs, func(i, j int) bool {
+		a, b := iommuKeyForDeviceID(devs[i].ID), iommuKeyForDeviceID(devs[j].ID)
+		if na, nb := extractNumber(a), extractNumber(b); na != nb {
+			return na < nb
+		}
+		return devs[i].ID < devs[j].ID
+	})
+	return &pluginapi.ListAndWatchResponse{Devices: devs}
+}
+
+// beginStream ends the previous ListAndWatch stream, so that a stream of a
+// restarted kubelet does not compete with the new one for health updates,
+// and returns the channel closed when this stream is superseded
+func (dpi *GenericDevicePlugin) beginStream() <-chan struct{} {
+	dpi.streamLock.Lock()
+	defer dpi.streamLock.Unlock()
+	if dpi.streamDone != nil {
+		close(dpi.streamDone)
+	}
+	dpi.streamDone = make(chan struct{})
+	return dpi.streamDone
+}
+
+// updateHealth sets the health of the given device and records the transition
+func (dpi *GenericDevicePlugin) updateHealth(id string, health string) {
+	// wait for in-flight allocations so they see a consistent device state
+	dpi.stateLock.Lock()
+	defer dpi.stateLock.Unlock()
+	dpi.healthLock.Lock()
+	changed := false
+	for _, dev := range dpi.devs {
+		if id == dev.ID && dev.Health != health {
+			dev.Health = health
+			dpi.transitions[id] = healthTransition{health: health, at: clk.Now()}
+			changed = true
+			message := fmt.Sprintf("Device %s of %s/%s changed to %s", id, DeviceNamespace, dpi.deviceName, health)
+			if health == pluginapi.Unhealthy {
+				events.warning("DeviceUnhealthy", message)
+				spares.deviceFailed()
+				cdiGC.deviceUnhealthy(iommuKeyForDeviceID(id))
+			} else {
+				events.normal("DeviceHealthy", message)
+				cdiGC.deviceHealthy(iommuKeyForDeviceID(id))
+			}
+			deviceEvents.publish(deviceEventHealth, DeviceNamespace+"/"+dpi.deviceName, id, health, nil)
+		}
+	}
+	dpi.healthLock.Unlock()
+	if changed {
+		deviceStates.record(dpi)
+	}
+}
+
+// checkAllocatable returns an error if the device is known to be unhealthy.
+// kubelet may still request a device that was just marked unhealthy.
+func (dpi *GenericDevicePlugin) checkAllocatable(id string) error {
+	dpi.healthLock.Lock()
+	defer dpi.healthLock.Unlock()
+	for _, dev := range dpi.devs {
+		if id != dev.ID || dev.Health != pluginapi.Unhealthy {
+			continue
+		}
+		if t, ok := dpi.transitions[id]; ok {
+			return fmt.Errorf("device %s is unhealthy since %s (%s ago)",
+				id, t.at.Format(time.RFC3339), clk.Since(t.at).Round(time.Second))
+		}
+		return fmt.Errorf("device %s is unhealthy", id)
+	}
+	return nil
+}
+
+// setHealth queues a health transition for the given device. Transitions are
+// coalesced and delivered to ListAndWatch by the health check.
+func (dpi *GenericDevicePlugin) setHealth(id string, health string) {
+	// administratively disabled devices stay unhealthy until re-enabled, as
+	// do devices under maintenance until released, all devices until the
+	// kata runtime is ready, NVSwitches until the fabric manager is and
+	// devices on a degraded NVLink fabric until it recovers
+	iommuKey := iommuKeyForDeviceID(id)
+	if health == pluginapi.Healthy && (outOfService(iommuKey) || runtimeGated() || fabricGated(iommuKey) || fabricDegraded.contains(iommuKey)) {
+		return
+	}
+	dpi.queue.push(id, health)
+}
+
+// reevaluateHealth re-delivers the last internally reported health of the
+// given device so that it is merged with the current external verdicts
+func (dpi *GenericDevicePlugin) reevaluateHealth(id string) {
+	dpi.healthLock.Lock()
+	health, ok := dpi.reported[id]
+	dpi.healthLock.Unlock()
+	if !ok {
+		health = pluginapi.Healthy
+	}
+	dpi.queue.pushIfIdle(id, health)
+}
+
+// deliverHealth forwards a health transition for the given device to
+// ListAndWatch. A device reported healthy by internal probes stays unhealthy
+// while an external health agent reports it unhealthy or while it is pinned
+// for flapping.
+func (dpi *GenericDevicePlugin) deliverHealth(id string, health string) {
+	dpi.healthLock.Lock()
+	if dpi.reported != nil {
+		dpi.reported[id] = health
+	}
+	dpi.healthLock.Unlock()
+	health = dpi.flapAdjustedHealth(id, health)
+	if health == pluginapi.Healthy && externalHealth.unhealthy(iommuKeyForDeviceID(id)) {
+		health = pluginapi.Unhealthy
+	}
+	ch := dpi.healthy
+	if health == pluginapi.Unhealthy {
+		ch = dpi.unhealthy
+	}
+	select {
+	case ch <- id:
+	case <-dpi.ctx.Done():
+	}
+}
+
+// Allocate performs allocation of devices based on the request and records
+// its latency
 func (dpi *GenericDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	trace := newAllocateTrace()
+	resp, err := dpi.allocate(ctx, reqs, trace)
+	if err == nil && !dpi.dryRun {
+		var deviceIDs []string
+		for _, req := range reqs.ContainerRequests {
+			deviceIDs = append(deviceIDs, req.DevicesIDs...)
+		}
+		observeAllocate(dpi.deviceName, deviceIDs, trace)
+	}
+	return resp, err
+}
+
+// allocate performs allocation of devices based on the request, timing its
+// phases in trace
+func (dpi *GenericDevicePlugin) allocate(ctx context.Context, reqs *pluginapi.AllocateRequest, trace *allocateTrace) (*pluginapi.AllocateResponse, error) {
+	release, err := dpi.allocations.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	trace.mark(allocatePhaseQueue)
+	dpi.stateLock.RLock()
+	defer dpi.stateLock.RUnlock()
+	trace.mark(allocatePhaseStateLock)
+
 	responses := pluginapi.AllocateResponse{}
 	iommufdSupported, err := supportsIOMMUFD()
 	if err != nil {
-		return nil, fmt.Errorf("could not determine iommufd support: %w", err)
+		return nil, allocateError(codes.Internal, allocateReasonInternal, dpi.deviceName, "",
+			"could not determine iommufd support: %v", err)
 	}
-	for _, req := range reqs.ContainerRequests {
-		deviceSpecs := make([]*pluginapi.DeviceSpec, 0)
-		for _, iommuID := range req.DevicesIDs {
+	trace.mark(allocatePhaseIommufdCheck)
+	_, hostContainer := hostContainerModeFor(dpi.deviceName)
+	withROM := romExposed(dpi.deviceName)
+	// groupOwners records which container each IOMMU group was given to,
+	// since a group cannot be split across the containers of a pod
+	groupOwners := make(map[int]int)
+	for i, req := range reqs.ContainerRequests {
+		c := newContainerAllocation(iommufdSupported)
+		var cdiNames []string
+		allocated := make([]NvidiaPCIDevice, 0)
+		// simulated allocations have no pod to match the policies against
+		if !dpi.dryRun {
+			if err := dpi.enforceAllocationPolicies(req.DevicesIDs); err != nil {
+				if errors.Is(err, errQuotaExceeded) {
+					return nil, allocateError(codes.ResourceExhausted, allocateReasonQuota, dpi.deviceName, "",
+						"allocation denied by policy: %v", err)
+				}
+				return nil, allocateError(codes.PermissionDenied, allocateReasonPolicy, dpi.deviceName, "",
+					"allocation denied by policy: %v", err)
+			}
+		}
+		trace.mark(allocatePhasePolicy)
+		if !dpi.dryRun {
+			if err := dpi.checkMigrationTwin(req.DevicesIDs); err != nil {
+				return nil, allocateError(codes.FailedPrecondition, allocateReasonMigrated, dpi.deviceName, "",
+					"invalid allocation request: %v", err)
+			}
+		}
+		for _, deviceID := range req.DevicesIDs {
+			// the health transition of a freed device may not have reached
+			// kubelet yet
+			if clearing.contains(iommuKeyForDeviceID(deviceID)) {
+				return nil, allocateError(codes.FailedPrecondition, allocateReasonClearing, dpi.deviceName, deviceID,
+					"invalid allocation request: device %s is being cleared after its previous owner", deviceID)
+			}
+			if err := dpi.checkAllocatable(deviceID); err != nil {
+				return nil, allocateError(codes.FailedPrecondition, allocateReasonUnhealthy, dpi.deviceName, deviceID,
+					"invalid allocation request: %v", err)
+			}
+			iommuID := iommuKeyForDeviceID(deviceID)
 			returnedMap := returnIommuMap()
 			// Retrieve the devices associated with the IOMMU group/fd
 			nvDevs, ok := returnedMap[iommuID]
 			if !ok {
-				return nil, fmt.Errorf("invalid allocation request: unknown iommu id: %s", iommuID)
+				return nil, allocateError(codes.InvalidArgument, allocateReasonUnknownID, dpi.deviceName, deviceID,
+					"invalid allocation request: unknown device id: %s", deviceID)
 			}
-
-			if iommufdSupported {
-				for _, dev := range nvDevs {
-					log.Printf("iommufd: allocating device %s (iommufd: %s)", dev.Address, dev.IommuFD)
-					if dev.IommuFD == "" {
-						return nil, fmt.Errorf("iommufd device not available for device %s", dev.Address)
-					}
-					deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
-						HostPath:      filepath.Join(vfioDevicePath, "devices", dev.IommuFD),
-						ContainerPath: filepath.Join(vfioDevicePath, "devices", dev.IommuFD),
-						Permissions:   "mrw",
-					})
+			for _, dev := range nvDevs {
+				if owner, ok := groupOwners[dev.IommuGroup]; ok && owner != i {
+					return nil, allocateError(codes.InvalidArgument, allocateReasonSplitGroup, dpi.deviceName, deviceID,
+						"invalid allocation request: IOMMU group %d of device %s cannot be split across containers %d and %d",
+						dev.IommuGroup, deviceID, owner, i)
 				}
-			} else {
+				groupOwners[dev.IommuGroup] = i
+			}
+			trace.mark(allocatePhaseMapLookup)
+			if err := dpi.wakeDevices(nvDevs); err != nil {
+				return nil, allocateError(codes.Unavailable, allocateReasonPowerState, dpi.deviceName, deviceID,
+					"failed to wake device: %v", err)
+			}
+			trace.mark(allocatePhaseWake)
+			allocated = append(allocated, nvDevs...)
+			cdiName := dpi.qualifiedCDIName(iommuID)
+			cdiNames = append(cdiNames, cdiName)
+			if gates.Enabled(CDIInAllocate) {
+				c.addCDIDevice(cdiName)
+			}
+
+			strategy, err := dpi.allocationStrategy(deviceID, iommuID, iommufdSupported)
+			if err != nil {
+				return nil, err
+			}
+			if err := strategy.allocate(dpi, c, deviceID, iommuID, nvDevs); err != nil {
+				return nil, err
+			}
+			// host containers drive the device themselves and need its
+			// sysfs directory
+			if hostContainer {
 				for _, dev := range nvDevs {
-					log.Printf("vfio: allocating device %s (IOMMU group: %d)", dev.Address, dev.IommuGroup)
+					c.mounts = append(c.mounts, sysfsMount(dev.Address))
 				}
-				deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
-					HostPath:      filepath.Join(vfioDevicePath, "vfio"),
-					ContainerPath: filepath.Join(vfioDevicePath, "vfio"),
-					Permissions:   "mrw",
-				})
-				deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
-					HostPath:      filepath.Join(vfioDevicePath, iommuID),
-					ContainerPath: filepath.Join(vfioDevicePath, iommuID),
-					Permissions:   "mrw",
-				})
+			}
+			// guests executing the expansion ROM read it from sysfs
+			if withROM {
+				c.mounts = append(c.mounts, romMounts(nvDevs)...)
+			}
+			trace.mark(allocatePhaseDeviceNodes)
+		}
+		annotations := numaAnnotations(allocated)
+		if gates.Enabled(IOMMUFDAnnotations) && len(c.iommufdPaths) > 0 {
+			annotations = withIommufdAnnotations(annotations, c.iommufdPaths)
+		}
+		if gates.Enabled(CDIAnnotations) && len(cdiNames) > 0 {
+			annotations, err = cdiapi.UpdateAnnotations(annotations, cdiAnnotationPlugin, dpi.deviceName, cdiNames)
+			if err != nil {
+				return nil, allocateError(codes.Internal, allocateReasonInternal, dpi.deviceName, "",
+					"failed to annotate CDI devices: %v", err)
 			}
 		}
+		trace.mark(allocatePhaseCDI)
 		response := pluginapi.ContainerAllocateResponse{
-			Devices: deviceSpecs,
+			Devices:     c.devices,
+			Mounts:      c.mounts,
+			Annotations: annotations,
+			CDIDevices:  c.cdiDevices,
 		}
 		log.Printf("Allocated devices %v", response)
 
 		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
 
+	if !dpi.dryRun {
+		for _, req := range reqs.ContainerRequests {
+			for _, deviceID := range req.DevicesIDs {
+				deviceEvents.publish(deviceEventAllocated, DeviceNamespace+"/"+dpi.deviceName, deviceID, "", nil)
+			}
+		}
+	}
 	return &responses, nil
 }
 
+// applyVfioPerms sets the configured owner and mode on an allocated device
+// node, unless allocations are only simulated. Resources served to host
+// containers use the owner and mode of their host container mode.
+func (dpi *GenericDevicePlugin) applyVfioPerms(hostPath string) error {
+	if dpi.dryRun {
+		return nil
+	}
+	if mode, ok := hostContainerModeFor(dpi.deviceName); ok {
+		_, err := mode.permissions().reconcile(hostPath)
+		return err
+	}
+	return vfioPerms.apply(hostPath)
+}
+
+// appendDeviceSpec appends spec unless a spec for the same host path was
+// already added, e.g. the shared /dev/vfio/vfio container node
+func appendDeviceSpec(specs []*pluginapi.DeviceSpec, seen map[string]bool, spec *pluginapi.DeviceSpec) []*pluginapi.DeviceSpec {
+	if seen[spec.HostPath] {
+		return specs
+	}
+	seen[spec.HostPath] = true
+	return append(specs, spec)
+}
+
 func (dpi *GenericDevicePlugin) cleanup() error {
 	if err := os.Remove(dpi.socketPath); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	setSocketOwned(dpi.socketPath, false)
 
 	return nil
 }
 
 func (dpi *GenericDevicePlugin) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	options := &pluginapi.DevicePluginOptions{
-		PreStartRequired: false,
+		PreStartRequired:                false,
+		GetPreferredAllocationAvailable: true,
 	}
 	return options, nil
 }
@@ -309,24 +692,46 @@ func (dpi *GenericDevicePlugin) PreStartContainer(ctx context.Context, in *plugi
 	return res, nil
 }
 
-// GetPreferredAllocation is for compatible with new DevicePluginServer API for DevicePlugin service. It has not been implemented in kubevrit-gpu-device-plugin
+// GetPreferredAllocation returns a preferred set of devices to allocate from
+// a list of available ones. The resulting preferred allocation is not
+// guaranteed to be the allocation ultimately performed by the devicemanager.
+// Administratively disabled devices are never preferred.
 func (dpi *GenericDevicePlugin) GetPreferredAllocation(ctx context.Context, in *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	// TODO
-	// returns a preferred set of devices to allocate
-	// from a list of available ones. The resulting preferred allocation is not
-	// guaranteed to be the allocation ultimately performed by the
-	// devicemanager. It is only designed to help the devicemanager make a more
-	// informed allocation decision when possible.
-	return nil, nil
+	response := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range in.ContainerRequests {
+		preferred := append([]string{}, req.MustIncludeDeviceIDs...)
+		included := make(map[string]bool, len(preferred))
+		for _, id := range preferred {
+			included[id] = true
+		}
+		available := make([]string, 0, len(req.AvailableDeviceIDs))
+		for _, id := range req.AvailableDeviceIDs {
+			if !included[id] && !outOfService(iommuKeyForDeviceID(id)) {
+				available = append(available, id)
+			}
+		}
+		sort.Strings(available)
+		// keep the devices of a VM on one NUMA node, and multi-GPU VMs need
+		// peer DMA, so on one PCIe switch within it
+		available = orderByNUMANode(available, req.MustIncludeDeviceIDs, int(req.AllocationSize)-len(preferred))
+		for _, id := range available {
+			if len(preferred) >= int(req.AllocationSize) {
+				break
+			}
+			preferred = append(preferred, id)
+		}
+		response.ContainerResponses = append(response.ContainerResponses,
+			&pluginapi.ContainerPreferredAllocationResponse{DeviceIDs: preferred})
+	}
+	return response, nil
 }
 
-// Health check of GPU devices
+// Health check of GPU devices. Each device node is watched by its own shard,
+// while this goroutine watches the socket directory for kubelet restarts.
 func (dpi *GenericDevicePlugin) healthCheck() error {
 	method := fmt.Sprintf("healthCheck(%s)", dpi.deviceName)
 	log.Printf("%s: invoked", method)
-	var pathDeviceMap = make(map[string]string)
 	var path = dpi.devicePath
-	var health = ""
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -335,13 +740,19 @@ func (dpi *GenericDevicePlugin) healthCheck() error {
 	}
 	defer watcher.Close()
 
-	err = watcher.Add(filepath.Dir(dpi.socketPath))
+	socketDir := filepath.Dir(dpi.socketPath)
+	err = watcher.Add(socketDir)
 	if err != nil {
 		log.Printf("%s: Unable to add device plugin socket path to fsnotify watcher: %v", method, err)
 		return err
 	}
+	// watch the parent as well, since a watch on the socket directory goes
+	// stale when the directory is replaced, e.g. by a kubelet reinstall
+	if err := watcher.Add(filepath.Dir(socketDir)); err != nil {
+		log.Printf("%s: Unable to watch the parent of the device plugin socket directory: %v", method, err)
+	}
 
-	_, err = os.Stat(path)
+	_, err = fsys.Stat(path)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			log.Printf("%s: Unable to stat device: %v", method, err)
@@ -349,41 +760,63 @@ func (dpi *GenericDevicePlugin) healthCheck() error {
 		}
 	}
 
+	// done stops the shards and the queue when this health check terminates
+	done := make(chan struct{})
+	defer close(done)
+
 	for _, dev := range dpi.devs {
-		devicePath := filepath.Join(path, dev.ID)
-		err = watcher.Add(devicePath)
+		devicePath := healthNodePath(path, iommuKeyForDeviceID(dev.ID))
 		log.Printf(" Adding Watcher to Path : %v", devicePath)
-		pathDeviceMap[devicePath] = dev.ID
+		shard, err := newHealthShard(dev.ID, devicePath)
 		if err != nil {
 			log.Printf("%s: Unable to add device path to fsnotify watcher: %v", method, err)
 			return err
 		}
+		go shard.run(method, done, dpi.queue)
 	}
+	go dpi.queue.run(dpi, done)
+	go dpi.runRecoveryProbes(done)
 
 	for {
 		select {
-		case <-dpi.stop:
+		case <-dpi.ctx.Done():
 			return nil
 		case event := <-watcher.Events:
-			v, ok := pathDeviceMap[event.Name]
-			if ok {
-				// Health in this case is if the device path actually exists
-				if event.Op == fsnotify.Create {
-					health = v
-					dpi.healthy <- health
-				} else if (event.Op == fsnotify.Remove) || (event.Op == fsnotify.Rename) {
-					log.Printf("%s: Marking device unhealthy: %s", method, event.Name)
-					health = v
-					dpi.unhealthy <- health
+			socketRemoved := event.Name == dpi.socketPath && event.Op == fsnotify.Remove
+			dirReplaced := socketDirReplaced(event, socketDir)
+			if socketRemoved || dirReplaced {
+				removedAt := clk.Now()
+				if dirReplaced {
+					log.Printf("%s: Device plugin socket directory %s was removed", method, socketDir)
+				} else {
+					// Watcher event for removal of socket file
+					log.Printf("%s: Socket path for GPU device was removed, kubelet likely restarted", method)
+				}
+				// the socket directory may be in the middle of being recreated
+				if !waitForDir(dpi.ctx, socketDir) {
+					return nil
+				}
+				// Serve on a new socket and register again, keeping the
+				// server and health checks
+				var err error
+				if dirReplaced {
+					err = watcher.Add(socketDir)
 				}
-			} else if event.Name == dpi.socketPath && event.Op == fsnotify.Remove {
-				// Watcher event for removal of socket file
-				log.Printf("%s: Socket path for GPU device was removed, kubelet likely restarted", method)
+				if err == nil {
+					err = dpi.reregister()
+				}
+				if err == nil {
+					log.Printf("%s: Re-registered %s device plugin", method, dpi.deviceName)
+					reregistrationDuration.WithLabelValues(dpi.deviceName).Observe(clk.Since(removedAt).Seconds())
+					continue
+				}
+				log.Printf("%s: Unable to re-register, restarting server: %v", method, err)
 				// Trigger restart of the DP servers
 				if err := dpi.restart(); err != nil {
 					log.Printf("%s: Unable to restart server %v", method, err)
 					return err
 				}
+				reregistrationDuration.WithLabelValues(dpi.deviceName).Observe(clk.Since(removedAt).Seconds())
 				log.Printf("%s: Successfully restarted %s device plugin server. Terminating.", method, dpi.deviceName)
 				return nil
 			}
@@ -391,8 +824,34 @@ func (dpi *GenericDevicePlugin) healthCheck() error {
 	}
 }
 
+// socketDirReplaced returns whether the event removes or moves away the
+// device plugin socket directory
+func socketDirReplaced(event fsnotify.Event, socketDir string) bool {
+	return event.Name == socketDir && (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename))
+}
+
+// waitForDir polls until the directory exists, returning false if ctx is
+// canceled first
+func waitForDir(ctx context.Context, dir string) bool {
+	ticker := clk.NewTicker(socketDirPollInterval)
+	defer ticker.Stop()
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C():
+		}
+	}
+}
+
 func supportsIOMMUFD() (bool, error) {
-	_, err := os.Stat(filepath.Join(rootPath, iommuDevicePath))
+	if !gates.Enabled(IOMMUFD) {
+		return false, nil
+	}
+	_, err := fsys.Stat(filepath.Join(rootPath, iommuDevicePath))
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			return false, nil
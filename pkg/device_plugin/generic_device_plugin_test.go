@@ -30,15 +30,28 @@ package device_plugin
 
 import (
 	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
 )
 
 var devices []*pluginapi.Device
@@ -52,6 +65,14 @@ var pciAddress3 = "0000:03:00.0"
 
 type fakeDevicePluginListAndWatchServer struct {
 	grpc.ServerStream
+	ctx context.Context
+}
+
+func (x *fakeDevicePluginListAndWatchServer) Context() context.Context {
+	if x.ctx == nil {
+		return context.Background()
+	}
+	return x.ctx
 }
 
 func (x *fakeDevicePluginListAndWatchServer) Send(m *pluginapi.ListAndWatchResponse) error {
@@ -89,7 +110,7 @@ var _ = Describe("Generic Device", func() {
 	var workDir string
 	var err error
 	var dpi *GenericDevicePlugin
-	var stop chan struct{}
+	var stop context.CancelFunc
 	var devicePath string
 
 	BeforeEach(func() {
@@ -118,12 +139,11 @@ var _ = Describe("Generic Device", func() {
 			Health: pluginapi.Healthy,
 		})
 		dpi = NewGenericDevicePlugin("foo", workDir+"/", devs)
-		stop = make(chan struct{})
-		dpi.stop = stop
+		dpi.ctx, stop = context.WithCancel(context.Background())
 	})
 
 	AfterEach(func() {
-		close(stop)
+		stop()
 		os.RemoveAll(workDir)
 	})
 
@@ -170,7 +190,7 @@ var _ = Describe("Generic Device", func() {
 		Expect(len(responses.GetContainerResponses()[0].Devices)).To(Equal(1))
 	})
 
-	It("Should fail allocation when iommufd is supported but device has no IommuFD", func() {
+	It("Should fall back to the VFIO group when iommufd is supported but device has no IommuFD", func() {
 		Expect(os.MkdirAll(filepath.Join(workDir, "dev"), 0744)).To(Succeed())
 		f, err := os.OpenFile(filepath.Join(workDir, "dev", "iommu"), os.O_RDONLY|os.O_CREATE, 0666)
 		Expect(err).ToNot(HaveOccurred())
@@ -182,8 +202,66 @@ var _ = Describe("Generic Device", func() {
 		requests.ContainerRequests = append(requests.ContainerRequests, &containerRequests)
 		ctx := context.Background()
 		responses, err := dpi.Allocate(ctx, &requests)
-		Expect(err).ToNot(BeNil())
+		Expect(err).ToNot(HaveOccurred())
+		var paths []string
+		for _, dev := range responses.GetContainerResponses()[0].Devices {
+			paths = append(paths, dev.HostPath)
+		}
+		Expect(paths).To(Equal([]string{"/dev/vfio/vfio", "/dev/vfio/3"}))
+	})
+
+	It("Should allocate a device by its stable device ID", func() {
+		stableIDMap = map[string]string{pciAddress2: iommuGroup2}
+		defer func() { stableIDMap = nil }()
+
+		devs := []string{pciAddress2}
+		containerRequests := pluginapi.ContainerAllocateRequest{DevicesIDs: devs}
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests, &containerRequests)
+		ctx := context.Background()
+		responses, err := dpi.Allocate(ctx, &requests)
+		Expect(err).To(BeNil())
+		Expect(responses.GetContainerResponses()[0].Devices[1].HostPath).To(Equal("/dev/vfio/2"))
+	})
+
+	It("Should annotate the allocation with NUMA nodes when enabled", func() {
+		numaHintsEnabled = true
+		defer func() { numaHintsEnabled = false }()
+		returnIommuMap = func() map[string][]NvidiaPCIDevice {
+			m := getFakeIommuMap()
+			m[iommuGroup1][0].NumaNode = 1
+			m[iommuGroup2][0].NumaNode = 0
+			return m
+		}
+
+		devs := []string{iommuGroup1, iommuGroup2}
+		containerRequests := pluginapi.ContainerAllocateRequest{DevicesIDs: devs}
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests, &containerRequests)
+		ctx := context.Background()
+		responses, err := dpi.Allocate(ctx, &requests)
+		Expect(err).To(BeNil())
+		Expect(responses.GetContainerResponses()[0].Annotations).To(HaveKeyWithValue(numaNodesAnnotation, "0,1"))
+	})
+
+	It("Should deny allocation of an unhealthy device", func() {
+		dpi.updateHealth(iommuGroup2, pluginapi.Unhealthy)
+
+		devs := []string{iommuGroup2}
+		containerRequests := pluginapi.ContainerAllocateRequest{DevicesIDs: devs}
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests, &containerRequests)
+		ctx := context.Background()
+		responses, err := dpi.Allocate(ctx, &requests)
+		Expect(err).To(MatchError(ContainSubstring("device 2 is unhealthy since")))
+		Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		Expect(allocateErrorReason(err)).To(Equal(allocateReasonUnhealthy))
 		Expect(responses).To(BeNil())
+
+		dpi.updateHealth(iommuGroup2, pluginapi.Healthy)
+		responses, err = dpi.Allocate(ctx, &requests)
+		Expect(err).To(BeNil())
+		Expect(responses.GetContainerResponses()).To(HaveLen(1))
 	})
 
 	It("Should fail allocation for unknown iommu id", func() {
@@ -194,6 +272,8 @@ var _ = Describe("Generic Device", func() {
 		ctx := context.Background()
 		responses, err := dpi.Allocate(ctx, &requests)
 		Expect(err).ToNot(BeNil())
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		Expect(allocateErrorReason(err)).To(Equal(allocateReasonUnknownID))
 		Expect(responses).To(BeNil())
 	})
 
@@ -211,6 +291,98 @@ var _ = Describe("Generic Device", func() {
 		fileObj.Close()
 	})
 
+	It("Should restart when the socket directory is replaced", func() {
+		socketDir := filepath.Join(workDir, "device-plugins")
+		Expect(os.Mkdir(socketDir, 0755)).To(Succeed())
+		dpi.socketPath = filepath.Join(socketDir, "sandbox-foo.sock")
+		result := make(chan error, 1)
+		go func() { result <- dpi.healthCheck() }()
+		time.Sleep(500 * time.Millisecond)
+
+		Expect(os.Rename(socketDir, socketDir+".old")).To(Succeed())
+		Consistently(result, 1500*time.Millisecond).ShouldNot(Receive())
+
+		Expect(os.Mkdir(socketDir, 0755)).To(Succeed())
+		// the server was never started, so the restart itself fails
+		Eventually(result, 5*time.Second).Should(Receive(MatchError(ContainSubstring("grpc server instance not found"))))
+	})
+
+	It("Should detect the removal of the socket directory", func() {
+		socketDir := filepath.Join(workDir, "device-plugins")
+		Expect(socketDirReplaced(fsnotify.Event{Name: socketDir, Op: fsnotify.Remove}, socketDir)).To(BeTrue())
+		Expect(socketDirReplaced(fsnotify.Event{Name: socketDir, Op: fsnotify.Rename}, socketDir)).To(BeTrue())
+		Expect(socketDirReplaced(fsnotify.Event{Name: socketDir, Op: fsnotify.Create}, socketDir)).To(BeFalse())
+		Expect(socketDirReplaced(fsnotify.Event{Name: filepath.Join(socketDir, "kubelet.sock"), Op: fsnotify.Remove}, socketDir)).To(BeFalse())
+	})
+
+	It("Should coalesce queued health transitions per device", func() {
+		queue := newHealthQueue()
+		queue.push(iommuGroup2, pluginapi.Unhealthy)
+		queue.push(iommuGroup1, pluginapi.Unhealthy)
+		queue.push(iommuGroup2, pluginapi.Healthy)
+
+		Expect(queue.drain()).To(Equal([]healthUpdate{
+			{id: iommuGroup2, health: pluginapi.Healthy},
+			{id: iommuGroup1, health: pluginapi.Unhealthy},
+		}))
+		Expect(queue.drain()).To(BeEmpty())
+	})
+
+	It("Should deliver device node removal to ListAndWatch", func() {
+		dpi.socketPath = filepath.Join(workDir, "sandbox-foo.sock")
+		fakeServer := &fakeDevicePluginListAndWatchServer{ServerStream: nil}
+		go dpi.ListAndWatch(&pluginapi.Empty{}, fakeServer)
+		go dpi.healthCheck()
+		time.Sleep(1 * time.Second)
+
+		os.Remove(devicePath)
+		Eventually(func() string {
+			dpi.healthLock.Lock()
+			defer dpi.healthLock.Unlock()
+			return dpi.devs[1].Health
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(pluginapi.Unhealthy))
+	})
+
+	It("Should end a ListAndWatch stream when a newer one starts or its client is gone", func() {
+		terminations := func(cause string) float64 {
+			var m dto.Metric
+			Expect(streamTerminations.WithLabelValues(dpi.deviceName, cause).Write(&m)).To(Succeed())
+			return m.GetCounter().GetValue()
+		}
+		superseded, eof := terminations(streamEndSuperseded), terminations(streamEndKubeletEOF)
+		connected := func() bool {
+			streams.lock.Lock()
+			defer streams.lock.Unlock()
+			_, ok := streams.connected[dpi.deviceName]
+			return ok
+		}
+
+		first := make(chan error, 1)
+		go func() { first <- dpi.ListAndWatch(&pluginapi.Empty{}, &fakeDevicePluginListAndWatchServer{}) }()
+		Consistently(first, 200*time.Millisecond).ShouldNot(Receive())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		second := make(chan error, 1)
+		go func() { second <- dpi.ListAndWatch(&pluginapi.Empty{}, &fakeDevicePluginListAndWatchServer{ctx: ctx}) }()
+		Eventually(first, time.Second).Should(Receive(BeNil()))
+		Consistently(second, 200*time.Millisecond).ShouldNot(Receive())
+		Expect(terminations(streamEndSuperseded)).To(Equal(superseded + 1))
+		// the superseded stream does not end the tracking of its successor
+		Expect(connected()).To(BeTrue())
+		rec := httptest.NewRecorder()
+		metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(rec.Body.String()).To(ContainSubstring(`sandbox_device_plugin_stream_connected_seconds{resource="` + dpi.deviceName + `"}`))
+
+		cancel()
+		Eventually(second, time.Second).Should(Receive(BeNil()))
+		Expect(terminations(streamEndKubeletEOF)).To(Equal(eof + 1))
+		Expect(connected()).To(BeFalse())
+	})
+
+	It("Should not re-register a plugin whose server is not running", func() {
+		Expect(dpi.reregister()).To(MatchError(ContainSubstring("grpc server instance not found")))
+	})
+
 	It("Should list devices and then react to changes in the health of the devices", func() {
 
 		fakeServer := &fakeDevicePluginListAndWatchServer{ServerStream: nil}
@@ -236,4 +408,763 @@ var _ = Describe("Generic Device", func() {
 		Expect(devices[0].Health).To(Equal(pluginapi.Healthy))
 		Expect(devices[1].Health).To(Equal(pluginapi.Healthy))
 	})
+
+	It("Should list devices ordered by their IOMMU number", func() {
+		dp := NewGenericDevicePlugin("foo", workDir+"/", []*pluginapi.Device{
+			{ID: "iommufd:vfio10", Health: pluginapi.Healthy},
+			{ID: "group:2", Health: pluginapi.Unhealthy},
+			{ID: "9", Health: pluginapi.Healthy},
+		})
+		var ids []string
+		for _, dev := range dp.listResponse().Devices {
+			ids = append(ids, dev.ID)
+		}
+		Expect(ids).To(Equal([]string{"group:2", "9", "iommufd:vfio10"}))
+		Expect(dp.listResponse().Devices[0].Health).To(Equal(pluginapi.Unhealthy))
+	})
+
+	It("Should bound unary RPCs with the configured timeout", func() {
+		interceptor := rpcTimeoutInterceptor(time.Minute)
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				deadline, ok := ctx.Deadline()
+				Expect(ok).To(BeTrue())
+				Expect(time.Until(deadline)).To(BeNumerically("<=", time.Minute))
+				return nil, nil
+			})
+		Expect(err).To(BeNil())
+	})
+
+	It("Should read gRPC server limits from the environment", func() {
+		os.Setenv("GRPC_MAX_CONCURRENT_STREAMS", "8")
+		os.Setenv("GRPC_RPC_TIMEOUT", "invalid")
+		defer os.Unsetenv("GRPC_MAX_CONCURRENT_STREAMS")
+		defer os.Unsetenv("GRPC_RPC_TIMEOUT")
+
+		config := loadGrpcServerConfig()
+		Expect(config.maxConcurrentStreams).To(Equal(uint32(8)))
+		Expect(config.rpcTimeout).To(Equal(defaultGrpcRPCTimeout))
+		Expect(config.maxConnectionAge).To(BeZero())
+		Expect(config.serverOptions()).To(HaveLen(4))
+	})
+
+	It("Should recover a quarantined device after consecutive passing probes", func() {
+		oldProbe, oldMap := recoveryProbe, iommuMap
+		defer func() { recoveryProbe, iommuMap = oldProbe, oldMap }()
+		iommuMap = map[string][]NvidiaPCIDevice{}
+		aer := uint64(0)
+		recoveryProbe = func(devicePath, iommuKey string) (uint64, error) {
+			return aer, nil
+		}
+
+		dpi.devs[0].Health = pluginapi.Unhealthy
+		states := make(map[string]*quarantineState)
+		dpi.probeQuarantined(states)
+		aer = 1
+		dpi.probeQuarantined(states)
+		dpi.probeQuarantined(states)
+		Expect(dpi.queue.drain()).To(BeEmpty())
+
+		dpi.probeQuarantined(states)
+		Expect(dpi.queue.drain()).To(Equal([]healthUpdate{{id: iommuGroup1, health: pluginapi.Healthy}}))
+		Expect(states).To(BeEmpty())
+	})
+
+	It("Should keep a device quarantined while its probe fails", func() {
+		oldProbe, oldMap := recoveryProbe, iommuMap
+		defer func() { recoveryProbe, iommuMap = oldProbe, oldMap }()
+		iommuMap = map[string][]NvidiaPCIDevice{}
+		recoveryProbe = func(devicePath, iommuKey string) (uint64, error) {
+			return 0, fmt.Errorf("device node not present")
+		}
+
+		dpi.devs[1].Health = pluginapi.Unhealthy
+		states := make(map[string]*quarantineState)
+		for i := 0; i < recoveryPasses+1; i++ {
+			dpi.probeQuarantined(states)
+		}
+		Expect(dpi.queue.drain()).To(BeEmpty())
+		Expect(states[iommuGroup2].passes).To(BeZero())
+	})
+
+	It("Should only restore the devices the NVSwitch health monitor failed", func() {
+		oldProbe, oldSwitchProbe, oldMap := recoveryProbe, nvSwitchProbe, iommuMap
+		defer func() {
+			recoveryProbe, nvSwitchProbe, iommuMap = oldProbe, oldSwitchProbe, oldMap
+			fabricDegraded.update(nil)
+		}()
+		iommuMap = getFakeIommuMap()
+		for key := range iommuMap {
+			iommuMap[key][0].Baseboard = "0000:00:01.0"
+		}
+		iommuMap[iommuGroup3][0].IsNVSwitch = true
+		linkDown := true
+		nvSwitchProbe = func(dev NvidiaPCIDevice) error {
+			if linkDown {
+				return fmt.Errorf("PCIe link is down")
+			}
+			return nil
+		}
+		recoveryProbe = func(devicePath, iommuKey string) (uint64, error) {
+			return 0, nil
+		}
+
+		// the NVSwitch is advertised by another plugin, and the second
+		// device already failed its health check
+		dpi.devs[1].Health = pluginapi.Unhealthy
+		monitor := newFabricMonitor()
+		monitor.evaluate([]*GenericDevicePlugin{dpi})
+		Expect(dpi.queue.drain()).To(ConsistOf(
+			healthUpdate{id: iommuGroup1, health: pluginapi.Unhealthy},
+			healthUpdate{id: iommuGroup2, health: pluginapi.Unhealthy},
+		))
+
+		// health probes cannot bring a device on a degraded fabric back
+		dpi.setHealth(iommuGroup1, pluginapi.Healthy)
+		Expect(dpi.queue.drain()).To(BeEmpty())
+
+		linkDown = false
+		monitor.evaluate([]*GenericDevicePlugin{dpi})
+		Expect(dpi.queue.drain()).To(Equal([]healthUpdate{{id: iommuGroup1, health: pluginapi.Healthy}}))
+	})
+
+	It("Should not duplicate the VFIO container node within a container", func() {
+		containerRequests := pluginapi.ContainerAllocateRequest{DevicesIDs: []string{iommuGroup1, iommuGroup2}}
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests, &containerRequests)
+		ctx := context.Background()
+		responses, err := dpi.Allocate(ctx, &requests)
+		Expect(err).To(BeNil())
+		var hostPaths []string
+		for _, spec := range responses.GetContainerResponses()[0].Devices {
+			hostPaths = append(hostPaths, spec.HostPath)
+		}
+		Expect(hostPaths).To(Equal([]string{"/dev/vfio/vfio", "/dev/vfio/1", "/dev/vfio/2"}))
+	})
+
+	It("Should allocate separate IOMMU groups to the containers of a pod", func() {
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests,
+			&pluginapi.ContainerAllocateRequest{DevicesIDs: []string{iommuGroup1}},
+			&pluginapi.ContainerAllocateRequest{DevicesIDs: []string{iommuGroup2}})
+		ctx := context.Background()
+		responses, err := dpi.Allocate(ctx, &requests)
+		Expect(err).To(BeNil())
+		Expect(responses.GetContainerResponses()).To(HaveLen(2))
+		Expect(responses.GetContainerResponses()[0].Devices[1].HostPath).To(Equal("/dev/vfio/1"))
+		Expect(responses.GetContainerResponses()[1].Devices[1].HostPath).To(Equal("/dev/vfio/2"))
+	})
+
+	It("Should reject splitting an IOMMU group across containers", func() {
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests,
+			&pluginapi.ContainerAllocateRequest{DevicesIDs: []string{iommuGroup1}},
+			&pluginapi.ContainerAllocateRequest{DevicesIDs: []string{iommuGroup1}})
+		ctx := context.Background()
+		responses, err := dpi.Allocate(ctx, &requests)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("cannot be split across containers"))
+		Expect(responses).To(BeNil())
+	})
+
+	It("Should return CDI device names when CDIInAllocate is enabled", func() {
+		defer gates.setEnabled(CDIInAllocate, true)()
+
+		containerRequests := pluginapi.ContainerAllocateRequest{DevicesIDs: []string{iommuGroup1}}
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests, &containerRequests)
+		ctx := context.Background()
+		responses, err := dpi.Allocate(ctx, &requests)
+		Expect(err).To(BeNil())
+		Expect(responses.GetContainerResponses()[0].CDIDevices).To(HaveLen(1))
+		Expect(responses.GetContainerResponses()[0].CDIDevices[0].Name).To(Equal("nvidia.com/foo=1"))
+	})
+
+	It("Should annotate CDI devices when CDIAnnotations is enabled", func() {
+		defer gates.setEnabled(CDIAnnotations, true)()
+
+		containerRequests := pluginapi.ContainerAllocateRequest{DevicesIDs: []string{iommuGroup1, iommuGroup2}}
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests, &containerRequests)
+		ctx := context.Background()
+		responses, err := dpi.Allocate(ctx, &requests)
+		Expect(err).To(BeNil())
+		response := responses.GetContainerResponses()[0]
+		Expect(response.CDIDevices).To(BeEmpty())
+		Expect(response.Annotations).To(HaveKeyWithValue("cdi.k8s.io/nvidia.sandbox_foo", "nvidia.com/foo=1,nvidia.com/foo=2"))
+	})
+
+	It("Should queue Allocate calls and reject them when the queue is full", func() {
+		dpi.allocations = newAllocateQueue(1, 1)
+		release, err := dpi.allocations.acquire(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+
+		containerRequests := pluginapi.ContainerAllocateRequest{DevicesIDs: []string{iommuGroup1}}
+		requests := pluginapi.AllocateRequest{}
+		requests.ContainerRequests = append(requests.ContainerRequests, &containerRequests)
+		queued := make(chan error, 1)
+		go func() {
+			_, err := dpi.Allocate(context.Background(), &requests)
+			queued <- err
+		}()
+		Eventually(func() uint32 {
+			dpi.allocations.lock.Lock()
+			defer dpi.allocations.lock.Unlock()
+			return dpi.allocations.waiting
+		}).Should(Equal(uint32(1)))
+
+		_, err = dpi.Allocate(context.Background(), &requests)
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+		Consistently(queued).ShouldNot(Receive())
+
+		release()
+		Eventually(queued).Should(Receive(BeNil()))
+	})
+
+	It("Should give up waiting for an allocation slot when the request is cancelled", func() {
+		q := newAllocateQueue(1, 1)
+		release, err := q.acquire(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		defer release()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = q.acquire(ctx)
+		Expect(status.Code(err)).To(Equal(codes.Canceled))
+		Expect(q.waiting).To(BeZero())
+	})
+
+	It("Should build the container edits with each allocation strategy", func() {
+		hostPaths := func(c *containerAllocation) []string {
+			var paths []string
+			for _, dev := range c.devices {
+				paths = append(paths, dev.HostPath)
+			}
+			return paths
+		}
+		fakeMap := getFakeIommuMap()
+
+		c := newContainerAllocation(true)
+		Expect(iommufdStrategy{}.allocate(dpi, c, iommuGroup1, iommuGroup1, fakeMap[iommuGroup1])).To(Succeed())
+		Expect(hostPaths(c)).To(Equal([]string{"/dev/vfio/devices/vfio3"}))
+		// devices without an iommufd device fall back to their group
+		Expect(iommufdStrategy{}.allocate(dpi, c, iommuGroup3, iommuGroup3, fakeMap[iommuGroup3])).To(Succeed())
+		Expect(hostPaths(c)).To(Equal([]string{"/dev/vfio/devices/vfio3", "/dev/vfio/vfio", "/dev/vfio/3"}))
+
+		c = newContainerAllocation(true)
+		Expect(groupStrategy{}.allocate(dpi, c, iommuGroup1, iommuGroup1, fakeMap[iommuGroup1])).To(Succeed())
+		Expect(groupStrategy{}.allocate(dpi, c, iommuGroup2, iommuGroup2, fakeMap[iommuGroup2])).To(Succeed())
+		Expect(hostPaths(c)).To(Equal([]string{"/dev/vfio/vfio", "/dev/vfio/1", "/dev/vfio/2"}))
+
+		// functions of a subtree without an iommufd device use their group
+		subtree := subtreeKeyPrefix + "0000:40:00.0"
+		c = newContainerAllocation(true)
+		devs := append(fakeMap[iommuGroup1], fakeMap[iommuGroup3]...)
+		Expect(subtreeStrategy{}.allocate(dpi, c, "subtree", subtree, devs)).To(Succeed())
+		Expect(hostPaths(c)).To(Equal([]string{"/dev/vfio/devices/vfio3", "/dev/vfio/vfio", "/dev/vfio/3"}))
+
+		c = newContainerAllocation(false)
+		Expect(cdiStrategy{}.allocate(dpi, c, iommuGroup1, iommuGroup1, fakeMap[iommuGroup1])).To(Succeed())
+		Expect(c.devices).To(BeEmpty())
+		Expect(c.cdiDevices).To(Equal([]*pluginapi.CDIDevice{{Name: "nvidia.com/foo=1"}}))
+		Expect(c.iommufdPaths).To(BeEmpty())
+
+		// the runtime injecting the nodes still learns their iommufd paths
+		c = newContainerAllocation(true)
+		Expect(cdiStrategy{}.allocate(dpi, c, iommuGroup1, iommuGroup1, fakeMap[iommuGroup1])).To(Succeed())
+		Expect(c.iommufdPaths).To(Equal([]string{"/dev/vfio/devices/vfio3"}))
+	})
+
+	It("Should annotate iommufd allocations when IOMMUFDAnnotations is enabled", func() {
+		Expect(os.MkdirAll(filepath.Join(workDir, "dev"), 0744)).To(Succeed())
+		f, err := os.OpenFile(filepath.Join(workDir, "dev", "iommu"), os.O_RDONLY|os.O_CREATE, 0666)
+		Expect(err).ToNot(HaveOccurred())
+		f.Close()
+		requests := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{iommuGroup1}}}}
+
+		responses, err := dpi.Allocate(context.Background(), requests)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(responses.GetContainerResponses()[0].Annotations).ToNot(HaveKey(vfioModeAnnotation))
+
+		defer gates.setEnabled(IOMMUFDAnnotations, true)()
+		responses, err = dpi.Allocate(context.Background(), requests)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(responses.GetContainerResponses()[0].Annotations).To(Equal(map[string]string{
+			vfioModeAnnotation:       "iommufd",
+			iommufdDevicesAnnotation: "/dev/vfio/devices/vfio3",
+		}))
+	})
+
+	It("Should allocate with the strategy configured for the resource", func() {
+		saved := currentSettings()
+		defer applySettings(saved)
+		s := saved
+		s.allocationStrategies = map[string]string{"foo": "cdi"}
+		applySettings(s)
+
+		requests := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{iommuGroup1}}}}
+		responses, err := dpi.Allocate(context.Background(), requests)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(responses.GetContainerResponses()[0].Devices).To(BeEmpty())
+		Expect(responses.GetContainerResponses()[0].CDIDevices[0].Name).To(Equal("nvidia.com/foo=1"))
+
+		s.allocationStrategies = map[string]string{"foo": "iommufd"}
+		applySettings(s)
+		_, err = dpi.Allocate(context.Background(), requests)
+		Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+	})
+
+	It("Should use legacy VFIO groups when the IOMMUFD gate is disabled", func() {
+		defer gates.setEnabled(IOMMUFD, false)()
+		Expect(os.MkdirAll(filepath.Join(workDir, "dev"), 0744)).To(Succeed())
+		f, err := os.OpenFile(filepath.Join(workDir, "dev", "iommu"), os.O_RDONLY|os.O_CREATE, 0666)
+		Expect(err).ToNot(HaveOccurred())
+		f.Close()
+
+		supported, err := supportsIOMMUFD()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(supported).To(BeFalse())
+	})
+
+	It("Should disable and re-enable devices from the node annotation", func() {
+		oldMap, oldProbe := iommuMap, recoveryProbe
+		defer func() {
+			iommuMap, recoveryProbe = oldMap, oldProbe
+			disabledDevices.update(map[string]bool{})
+		}()
+		iommuMap = getFakeIommuMap()
+
+		changes := applyDisabledDevices([]*GenericDevicePlugin{dpi}, pciAddress2+", 0000:ff:00.0")
+		Expect(changes).To(HaveLen(1))
+		Expect(dpi.queue.drain()).To(Equal([]healthUpdate{{id: iommuGroup2, health: pluginapi.Unhealthy}}))
+
+		// health probes cannot bring a disabled device back
+		dpi.setHealth(iommuGroup2, pluginapi.Healthy)
+		Expect(dpi.queue.drain()).To(BeEmpty())
+
+		// a device failing its probe stays unhealthy when re-enabled
+		probeErr := fmt.Errorf("device node not present")
+		recoveryProbe = func(devicePath, iommuKey string) (uint64, error) {
+			return 0, probeErr
+		}
+		changes = applyDisabledDevices([]*GenericDevicePlugin{dpi}, "")
+		Expect(changes).To(HaveLen(1))
+		Expect(dpi.queue.drain()).To(BeEmpty())
+
+		applyDisabledDevices([]*GenericDevicePlugin{dpi}, pciAddress2)
+		Expect(dpi.queue.drain()).To(HaveLen(1))
+		probeErr = nil
+		applyDisabledDevices([]*GenericDevicePlugin{dpi}, "")
+		Expect(dpi.queue.drain()).To(Equal([]healthUpdate{{id: iommuGroup2, health: pluginapi.Healthy}}))
+	})
+
+	It("Should reserve devices for maintenance until released or expired", func() {
+		oldMap, oldProbe := iommuMap, recoveryProbe
+		defer func() {
+			iommuMap, recoveryProbe = oldMap, oldProbe
+			clk = clock.RealClock{}
+			maintenance.update(map[string]MaintenanceReservation{})
+		}()
+		iommuMap = getFakeIommuMap()
+		clk = clocktesting.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+		recoveryProbe = func(devicePath, iommuKey string) (uint64, error) {
+			return 0, nil
+		}
+
+		annotation := pciAddress1 + "=fw-flash@2026-01-01T01:00:00Z, " + pciAddress2 + "@2025-12-31T00:00:00Z, " + pciAddress3 + "@tomorrow"
+		changes := applyMaintenance([]*GenericDevicePlugin{dpi}, annotation)
+		Expect(changes).To(Equal([]string{"Device 1 of nvidia.com/foo reserved for maintenance job fw-flash"}))
+		Expect(dpi.queue.drain()).To(Equal([]healthUpdate{{id: iommuGroup1, health: pluginapi.Unhealthy}}))
+		Expect(maintenance.reservation(iommuGroup1)).To(Equal(&MaintenanceReservation{Job: "fw-flash", Until: "2026-01-01T01:00:00Z"}))
+		Expect(maintenance.reservation(iommuGroup2)).To(BeNil())
+
+		// health probes cannot bring a reserved device back
+		dpi.setHealth(iommuGroup1, pluginapi.Healthy)
+		Expect(dpi.queue.drain()).To(BeEmpty())
+
+		clk.(*clocktesting.FakeClock).Step(time.Hour)
+		changes = applyMaintenance([]*GenericDevicePlugin{dpi}, annotation)
+		Expect(changes).To(Equal([]string{"Device 1 of nvidia.com/foo released from maintenance"}))
+		Expect(dpi.queue.drain()).To(Equal([]healthUpdate{{id: iommuGroup1, health: pluginapi.Healthy}}))
+	})
+
+	It("Should hold devices unhealthy until the kata runtime is ready", func() {
+		defer func() {
+			requireKataRuntime = false
+			kataRuntimeReady.Store(false)
+		}()
+		requireKataRuntime = true
+		Expect(runtimeGated()).To(BeTrue())
+
+		// health probes cannot bring a gated device back
+		dpi.setHealth(iommuGroup1, pluginapi.Healthy)
+		Expect(dpi.queue.drain()).To(BeEmpty())
+
+		Expect(applyRuntimeGate([]*GenericDevicePlugin{dpi}, true)).To(BeTrue())
+		Expect(runtimeGated()).To(BeFalse())
+		Expect(dpi.queue.drain()).To(HaveLen(len(dpi.devs)))
+		Expect(applyRuntimeGate([]*GenericDevicePlugin{dpi}, true)).To(BeFalse())
+
+		Expect(applyRuntimeGate([]*GenericDevicePlugin{dpi}, false)).To(BeTrue())
+		Expect(dpi.queue.drain()).To(ContainElement(healthUpdate{id: iommuGroup1, health: pluginapi.Unhealthy}))
+	})
+
+	It("Should hold NVSwitches unhealthy until the fabric manager is ready", func() {
+		oldMap := iommuMap
+		defer func() {
+			iommuMap = oldMap
+			fabricManagerReadyFile = ""
+			fabricManagerReady.Store(false)
+		}()
+		iommuMap = getFakeIommuMap()
+		iommuMap[iommuGroup2][0].IsNVSwitch = true
+		fabricManagerReadyFile = "run/nvidia-fabricmanager/ready"
+
+		Expect(fabricGated(iommuGroup1)).To(BeFalse())
+		Expect(fabricGated(iommuGroup2)).To(BeTrue())
+		dpi.setHealth(iommuGroup2, pluginapi.Healthy)
+		Expect(dpi.queue.drain()).To(BeEmpty())
+		Expect(checkFabricManager()).To(MatchError(ContainSubstring("readiness file run/nvidia-fabricmanager/ready not found")))
+
+		Expect(os.MkdirAll(filepath.Join(workDir, "run/nvidia-fabricmanager"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(workDir, "run/nvidia-fabricmanager/ready"), nil, 0644)).To(Succeed())
+		Expect(checkFabricManager()).To(Succeed())
+		Expect(applyFabricGate([]*GenericDevicePlugin{dpi}, true)).To(BeTrue())
+		Expect(fabricGated(iommuGroup2)).To(BeFalse())
+		Expect(dpi.queue.drain()).To(Equal([]healthUpdate{{id: iommuGroup2, health: pluginapi.Healthy}}))
+		Expect(applyFabricGate([]*GenericDevicePlugin{dpi}, true)).To(BeFalse())
+
+		Expect(applyFabricGate([]*GenericDevicePlugin{dpi}, false)).To(BeTrue())
+		Expect(dpi.queue.drain()).To(Equal([]healthUpdate{{id: iommuGroup2, health: pluginapi.Unhealthy}}))
+	})
+
+	It("Should check the fabric manager readiness URL", func() {
+		defer func() { fabricManagerReadyURL = "" }()
+		ready := true
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ready {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+		fabricManagerReadyURL = server.URL
+
+		Expect(checkFabricManager()).To(Succeed())
+		ready = false
+		Expect(checkFabricManager()).To(MatchError(HaveSuffix("answered 503 Service Unavailable")))
+	})
+
+	It("Should not prefer administratively disabled devices", func() {
+		defer disabledDevices.update(map[string]bool{})
+		disabledDevices.update(map[string]bool{iommuGroup1: true})
+
+		req := &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+				AvailableDeviceIDs: []string{iommuGroup3, iommuGroup1, iommuGroup2},
+				AllocationSize:     2,
+			}},
+		}
+		res, err := dpi.GetPreferredAllocation(context.Background(), req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.ContainerResponses[0].DeviceIDs).To(Equal([]string{iommuGroup2, iommuGroup3}))
+	})
+
+	It("Should read the ACS control register from the extended capabilities", func() {
+		config := make([]byte, 4096)
+		// AER capability pointing to the ACS capability at 0x148
+		binary.LittleEndian.PutUint32(config[0x100:], 0x0001|1<<16|0x148<<20)
+		binary.LittleEndian.PutUint32(config[0x148:], pciExtCapIDACS|1<<16)
+		binary.LittleEndian.PutUint16(config[0x14e:], 0x001d)
+
+		ctrl, found := acsControl(config)
+		Expect(found).To(BeTrue())
+		Expect(ctrl).To(Equal(uint16(0x001d)))
+
+		_, found = acsControl(config[:0x148])
+		Expect(found).To(BeFalse())
+	})
+
+	It("Should group devices behind a PCIe switch without ACS redirection", func() {
+		defer func() { acsRedirects = readACSRedirects }()
+		redirecting := map[string]bool{}
+		acsRedirects = func(address string) (bool, error) {
+			return redirecting[address], nil
+		}
+		switched := filepath.Join(workDir, "devices/pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:08.0/0000:03:00.0")
+		direct := filepath.Join(workDir, "devices/pci0000:00/0000:00:02.0/0000:04:00.0")
+		Expect(os.MkdirAll(switched, 0755)).To(Succeed())
+		Expect(os.MkdirAll(direct, 0755)).To(Succeed())
+		Expect(os.Symlink(switched, filepath.Join(workDir, "0000:03:00.0"))).To(Succeed())
+
+		Expect(upstreamBridges(filepath.Join(workDir, "0000:03:00.0"))).To(Equal([]string{"0000:02:08.0", "0000:01:00.0", "0000:00:01.0"}))
+		Expect(getP2PGroup(filepath.Join(workDir, "0000:03:00.0"))).To(Equal("0000:01:00.0"))
+		Expect(getP2PGroup(direct)).To(BeEmpty())
+
+		redirecting["0000:02:08.0"] = true
+		Expect(getP2PGroup(switched)).To(BeEmpty())
+	})
+
+	It("Should prefer devices sharing a P2P group", func() {
+		oldIommuMap := iommuMap
+		defer func() { iommuMap = oldIommuMap }()
+		iommuMap = map[string][]NvidiaPCIDevice{
+			"1": {{Address: "0000:03:00.0", P2PGroup: "0000:01:00.0"}},
+			"2": {{Address: "0000:04:00.0", P2PGroup: "0000:01:00.0"}},
+			"3": {{Address: "0000:83:00.0", P2PGroup: "0000:81:00.0"}},
+			"4": {{Address: "0000:84:00.0", P2PGroup: "0000:81:00.0"}},
+			"5": {{Address: "0000:85:00.0", P2PGroup: "0000:81:00.0"}},
+			"6": {{Address: "0000:c1:00.0"}},
+		}
+		preferred := func(size int32, must ...string) []string {
+			req := &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+					AvailableDeviceIDs:   []string{"6", "5", "4", "3", "2", "1"},
+					MustIncludeDeviceIDs: must,
+					AllocationSize:       size,
+				}},
+			}
+			res, err := dpi.GetPreferredAllocation(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			return res.ContainerResponses[0].DeviceIDs
+		}
+
+		Expect(preferred(1)).To(Equal([]string{"6"}))
+		Expect(preferred(2)).To(Equal([]string{"1", "2"}))
+		Expect(preferred(3)).To(Equal([]string{"3", "4", "5"}))
+		Expect(preferred(4)).To(Equal([]string{"3", "4", "5", "1"}))
+		Expect(preferred(2, "4")).To(Equal([]string{"4", "3"}))
+	})
+
+	It("Should prefer devices on a single NUMA node", func() {
+		oldIommuMap := iommuMap
+		defer func() { iommuMap = oldIommuMap }()
+		iommuMap = map[string][]NvidiaPCIDevice{
+			"1": {{Address: "0000:03:00.0", NumaNode: 0}},
+			"2": {{Address: "0000:04:00.0", NumaNode: 0}},
+			"3": {{Address: "0000:83:00.0", NumaNode: 1}},
+			"4": {{Address: "0000:84:00.0", NumaNode: 1}},
+			"5": {{Address: "0000:85:00.0", NumaNode: 1}},
+			"6": {{Address: "0000:c1:00.0", NumaNode: -1}},
+		}
+		preferred := func(size int32, must ...string) []string {
+			req := &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+					AvailableDeviceIDs:   []string{"6", "5", "4", "3", "2", "1"},
+					MustIncludeDeviceIDs: must,
+					AllocationSize:       size,
+				}},
+			}
+			res, err := dpi.GetPreferredAllocation(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			return res.ContainerResponses[0].DeviceIDs
+		}
+
+		Expect(preferred(1)).To(Equal([]string{"1"}))
+		Expect(preferred(2)).To(Equal([]string{"1", "2"}))
+		Expect(preferred(3)).To(Equal([]string{"3", "4", "5"}))
+		Expect(preferred(4)).To(Equal([]string{"3", "4", "5", "1"}))
+		Expect(preferred(2, "4")).To(Equal([]string{"4", "3"}))
+		Expect(preferred(6)).To(Equal([]string{"3", "4", "5", "1", "2", "6"}))
+
+		Expect(topologyForIommuKey("3")).To(Equal(&pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 1}}}))
+		Expect(topologyForIommuKey("6")).To(BeNil())
+	})
+
+	It("Should discover ConnectX NICs bound to vfio-pci", func() {
+		pciDev := func(address, vendor, class, driver string, group int) {
+			devPath := filepath.Join(workDir, pciDevicesPath, address)
+			Expect(os.MkdirAll(devPath, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(devPath, "vendor"), []byte(vendor+"\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(devPath, "class"), []byte(class+"\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(devPath, "device"), []byte("0x101d\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(devPath, "numa_node"), []byte("1\n"), 0644)).To(Succeed())
+			Expect(os.Symlink("../../bus/pci/drivers/"+driver, filepath.Join(devPath, "driver"))).To(Succeed())
+			Expect(os.Symlink(fmt.Sprintf("../../kernel/iommu_groups/%d", group), filepath.Join(devPath, "iommu_group"))).To(Succeed())
+		}
+		pciDev("0000:04:00.0", "0x15b3", "0x020000", "vfio-pci", 40)
+		pciDev("0000:05:00.0", "0x15b3", "0x020700", "mlx5_core", 41)
+		pciDev("0000:06:00.0", "0x15b3", "0x010802", "vfio-pci", 42)
+		pciDev("0000:07:00.0", "0x8086", "0x020000", "vfio-pci", 43)
+
+		nics, err := discoverNICs()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nics).To(Equal([]NvidiaPCIDevice{{Address: "0000:04:00.0", DeviceID: 0x101d, Driver: "vfio-pci", IommuGroup: 40, NumaNode: 1}}))
+	})
+
+	It("Should pair each GPU with its nearest NIC", func() {
+		place := func(address, topology string) {
+			target := filepath.Join(workDir, "devices", topology, address)
+			Expect(os.MkdirAll(target, 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(workDir, pciDevicesPath), 0755)).To(Succeed())
+			Expect(os.Symlink(target, filepath.Join(workDir, pciDevicesPath, address))).To(Succeed())
+		}
+		place("0000:03:00.0", "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:00.0")
+		place("0000:04:00.0", "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:01.0")
+		place("0000:05:00.0", "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:02.0")
+		place("0000:81:00.0", "pci0000:80/0000:80:01.0")
+		place("0000:82:00.0", "pci0000:80/0000:80:02.0")
+
+		gpus := map[string]NvidiaPCIDevice{
+			"1": {Address: "0000:03:00.0", NumaNode: 0},
+			"2": {Address: "0000:05:00.0", NumaNode: 0},
+			"3": {Address: "0000:81:00.0", NumaNode: 1},
+		}
+		nics := []NvidiaPCIDevice{
+			{Address: "0000:82:00.0", IommuGroup: 41, NumaNode: 1},
+			{Address: "0000:04:00.0", IommuGroup: 40, NumaNode: 0},
+		}
+		pairs := pairNICs(gpus, nics)
+		Expect(pairs).To(HaveLen(2))
+		// both switch GPUs are equally close to the NIC, the first one wins
+		Expect(pairs["1"].Address).To(Equal("0000:04:00.0"))
+		Expect(pairs["3"].Address).To(Equal("0000:82:00.0"))
+	})
+
+	It("Should allocate the paired NIC along with the GPU", func() {
+		defer func() { nicCompanions = nil }()
+		nicCompanions = map[string]NvidiaPCIDevice{iommuGroup1: {Address: "0000:04:00.0", IommuGroup: 40}}
+
+		requests := pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{iommuGroup1}}}}
+		responses, err := dpi.Allocate(context.Background(), &requests)
+		Expect(err).ToNot(HaveOccurred())
+		devs := responses.GetContainerResponses()[0].Devices
+		Expect(devs).To(HaveLen(3))
+		Expect(devs[2].HostPath).To(Equal("/dev/vfio/40"))
+	})
+
+	It("Should address each device of a mixed iommufd host in its own mode", func() {
+		defer func() { nicCompanions = nil }()
+		nicCompanions = map[string]NvidiaPCIDevice{"iommufd:vfio3": {Address: "0000:04:00.0", IommuGroup: 40}}
+		fakeMap := getFakeIommuMap()
+
+		// the NIC without an iommufd device is addressed by its group
+		c := newContainerAllocation(true)
+		Expect(iommufdStrategy{}.allocate(dpi, c, "iommufd:vfio3", "iommufd:vfio3", fakeMap[iommuGroup1])).To(Succeed())
+		var paths []string
+		for _, dev := range c.devices {
+			paths = append(paths, dev.HostPath)
+		}
+		Expect(paths).To(Equal([]string{"/dev/vfio/devices/vfio3", "/dev/vfio/vfio", "/dev/vfio/40"}))
+
+		Expect(healthNodePath("/dev/vfio/devices/", "iommufd:vfio3")).To(Equal("/dev/vfio/devices/vfio3"))
+		Expect(healthNodePath("/dev/vfio/devices/", "group:7")).To(Equal("/dev/vfio/7"))
+	})
+
+	Context("allocation policies", func() {
+		var oldPolicies map[string]bool
+		var oldQuotas map[string]int
+		var pods []corev1.Pod
+		var owners map[string]deviceOwner
+
+		pendingPod := func(namespace, name string, age time.Duration, limits corev1.ResourceList) corev1.Pod {
+			return corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, CreationTimestamp: metav1.NewTime(time.Now().Add(-age))},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name:      "compute",
+					Resources: corev1.ResourceRequirements{Limits: limits},
+				}}},
+				Status: corev1.PodStatus{Phase: corev1.PodPending},
+			}
+		}
+		allocate := func(ids ...string) error {
+			_, err := dpi.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+			})
+			return err
+		}
+
+		BeforeEach(func() {
+			oldPolicies, oldQuotas = allocationPolicies, namespaceQuotas
+			pods, owners = nil, map[string]deviceOwner{}
+			podCorrelatorFunc = func() (*podCorrelator, error) {
+				return &podCorrelator{
+					pods:   func(ctx context.Context) ([]corev1.Pod, error) { return pods, nil },
+					owners: func() (map[string]deviceOwner, error) { return owners, nil },
+				}, nil
+			}
+		})
+
+		AfterEach(func() {
+			allocationPolicies, namespaceQuotas = oldPolicies, oldQuotas
+			podCorrelatorFunc = inClusterPodCorrelator
+		})
+
+		It("Should correlate an allocation to the oldest waiting container", func() {
+			two := corev1.ResourceList{"nvidia.com/foo": resource.MustParse("2")}
+			running := pendingPod("default", "running", 3*time.Hour, two)
+			running.Status.Phase = corev1.PodRunning
+			pods = []corev1.Pod{
+				pendingPod("default", "young", time.Minute, two),
+				pendingPod("default", "allocated", 2*time.Hour, two),
+				pendingPod("default", "old", time.Hour, two),
+				pendingPod("default", "one", 4*time.Hour, corev1.ResourceList{"nvidia.com/foo": resource.MustParse("1")}),
+				running,
+			}
+			owners["nvidia.com/foo/7"] = deviceOwner{Namespace: "default", Pod: "allocated", Container: "compute"}
+
+			correlator, _ := podCorrelatorFunc()
+			pod, owner, err := correlator.correlate("nvidia.com/foo", 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pod.Name).To(Equal("old"))
+			Expect(owner.String()).To(Equal("default/old/compute"))
+
+			_, _, err = correlator.correlate("nvidia.com/foo", 3)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny allocations exceeding the namespace quota", func() {
+			allocationPolicies = parseAllocationPolicies("namespace-quota")
+			namespaceQuotas = parseNamespaceQuotas("team-a=2, team-b=bad")
+			Expect(namespaceQuotas).To(Equal(map[string]int{"team-a": 2}))
+			pods = []corev1.Pod{pendingPod("team-a", "vm", time.Minute, corev1.ResourceList{"nvidia.com/foo": resource.MustParse("2")})}
+
+			Expect(allocate(iommuGroup1, iommuGroup2)).To(Succeed())
+
+			owners["nvidia.com/bar/9"] = deviceOwner{Namespace: "team-a", Pod: "other", Container: "compute"}
+			err := allocate(iommuGroup1, iommuGroup2)
+			Expect(err).To(MatchError(ContainSubstring("exceeding its quota of 2")))
+			Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+			Expect(allocateErrorReason(err)).To(Equal(allocateReasonQuota))
+		})
+
+		It("Should take namespace quotas from the ConfigMap", func() {
+			oldEnvQuotas := envNamespaceQuotas
+			defer func() { envNamespaceQuotas = oldEnvQuotas }()
+			envNamespaceQuotas = map[string]int{"team-a": 2, "team-b": 4}
+			namespaceQuotas = envNamespaceQuotas
+
+			cm := &corev1.ConfigMap{Data: map[string]string{"team-a": "1", "team-c": " 3 ", "team-d": "-1"}}
+			Expect(applyNamespaceQuotas(cm)).To(BeTrue())
+			Expect(namespaceQuotas).To(Equal(map[string]int{"team-a": 1, "team-b": 4, "team-c": 3}))
+			Expect(applyNamespaceQuotas(cm)).To(BeFalse())
+
+			allocationPolicies = parseAllocationPolicies("namespace-quota")
+			pods = []corev1.Pod{pendingPod("team-a", "vm", time.Minute, corev1.ResourceList{"nvidia.com/foo": resource.MustParse("2")})}
+			Expect(allocate(iommuGroup1, iommuGroup2)).To(MatchError(ContainSubstring("exceeding its quota of 1")))
+
+			// a deleted ConfigMap restores the quotas of the environment
+			Expect(applyNamespaceQuotas(nil)).To(BeTrue())
+			Expect(namespaceQuotas).To(Equal(envNamespaceQuotas))
+			Expect(allocate(iommuGroup1, iommuGroup2)).To(Succeed())
+		})
+
+		It("Should deny NVSwitches to pods without GPUs", func() {
+			oldNVSwitchIDs, oldAlias := nvSwitchDeviceIDs, NVSwitchAlias
+			defer func() { nvSwitchDeviceIDs, NVSwitchAlias = oldNVSwitchIDs, oldAlias }()
+			nvSwitchDeviceIDs, NVSwitchAlias = map[string]bool{"22a3": true}, "foo"
+			allocationPolicies = parseAllocationPolicies("deny-nvswitch-only,unknown")
+
+			pods = []corev1.Pod{pendingPod("default", "vm", time.Minute, corev1.ResourceList{"nvidia.com/foo": resource.MustParse("1")})}
+			Expect(allocate(iommuGroup1)).To(MatchError(ContainSubstring("requests NVSwitches without GPUs")))
+
+			pods[0].Spec.Containers[0].Resources.Limits["nvidia.com/pgpu"] = resource.MustParse("8")
+			Expect(allocate(iommuGroup1)).To(Succeed())
+		})
+
+		It("Should allow allocations it cannot correlate", func() {
+			allocationPolicies = parseAllocationPolicies("namespace-quota")
+			namespaceQuotas = parseNamespaceQuotas("default=0")
+			Expect(allocate(iommuGroup1)).To(Succeed())
+		})
+	})
 })
@@ -37,17 +37,64 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	resource "k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 const (
 	ctxTimeout = 5 * time.Second
+
+	// kataRuntimeLabelKey marks nodes the kata runtime is installed on
+	kataRuntimeLabelKey   = "katacontainers.io/kata-runtime"
+	kataRuntimeLabelValue = "true"
+	// kataRuntimeWaitTimeout bounds the wait for the kata runtime label
+	kataRuntimeWaitTimeout = 20 * time.Minute
+
+	defaultGFDServiceAccount = "nvidia-sandbox-device-plugin"
 )
 
+// gfdPodConfig is the placement and identity of the GFD pod
+type gfdPodConfig struct {
+	namespace        string
+	serviceAccount   string
+	imagePullSecrets []string
+	priorityClass    string
+}
+
+// loadGFDPodConfig reads the GFD pod configuration from the environment. The
+// pod runs in the namespace of the device plugin unless GFD_NAMESPACE is set.
+func loadGFDPodConfig() gfdPodConfig {
+	var secrets []string
+	for _, secret := range strings.Split(os.Getenv("GFD_IMAGE_PULL_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return gfdPodConfig{
+		namespace:        getEnvString("GFD_NAMESPACE", os.Getenv("POD_NAMESPACE")),
+		serviceAccount:   getEnvString("GFD_SERVICE_ACCOUNT", defaultGFDServiceAccount),
+		imagePullSecrets: secrets,
+		priorityClass:    os.Getenv("GFD_PRIORITY_CLASS"),
+	}
+}
+
+// verifyServiceAccount returns an error if the service account does not
+// exist, since a pod referencing it would never be admitted
+func verifyServiceAccount(clientset kubernetes.Interface, namespace, name string) error {
+	ctx, cancel := apiContext()
+	defer cancel()
+	if _, err := clientset.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("service account %s/%s does not exist", namespace, name)
+		}
+		return fmt.Errorf("error fetching service account %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
 func getGFDImageName(clientset *kubernetes.Clientset, namespace string) string {
 	// if there is an override on the image, then use that
 	gfdImage := os.Getenv("GFD_IMAGE")
@@ -56,7 +103,7 @@ func getGFDImageName(clientset *kubernetes.Clientset, namespace string) string {
 	}
 
 	// else use self image
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	ctx, cancel := apiContext()
 	defer cancel()
 	podName := os.Getenv("HOSTNAME")
 	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
@@ -69,7 +116,17 @@ func getGFDImageName(clientset *kubernetes.Clientset, namespace string) string {
 	return gfdImage
 }
 
-func runGFD() {
+// labelNodeWithGFD labels the node once, natively in GFD_FALLBACK_MODE and
+// otherwise with a GFD pod that is deleted once it completed
+func labelNodeWithGFD() {
+	// label natively when the GFD image cannot run on this cluster
+	if mode := os.Getenv("GFD_FALLBACK_MODE"); mode != "" {
+		if err := runNativeLabeling(mode); err != nil {
+			log.Printf("Error writing native GPU labels: %v", err)
+		}
+		return
+	}
+
 	// 1. Get the Node Name from the environment (passed via Downward API)
 	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
@@ -81,16 +138,22 @@ func runGFD() {
 		log.Printf("POD_NAMESPACE environment variable is required for running GFD")
 		return
 	}
+	cfg := loadGFDPodConfig()
 
 	// 2. Authenticate within the cluster
-	config, err := rest.InClusterConfig()
+	clientset, err := newInClusterClientset()
 	if err != nil {
-		log.Printf("Error obtaining cluster credentials for GFD launch: %v", err.Error())
+		log.Printf("Error authenticating for GFD launch: %v", err.Error())
 		return
 	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Printf("Error obtaining clientset for GFD launch: %v", err.Error())
+
+	// report the exact permissions missing rather than the API errors of the launch
+	if missing, err := missingRBAC(selfAccessReviewer(clientset), gfdRBACRequirements()); err != nil {
+		log.Printf("Unable to verify GFD permissions: %v", err)
+	} else if len(missing) > 0 {
+		msg := fmt.Sprintf("Not launching GFD pod: missing permissions: %s", formatMissingRBAC(missing))
+		log.Print(msg)
+		events.warning("GFDFailed", msg)
 		return
 	}
 
@@ -99,45 +162,61 @@ func runGFD() {
 		log.Printf("Error: No GFD Image available to run GFD")
 	}
 
-	err = WaitForKataRuntime(clientset, nodeName)
+	err = WaitForKataRuntime(nodeName)
 	if err != nil {
 		log.Printf("Error waiting for Kata runtime to come up for GFD job: %v", err.Error())
 		return
 	}
 
+	resolver := NewRuntimeClassResolver(clientset, nodeName)
+	runtimeClassName, err := resolver.Resolve()
+	if err != nil {
+		log.Printf("Error resolving runtime class, using %s: %v", defaultRuntimeClass, err)
+		runtimeClassName = defaultRuntimeClass
+	}
+	if err := resolver.Publish(runtimeClassName); err != nil {
+		log.Printf("Error publishing runtime class: %v", err)
+	}
+
+	if err := verifyServiceAccount(clientset, cfg.namespace, cfg.serviceAccount); err != nil {
+		log.Printf("Not launching GFD pod: %v", err)
+		events.warning("GFDFailed", fmt.Sprintf("Not launching GFD pod: %v", err))
+		return
+	}
+
 	// 3. Create the gfd pod and delete when its done
-	gfdPod := createGFDPod(clientset, nodeName, namespace, gfdImage)
+	namespace = cfg.namespace
+	if gfdMaxConcurrent > 0 {
+		sem := newGFDSemaphore(clientset.CoordinationV1().Leases(namespace), nodeName, int(gfdMaxConcurrent))
+		release, err := sem.acquire(daemonCtx)
+		if err != nil {
+			log.Printf("Not launching GFD pod: %v", err)
+			events.warning("GFDFailed", fmt.Sprintf("Not launching GFD pod: %v", err))
+			return
+		}
+		defer release()
+	}
+	gfdPod := createGFDPod(nodeName, gfdImage, runtimeClassName, cfg)
 	err = LaunchPodWithRetries(clientset, gfdPod, namespace)
 	if err != nil {
 		log.Printf("Error creating GFD pod: %v", err.Error())
+		events.warning("GFDFailed", fmt.Sprintf("Creating GFD pod %s/%s failed: %v", namespace, gfdPod.Name, err))
 		return
 	}
+	events.normal("GFDLaunched", fmt.Sprintf("Launched GFD pod %s/%s with runtime class %s", namespace, gfdPod.Name, runtimeClassName))
 	err = CheckAndDeleteCompletedPod(clientset, gfdPod.Name, namespace)
 	if err != nil {
 		log.Printf("Error reaping GFD pod: %v", err.Error())
+		events.warning("GFDFailed", fmt.Sprintf("GFD pod %s/%s did not complete: %v", namespace, gfdPod.Name, err))
 		return
 	}
 
 	log.Println("GFD pod launched and cleaned up successfully.")
-	return
+	events.normal("GFDCompleted", fmt.Sprintf("GFD pod %s/%s completed", namespace, gfdPod.Name))
 }
 
-func createGFDPod(clientset *kubernetes.Clientset, nodeName, namespace, gfdImage string) *corev1.Pod {
+func createGFDPod(nodeName, gfdImage, runtimeClassName string, cfg gfdPodConfig) *corev1.Pod {
 	var trueValue bool = true
-	var runtimeClassName string = "kata-qemu-nvidia-gpu"
-	// check if this is an snp machine with ConfidentialContainers enabled
-	exists, value := getNodeLabel(clientset, nodeName, "nvidia.com/cc.ready.state")
-	if exists && strings.EqualFold(value, "true") {
-		exists, value = getNodeLabel(clientset, nodeName, "amd.feature.node.kubernetes.io/snp")
-		if exists && strings.EqualFold(value, "true") {
-			runtimeClassName = "kata-qemu-nvidia-gpu-snp"
-		} else {
-			exists, value = getNodeLabel(clientset, nodeName, "intel.feature.node.kubernetes.io/tdx")
-			if exists && strings.EqualFold(value, "true") {
-				runtimeClassName = "kata-qemu-nvidia-gpu-tdx"
-			}
-		}
-	}
 	log.Printf("Runtime class for GFD pod: %s", runtimeClassName)
 
 	resourceName := fmt.Sprintf("%s/%s", DeviceNamespace, getGPUDeviceName())
@@ -152,7 +231,8 @@ func createGFDPod(clientset *kubernetes.Clientset, nodeName, namespace, gfdImage
 			NodeName:           nodeName, // This forces the pod to land on the specific node
 			RestartPolicy:      corev1.RestartPolicyOnFailure,
 			RuntimeClassName:   &runtimeClassName,
-			ServiceAccountName: "nvidia-sandbox-device-plugin",
+			ServiceAccountName: cfg.serviceAccount,
+			PriorityClassName:  cfg.priorityClass,
 			Containers: []corev1.Container{
 				{
 					Name:    "gpu-feature-discovery",
@@ -163,7 +243,7 @@ func createGFDPod(clientset *kubernetes.Clientset, nodeName, namespace, gfdImage
 						{Name: "GFD_ONESHOT", Value: "true"},
 						{Name: "GFD_USE_NODE_FEATURE_API", Value: "true"},
 						{Name: "NODE_NAME", Value: nodeName},
-						{Name: "NAMESPACE", Value: namespace},
+						{Name: "NAMESPACE", Value: cfg.namespace},
 					},
 					Resources: corev1.ResourceRequirements{
 						Limits: corev1.ResourceList{
@@ -208,36 +288,23 @@ func createGFDPod(clientset *kubernetes.Clientset, nodeName, namespace, gfdImage
 			},
 		},
 	}
-	return pod
-}
-
-// getNodeLabel gets a specified label from the node. returns boolean(found/not-found),
-// and string(value)
-func getNodeLabel(clientset *kubernetes.Clientset, nodeName, labelKey string) (bool, string) {
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-	defer cancel()
-	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-	if err != nil {
-		// Returning (false, nil) tells the backoff to keep trying
-		log.Printf("API Error fetching node: %v", err)
-		return false, ""
-	}
-
-	val, exists := node.Labels[labelKey]
-	if exists {
-		log.Printf("Success: Label %s found!", labelKey)
-		return true, val
+	for _, secret := range cfg.imagePullSecrets {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: secret})
 	}
-	return false, ""
+	return pod
 }
 
 // LaunchPodWithRetries creates the pod object with exponential backoff based retries
 func LaunchPodWithRetries(clientset *kubernetes.Clientset, pod *corev1.Pod, namespace string) error {
 
 	// attempt a delete if the pod already exists
-	existingPod, err := clientset.CoreV1().Pods(namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	getCtx, cancel := apiContext()
+	defer cancel()
+	existingPod, err := clientset.CoreV1().Pods(namespace).Get(getCtx, pod.Name, metav1.GetOptions{})
 	if err == nil {
-		err = clientset.CoreV1().Pods(namespace).Delete(context.Background(), existingPod.Name, metav1.DeleteOptions{})
+		deleteCtx, cancel := apiContext()
+		defer cancel()
+		err = clientset.CoreV1().Pods(namespace).Delete(deleteCtx, existingPod.Name, metav1.DeleteOptions{})
 		if err != nil {
 			fmt.Printf("Error deleting existing GFD pod: %v", err.Error())
 			return err
@@ -254,8 +321,8 @@ func LaunchPodWithRetries(clientset *kubernetes.Clientset, pod *corev1.Pod, name
 	}
 
 	// 2. Execute the retry logic
-	err = wait.ExponentialBackoff(backoff, func() (bool, error) {
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	err = wait.ExponentialBackoffWithContext(daemonCtx, backoff, func(innerCtx context.Context) (bool, error) {
+		ctx, cancel := context.WithTimeout(innerCtx, ctxTimeout)
 		defer cancel()
 
 		result, err := clientset.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{})
@@ -270,48 +337,24 @@ func LaunchPodWithRetries(clientset *kubernetes.Clientset, pod *corev1.Pod, name
 	return err
 }
 
-// WaitForKataRuntime
-func WaitForKataRuntime(clientset *kubernetes.Clientset, nodeName string) error {
-	kataRuntimeLabelKey := "katacontainers.io/kata-runtime"
-	kataRuntimeLabelValue := "true"
-
-	// 1. Define the Exponential Backoff parameters
-	backoff := wait.Backoff{
-		Duration: 1 * time.Second,  // Initial delay
-		Factor:   1.5,              // Multiply delay by this factor each step
-		Jitter:   0.1,              // Add random variation to avoid "thundering herd"
-		Steps:    50,               // Total number of retries
-		Cap:      30 * time.Second, // Maximum delay between any two attempts
+// WaitForKataRuntime waits for the kata runtime label on the node or one of
+// its NFD NodeFeatures and for the RuntimeClass its sandboxes use, reacting
+// to label and RuntimeClass changes as they are watched
+func WaitForKataRuntime(nodeName string) error {
+	k, err := watchKataRuntime(nodeName)
+	if err != nil {
+		return err
 	}
+	log.Printf("Waiting for label %s=%s and the kata RuntimeClass on node %s...", kataRuntimeLabelKey, kataRuntimeLabelValue, nodeName)
 
-	log.Printf("Monitoring node %s with exponential backoff...\n", nodeName)
-
-	// 2. Execute the retry logic
-	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-
-		node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-		if err != nil {
-			// Returning (false, nil) tells the backoff to keep trying
-			log.Printf("API Error fetching node: %v. Retrying...\n", err)
-			return false, nil
-		}
-
-		val, exists := node.Labels[kataRuntimeLabelKey]
-		if exists && val == kataRuntimeLabelValue {
-			log.Printf("Success: Label %s found!", kataRuntimeLabelKey)
-			return true, nil // (true, nil) stops the loop successfully
-		}
-
-		log.Printf("Label %s=%s not found yet. Backing off...\n", kataRuntimeLabelKey, kataRuntimeLabelValue)
-		return false, nil
-	})
-
-	if err != nil {
-		log.Printf("Finished: Could not find label after %d attempts. Error: %v\n", backoff.Steps, err)
+	ctx, cancel := context.WithTimeout(daemonCtx, kataRuntimeWaitTimeout)
+	defer cancel()
+	if err := k.wait(ctx); err != nil {
+		log.Printf("Finished: Kata runtime not ready within %v. Error: %v", kataRuntimeWaitTimeout, err)
+		return err
 	}
-	return err
+	log.Printf("Success: Kata runtime is ready!")
+	return nil
 }
 
 // CheckAndDeleteCompletedPod checks if a pod is 'Succeeded' (Completed) and deletes it.
@@ -326,7 +369,7 @@ func CheckAndDeleteCompletedPod(clientset *kubernetes.Clientset, name, namespace
 	}
 
 	// 2. Execute the retry loop
-	err := wait.ExponentialBackoffWithContext(context.Background(), backoff, func(innerCtx context.Context) (bool, error) {
+	err := wait.ExponentialBackoffWithContext(daemonCtx, backoff, func(innerCtx context.Context) (bool, error) {
 		pod, err := clientset.CoreV1().Pods(namespace).Get(innerCtx, name, metav1.GetOptions{})
 		if err != nil {
 			// If the pod is gone, we stop retrying and return an error
@@ -361,23 +404,12 @@ func CheckAndDeleteCompletedPod(clientset *kubernetes.Clientset, name, namespace
 }
 
 func getGPUDeviceName() string {
-	for deviceID, _ := range deviceMap {
+	for deviceID := range deviceMap {
 		// Determine device name - skip nvswitch
-		var deviceName string
 		if isNVSwitchDeviceID(deviceID) {
 			continue
 		}
-
-		if PGPUAlias != "" {
-			deviceName = PGPUAlias
-		} else {
-			deviceName = getDeviceNameForID(deviceID)
-		}
-
-		if deviceName == "" {
-			log.Printf("Error: Could not find device name for device id: %s", deviceID)
-			deviceName = deviceID
-		}
+		deviceName := resourceNameForDeviceID(deviceID)
 		// return the first valid GPU device name, in case of heterogeneous nodes, this
 		// will be insufficent, but we are limited by GFD labeling
 		return deviceName
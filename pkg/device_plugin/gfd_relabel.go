@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// gfdEnabled labels the node with GFD or, in GFD_FALLBACK_MODE,
+	// natively; disabled, the node is not labeled at all
+	gfdEnabled = getEnvBool("GFD_ENABLED", true)
+	// gfdRelabelInterval is the interval at which the node is labeled again,
+	// so that the labels follow driver and MIG changes; 0 labels it once
+	gfdRelabelInterval = getEnvDuration("GFD_RELABEL_INTERVAL", 0)
+	// gfdRelabelOnDeviceChange labels the node again whenever the advertised
+	// device set changes
+	gfdRelabelOnDeviceChange = getEnvBool("GFD_RELABEL_ON_DEVICE_CHANGE", false)
+)
+
+// gfdRelabelTrigger requests a GFD run when the advertised device set changes
+type gfdRelabelTrigger struct {
+	lock sync.Mutex
+	// devices is the device set last observed, nil before the first
+	// observation
+	devices []string
+	ch      chan struct{}
+}
+
+var gfdRelabel = &gfdRelabelTrigger{ch: make(chan struct{}, 1)}
+
+// deviceSet returns the sorted "<resource name>/<device ID>" of the devices of
+// the plugins
+func deviceSet(plugins []*GenericDevicePlugin) []string {
+	devices := []string{}
+	for _, dp := range plugins {
+		for _, dev := range dp.devices() {
+			devices = append(devices, dp.deviceName+"/"+dev.ID)
+		}
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// observe records the devices of the serving plugins and, with
+// GFD_RELABEL_ON_DEVICE_CHANGE, requests a GFD run if they changed since the
+// last observation. The first observation only records them, since the node
+// is labeled once the plugins are started anyway.
+func (t *gfdRelabelTrigger) observe(plugins []*GenericDevicePlugin) {
+	devices := deviceSet(plugins)
+	t.lock.Lock()
+	changed := t.devices != nil && strings.Join(t.devices, ",") != strings.Join(devices, ",")
+	t.devices = devices
+	t.lock.Unlock()
+	if !changed || !gfdRelabelOnDeviceChange {
+		return
+	}
+	select {
+	case t.ch <- struct{}{}:
+	default:
+		// a run is already pending
+	}
+}
+
+// runGFD labels the node once the device plugins are started, then again
+// every GFD_RELABEL_INTERVAL and, with GFD_RELABEL_ON_DEVICE_CHANGE, whenever
+// the advertised device set changes, until the daemon context is canceled.
+// Device set changes during a run are coalesced into a single next run.
+func runGFD() {
+	if !gfdEnabled {
+		log.Printf("GFD is disabled, not labeling the node")
+		return
+	}
+	labelNodeWithGFD()
+	if gfdRelabelInterval <= 0 && !gfdRelabelOnDeviceChange {
+		return
+	}
+
+	var tick <-chan time.Time
+	if gfdRelabelInterval > 0 {
+		ticker := clk.NewTicker(gfdRelabelInterval)
+		defer ticker.Stop()
+		tick = ticker.C()
+	}
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-tick:
+			log.Printf("Relabeling the node after %s", gfdRelabelInterval)
+		case <-gfdRelabel.ch:
+			log.Printf("Relabeling the node after the advertised devices changed")
+		}
+		labelNodeWithGFD()
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+const (
+	// gfdSlotLeasePrefix names the leases used as GFD launch slots
+	gfdSlotLeasePrefix = "sandbox-gfd-slot-"
+
+	defaultGFDSlotLeaseDuration = 10 * time.Minute
+	defaultGFDSlotRetryInterval = 15 * time.Second
+)
+
+var (
+	// gfdMaxConcurrent bounds the GFD pods running at once across the
+	// cluster; 0 launches them without coordination
+	gfdMaxConcurrent = getEnvUint("GFD_MAX_CONCURRENT", 0)
+	// gfdSlotLeaseDuration is how long a slot stays held without renewal,
+	// after which a crashed holder's slot is taken over
+	gfdSlotLeaseDuration = getEnvDuration("GFD_SLOT_LEASE_DURATION", defaultGFDSlotLeaseDuration)
+	// gfdSlotRetryInterval is the interval at which a queued node retries
+	// to take a slot
+	gfdSlotRetryInterval = defaultGFDSlotRetryInterval
+)
+
+// gfdSemaphore limits the GFD pods launched at once across the cluster. Each
+// slot is a coordination.k8s.io Lease held by the node running a GFD pod.
+type gfdSemaphore struct {
+	leases   coordinationv1client.LeaseInterface
+	holder   string
+	slots    int
+	duration time.Duration
+}
+
+func newGFDSemaphore(leases coordinationv1client.LeaseInterface, holder string, slots int) *gfdSemaphore {
+	duration := gfdSlotLeaseDuration
+	if duration < time.Second {
+		duration = defaultGFDSlotLeaseDuration
+	}
+	return &gfdSemaphore{
+		leases:   leases,
+		holder:   holder,
+		slots:    slots,
+		duration: duration,
+	}
+}
+
+// acquire waits until a slot is taken and returns the function releasing it.
+// The slot is renewed until it is released. Nodes waiting for a slot are
+// reported with an event once, when they are first queued.
+func (s *gfdSemaphore) acquire(ctx context.Context) (func(), error) {
+	queued := false
+	for {
+		name, holders, err := s.tryAcquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			log.Printf("Acquired GFD slot %s", name)
+			if queued {
+				events.normal("GFDSlotAcquired", fmt.Sprintf("Acquired GFD slot %s", name))
+			}
+			return s.hold(name), nil
+		}
+		if !queued {
+			queued = true
+			msg := fmt.Sprintf("Waiting for one of %d GFD slot(s), held by %s", s.slots, strings.Join(holders, ", "))
+			log.Print(msg)
+			events.normal("GFDQueued", msg)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-clk.After(gfdSlotRetryInterval):
+		}
+	}
+}
+
+// tryAcquire tries to take each slot once. It returns the name of the lease
+// taken, or the holders of the slots if all are taken.
+func (s *gfdSemaphore) tryAcquire(ctx context.Context) (string, []string, error) {
+	var holders []string
+	for i := 0; i < s.slots; i++ {
+		name := fmt.Sprintf("%s%d", gfdSlotLeasePrefix, i)
+		reqCtx, cancel := context.WithTimeout(ctx, ctxTimeout)
+		lease, err := s.leases.Get(reqCtx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = s.leases.Create(reqCtx, s.leaseFor(&coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: name}}), metav1.CreateOptions{})
+			cancel()
+			if err == nil {
+				return name, nil, nil
+			}
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+			return "", nil, fmt.Errorf("failed to create GFD slot %s: %w", name, err)
+		}
+		if err != nil {
+			cancel()
+			return "", nil, fmt.Errorf("failed to get GFD slot %s: %w", name, err)
+		}
+		if holder := s.heldBy(lease); holder != "" {
+			cancel()
+			holders = append(holders, holder)
+			continue
+		}
+		_, err = s.leases.Update(reqCtx, s.leaseFor(lease), metav1.UpdateOptions{})
+		cancel()
+		if err == nil {
+			return name, nil, nil
+		}
+		// another node took the slot first
+		if apierrors.IsConflict(err) {
+			continue
+		}
+		return "", nil, fmt.Errorf("failed to take GFD slot %s: %w", name, err)
+	}
+	return "", holders, nil
+}
+
+// heldBy returns the holder of the lease, or "" if the slot is free, held by
+// us, or its holder stopped renewing it
+func (s *gfdSemaphore) heldBy(lease *coordinationv1.Lease) string {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || *spec.HolderIdentity == s.holder {
+		return ""
+	}
+	if spec.RenewTime != nil && spec.LeaseDurationSeconds != nil {
+		expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+		if clk.Now().After(expiry) {
+			log.Printf("Taking over GFD slot %s from %s, which stopped renewing it", lease.Name, *spec.HolderIdentity)
+			return ""
+		}
+	}
+	return *spec.HolderIdentity
+}
+
+// leaseFor returns a copy of the lease held by us and renewed now
+func (s *gfdSemaphore) leaseFor(lease *coordinationv1.Lease) *coordinationv1.Lease {
+	lease = lease.DeepCopy()
+	holder := s.holder
+	seconds := int32(s.duration / time.Second)
+	now := metav1.NewMicroTime(clk.Now())
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	return lease
+}
+
+// hold renews the slot until the returned function releases it
+func (s *gfdSemaphore) hold(name string) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := clk.NewTicker(s.duration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				if err := s.update(name, true); err != nil {
+					log.Printf("Error renewing GFD slot %s: %v", name, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		if err := s.update(name, false); err != nil {
+			log.Printf("Error releasing GFD slot %s: %v", name, err)
+			return
+		}
+		log.Printf("Released GFD slot %s", name)
+	}
+}
+
+// update renews the slot, or releases it, if we still hold it
+func (s *gfdSemaphore) update(name string, renew bool) error {
+	ctx, cancel := apiContext()
+	defer cancel()
+	lease, err := s.leases.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != s.holder {
+		return fmt.Errorf("slot was taken over by another node")
+	}
+	lease = lease.DeepCopy()
+	if renew {
+		now := metav1.NewMicroTime(clk.Now())
+		lease.Spec.RenewTime = &now
+	} else {
+		lease.Spec.HolderIdentity = nil
+		lease.Spec.AcquireTime = nil
+		lease.Spec.RenewTime = nil
+	}
+	_, err = s.leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	defaultGrpcMaxConcurrentStreams = 64
+	defaultGrpcRPCTimeout           = 30 * time.Second
+	defaultGrpcKeepaliveTime        = 2 * time.Minute
+	defaultGrpcKeepaliveTimeout     = 20 * time.Second
+	grpcKeepaliveMinTime            = 10 * time.Second
+)
+
+// grpcServerConfig holds the limits applied to the device plugin gRPC server
+type grpcServerConfig struct {
+	maxConcurrentStreams  uint32
+	rpcTimeout            time.Duration
+	keepaliveTime         time.Duration
+	keepaliveTimeout      time.Duration
+	maxConnectionAge      time.Duration
+	maxConnectionAgeGrace time.Duration
+}
+
+// loadGrpcServerConfig reads the gRPC server limits from the environment.
+// Connection age limits are disabled by default since kubelet keeps a single
+// long-lived ListAndWatch stream open per plugin.
+func loadGrpcServerConfig() grpcServerConfig {
+	return grpcServerConfig{
+		maxConcurrentStreams:  getEnvUint("GRPC_MAX_CONCURRENT_STREAMS", defaultGrpcMaxConcurrentStreams),
+		rpcTimeout:            getEnvDuration("GRPC_RPC_TIMEOUT", defaultGrpcRPCTimeout),
+		keepaliveTime:         getEnvDuration("GRPC_KEEPALIVE_TIME", defaultGrpcKeepaliveTime),
+		keepaliveTimeout:      getEnvDuration("GRPC_KEEPALIVE_TIMEOUT", defaultGrpcKeepaliveTimeout),
+		maxConnectionAge:      getEnvDuration("GRPC_MAX_CONNECTION_AGE", 0),
+		maxConnectionAgeGrace: getEnvDuration("GRPC_MAX_CONNECTION_AGE_GRACE", 0),
+	}
+}
+
+// serverOptions converts the config to gRPC server options
+func (c grpcServerConfig) serverOptions() []grpc.ServerOption {
+	params := keepalive.ServerParameters{
+		Time:    c.keepaliveTime,
+		Timeout: c.keepaliveTimeout,
+	}
+	if c.maxConnectionAge > 0 {
+		params.MaxConnectionAge = c.maxConnectionAge
+		params.MaxConnectionAgeGrace = c.maxConnectionAgeGrace
+	}
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(params),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             grpcKeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+	}
+	if c.maxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.maxConcurrentStreams))
+	}
+	if c.rpcTimeout > 0 {
+		opts = append(opts, grpc.UnaryInterceptor(rpcTimeoutInterceptor(c.rpcTimeout)))
+	}
+	return opts
+}
+
+// rpcTimeoutInterceptor bounds every unary RPC with the given timeout so a
+// stuck request cannot hold resources indefinitely. Streaming RPCs such as
+// ListAndWatch are long-lived by design and are not affected.
+func rpcTimeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// healthAgentSourceKey is the gRPC metadata key naming the reporting agent
+	healthAgentSourceKey = "source"
+	// defaultHealthAgentSource is used when an agent does not name itself
+	defaultHealthAgentSource = "default"
+)
+
+// healthAgentSocket is the unix socket external health agents report on;
+// empty disables the API
+var healthAgentSocket = getEnvString("HEALTH_AGENT_SOCKET", "")
+
+// externalHealthSet holds the health verdicts pushed by external agents per
+// PCI address and agent
+type externalHealthSet struct {
+	lock     sync.RWMutex
+	verdicts map[string]map[string]string
+}
+
+var externalHealth = newExternalHealthSet()
+
+func newExternalHealthSet() *externalHealthSet {
+	return &externalHealthSet{verdicts: make(map[string]map[string]string)}
+}
+
+// unhealthy returns true if any agent reported a function of the device with
+// the IOMMU key unhealthy
+func (e *externalHealthSet) unhealthy(iommuKey string) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	for _, dev := range iommuMap[iommuKey] {
+		for _, health := range e.verdicts[dev.Address] {
+			if health == pluginapi.Unhealthy {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// update records the verdicts of an agent and returns the PCI addresses whose
+// verdict changed. An empty health clears the verdict of the agent.
+func (e *externalHealthSet) update(source string, verdicts map[string]string) []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var changed []string
+	for address, health := range verdicts {
+		sources := e.verdicts[address]
+		if sources[source] == health {
+			continue
+		}
+		if health == "" {
+			delete(sources, source)
+			if len(sources) == 0 {
+				delete(e.verdicts, address)
+			}
+		} else {
+			if sources == nil {
+				sources = make(map[string]string)
+				e.verdicts[address] = sources
+			}
+			sources[source] = health
+		}
+		changed = append(changed, address)
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// iommuKeyForAddress returns the IOMMU key of the discovered device at the
+// PCI address
+func iommuKeyForAddress(address string) (string, bool) {
+	for iommuKey, devs := range iommuMap {
+		for _, dev := range devs {
+			if dev.Address == address {
+				return iommuKey, true
+			}
+		}
+	}
+	return "", false
+}
+
+// HealthAgentServer receives device health verdicts from external agents
+type HealthAgentServer interface {
+	// ReportHealth records the health of the devices in the request. The ID
+	// of each device is its PCI address and its health is Healthy, Unhealthy
+	// or empty to withdraw an earlier verdict of the agent.
+	ReportHealth(context.Context, *pluginapi.ListAndWatchResponse) (*pluginapi.Empty, error)
+}
+
+// healthAgentServer applies external verdicts to the plugins of the manager
+type healthAgentServer struct {
+	manager *DevicePluginManager
+}
+
+// ReportHealth records the verdicts of the agent named by the "source"
+// metadata and re-evaluates the health of the affected devices, which are
+// unhealthy if either an internal probe or any agent reports them unhealthy
+func (s *healthAgentServer) ReportHealth(ctx context.Context, req *pluginapi.ListAndWatchResponse) (*pluginapi.Empty, error) {
+	source := defaultHealthAgentSource
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(healthAgentSourceKey); len(values) > 0 && values[0] != "" {
+			source = values[0]
+		}
+	}
+
+	verdicts := make(map[string]string)
+	for _, dev := range req.GetDevices() {
+		if !pciAddressRegexp.MatchString(dev.ID) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid PCI address %q", dev.ID)
+		}
+		switch dev.Health {
+		case pluginapi.Healthy, pluginapi.Unhealthy, "":
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "invalid health %q of %s", dev.Health, dev.ID)
+		}
+		verdicts[dev.ID] = dev.Health
+	}
+
+	keys := make(map[string]bool)
+	for _, address := range externalHealth.update(source, verdicts) {
+		iommuKey, ok := iommuKeyForAddress(address)
+		if !ok {
+			log.Printf("Health agent %s reported unknown device %s", source, address)
+			continue
+		}
+		log.Printf("Health agent %s reported device %s as %q", source, address, verdicts[address])
+		keys[iommuKey] = true
+	}
+	for _, dp := range s.manager.Plugins() {
+		for _, dev := range dp.devs {
+			if keys[iommuKeyForDeviceID(dev.ID)] {
+				dp.reevaluateHealth(dev.ID)
+			}
+		}
+	}
+	return &pluginapi.Empty{}, nil
+}
+
+func _HealthAgent_ReportHealth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(pluginapi.ListAndWatchResponse)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HealthAgentServer).ReportHealth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/v1alpha1.HealthAgent/ReportHealth",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HealthAgentServer).ReportHealth(ctx, req.(*pluginapi.ListAndWatchResponse))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// healthAgentServiceDesc describes the v1alpha1.HealthAgent service. Its
+// messages are those of the device plugin API so agents can use the
+// generated kubelet client types.
+var healthAgentServiceDesc = grpc.ServiceDesc{
+	ServiceName: "v1alpha1.HealthAgent",
+	HandlerType: (*HealthAgentServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ReportHealth",
+			Handler:    _HealthAgent_ReportHealth_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "health_agent.proto",
+}
+
+// serveHealthAgent serves the health agent API on the unix socket until the
+// daemon context is canceled
+func serveHealthAgent(m *DevicePluginManager) {
+	if healthAgentSocket == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(healthAgentSocket), 0755); err != nil {
+		log.Printf("Error creating health agent socket directory: %v", err)
+		return
+	}
+	if err := os.Remove(healthAgentSocket); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing stale health agent socket: %v", err)
+		return
+	}
+	listener, err := net.Listen("unix", healthAgentSocket)
+	if err != nil {
+		log.Printf("Error listening on health agent socket %s: %v", healthAgentSocket, err)
+		return
+	}
+
+	server := grpc.NewServer(auxGRPCServerOptions()...)
+	server.RegisterService(&healthAgentServiceDesc, &healthAgentServer{manager: m})
+	go func() {
+		<-daemonCtx.Done()
+		server.Stop()
+	}()
+	log.Printf("Serving health agent API on %s", healthAgentSocket)
+	if err := server.Serve(listener); err != nil {
+		log.Printf("Error serving health agent API: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultHealthFlapThreshold = 6
+	defaultHealthFlapWindow    = 5 * time.Minute
+	defaultHealthFlapCooldown  = 10 * time.Minute
+)
+
+var (
+	// healthFlapThreshold is the number of health transitions within
+	// healthFlapWindow after which a device is pinned unhealthy; zero
+	// disables flap suppression
+	healthFlapThreshold = getEnvUint("HEALTH_FLAP_THRESHOLD", defaultHealthFlapThreshold)
+	healthFlapWindow    = getEnvDuration("HEALTH_FLAP_WINDOW", defaultHealthFlapWindow)
+	// healthFlapCooldown is how long a flapping device stays unhealthy
+	healthFlapCooldown = getEnvDuration("HEALTH_FLAP_COOLDOWN", defaultHealthFlapCooldown)
+
+	healthFlaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sandbox_device_plugin_health_flaps_total",
+		Help: "Devices pinned unhealthy for flapping between healthy and unhealthy per resource.",
+	}, []string{"resource"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(healthFlaps)
+}
+
+// flapState tracks the recent health transitions of a device
+type flapState struct {
+	last        string
+	transitions []time.Time
+	pinnedUntil time.Time
+}
+
+// flapDetector pins devices unhealthy whose health changes too often, e.g.
+// because of a loose power cable or a resetting firmware, so that they do not
+// thrash scheduling
+type flapDetector struct {
+	lock    sync.Mutex
+	devices map[string]*flapState
+}
+
+func newFlapDetector() *flapDetector {
+	return &flapDetector{devices: make(map[string]*flapState)}
+}
+
+// observe records the health reported for the device. It returns how long
+// the device stays pinned unhealthy, and whether this report started the pin.
+func (d *flapDetector) observe(id, health string) (time.Duration, bool) {
+	if d == nil || healthFlapThreshold == 0 {
+		return 0, false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	state, ok := d.devices[id]
+	if !ok {
+		state = &flapState{last: health}
+		d.devices[id] = state
+	}
+	now := clk.Now()
+	if health != state.last {
+		state.last = health
+		state.transitions = append(state.transitions, now)
+	}
+	recent := state.transitions[:0]
+	for _, at := range state.transitions {
+		if now.Sub(at) < healthFlapWindow {
+			recent = append(recent, at)
+		}
+	}
+	state.transitions = recent
+
+	started := false
+	if !now.Before(state.pinnedUntil) && len(state.transitions) >= int(healthFlapThreshold) {
+		state.pinnedUntil = now.Add(healthFlapCooldown)
+		state.transitions = nil
+		started = true
+	}
+	return state.pinnedUntil.Sub(now), started
+}
+
+// pinned returns whether the device is currently pinned unhealthy
+func (d *flapDetector) pinned(id string) bool {
+	if d == nil {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	state, ok := d.devices[id]
+	return ok && clk.Now().Before(state.pinnedUntil)
+}
+
+// deviceFlapping reports a device pinned unhealthy for pin and re-delivers
+// its health once the pin ends
+func (dpi *GenericDevicePlugin) deviceFlapping(id string, pin time.Duration) {
+	msg := fmt.Sprintf("Device %s of %s/%s is flapping between healthy and unhealthy, keeping it unhealthy for %s",
+		id, DeviceNamespace, dpi.deviceName, pin)
+	log.Print(msg)
+	events.warning("DeviceFlapping", msg)
+	healthFlaps.WithLabelValues(dpi.deviceName).Inc()
+	go func() {
+		timer := clk.NewTimer(pin)
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+			dpi.reevaluateHealth(id)
+		case <-dpi.ctx.Done():
+		}
+	}()
+}
+
+// flapAdjustedHealth returns Unhealthy while the device is pinned for
+// flapping, and the reported health otherwise
+func (dpi *GenericDevicePlugin) flapAdjustedHealth(id, health string) string {
+	pin, started := dpi.flaps.observe(id, health)
+	if started {
+		dpi.deviceFlapping(id, pin)
+	}
+	if pin > 0 {
+		return pluginapi.Unhealthy
+	}
+	return health
+}
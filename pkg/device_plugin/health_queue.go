@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// healthQueue coalesces device health transitions. Only the latest pending
+// state of each device is delivered, in the order devices first became pending,
+// so a device bouncing quickly does not flood ListAndWatch.
+type healthQueue struct {
+	lock    sync.Mutex
+	pending map[string]string
+	order   []string
+	notify  chan struct{}
+}
+
+func newHealthQueue() *healthQueue {
+	return &healthQueue{
+		pending: make(map[string]string),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// push records the latest health of a device without blocking
+func (q *healthQueue) push(id string, health string) {
+	q.lock.Lock()
+	if _, ok := q.pending[id]; !ok {
+		q.order = append(q.order, id)
+	}
+	q.pending[id] = health
+	q.lock.Unlock()
+	q.signal()
+}
+
+// pushIfIdle records the health of a device unless a transition is already
+// pending, which would be newer
+func (q *healthQueue) pushIfIdle(id string, health string) {
+	q.lock.Lock()
+	if _, ok := q.pending[id]; ok {
+		q.lock.Unlock()
+		return
+	}
+	q.order = append(q.order, id)
+	q.pending[id] = health
+	q.lock.Unlock()
+	q.signal()
+}
+
+// signal wakes up the delivery loop without blocking
+func (q *healthQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// healthUpdate is a coalesced health transition of a device
+type healthUpdate struct {
+	id     string
+	health string
+}
+
+// pendingUpdates returns the pending transitions without clearing them
+func (q *healthQueue) pendingUpdates() []healthUpdate {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	updates := make([]healthUpdate, 0, len(q.order))
+	for _, id := range q.order {
+		updates = append(updates, healthUpdate{id: id, health: q.pending[id]})
+	}
+	return updates
+}
+
+// drain returns and clears all pending transitions
+func (q *healthQueue) drain() []healthUpdate {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	updates := make([]healthUpdate, 0, len(q.order))
+	for _, id := range q.order {
+		updates = append(updates, healthUpdate{id: id, health: q.pending[id]})
+	}
+	q.pending = make(map[string]string)
+	q.order = nil
+	return updates
+}
+
+// run delivers pending transitions to ListAndWatch until done is closed
+func (q *healthQueue) run(dpi *GenericDevicePlugin, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-q.notify:
+			for _, u := range q.drain() {
+				dpi.deliverHealth(u.id, u.health)
+			}
+		}
+	}
+}
+
+// healthShard watches the device node of a single device
+type healthShard struct {
+	id         string
+	devicePath string
+	watcher    *fsnotify.Watcher
+}
+
+func newHealthShard(id, devicePath string) (*healthShard, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(devicePath); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return &healthShard{id: id, devicePath: devicePath, watcher: watcher}, nil
+}
+
+// run handles the events of the device node until done is closed. The
+// resulting transitions are aggregated through the queue.
+func (s *healthShard) run(method string, done <-chan struct{}, queue *healthQueue) {
+	defer s.watcher.Close()
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-s.watcher.Errors:
+			log.Printf("%s: watcher error for %s: %v", method, s.devicePath, err)
+		case event := <-s.watcher.Events:
+			if event.Name != s.devicePath {
+				continue
+			}
+			// Health in this case is if the device path actually exists
+			if event.Op == fsnotify.Create {
+				queue.push(s.id, pluginapi.Healthy)
+			} else if (event.Op == fsnotify.Remove) || (event.Op == fsnotify.Rename) {
+				log.Printf("%s: Marking device unhealthy: %s", method, event.Name)
+				queue.push(s.id, pluginapi.Unhealthy)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// hostContainerMode is the resolved host container mode of a resource
+type hostContainerMode struct {
+	uid  int // -1 keeps VFIO_DEVICE_UID
+	gid  int // -1 keeps VFIO_DEVICE_GID
+	mode os.FileMode
+}
+
+// resolve returns the mode of a validated config
+func (hc HostContainerConfig) resolve() hostContainerMode {
+	m := hostContainerMode{uid: -1, gid: -1}
+	if hc.UID != nil {
+		m.uid = *hc.UID
+	}
+	if hc.GID != nil {
+		m.gid = *hc.GID
+	}
+	m.mode, _ = parseFileMode(hc.Mode)
+	return m
+}
+
+// hostContainerModeFor returns the host container mode of the resource, if
+// its devices are served to host containers
+func hostContainerModeFor(resource string) (hostContainerMode, bool) {
+	deviceFilterLock.RLock()
+	defer deviceFilterLock.RUnlock()
+	m, ok := hostContainers[resource]
+	return m, ok
+}
+
+// permissions returns the owner and mode of the VFIO nodes, falling back to
+// those of the environment
+func (m hostContainerMode) permissions() *vfioPermissions {
+	p := &vfioPermissions{uid: vfioPerms.uid, gid: vfioPerms.gid, mode: vfioPerms.mode}
+	if m.uid >= 0 {
+		p.uid = m.uid
+	}
+	if m.gid >= 0 {
+		p.gid = m.gid
+	}
+	if m.mode != 0 {
+		p.mode = m.mode
+	}
+	return p
+}
+
+// sysfsMount returns the read-only mount of the sysfs directory of a PCI
+// function, which userspace drivers read the resources, IOMMU group and NUMA
+// node of the device from
+func sysfsMount(address string) *pluginapi.Mount {
+	path := filepath.Join("/", pciDevicesPath, address)
+	return &pluginapi.Mount{ContainerPath: path, HostPath: path, ReadOnly: true}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// instanceLockPollInterval is how often a held instance lock is tried again
+const instanceLockPollInterval = 500 * time.Millisecond
+
+var (
+	// instanceLockFile is the hostPath file locked by the running instance,
+	// so that the pods of a rolling update do not both own the sockets and
+	// CDI specs; empty disables the lock
+	instanceLockFile = getEnvString("INSTANCE_LOCK_FILE", "")
+	// instanceLockTimeout is how long to wait for the previous instance to
+	// exit before taking over
+	instanceLockTimeout = getEnvDuration("INSTANCE_LOCK_TIMEOUT", time.Minute)
+	// instanceLock is the locked file, held until the process exits
+	instanceLock *os.File
+)
+
+// errInstanceLocked is returned when another instance holds the lock
+var errInstanceLocked = errors.New("instance lock is held by another instance")
+
+// tryInstanceLock takes the advisory lock on the open file without blocking
+func tryInstanceLock(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errInstanceLocked
+	}
+	return err
+}
+
+// lockHolder returns the PID recorded in the lock file by its holder
+func lockHolder(f *os.File) string {
+	data, err := os.ReadFile(f.Name())
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// acquireInstanceLock locks the file at path, waiting up to timeout for the
+// instance holding it to exit. After the timeout the lock is taken over: the
+// file is returned unlocked with takenOver set, and is locked in the
+// background once the previous instance exits.
+func acquireInstanceLock(path string, timeout time.Duration) (f *os.File, takenOver bool, err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, false, fmt.Errorf("failed to create the directory of %s: %w", path, err)
+	}
+	f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open instance lock %s: %w", path, err)
+	}
+	deadline := clk.Now().Add(timeout)
+	logged := false
+	for {
+		err := tryInstanceLock(f)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errInstanceLocked) {
+			f.Close()
+			return nil, false, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if !clk.Now().Before(deadline) {
+			go lockWhenReleased(f)
+			return f, true, nil
+		}
+		if !logged {
+			log.Printf("Waiting up to %s for the instance with PID %s holding %s to exit", timeout, lockHolder(f), path)
+			logged = true
+		}
+		<-clk.After(instanceLockPollInterval)
+	}
+	writeLockHolder(f)
+	return f, false, nil
+}
+
+// lockWhenReleased locks the file once the instance it was taken over from
+// exits, so that later instances wait for this one
+func lockWhenReleased(f *os.File) {
+	for tryInstanceLock(f) != nil {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-clk.After(instanceLockPollInterval):
+		}
+	}
+	log.Printf("Acquired instance lock %s after the previous instance exited", f.Name())
+	writeLockHolder(f)
+}
+
+// writeLockHolder records our PID in the lock file for diagnostics
+func writeLockHolder(f *os.File) {
+	err := f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		log.Printf("Unable to record the PID in %s: %v", f.Name(), err)
+	}
+}
+
+// lockInstance waits until no other instance of the plugin runs on the node,
+// taking over after INSTANCE_LOCK_TIMEOUT
+func lockInstance() error {
+	if instanceLockFile == "" || instanceLock != nil {
+		return nil
+	}
+	f, takenOver, err := acquireInstanceLock(instanceLockFile, instanceLockTimeout)
+	if err != nil {
+		return err
+	}
+	instanceLock = f
+	if takenOver {
+		msg := fmt.Sprintf("Taking over from the instance with PID %s holding %s after %s", lockHolder(f), instanceLockFile, instanceLockTimeout)
+		log.Print(msg)
+		events.warning("InstanceLockTakeover", msg)
+		return nil
+	}
+	log.Printf("Acquired instance lock %s", instanceLockFile)
+	return nil
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	inventoryKind            = "NodeVfioInventory"
+	defaultInventoryInterval = 1 * time.Minute
+
+	// healthUnknown is the health of devices without a serving plugin
+	healthUnknown = "Unknown"
+)
+
+// Reasons a device is reported unhealthy in the inventory. A device is
+// unhealthy for a failed health check unless it is held unhealthy for one
+// of the other reasons.
+const (
+	unhealthyReasonDisabled      = "disabled"
+	unhealthyReasonMaintenance   = "maintenance"
+	unhealthyReasonClearing      = "clearing"
+	unhealthyReasonRuntimeGate   = "runtime-not-ready"
+	unhealthyReasonFabricManager = "fabric-manager-not-ready"
+	unhealthyReasonHealthAgent   = "health-agent"
+	unhealthyReasonFlapping      = "flapping"
+	unhealthyReasonHealthCheck   = "health-check-failed"
+)
+
+var inventoryGVR = schema.GroupVersionResource{
+	Group:    "sandbox.nvidia.com",
+	Version:  "v1alpha1",
+	Resource: "nodevfioinventories",
+}
+
+// ccCapableArchitectures lists the GPU architectures that support confidential computing
+var ccCapableArchitectures = []string{"GH100", "GB100", "GB102"}
+
+// InventoryDevice is a single passthrough device published in the NodeVfioInventory
+type InventoryDevice struct {
+	ID           string   `json:"id"`
+	ResourceName string   `json:"resourceName"`
+	Model        string   `json:"model"`
+	PCIAddress   string   `json:"pciAddress"`
+	Driver       string   `json:"driver,omitempty"`
+	IommuGroup   int      `json:"iommuGroup"`
+	IommuFD      string   `json:"iommuFD,omitempty"`
+	NumaNode     int      `json:"numaNode"`
+	NVSwitch     bool     `json:"nvswitch"`
+	CCCapable    bool     `json:"ccCapable"`
+	P2PGroup     string   `json:"p2pGroup,omitempty"`
+	Serial       string   `json:"serial,omitempty"`
+	BoardSerial  string   `json:"boardSerial,omitempty"`
+	Reserved     bool     `json:"reserved,omitempty"`
+	Spare        bool     `json:"spare,omitempty"`
+	AllocatedTo  string   `json:"allocatedTo,omitempty"`
+	ResetMethods []string `json:"resetMethods,omitempty"`
+	ResetScope   string   `json:"resetScope"`
+	// Health is the health advertised to the kubelet, or Unknown when the
+	// resource has no serving plugin
+	Health          string `json:"health,omitempty"`
+	UnhealthyReason string `json:"unhealthyReason,omitempty"`
+}
+
+// InventoryStatus is the observed device inventory of a node
+type InventoryStatus struct {
+	Devices     []InventoryDevice `json:"devices"`
+	LastUpdated string            `json:"lastUpdated"`
+}
+
+// isCCCapable reports whether a device supports confidential computing, based
+// on the architecture prefix of its PCI database name (e.g. "GH100 [H100 PCIe]")
+func isCCCapable(dev NvidiaPCIDevice) bool {
+	if dev.IsNVSwitch {
+		return false
+	}
+	for _, arch := range ccCapableArchitectures {
+		if strings.HasPrefix(dev.DeviceName, arch) {
+			return true
+		}
+	}
+	return false
+}
+
+// unhealthyReason returns why the device with the given ID, advertised by the
+// plugin, is unhealthy
+func unhealthyReason(dpi *GenericDevicePlugin, id string) string {
+	iommuKey := iommuKeyForDeviceID(id)
+	switch {
+	case disabledDevices.contains(iommuKey):
+		return unhealthyReasonDisabled
+	case maintenance.contains(iommuKey):
+		return unhealthyReasonMaintenance
+	case clearing.contains(iommuKey):
+		return unhealthyReasonClearing
+	case runtimeGated():
+		return unhealthyReasonRuntimeGate
+	case fabricGated(iommuKey):
+		return unhealthyReasonFabricManager
+	case externalHealth.unhealthy(iommuKey):
+		return unhealthyReasonHealthAgent
+	case dpi.flaps.pinned(id):
+		return unhealthyReasonFlapping
+	}
+	return unhealthyReasonHealthCheck
+}
+
+// advertisedHealth returns the health and, for unhealthy devices, the reason
+// of every device advertised by the plugins, keyed by
+// "<resource name>/<device ID>"
+func advertisedHealth(plugins []*GenericDevicePlugin) (map[string]string, map[string]string) {
+	health := make(map[string]string)
+	reasons := make(map[string]string)
+	for _, dp := range plugins {
+		for _, dev := range dp.devices() {
+			key := fmt.Sprintf("%s/%s/%s", DeviceNamespace, dp.deviceName, dev.ID)
+			health[key] = dev.Health
+			if dev.Health == pluginapi.Unhealthy {
+				reasons[key] = unhealthyReason(dp, dev.ID)
+			}
+		}
+	}
+	return health, reasons
+}
+
+// buildInventory returns the discovered devices, sorted by PCI address, along
+// with the pod container each device is allocated to and the health
+// advertised by the plugins
+func buildInventory(owners map[string]deviceOwner, plugins []*GenericDevicePlugin) []InventoryDevice {
+	var inventory []InventoryDevice
+	health, reasons := advertisedHealth(plugins)
+	reserved, spare := heldBackIommuKeys()
+	for iommuKey, devs := range iommuMap {
+		id := stableIDForIommuKey(iommuKey)
+		for _, dev := range devs {
+			resourceName := fmt.Sprintf("%s/%s", DeviceNamespace,
+				resourceNameForIommuKey(fmt.Sprintf("%04x", dev.DeviceID), iommuKey))
+			item := InventoryDevice{
+				ID:           id,
+				ResourceName: resourceName,
+				Model:        dev.DeviceName,
+				PCIAddress:   dev.Address,
+				Driver:       dev.Driver,
+				IommuGroup:   dev.IommuGroup,
+				IommuFD:      dev.IommuFD,
+				NumaNode:     dev.NumaNode,
+				NVSwitch:     dev.IsNVSwitch,
+				CCCapable:    isCCCapable(dev),
+				P2PGroup:     dev.P2PGroup,
+				Serial:       dev.Serial,
+				BoardSerial:  dev.BoardSerial,
+				Reserved:     reserved[iommuKey],
+				Spare:        spare[iommuKey] && !spares.isPromoted(iommuKey),
+				ResetMethods: dev.ResetMethods,
+				ResetScope:   resetScope(dev.ResetMethods),
+			}
+			if owner, ok := owners[resourceName+"/"+id]; ok {
+				item.AllocatedTo = owner.String()
+			}
+			item.Health = health[resourceName+"/"+id]
+			if item.Health == "" {
+				item.Health = healthUnknown
+			}
+			item.UnhealthyReason = reasons[resourceName+"/"+id]
+			inventory = append(inventory, item)
+		}
+	}
+	sort.Slice(inventory, func(i, j int) bool {
+		return inventory[i].PCIAddress < inventory[j].PCIAddress
+	})
+	return inventory
+}
+
+// publishInventory creates or updates the NodeVfioInventory of the node
+func publishInventory(client dynamic.Interface, nodeName string, m *DevicePluginManager) error {
+	owners, err := listDeviceOwners()
+	if err != nil {
+		log.Printf("Unable to determine device owners for inventory: %v", err)
+	}
+	status := InventoryStatus{
+		Devices:     buildInventory(owners, m.Plugins()),
+		LastUpdated: time.Now().UTC().Format(time.RFC3339),
+	}
+	statusObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return fmt.Errorf("error encoding inventory: %w", err)
+	}
+
+	ctx, cancel := apiContext()
+	defer cancel()
+	resource := client.Resource(inventoryGVR)
+	existing, err := resource.Get(ctx, nodeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(inventoryGVR.GroupVersion().String())
+		obj.SetKind(inventoryKind)
+		obj.SetName(nodeName)
+		obj.Object["status"] = statusObj
+		_, err = resource.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching inventory: %w", err)
+	}
+	existing.Object["status"] = statusObj
+	_, err = resource.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// runInventoryPublisher periodically publishes the node inventory as a
+// NodeVfioInventory custom resource named after the node. It is enabled with
+// PUBLISH_INVENTORY=true and requires the CRD to be installed.
+func runInventoryPublisher(m *DevicePluginManager) {
+	if !getEnvBool("PUBLISH_INVENTORY", false) {
+		return
+	}
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		log.Printf("NODE_NAME environment variable is required for publishing the inventory")
+		return
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Printf("Error obtaining cluster credentials for inventory: %v", err)
+		return
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Printf("Error obtaining dynamic client for inventory: %v", err)
+		return
+	}
+
+	interval := getEnvDuration("INVENTORY_INTERVAL", defaultInventoryInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := publishInventory(client, nodeName, m); err != nil {
+			log.Printf("Error publishing inventory: %v", err)
+		}
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
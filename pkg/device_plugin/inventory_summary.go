@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// InventoryModelSummary is the passthrough capacity of a device model across
+// the nodes publishing their inventory
+type InventoryModelSummary struct {
+	Model string `json:"model"`
+	Nodes int    `json:"nodes"`
+	Total int    `json:"total"`
+	// Allocated devices are assigned to a pod container
+	Allocated int `json:"allocated"`
+	// Free devices are healthy, unallocated and not held back as reserved or
+	// spare devices
+	Free int `json:"free"`
+	// HeldBack devices are reserved or spare devices
+	HeldBack  int `json:"heldBack"`
+	Unhealthy int `json:"unhealthy"`
+}
+
+// UnhealthyInventoryDevice is an unhealthy device of a node
+type UnhealthyInventoryDevice struct {
+	Node         string `json:"node"`
+	ResourceName string `json:"resourceName"`
+	ID           string `json:"id"`
+	PCIAddress   string `json:"pciAddress"`
+	Model        string `json:"model"`
+	Reason       string `json:"reason"`
+}
+
+// InventorySummary aggregates the NodeVfioInventory of every node
+type InventorySummary struct {
+	Nodes     int                        `json:"nodes"`
+	Models    []InventoryModelSummary    `json:"models"`
+	Unhealthy []UnhealthyInventoryDevice `json:"unhealthy"`
+}
+
+// summarizeInventories aggregates the inventories by device model, sorted by
+// model, and lists the unhealthy devices sorted by node and PCI address
+func summarizeInventories(inventories map[string]InventoryStatus) InventorySummary {
+	summary := InventorySummary{
+		Nodes:     len(inventories),
+		Models:    []InventoryModelSummary{},
+		Unhealthy: []UnhealthyInventoryDevice{},
+	}
+	models := make(map[string]*InventoryModelSummary)
+	nodes := make(map[string]map[string]bool)
+	for node, inventory := range inventories {
+		for _, dev := range inventory.Devices {
+			model, ok := models[dev.Model]
+			if !ok {
+				model = &InventoryModelSummary{Model: dev.Model}
+				models[dev.Model] = model
+				nodes[dev.Model] = make(map[string]bool)
+			}
+			nodes[dev.Model][node] = true
+			model.Total++
+			switch {
+			case dev.AllocatedTo != "":
+				model.Allocated++
+			case dev.Reserved || dev.Spare:
+				model.HeldBack++
+			case dev.Health != pluginapi.Unhealthy:
+				model.Free++
+			}
+			if dev.Health == pluginapi.Unhealthy {
+				model.Unhealthy++
+				summary.Unhealthy = append(summary.Unhealthy, UnhealthyInventoryDevice{
+					Node:         node,
+					ResourceName: dev.ResourceName,
+					ID:           dev.ID,
+					PCIAddress:   dev.PCIAddress,
+					Model:        dev.Model,
+					Reason:       dev.UnhealthyReason,
+				})
+			}
+		}
+	}
+	for name, model := range models {
+		model.Nodes = len(nodes[name])
+		summary.Models = append(summary.Models, *model)
+	}
+	sort.Slice(summary.Models, func(i, j int) bool { return summary.Models[i].Model < summary.Models[j].Model })
+	sort.Slice(summary.Unhealthy, func(i, j int) bool {
+		a, b := summary.Unhealthy[i], summary.Unhealthy[j]
+		if a.Node != b.Node {
+			return a.Node < b.Node
+		}
+		return a.PCIAddress < b.PCIAddress
+	})
+	return summary
+}
+
+// inventorySummaryTable renders the summary as a table per model followed by
+// a table of the unhealthy devices, if any
+func inventorySummaryTable(summary InventorySummary) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tNODES\tTOTAL\tALLOCATED\tFREE\tHELD BACK\tUNHEALTHY")
+	for _, m := range summary.Models {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", m.Model, m.Nodes, m.Total, m.Allocated, m.Free, m.HeldBack, m.Unhealthy)
+	}
+	w.Flush()
+	if len(summary.Unhealthy) == 0 {
+		return b.String()
+	}
+	b.WriteString("\n")
+	w = tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tRESOURCE\tDEVICE\tPCI ADDRESS\tMODEL\tREASON")
+	for _, dev := range summary.Unhealthy {
+		reason := dev.Reason
+		if reason == "" {
+			reason = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", dev.Node, dev.ResourceName, dev.ID, dev.PCIAddress, dev.Model, reason)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// SummarizeInventories prints the passthrough device capacity of the cluster
+// aggregated from the inventories published with PUBLISH_INVENTORY=true, as
+// a table or as JSON. The cluster is reached like kubectl does, with the
+// given kubeconfig, KUBECONFIG, ~/.kube/config or the in-cluster
+// credentials. It requires list permission on nodevfioinventories.
+func SummarizeInventories(w io.Writer, kubeconfig, output string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unsupported output format %q, expected table or json", output)
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return fmt.Errorf("error obtaining cluster credentials: %w", err)
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("error obtaining dynamic client: %w", err)
+	}
+	inventories, err := listInventories(client)
+	if err != nil {
+		return fmt.Errorf("error listing the node inventories: %w", err)
+	}
+	summary := summarizeInventories(inventories)
+	if output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summary)
+	}
+	_, err = io.WriteString(w, inventorySummaryTable(summary))
+	return err
+}
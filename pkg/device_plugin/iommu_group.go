@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// viableGroupDrivers are the drivers that other devices in an IOMMU group may
+// be bound to without preventing the group from being assigned, besides the
+// vfio drivers. Devices with no driver are viable as well.
+var viableGroupDrivers = map[string]bool{
+	"vfio-pci": true,
+	"pci-stub": true,
+	"pcieport": true,
+}
+
+// iommuGroupMember is a PCI function in an IOMMU group
+type iommuGroupMember struct {
+	Address string
+	Driver  string
+}
+
+// getIommuGroupMembers lists the PCI functions of an IOMMU group and their drivers
+func getIommuGroupMembers(group int) ([]iommuGroupMember, error) {
+	devicesDir := filepath.Join(rootPath, iommuGroupsPath, strconv.Itoa(group), "devices")
+	entries, err := os.ReadDir(devicesDir)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]iommuGroupMember, 0, len(entries))
+	for _, entry := range entries {
+		member := iommuGroupMember{Address: entry.Name()}
+		link, err := os.Readlink(filepath.Join(devicesDir, entry.Name(), "driver"))
+		if err == nil {
+			member.Driver = filepath.Base(link)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("unable to read driver of %s: %w", entry.Name(), err)
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// checkIommuGroupViable verifies that every function in the IOMMU group is
+// bound to vfio-pci (or is otherwise safe), since a group is only assignable
+// as a whole. Groups whose membership cannot be read are not rejected.
+func checkIommuGroupViable(group int) error {
+	members, err := getIommuGroupMembers(group)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to verify IOMMU group %d: %w", group, err)
+	}
+	var blocking []string
+	for _, member := range members {
+		if member.Driver == "" || viableGroupDrivers[member.Driver] || isVfioDriver(member.Driver) {
+			continue
+		}
+		blocking = append(blocking, fmt.Sprintf("%s (%s)", member.Address, member.Driver))
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf("IOMMU group %d contains functions not bound to vfio-pci: %s",
+			group, strings.Join(blocking, ", "))
+	}
+	return nil
+}
+
+// mergeSharedIommuGroups advertises the GPUs sharing an IOMMU group, e.g. the
+// GPUs of a multi-GPU board such as the A16 without ACS between them, as a
+// single device. A group is only assignable as a whole, so its GPUs cannot go
+// to different sandboxes. Keyed by their group, such GPUs already form one
+// device; keyed by their iommufd devices, their keys are merged into the key
+// of the group. GPUs in groups of their own stay individual devices.
+func mergeSharedIommuGroups() {
+	keysByGroup := make(map[int][]string)
+	for iommuKey, devs := range iommuMap {
+		if !strings.HasPrefix(iommuKey, iommufdKeyPrefix) || len(devs) == 0 {
+			continue
+		}
+		keysByGroup[devs[0].IommuGroup] = append(keysByGroup[devs[0].IommuGroup], iommuKey)
+	}
+	for group, keys := range keysByGroup {
+		if len(keys) < 2 {
+			continue
+		}
+		groupKey := iommuGroupKeyPrefix + strconv.Itoa(group)
+		merged := make(map[string]bool, len(keys))
+		var devs []NvidiaPCIDevice
+		for _, iommuKey := range keys {
+			devs = append(devs, iommuMap[iommuKey]...)
+			delete(iommuMap, iommuKey)
+			merged[iommuKey] = true
+		}
+		sort.Slice(devs, func(i, j int) bool { return devs[i].Address < devs[j].Address })
+		iommuMap[groupKey] = devs
+
+		for deviceID, deviceKeys := range deviceMap {
+			kept := deviceKeys[:0]
+			for _, iommuKey := range deviceKeys {
+				if !merged[iommuKey] {
+					kept = append(kept, iommuKey)
+				}
+			}
+			if len(kept) == 0 {
+				delete(deviceMap, deviceID)
+			} else {
+				deviceMap[deviceID] = kept
+			}
+		}
+		deviceID := fmt.Sprintf("%04x", devs[0].DeviceID)
+		deviceMap[deviceID] = append(deviceMap[deviceID], groupKey)
+	}
+
+	for iommuKey, devs := range iommuMap {
+		if len(devs) < 2 || isSubtreeKey(iommuKey) {
+			continue
+		}
+		addresses := make([]string, 0, len(devs))
+		for _, dev := range devs {
+			addresses = append(addresses, dev.Address)
+		}
+		log.Printf("Advertising %s sharing IOMMU group %d as one device", strings.Join(addresses, ", "), devs[0].IommuGroup)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// iommuGroupKeyPrefix namespaces the keys of devices addressed by their
+	// legacy VFIO group
+	iommuGroupKeyPrefix = "group:"
+	// iommufdKeyPrefix namespaces the keys of devices addressed by their
+	// iommufd character device
+	iommufdKeyPrefix = "iommufd:"
+)
+
+// iommuKeyFor returns the internal key of a device: its iommufd character
+// device when iommufd is used and the device has one, its IOMMU group
+// otherwise. The keys are namespaced, so that group 8 and iommufd device
+// vfio8 never alias when a host mixes both.
+func iommuKeyFor(group int, iommufd string, iommufdSupported bool) string {
+	if iommufdSupported && iommufd != "" {
+		return iommufdKeyPrefix + iommufd
+	}
+	return iommuGroupKeyPrefix + strconv.Itoa(group)
+}
+
+// iommuKeyName returns the name a key is known by outside the plugin: the
+// IOMMU group or iommufd device number, used for CDI device names and VFIO
+// group nodes. A subtree is named after its bridge. Keys without a
+// namespace are returned as is.
+func iommuKeyName(iommuKey string) string {
+	if fd, ok := strings.CutPrefix(iommuKey, iommufdKeyPrefix); ok {
+		return strings.TrimPrefix(fd, "vfio")
+	}
+	if bridge, ok := strings.CutPrefix(iommuKey, subtreeKeyPrefix); ok {
+		return "subtree-" + bridge
+	}
+	return strings.TrimPrefix(iommuKey, iommuGroupKeyPrefix)
+}
+
+// cdiDeviceName returns the CDI device name of a key, which is its external
+// name. A group whose number is also the number of an iommufd device is
+// named "group<N>", so that both get a distinct CDI device.
+func cdiDeviceName(iommuKey string) string {
+	name := iommuKeyName(iommuKey)
+	if strings.HasPrefix(iommuKey, iommuGroupKeyPrefix) {
+		if _, ok := iommuMap[iommufdKeyPrefix+"vfio"+name]; ok {
+			return "group" + name
+		}
+	}
+	return name
+}
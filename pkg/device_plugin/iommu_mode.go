@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	iommuModeLabel     = "nvidia.com/sandbox-device-plugin.iommu-mode"
+	kernelCmdlinePath  = "proc/cmdline"
+	iommuClassPath     = "sys/class/iommu"
+	iommuGroupTypeFile = "type"
+)
+
+// iommuMode is how the IOMMU translates the DMA of host owned devices
+type iommuMode string
+
+const (
+	// iommuTranslated isolates every device in its own DMA domain
+	iommuTranslated iommuMode = "translated"
+	// iommuPassthrough gives host owned devices an identity mapping of all
+	// of memory; devices bound to vfio-pci are still translated
+	iommuPassthrough iommuMode = "passthrough"
+	// iommuDisabled leaves DMA untranslated
+	iommuDisabled iommuMode = "disabled"
+)
+
+// requireIommuTranslation refuses to advertise devices unless the IOMMU
+// translates the DMA of all devices
+var requireIommuTranslation = getEnvBool("REQUIRE_IOMMU_TRANSLATION", false)
+
+// iommuTranslationSeverity returns the severity of the IOMMU translation check
+func iommuTranslationSeverity() preflightSeverity {
+	if requireIommuTranslation {
+		return severityCritical
+	}
+	return severityWarning
+}
+
+// detectIommuMode returns the IOMMU mode of the host and where it was read
+// from. The default domain type of the IOMMU groups is authoritative; the
+// kernel command line is only used on kernels that do not report it.
+func detectIommuMode() (iommuMode, string) {
+	classPath := filepath.Join(rootPath, iommuClassPath)
+	units, err := os.ReadDir(classPath)
+	if err != nil || len(units) == 0 {
+		return iommuDisabled, classPath
+	}
+	if mode, ok := iommuGroupMode(); ok {
+		return mode, filepath.Join(rootPath, iommuGroupsPath)
+	}
+	cmdlinePath := filepath.Join(rootPath, kernelCmdlinePath)
+	cmdline, err := os.ReadFile(cmdlinePath)
+	if err != nil {
+		log.Printf("Unable to read %s, assuming the IOMMU translates: %v", cmdlinePath, err)
+		return iommuTranslated, classPath
+	}
+	return parseIommuCmdline(string(cmdline)), cmdlinePath
+}
+
+// iommuGroupMode returns the IOMMU mode from the default domain type of the
+// IOMMU groups, if the kernel reports it
+func iommuGroupMode() (iommuMode, bool) {
+	types, _ := filepath.Glob(filepath.Join(rootPath, iommuGroupsPath, "*", iommuGroupTypeFile))
+	if len(types) == 0 {
+		return "", false
+	}
+	for _, path := range types {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// identity domains map all of memory, DMA and DMA-FQ domains
+		// translate
+		if strings.TrimSpace(string(data)) == "identity" {
+			return iommuPassthrough, true
+		}
+	}
+	return iommuTranslated, true
+}
+
+// parseIommuCmdline returns the IOMMU mode selected by the kernel parameters,
+// where later parameters override earlier ones
+func parseIommuCmdline(cmdline string) iommuMode {
+	mode := iommuTranslated
+	for _, param := range strings.Fields(cmdline) {
+		name, value, _ := strings.Cut(param, "=")
+		switch name {
+		case "iommu":
+			switch value {
+			case "pt":
+				mode = iommuPassthrough
+			case "nopt":
+				mode = iommuTranslated
+			case "off":
+				mode = iommuDisabled
+			}
+		case "iommu.passthrough":
+			switch strings.ToLower(value) {
+			case "1", "y", "on":
+				mode = iommuPassthrough
+			case "0", "n", "off":
+				mode = iommuTranslated
+			}
+		case "intel_iommu", "amd_iommu":
+			for _, opt := range strings.Split(value, ",") {
+				switch opt {
+				case "off":
+					mode = iommuDisabled
+				case "pt":
+					mode = iommuPassthrough
+				}
+			}
+		}
+	}
+	return mode
+}
+
+// checkIommuTranslation verifies that the IOMMU translates the DMA of host
+// owned devices, so that they cannot reach the memory of the sandboxes
+func checkIommuTranslation() error {
+	mode, source := detectIommuMode()
+	switch mode {
+	case iommuDisabled:
+		return fmt.Errorf("%w: the IOMMU is disabled (%s)", errPreflightSkipped, source)
+	case iommuPassthrough:
+		return fmt.Errorf("the IOMMU is in passthrough mode (%s), host owned devices can DMA to all of memory", source)
+	}
+	return nil
+}
+
+// labelIommuMode labels the node with the IOMMU mode of the host
+func labelIommuMode() {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		log.Printf("NODE_NAME is not set, not labeling the IOMMU mode")
+		return
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		log.Printf("Error authenticating for the IOMMU mode label: %v", err)
+		return
+	}
+	mode, _ := detectIommuMode()
+	value := string(mode)
+	if err := patchNodeLabels(clientset, nodeName, map[string]*string{iommuModeLabel: &value}); err != nil {
+		log.Printf("Error labeling the IOMMU mode: %v", err)
+	}
+}
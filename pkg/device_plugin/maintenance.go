@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// maintenanceAnnotation reserves devices for out-of-band maintenance jobs,
+// e.g. a firmware flash pod. It lists comma separated
+// <PCI address>[=<job>][@<RFC 3339 expiry>] entries.
+const maintenanceAnnotation = "nvidia.com/sandbox-device-plugin.maintenance"
+
+// MaintenanceReservation describes the maintenance job a device is reserved for
+type MaintenanceReservation struct {
+	Job   string `json:"job,omitempty"`
+	Until string `json:"until,omitempty"`
+}
+
+// maintenanceSet holds the reservations of devices under maintenance by IOMMU
+// key
+type maintenanceSet struct {
+	lock         sync.RWMutex
+	reservations map[string]MaintenanceReservation
+}
+
+var maintenance = &maintenanceSet{reservations: make(map[string]MaintenanceReservation)}
+
+// contains returns true if the device with the IOMMU key is reserved for
+// maintenance
+func (s *maintenanceSet) contains(iommuKey string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.reservations[iommuKey]
+	return ok
+}
+
+// reservation returns the maintenance reservation of the device with the
+// IOMMU key, or nil if it is not reserved
+func (s *maintenanceSet) reservation(iommuKey string) *MaintenanceReservation {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r, ok := s.reservations[iommuKey]
+	if !ok {
+		return nil
+	}
+	return &r
+}
+
+// update replaces the reservations and returns the keys that were newly
+// reserved and released
+func (s *maintenanceSet) update(reservations map[string]MaintenanceReservation) (reserved, released []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range reservations {
+		if _, ok := s.reservations[key]; !ok {
+			reserved = append(reserved, key)
+		}
+	}
+	for key := range s.reservations {
+		if _, ok := reservations[key]; !ok {
+			released = append(released, key)
+		}
+	}
+	s.reservations = reservations
+	sort.Strings(reserved)
+	sort.Strings(released)
+	return reserved, released
+}
+
+// outOfService returns true if the device with the IOMMU key is disabled by
+// the administrator, reserved for maintenance or not cleared since it was
+// freed
+func outOfService(iommuKey string) bool {
+	return disabledDevices.contains(iommuKey) || maintenance.contains(iommuKey) || clearing.contains(iommuKey)
+}
+
+// maintenanceReservations maps the entries of the annotation that have not
+// expired at now to the IOMMU keys of the discovered devices. Invalid
+// entries are logged and ignored.
+func maintenanceReservations(annotation string, now time.Time) map[string]MaintenanceReservation {
+	byAddress := make(map[string]MaintenanceReservation)
+	for _, entry := range strings.Split(annotation, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var r MaintenanceReservation
+		if rest, until, found := strings.Cut(entry, "@"); found {
+			expiry, err := time.Parse(time.RFC3339, until)
+			if err != nil {
+				log.Printf("Ignoring maintenance reservation %q: invalid expiry: %v", entry, err)
+				continue
+			}
+			if !now.Before(expiry) {
+				continue
+			}
+			entry, r.Until = rest, expiry.UTC().Format(time.RFC3339)
+		}
+		address, job, _ := strings.Cut(entry, "=")
+		r.Job = job
+		byAddress[address] = r
+	}
+	reservations := make(map[string]MaintenanceReservation)
+	for iommuKey, devs := range iommuMap {
+		for _, dev := range devs {
+			if r, ok := byAddress[dev.Address]; ok {
+				reservations[iommuKey] = r
+			}
+		}
+	}
+	return reservations
+}
+
+// applyMaintenance marks newly reserved devices unhealthy and released devices
+// healthy once they pass the recovery probe, and returns a description of each
+// change
+func applyMaintenance(plugins []*GenericDevicePlugin, annotation string) []string {
+	reservations := maintenanceReservations(annotation, clk.Now())
+	reserved, released := maintenance.update(reservations)
+	var changes []string
+	for _, dp := range plugins {
+		for _, dev := range dp.devs {
+			iommuKey := iommuKeyForDeviceID(dev.ID)
+			for _, key := range reserved {
+				if key != iommuKey {
+					continue
+				}
+				dp.setHealth(dev.ID, pluginapi.Unhealthy)
+				msg := fmt.Sprintf("Device %s of %s/%s reserved for maintenance", dev.ID, DeviceNamespace, dp.deviceName)
+				if r := reservations[key]; r.Job != "" {
+					msg += " job " + r.Job
+				}
+				changes = append(changes, msg)
+			}
+			for _, key := range released {
+				if key == iommuKey {
+					dp.reprobeHealth(dev.ID)
+					changes = append(changes, fmt.Sprintf("Device %s of %s/%s released from maintenance", dev.ID, DeviceNamespace, dp.deviceName))
+				}
+			}
+		}
+	}
+	return changes
+}
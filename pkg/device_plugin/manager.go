@@ -0,0 +1,363 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readinessProbeAddr is the address /readyz is served on; empty disables it
+var readinessProbeAddr = getEnvString("READINESS_PROBE_ADDR", "")
+
+// DevicePluginManager owns the device plugins serving the discovered
+// resources, so that they can be stopped or reloaded without exiting the
+// process. The controllers started with it follow the current plugins.
+type DevicePluginManager struct {
+	lock sync.Mutex
+	// plugins holds the serving plugin of each resource
+	plugins map[string]*GenericDevicePlugin
+	// ready tracks per resource whether its plugin is serving
+	ready   map[string]bool
+	running bool
+	// paused keeps the plugins stopped, e.g. while the vfio modules reload
+	paused bool
+	// startLock serializes starts, e.g. a config reload and a spare promotion
+	startLock sync.Mutex
+}
+
+func newDevicePluginManager() *DevicePluginManager {
+	return &DevicePluginManager{
+		plugins: make(map[string]*GenericDevicePlugin),
+		ready:   make(map[string]bool),
+	}
+}
+
+// start creates a device plugin for each resource and starts the plugins of
+// resources that are new or whose devices changed. Plugins of resources that
+// are gone or changed are stopped first; unchanged plugins keep serving. The
+// plugins are started concurrently, so that a slow registration does not
+// delay other resources.
+func (m *DevicePluginManager) start() {
+	m.startLock.Lock()
+	defer m.startLock.Unlock()
+	m.lock.Lock()
+	paused := m.paused
+	m.lock.Unlock()
+	if paused {
+		log.Printf("Not starting device plugins while advertisement is paused")
+		return
+	}
+	desired, err := newDevicePlugins()
+	if err != nil {
+		log.Printf("Error creating device plugins: %v", err)
+		return
+	}
+
+	m.lock.Lock()
+	m.running = true
+	wanted := make(map[string]bool)
+	var starting, stopping []*GenericDevicePlugin
+	for _, dp := range desired {
+		wanted[dp.deviceName] = true
+		if cur, ok := m.plugins[dp.deviceName]; ok {
+			if sameDevices(cur, dp) {
+				continue
+			}
+			stopping = append(stopping, cur)
+			delete(m.plugins, dp.deviceName)
+		}
+		m.ready[dp.deviceName] = false
+		starting = append(starting, dp)
+	}
+	for name, cur := range m.plugins {
+		if !wanted[name] {
+			stopping = append(stopping, cur)
+			delete(m.plugins, name)
+		}
+	}
+	for name := range m.ready {
+		if !wanted[name] {
+			delete(m.ready, name)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, dp := range stopping {
+		log.Printf("Stopping %s device plugin", dp.deviceName)
+		stopPlugin(dp)
+	}
+
+	var wg sync.WaitGroup
+	started := 0
+	for _, dp := range starting {
+		dp.ctx, dp.cancel = context.WithCancel(daemonCtx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := startDevicePlugin(dp); err != nil {
+				log.Printf("Error starting %s device plugin: %v", dp.deviceName, err)
+				stopPlugin(dp)
+				return
+			}
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			m.plugins[dp.deviceName] = dp
+			m.ready[dp.deviceName] = true
+			started++
+		}()
+	}
+	wg.Wait()
+	for _, dp := range m.Plugins() {
+		deviceStates.record(dp)
+	}
+	deviceStates.prune(wanted)
+	gfdRelabel.observe(m.Plugins())
+	log.Printf("Started %d of %d device plugin(s), %d unchanged", started, len(starting), len(desired)-len(starting))
+}
+
+// sameDevices returns whether two plugins serve the same devices
+func sameDevices(a, b *GenericDevicePlugin) bool {
+	if a.devicePath != b.devicePath || len(a.devs) != len(b.devs) {
+		return false
+	}
+	ids := make(map[string]bool, len(a.devs))
+	for _, dev := range a.devs {
+		ids[dev.ID] = true
+	}
+	for _, dev := range b.devs {
+		if !ids[dev.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+// stopPlugin ends the health check of the plugin before stopping it, so that
+// the removal of its socket is not mistaken for a kubelet restart
+func stopPlugin(dp *GenericDevicePlugin) {
+	dp.cancel()
+	if err := dp.Stop(); err != nil {
+		log.Printf("Error stopping %s device plugin: %v", dp.deviceName, err)
+	}
+}
+
+// Stop stops the device plugins. The controllers keep running until the
+// daemon context is canceled.
+func (m *DevicePluginManager) Stop() {
+	m.lock.Lock()
+	plugins := m.plugins
+	m.plugins = make(map[string]*GenericDevicePlugin)
+	m.running = false
+	for name := range m.ready {
+		m.ready[name] = false
+	}
+	m.lock.Unlock()
+
+	for _, dp := range plugins {
+		stopPlugin(dp)
+	}
+}
+
+// Reload rediscovers the devices and restarts the device plugins of the
+// resources whose devices changed
+func (m *DevicePluginManager) Reload() {
+	log.Printf("Reloading device plugins")
+	discoveryErr := discoverDevices()
+	if err := checkDiscoveryError(); err != nil {
+		exitOnDiscoveryError(err)
+		return
+	}
+	m.start()
+	liftStartupTaint(m, discoveryErr)
+}
+
+// pause stops the device plugins and keeps them stopped until resume
+func (m *DevicePluginManager) pause() {
+	m.startLock.Lock()
+	m.lock.Lock()
+	m.paused = true
+	m.lock.Unlock()
+	m.startLock.Unlock()
+	m.Stop()
+}
+
+// resume rediscovers the devices and starts the device plugins again
+func (m *DevicePluginManager) resume() {
+	m.lock.Lock()
+	m.paused = false
+	m.lock.Unlock()
+	m.Reload()
+}
+
+// Plugins returns the device plugins that are currently serving, sorted by
+// resource name
+func (m *DevicePluginManager) Plugins() []*GenericDevicePlugin {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	plugins := make([]*GenericDevicePlugin, 0, len(m.plugins))
+	for _, dp := range m.plugins {
+		plugins = append(plugins, dp)
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].deviceName < plugins[j].deviceName })
+	return plugins
+}
+
+// Ready returns whether the plugin of every discovered resource is serving
+func (m *DevicePluginManager) Ready() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, ready := range m.ready {
+		if !ready {
+			return false
+		}
+	}
+	return m.running
+}
+
+// Status returns the readiness of each discovered resource
+func (m *DevicePluginManager) Status() map[string]bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	status := make(map[string]bool, len(m.ready))
+	for name, ready := range m.ready {
+		status[name] = ready
+	}
+	return status
+}
+
+// runControllers starts the node level controllers, which run until the
+// daemon context is canceled
+func (m *DevicePluginManager) runControllers() {
+	// monitor NVSwitch fabric health
+	go runNVSwitchHealthMonitor(m)
+
+	// publish the node inventory custom resource
+	go runInventoryPublisher(m)
+
+	// fence the node when all devices of a resource fail
+	go runNodeFailureCoordinator()
+
+	// keep the configured ownership of allocated VFIO device nodes
+	go runVfioPermissionReconciler()
+
+	// apply administratively disabled devices from the node annotation
+	go runDisabledDeviceWatcher(m)
+
+	// hold devices unhealthy until the kata runtime is ready
+	go runRuntimeGate(m)
+
+	// hold the NVSwitches unhealthy until the fabric manager is ready
+	go runFabricManagerGate(m)
+
+	// replace failed devices with hot spares
+	go runSparePromoter(m)
+
+	// drop devices gone from the host from the CDI specs
+	go runCDICollector()
+
+	// rediscover the devices after the vfio modules are reloaded
+	go runVfioReloadMonitor(m)
+
+	// publish and clear the devices freed by terminated pods
+	go watchFreedDevices(m)
+
+	// apply namespace device quotas from the ConfigMap
+	go runNamespaceQuotaWatcher()
+
+	// label the node with GFD, once or periodically
+	go runGFD()
+
+	// record lifecycle milestones as node events
+	go runEventRecorder()
+}
+
+// ServeHTTP reports the aggregated readiness of the resources, listing each
+// of them, with 503 when any resource is not serving
+func (m *DevicePluginManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := m.Status()
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		if status[name] {
+			fmt.Fprintf(&b, "[+]%s ok\n", name)
+		} else {
+			fmt.Fprintf(&b, "[-]%s not ready\n", name)
+		}
+	}
+	if !m.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b.WriteString("readyz check failed\n")
+	} else {
+		b.WriteString("readyz check passed\n")
+	}
+	w.Write([]byte(b.String()))
+}
+
+// serveReadiness serves /readyz and /healthz on readinessProbeAddr until the
+// daemon context is canceled
+func serveReadiness(m *DevicePluginManager) {
+	if readinessProbeAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", m)
+	mux.HandleFunc("/healthz", serveHealthz)
+	// probes cannot present a client certificate, metrics scrapers can
+	mux.Handle("/metrics", requireClientCert(metricsHandler()))
+	listener, err := net.Listen("tcp", readinessProbeAddr)
+	if err != nil {
+		log.Printf("Error listening for readiness on %s: %v", readinessProbeAddr, err)
+		return
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: connectionTimeout}
+	go func() {
+		<-daemonCtx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	log.Printf("Serving readiness on %s/readyz", readinessProbeAddr)
+	if err := serveAuxHTTP(server, listener, tls.VerifyClientCertIfGiven); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error serving readiness: %v", err)
+	}
+}
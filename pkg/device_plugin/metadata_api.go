@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// nvidiaVendorID is the PCI vendor ID of all discovered devices
+const nvidiaVendorID = 0x10de
+
+// metadataSocket is the unix socket the read-only device metadata API is
+// served on; empty disables the API
+var metadataSocket = getEnvString("METADATA_SOCKET", "")
+
+// DeviceMetadata is the full metadata of a device returned by the metadata API
+type DeviceMetadata struct {
+	InventoryDevice
+	VendorID  string `json:"vendorID"`
+	DeviceID  string `json:"deviceID"`
+	Baseboard string `json:"baseboard,omitempty"`
+	MemoryMiB int    `json:"memoryMiB,omitempty"`
+	Allocated bool   `json:"allocated"`
+	// Maintenance is the job the device is reserved for, if any
+	Maintenance *MaintenanceReservation `json:"maintenance,omitempty"`
+}
+
+// metadataHandler serves the device metadata API:
+//
+//	GET /v1/devices        all devices, sorted by PCI address
+//	GET /v1/devices/<id>   a single device by advertised ID or PCI address
+type metadataHandler struct {
+	manager *DevicePluginManager
+	// owners returns the pod container of each allocated device
+	owners func() (map[string]deviceOwner, error)
+}
+
+// deviceMetadata returns the metadata of every discovered device
+func (h *metadataHandler) deviceMetadata() []DeviceMetadata {
+	owners, err := h.owners()
+	if err != nil {
+		log.Printf("Unable to determine device owners for metadata: %v", err)
+	}
+	devices := make(map[string]NvidiaPCIDevice)
+	for _, devs := range iommuMap {
+		for _, dev := range devs {
+			devices[dev.Address] = dev
+		}
+	}
+
+	var metadata []DeviceMetadata
+	for _, item := range buildInventory(owners, h.manager.Plugins()) {
+		dev := devices[item.PCIAddress]
+		metadata = append(metadata, DeviceMetadata{
+			InventoryDevice: item,
+			VendorID:        fmt.Sprintf("%04x", nvidiaVendorID),
+			DeviceID:        fmt.Sprintf("%04x", dev.DeviceID),
+			Baseboard:       dev.Baseboard,
+			MemoryMiB:       dev.MemoryMiB,
+			Allocated:       item.AllocatedTo != "",
+			Maintenance:     maintenance.reservation(iommuKeyForDeviceID(item.ID)),
+		})
+	}
+	return metadata
+}
+
+func (h *metadataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body interface{}
+	switch {
+	case r.URL.Path == "/v1/devices":
+		metadata := h.deviceMetadata()
+		if metadata == nil {
+			metadata = []DeviceMetadata{}
+		}
+		body = metadata
+	case strings.HasPrefix(r.URL.Path, "/v1/devices/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/devices/")
+		for _, dev := range h.deviceMetadata() {
+			if dev.ID == key || dev.PCIAddress == key {
+				body = dev
+				break
+			}
+		}
+		if body == nil {
+			http.Error(w, fmt.Sprintf("device %q not found", key), http.StatusNotFound)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding device metadata: %v", err)
+	}
+}
+
+// serveMetadata serves the device metadata API on metadataSocket until the
+// daemon context is canceled
+func serveMetadata(m *DevicePluginManager) {
+	if metadataSocket == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(metadataSocket), 0755); err != nil {
+		log.Printf("Error creating metadata socket directory: %v", err)
+		return
+	}
+	if err := os.Remove(metadataSocket); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing stale metadata socket: %v", err)
+		return
+	}
+	listener, err := net.Listen("unix", metadataSocket)
+	if err != nil {
+		log.Printf("Error listening on metadata socket %s: %v", metadataSocket, err)
+		return
+	}
+
+	server := &http.Server{
+		Handler:           &metadataHandler{manager: m, owners: listDeviceOwners},
+		ReadHeaderTimeout: connectionTimeout,
+	}
+	go func() {
+		<-daemonCtx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	log.Printf("Serving device metadata on %s", metadataSocket)
+	if err := serveAuxHTTP(server, listener, tls.RequireAndVerifyClientCert); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error serving device metadata: %v", err)
+	}
+}
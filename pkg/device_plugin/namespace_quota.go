@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultNamespaceQuotaInterval = time.Minute
+
+var (
+	// namespaceQuotaConfigMap names the ConfigMap ("name" in POD_NAMESPACE or
+	// "namespace/name") holding the namespace device quotas, whose keys are
+	// namespaces and whose values are device counts
+	namespaceQuotaConfigMap = getEnvString("NAMESPACE_DEVICE_QUOTAS_CONFIGMAP", "")
+
+	// envNamespaceQuotas are the quotas set in the environment, which the
+	// ConfigMap entries override
+	envNamespaceQuotas = namespaceQuotas
+
+	// namespaceQuotaLock guards namespaceQuotas against updates from the
+	// ConfigMap while allocations are checked
+	namespaceQuotaLock sync.RWMutex
+)
+
+// errQuotaExceeded is returned when an allocation would exceed the device
+// quota of a namespace
+var errQuotaExceeded = errors.New("namespace device quota exceeded")
+
+// namespaceQuota returns the device quota of the namespace, if it has one
+func namespaceQuota(namespace string) (int, bool) {
+	namespaceQuotaLock.RLock()
+	defer namespaceQuotaLock.RUnlock()
+	quota, ok := namespaceQuotas[namespace]
+	return quota, ok
+}
+
+// parseNamespaceQuotaData parses the data of the quota ConfigMap, ignoring
+// invalid entries
+func parseNamespaceQuotaData(data map[string]string) map[string]int {
+	quotas := make(map[string]int)
+	for namespace, count := range data {
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 0 {
+			log.Printf("Ignoring invalid namespace device quota %s=%q", namespace, count)
+			continue
+		}
+		quotas[namespace] = n
+	}
+	return quotas
+}
+
+// applyNamespaceQuotas sets the quotas of the environment overridden by those
+// of the ConfigMap, which may be nil if it does not exist, and returns
+// whether they changed
+func applyNamespaceQuotas(cm *corev1.ConfigMap) bool {
+	quotas := make(map[string]int)
+	for namespace, n := range envNamespaceQuotas {
+		quotas[namespace] = n
+	}
+	if cm != nil {
+		for namespace, n := range parseNamespaceQuotaData(cm.Data) {
+			quotas[namespace] = n
+		}
+	}
+
+	namespaceQuotaLock.Lock()
+	defer namespaceQuotaLock.Unlock()
+	if len(quotas) == len(namespaceQuotas) {
+		changed := false
+		for namespace, n := range quotas {
+			if old, ok := namespaceQuotas[namespace]; !ok || old != n {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return false
+		}
+	}
+	namespaceQuotas = quotas
+	return true
+}
+
+// formatNamespaceQuotas renders the quotas for logging
+func formatNamespaceQuotas(quotas map[string]int) string {
+	pairs := make([]string, 0, len(quotas))
+	for namespace, n := range quotas {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", namespace, n))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// runNamespaceQuotaWatcher polls the quota ConfigMap and applies its changes
+// until the daemon context is canceled
+func runNamespaceQuotaWatcher() {
+	if namespaceQuotaConfigMap == "" {
+		return
+	}
+	namespace, name, found := strings.Cut(namespaceQuotaConfigMap, "/")
+	if !found {
+		namespace, name = os.Getenv("POD_NAMESPACE"), namespaceQuotaConfigMap
+	}
+	if namespace == "" {
+		log.Printf("POD_NAMESPACE is not set, not watching namespace device quotas in ConfigMap %s", name)
+		return
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		log.Printf("Error authenticating for namespace quota watcher: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(getEnvDuration("NAMESPACE_DEVICE_QUOTAS_INTERVAL", defaultNamespaceQuotaInterval))
+	defer ticker.Stop()
+	for {
+		ctx, cancel := apiContext()
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		cancel()
+		switch {
+		case apierrors.IsNotFound(err):
+			cm, err = nil, nil
+		case err != nil:
+			log.Printf("Error fetching namespace device quotas from ConfigMap %s/%s: %v", namespace, name, err)
+		}
+		if err == nil && applyNamespaceQuotas(cm) {
+			namespaceQuotaLock.RLock()
+			msg := fmt.Sprintf("Namespace device quotas changed to %q", formatNamespaceQuotas(namespaceQuotas))
+			namespaceQuotaLock.RUnlock()
+			log.Print(msg)
+			events.normal("NamespaceQuotasChanged", msg)
+		}
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
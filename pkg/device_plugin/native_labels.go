@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+)
+
+const (
+	nativeLabelsFeaturesFile = "features-file"
+	nativeLabelsNodeLabels   = "node-labels"
+	nativeLabelsFileName     = "nvidia-sandbox-device-plugin"
+
+	gpuProductLabel = "nvidia.com/gpu.product"
+	gpuCountLabel   = "nvidia.com/gpu.count"
+	gpuMemoryLabel  = "nvidia.com/gpu.memory"
+	gpuPresentLabel = "nvidia.com/gpu.present"
+	// resourceMemoryLabelFormat labels the memory size of the GPUs of a
+	// resource, e.g. nvidia.com/GA100_A100_PCIE_40GB.memory
+	resourceMemoryLabelFormat = "nvidia.com/%s.memory"
+)
+
+var (
+	// nfdFeaturesDir can be set for testing to redirect the NFD features file
+	nfdFeaturesDir = "/etc/kubernetes/node-feature-discovery/features.d"
+
+	memoryInNameRegexp = regexp.MustCompile(`(\d+)\s*GB`)
+	labelValueRegexp   = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+	// gpuMemoryMiBByDeviceID holds the memory size of data center GPUs whose
+	// PCI database name does not include it
+	gpuMemoryMiBByDeviceID = map[uint16]int{
+		0x1eb8: 16 * 1024, // Tesla T4
+		0x20b7: 24 * 1024, // A30
+		0x2236: 24 * 1024, // A10
+		0x2237: 24 * 1024, // A10G
+		0x2322: 80 * 1024, // H800 PCIe
+		0x2331: 80 * 1024, // H100 PCIe
+		0x26b5: 48 * 1024, // L40
+		0x26b9: 48 * 1024, // L40S
+		0x27b8: 24 * 1024, // L4
+	}
+)
+
+// getGPUMemoryMiB returns the GPU memory size in MiB. The size is taken from
+// the PCI database name (e.g. "GH100 [H100 SXM5 80GB]") or the table of known
+// device IDs, and falls back to the size of BAR1, which maps the framebuffer
+// on most data center GPUs.
+func getGPUMemoryMiB(dev *nvpci.NvidiaPCIDevice) int {
+	if dev.IsNVSwitch() {
+		return 0
+	}
+	if m := memoryInNameRegexp.FindStringSubmatch(dev.DeviceName); m != nil {
+		if gb, err := strconv.Atoi(m[1]); err == nil {
+			return gb * 1024
+		}
+	}
+	if mib, ok := gpuMemoryMiBByDeviceID[dev.Device]; ok {
+		return mib
+	}
+	if bar1, ok := dev.Resources[1]; ok && bar1 != nil && bar1.End > bar1.Start {
+		return int((uint64(bar1.End-bar1.Start) + 1) >> 20)
+	}
+	return 0
+}
+
+// productLabelValue converts a PCI database device name into a label value,
+// preferring the marketing name in brackets ("GH100 [H100 PCIe]" -> "H100-PCIe")
+func productLabelValue(deviceName string) string {
+	name := deviceName
+	if start := strings.Index(name, "["); start >= 0 {
+		if end := strings.LastIndex(name, "]"); end > start {
+			name = name[start+1 : end]
+		}
+	}
+	name = labelValueRegexp.ReplaceAllString(strings.TrimSpace(name), "-")
+	name = strings.Trim(name, "-._")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-._")
+	}
+	return name
+}
+
+// computeNativeLabels computes the essential GPU labels normally written by
+// GFD from the discovered devices
+func computeNativeLabels() map[string]string {
+	var gpus []NvidiaPCIDevice
+	for _, devs := range iommuMap {
+		for _, dev := range devs {
+			if !dev.IsNVSwitch {
+				gpus = append(gpus, dev)
+			}
+		}
+	}
+	if len(gpus) == 0 {
+		return nil
+	}
+	// use the lowest addressed GPU for the product, like GFD on heterogeneous nodes
+	sort.Slice(gpus, func(i, j int) bool {
+		return gpus[i].Address < gpus[j].Address
+	})
+
+	labels := map[string]string{
+		gpuPresentLabel: "true",
+		gpuCountLabel:   strconv.Itoa(len(gpus)),
+	}
+	if product := productLabelValue(gpus[0].DeviceName); product != "" {
+		labels[gpuProductLabel] = product
+	}
+	if gpus[0].MemoryMiB > 0 {
+		labels[gpuMemoryLabel] = strconv.Itoa(gpus[0].MemoryMiB)
+	}
+	// label the memory of each resource, so that variants of a model with
+	// different memory sizes can be told apart on mixed nodes
+	memory := make(map[string]int)
+	for _, gpu := range gpus {
+		if gpu.MemoryMiB <= 0 {
+			continue
+		}
+		resource := resourceNameForDeviceID(fmt.Sprintf("%04x", gpu.DeviceID))
+		if cur, ok := memory[resource]; !ok || gpu.MemoryMiB < cur {
+			memory[resource] = gpu.MemoryMiB
+		}
+	}
+	for resource, mib := range memory {
+		labels[fmt.Sprintf(resourceMemoryLabelFormat, resource)] = strconv.Itoa(mib)
+	}
+	return labels
+}
+
+// writeFeaturesFile writes the labels as an NFD local feature file
+func writeFeaturesFile(labels map[string]string) error {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, labels[k])
+	}
+
+	if err := os.MkdirAll(nfdFeaturesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", nfdFeaturesDir, err)
+	}
+	// write to a temporary file first so NFD never reads a partial file
+	target := filepath.Join(nfdFeaturesDir, nativeLabelsFileName)
+	tmp, err := os.CreateTemp(nfdFeaturesDir, "."+nativeLabelsFileName+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create features file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write features file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write features file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write features file: %w", err)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// runNativeLabeling labels the node without launching the GFD pod, either by
+// writing an NFD features file or by patching the node labels directly
+func runNativeLabeling(mode string) error {
+	labels := computeNativeLabels()
+	if len(labels) == 0 {
+		log.Printf("No GPUs discovered, skipping native labeling")
+		return nil
+	}
+	log.Printf("Writing native GPU labels (%s): %v", mode, labels)
+
+	switch mode {
+	case nativeLabelsFeaturesFile:
+		return writeFeaturesFile(labels)
+	case nativeLabelsNodeLabels:
+		nodeName := os.Getenv("NODE_NAME")
+		if nodeName == "" {
+			return fmt.Errorf("NODE_NAME environment variable is required for labeling the node")
+		}
+		clientset, err := newInClusterClientset()
+		if err != nil {
+			return err
+		}
+		patch := make(map[string]*string, len(labels))
+		for k := range labels {
+			v := labels[k]
+			patch[k] = &v
+		}
+		return patchNodeLabels(clientset, nodeName, patch)
+	default:
+		return fmt.Errorf("unknown native labeling mode %q", mode)
+	}
+}
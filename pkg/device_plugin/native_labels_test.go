@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Native labels", func() {
+	It("derives the product label value from the PCI database name", func() {
+		Expect(productLabelValue("GH100 [H100 SXM5 80GB]")).To(Equal("H100-SXM5-80GB"))
+		Expect(productLabelValue("GA100GL [A30 PCIe]")).To(Equal("A30-PCIe"))
+		Expect(productLabelValue("Device 2901")).To(Equal("Device-2901"))
+	})
+
+	It("derives GPU memory from the name, device ID or BAR1", func() {
+		Expect(getGPUMemoryMiB(&nvpci.NvidiaPCIDevice{
+			Class:      nvpci.PCI3dControllerClass,
+			DeviceName: "GH100 [H100 SXM5 80GB]",
+		})).To(Equal(80 * 1024))
+		Expect(getGPUMemoryMiB(&nvpci.NvidiaPCIDevice{
+			Class:      nvpci.PCI3dControllerClass,
+			DeviceName: "GA100 [A100 PCIe]",
+			Resources: nvpci.MemoryResources{
+				1: {Start: 0x0, End: 0xfffffffff},
+			},
+		})).To(Equal(64 * 1024))
+		Expect(getGPUMemoryMiB(&nvpci.NvidiaPCIDevice{
+			Class:      nvpci.PCI3dControllerClass,
+			Device:     0x26b9,
+			DeviceName: "AD102GL [L40S]",
+			Resources: nvpci.MemoryResources{
+				1: {Start: 0x0, End: 0xfffffffff},
+			},
+		})).To(Equal(48 * 1024))
+		Expect(getGPUMemoryMiB(&nvpci.NvidiaPCIDevice{
+			Class:      nvpci.PCINvSwitchClass,
+			DeviceName: "GH100 [H100 NVSwitch]",
+		})).To(BeZero())
+	})
+
+	It("computes labels and writes them as an NFD features file", func() {
+		oldAlias := PGPUAlias
+		defer func() { PGPUAlias = oldAlias }()
+		PGPUAlias = "pgpu"
+		iommuMap = map[string][]NvidiaPCIDevice{
+			"1": {{Address: "0000:01:00.0", DeviceName: "GH100 [H100 PCIe]", MemoryMiB: 81920}},
+			"2": {{Address: "0000:02:00.0", DeviceName: "GH100 [H100 PCIe]", MemoryMiB: 81920}},
+			"3": {{Address: "0000:03:00.0", DeviceName: "GH100 [H100 NVSwitch]", IsNVSwitch: true}},
+		}
+		labels := computeNativeLabels()
+		Expect(labels).To(Equal(map[string]string{
+			gpuPresentLabel:          "true",
+			gpuCountLabel:            "2",
+			gpuProductLabel:          "H100-PCIe",
+			gpuMemoryLabel:           "81920",
+			"nvidia.com/pgpu.memory": "81920",
+		}))
+
+		workDir, err := os.MkdirTemp("", "features-test")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(workDir)
+		oldDir := nfdFeaturesDir
+		defer func() { nfdFeaturesDir = oldDir }()
+		nfdFeaturesDir = workDir
+
+		Expect(writeFeaturesFile(labels)).To(Succeed())
+		data, err := os.ReadFile(filepath.Join(workDir, nativeLabelsFileName))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("nvidia.com/gpu.count=2\nnvidia.com/gpu.memory=81920\nnvidia.com/gpu.present=true\nnvidia.com/gpu.product=H100-PCIe\nnvidia.com/pgpu.memory=81920\n"))
+		entries, err := os.ReadDir(workDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("labels the smallest memory size of each resource", func() {
+		oldAlias := PGPUAlias
+		defer func() { PGPUAlias = oldAlias }()
+		PGPUAlias = ""
+		iommuMap = map[string][]NvidiaPCIDevice{
+			"1": {{Address: "0000:01:00.0", DeviceID: 0x20f1, DeviceName: "GA100 [A100 PCIe 40GB]", MemoryMiB: 40960}},
+			"2": {{Address: "0000:02:00.0", DeviceID: 0x20b5, DeviceName: "GA100 [A100 PCIe 80GB]", MemoryMiB: 81920}},
+			"3": {{Address: "0000:03:00.0", DeviceID: 0x20b5, DeviceName: "GA100 [A100 PCIe 80GB]", MemoryMiB: 81920}},
+		}
+		labels := computeNativeLabels()
+		Expect(labels).To(HaveKeyWithValue("nvidia.com/GA100_A100_PCIE_40GB.memory", "40960"))
+		Expect(labels).To(HaveKeyWithValue("nvidia.com/GA100_A100_PCIE_80GB.memory", "81920"))
+		Expect(labels).To(HaveKeyWithValue(gpuMemoryLabel, "40960"))
+	})
+})
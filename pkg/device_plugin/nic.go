@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// mellanoxVendorID is the PCI vendor ID of ConnectX NICs
+	mellanoxVendorID = 0x15b3
+	// pciNetworkClass is the PCI base class of network controllers
+	pciNetworkClass = 0x02
+	// numaDistancePenalty is added to the distance of devices on different
+	// NUMA nodes, so that any pairing within a NUMA node is preferred
+	numaDistancePenalty = 100
+)
+
+var (
+	// nicCompanionsEnabled enables the discovery of ConnectX NICs bound to
+	// vfio-pci and their co-allocation with the nearest GPU
+	nicCompanionsEnabled = getEnvBool("NIC_COMPANIONS", false)
+	// nicCompanions maps the IOMMU key of a GPU to its paired NIC
+	nicCompanions map[string]NvidiaPCIDevice
+)
+
+// discoverNICs returns the ConnectX NICs bound to vfio-pci whose IOMMU group
+// can be assigned
+func discoverNICs() ([]NvidiaPCIDevice, error) {
+	entries, err := fsys.ReadDir(filepath.Join(rootPath, pciDevicesPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PCI devices: %w", err)
+	}
+	var nics []NvidiaPCIDevice
+	for _, entry := range entries {
+		address := entry.Name()
+		devPath := filepath.Join(rootPath, pciDevicesPath, address)
+		vendor, err := readSysfsHex(filepath.Join(devPath, "vendor"))
+		if err != nil || vendor != mellanoxVendorID {
+			continue
+		}
+		class, err := readSysfsHex(filepath.Join(devPath, "class"))
+		if err != nil || class>>16 != pciNetworkClass {
+			continue
+		}
+		nic, err := readPCIDevice(address)
+		if err != nil {
+			discoverySkips.skip(address, "nic", fmt.Sprintf("Skipping NIC %s: %v", address, err))
+			continue
+		}
+		if err := checkIommuGroupViable(nic.IommuGroup); err != nil {
+			discoverySkips.skip(address, "iommu-group", fmt.Sprintf("Skipping NIC %s: %v", address, err))
+			continue
+		}
+		if device, err := readSysfsHex(filepath.Join(devPath, "device")); err == nil {
+			nic.DeviceID = uint16(device)
+		}
+		nic.NumaNode = -1
+		if data, err := fsys.ReadFile(filepath.Join(devPath, "numa_node")); err == nil {
+			if node, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				nic.NumaNode = node
+			}
+		}
+		nics = append(nics, nic)
+	}
+	return nics, nil
+}
+
+// readSysfsHex reads a hexadecimal sysfs attribute such as "0x15b3"
+func readSysfsHex(path string) (uint64, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"), 16, 32)
+}
+
+// pciTopologyPath returns the root complex and the PCI addresses from the root
+// port down to the device
+func pciTopologyPath(address string) []string {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(rootPath, pciDevicesPath, address))
+	if err != nil {
+		return nil
+	}
+	var path []string
+	for _, part := range strings.Split(resolved, string(filepath.Separator)) {
+		if strings.HasPrefix(part, "pci") || pciAddressRegexp.MatchString(part) {
+			path = append(path, part)
+		}
+	}
+	return path
+}
+
+// topologyDistance returns the number of PCIe hops between two devices, the
+// devices of other root complexes being the farthest
+func topologyDistance(a, b []string, numaA, numaB int) int {
+	common := 0
+	for common < len(a) && common < len(b) && a[common] == b[common] {
+		common++
+	}
+	distance := len(a) + len(b) - 2*common
+	if numaA != numaB {
+		distance += numaDistancePenalty
+	}
+	return distance
+}
+
+// pairNICs pairs each GPU with its nearest NIC. Since the IOMMU group of a
+// NIC can only be assigned to one VM, every NIC is paired with at most one
+// GPU, the closest pairs being made first.
+func pairNICs(gpus map[string]NvidiaPCIDevice, nics []NvidiaPCIDevice) map[string]NvidiaPCIDevice {
+	type candidate struct {
+		gpuKey   string
+		gpu      NvidiaPCIDevice
+		nic      NvidiaPCIDevice
+		distance int
+	}
+	nicPaths := make(map[string][]string)
+	for _, nic := range nics {
+		nicPaths[nic.Address] = pciTopologyPath(nic.Address)
+	}
+	var candidates []candidate
+	for key, gpu := range gpus {
+		gpuPath := pciTopologyPath(gpu.Address)
+		for _, nic := range nics {
+			candidates = append(candidates, candidate{
+				gpuKey:   key,
+				gpu:      gpu,
+				nic:      nic,
+				distance: topologyDistance(gpuPath, nicPaths[nic.Address], gpu.NumaNode, nic.NumaNode),
+			})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.distance != b.distance {
+			return a.distance < b.distance
+		}
+		if a.gpu.Address != b.gpu.Address {
+			return a.gpu.Address < b.gpu.Address
+		}
+		return a.nic.Address < b.nic.Address
+	})
+
+	pairs := make(map[string]NvidiaPCIDevice)
+	pairedNICs := make(map[string]bool)
+	for _, c := range candidates {
+		if _, ok := pairs[c.gpuKey]; ok || pairedNICs[c.nic.Address] {
+			continue
+		}
+		pairs[c.gpuKey] = c.nic
+		pairedNICs[c.nic.Address] = true
+	}
+	return pairs
+}
+
+// discoverNICCompanions discovers the NICs and pairs them with the GPUs of
+// the IOMMU map
+func discoverNICCompanions() {
+	nicCompanions = nil
+	if !nicCompanionsEnabled {
+		return
+	}
+	nics, err := discoverNICs()
+	if err != nil {
+		log.Printf("Error discovering NIC companions: %v", err)
+		return
+	}
+	gpus := make(map[string]NvidiaPCIDevice)
+	for iommuKey, devs := range iommuMap {
+		for _, dev := range devs {
+			if !dev.IsNVSwitch {
+				gpus[iommuKey] = dev
+				break
+			}
+		}
+	}
+	nicCompanions = pairNICs(gpus, nics)
+	for iommuKey, nic := range nicCompanions {
+		log.Printf("Pairing GPU %s with NIC %s (vfio group: %d)", gpus[iommuKey].Address, nic.Address, nic.IommuGroup)
+	}
+	if len(nics) > len(nicCompanions) {
+		log.Printf("%d NIC(s) were not paired with a GPU", len(nics)-len(nicCompanions))
+	}
+}
+
+// companionNodes returns the VFIO nodes of the NIC paired with the GPU of the
+// given IOMMU key, if any: its iommufd device when iommufd is used and the NIC
+// has one, otherwise the legacy VFIO container node followed by its group
+// node, since the GPU may be addressed through iommufd. The NIC node is last.
+func companionNodes(iommuKey string, iommufdSupported bool) ([]vfioNode, error) {
+	nic, ok := nicCompanions[iommuKey]
+	if !ok {
+		return nil, nil
+	}
+	if iommufdSupported && nic.IommuFD != "" {
+		node, err := containerPaths.iommufdNode(nic.IommuFD)
+		if err != nil {
+			return nil, err
+		}
+		return []vfioNode{node}, nil
+	}
+	control, err := containerPaths.controlNode()
+	if err != nil {
+		return nil, err
+	}
+	group, err := containerPaths.groupNode(strconv.Itoa(nic.IommuGroup))
+	if err != nil {
+		return nil, err
+	}
+	return []vfioNode{control, group}, nil
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	nodeFailureActionNone   = "none"
+	nodeFailureActionTaint  = "taint"
+	nodeFailureActionCordon = "cordon"
+
+	// deviceFailureTaintKey is tainted on the node while every device of a
+	// resource is unhealthy
+	deviceFailureTaintKey = "nvidia.com/sandbox-device-plugin.device-failure"
+	// cordonedAnnotation marks nodes cordoned by the device plugin, so that
+	// only those are uncordoned again on recovery
+	cordonedAnnotation = "nvidia.com/sandbox-device-plugin.cordoned"
+
+	nodeFailureRetryInterval = time.Minute
+)
+
+// nodeFailureAction selects how the node is fenced when all devices of a
+// resource fail: "none", "taint" (NoSchedule) or "cordon"
+var nodeFailureAction = getEnvString("NODE_FAILURE_ACTION", nodeFailureActionNone)
+
+// nodeFailureCoordinator fences the node while at least one resource has no
+// healthy device left, and lifts the fence once health recovers
+type nodeFailureCoordinator struct {
+	lock    sync.Mutex
+	failed  map[string]bool
+	applied bool
+	notify  chan struct{}
+	// apply fences (true) or unfences (false) the node
+	apply func(fenced bool, resources []string) error
+}
+
+var nodeFailures = newNodeFailureCoordinator()
+
+func newNodeFailureCoordinator() *nodeFailureCoordinator {
+	return &nodeFailureCoordinator{
+		failed: make(map[string]bool),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// report records whether every device of the resource is unhealthy
+func (c *nodeFailureCoordinator) report(resource string, allFailed bool) {
+	c.lock.Lock()
+	if allFailed {
+		c.failed[resource] = true
+	} else {
+		delete(c.failed, resource)
+	}
+	c.lock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// reconcile fences or unfences the node to match the reported failures
+func (c *nodeFailureCoordinator) reconcile() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fenced := len(c.failed) > 0
+	if fenced == c.applied {
+		return nil
+	}
+	resources := make([]string, 0, len(c.failed))
+	for resource := range c.failed {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	if err := c.apply(fenced, resources); err != nil {
+		return err
+	}
+	c.applied = fenced
+	return nil
+}
+
+// run reconciles the node on every report, retrying failed updates, until stop
+func (c *nodeFailureCoordinator) run() {
+	ticker := time.NewTicker(nodeFailureRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-c.notify:
+		case <-ticker.C:
+		}
+		if err := c.reconcile(); err != nil {
+			log.Printf("Error updating node for device failures: %v", err)
+		}
+	}
+}
+
+// runNodeFailureCoordinator starts fencing the node on total device failure
+// when NODE_FAILURE_ACTION is set
+func runNodeFailureCoordinator() {
+	var apply func(clientset kubernetes.Interface, nodeName string, fenced bool, resources []string) error
+	switch nodeFailureAction {
+	case "", nodeFailureActionNone:
+		return
+	case nodeFailureActionTaint:
+		apply = setDeviceFailureTaint
+	case nodeFailureActionCordon:
+		apply = setDeviceFailureCordon
+	default:
+		log.Printf("Unknown NODE_FAILURE_ACTION %q, not fencing the node on device failure", nodeFailureAction)
+		return
+	}
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		log.Printf("NODE_NAME environment variable is required for NODE_FAILURE_ACTION")
+		return
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		log.Printf("Error authenticating for node failure handling: %v", err)
+		return
+	}
+	nodeFailures.apply = func(fenced bool, resources []string) error {
+		return apply(clientset, nodeName, fenced, resources)
+	}
+	nodeFailures.run()
+}
+
+// reportNodeFailure reports to the coordinator whether all devices of this
+// plugin are unhealthy
+func (dpi *GenericDevicePlugin) reportNodeFailure() {
+	dpi.healthLock.Lock()
+	allFailed := len(dpi.devs) > 0
+	for _, dev := range dpi.devs {
+		if dev.Health != pluginapi.Unhealthy {
+			allFailed = false
+			break
+		}
+	}
+	dpi.healthLock.Unlock()
+	nodeFailures.report(dpi.deviceName, allFailed)
+}
+
+// updateTaints returns taints with the device failure taint added or removed,
+// and whether anything changed
+func updateTaints(taints []corev1.Taint, fenced bool, resources []string) ([]corev1.Taint, bool) {
+	var result []corev1.Taint
+	found := false
+	for _, taint := range taints {
+		if taint.Key == deviceFailureTaintKey {
+			found = true
+			continue
+		}
+		result = append(result, taint)
+	}
+	if !fenced {
+		return result, found
+	}
+	value := ""
+	if len(resources) == 1 {
+		value = resources[0]
+	}
+	return append(result, corev1.Taint{
+		Key:    deviceFailureTaintKey,
+		Value:  value,
+		Effect: corev1.TaintEffectNoSchedule,
+	}), true
+}
+
+// setDeviceFailureTaint adds or removes the device failure taint on the node
+func setDeviceFailureTaint(clientset kubernetes.Interface, nodeName string, fenced bool, resources []string) error {
+	ctx, cancel := apiContext()
+	defer cancel()
+	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error fetching node %s: %w", nodeName, err)
+	}
+	taints, changed := updateTaints(node.Spec.Taints, fenced, resources)
+	if !changed {
+		return nil
+	}
+	node.Spec.Taints = taints
+	if _, err := clientset.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("error updating taints of node %s: %w", nodeName, err)
+	}
+	log.Printf("Device failure taint on node %s set to %v (failed resources: %v)", nodeName, fenced, resources)
+	return nil
+}
+
+// setDeviceFailureCordon cordons the node, or uncordons it if it was cordoned
+// by the device plugin. A node already cordoned, e.g. by an administrator, is
+// left alone so that recovering devices do not uncordon it.
+func setDeviceFailureCordon(clientset kubernetes.Interface, nodeName string, fenced bool, resources []string) error {
+	ctx, cancel := apiContext()
+	defer cancel()
+	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error fetching node %s: %w", nodeName, err)
+	}
+	var annotation *string
+	if fenced {
+		if node.Spec.Unschedulable {
+			return nil
+		}
+		value := "true"
+		annotation = &value
+	} else if _, ok := node.Annotations[cordonedAnnotation]; !ok {
+		// cordoned by someone else, leave it alone
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{cordonedAnnotation: annotation},
+		},
+		"spec": map[string]interface{}{
+			"unschedulable": fenced,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding node cordon patch: %w", err)
+	}
+	_, err = clientset.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("error cordoning node %s: %w", nodeName, err)
+	}
+	log.Printf("Node %s unschedulable set to %v (failed resources: %v)", nodeName, fenced, resources)
+	return nil
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// nodeFeatureGVR is the NFD resource the worker of each node publishes its
+// feature labels in, before the NFD master applies them to the node
+var nodeFeatureGVR = schema.GroupVersionResource{Group: "nfd.k8s.io", Version: "v1alpha1", Resource: "nodefeatures"}
+
+// nodeFeatureNodeLabel names the node a NodeFeature belongs to
+const nodeFeatureNodeLabel = "nfd.node.kubernetes.io/node-name"
+
+// nodeWatcher caches the node of the plugin and the labels of its NFD
+// NodeFeatures from informers, so that waiting for labels and annotations
+// does not poll the API server
+type nodeWatcher struct {
+	lock     sync.Mutex
+	node     *corev1.Node
+	features map[string]map[string]string // labels by NodeFeature namespace/name
+	changed  chan struct{}                // closed and replaced on every change
+}
+
+func newNodeWatcher() *nodeWatcher {
+	return &nodeWatcher{features: make(map[string]map[string]string), changed: make(chan struct{})}
+}
+
+// notify wakes the waiters for a change. Called with the lock held.
+func (w *nodeWatcher) notify() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+func (w *nodeWatcher) setNode(node *corev1.Node) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.node = node
+	w.notify()
+}
+
+func (w *nodeWatcher) setFeature(key string, labels map[string]string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if labels == nil {
+		delete(w.features, key)
+	} else {
+		w.features[key] = labels
+	}
+	w.notify()
+}
+
+// current returns the cached node, nil until it was listed, and a channel
+// closed on the next change
+func (w *nodeWatcher) current() (*corev1.Node, <-chan struct{}) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.node, w.changed
+}
+
+// labels returns the labels of the node merged with those its NodeFeatures
+// publish and that the NFD master has not applied yet. Labels of the node
+// take precedence.
+func (w *nodeWatcher) labels() (map[string]string, <-chan struct{}) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	labels := make(map[string]string)
+	for _, features := range w.features {
+		for k, v := range features {
+			labels[k] = v
+		}
+	}
+	if w.node != nil {
+		for k, v := range w.node.Labels {
+			labels[k] = v
+		}
+	}
+	return labels, w.changed
+}
+
+// waitForLabels blocks until ready accepts the labels or the context is done
+func (w *nodeWatcher) waitForLabels(ctx context.Context, ready func(labels map[string]string) bool) error {
+	for {
+		labels, changed := w.labels()
+		if ready(labels) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// nodeFeatureLabels returns the labels of a NodeFeature object
+func nodeFeatureLabels(obj interface{}) (string, map[string]string, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	feature, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return "", nil, false
+	}
+	labels, _, _ := unstructured.NestedStringMap(feature.Object, "spec", "labels")
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return feature.GetNamespace() + "/" + feature.GetName(), labels, true
+}
+
+// start runs the informers of the node and, when the NFD CRD is installed,
+// its NodeFeatures until stop is closed, and waits for their initial lists
+func (w *nodeWatcher) start(clientset kubernetes.Interface, client dynamic.Interface, nodeName string, stop <-chan struct{}) error {
+	selector := fields.OneTermEqualSelector(metav1.ObjectNameField, nodeName).String()
+	nodes := cache.NewSharedInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().Nodes().List(daemonCtx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().Nodes().Watch(daemonCtx, options)
+		},
+	}, &corev1.Node{}, 0)
+	update := func(obj interface{}) {
+		if node, ok := obj.(*corev1.Node); ok {
+			w.setNode(node)
+		}
+	}
+	if _, err := nodes.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+	}); err != nil {
+		return err
+	}
+	go nodes.Run(stop)
+	synced := []cache.InformerSynced{nodes.HasSynced}
+
+	featureSelector := nodeFeatureNodeLabel + "=" + nodeName
+	features := client.Resource(nodeFeatureGVR).Namespace(metav1.NamespaceAll)
+	ctx, cancel := apiContext()
+	_, err := features.List(ctx, metav1.ListOptions{LabelSelector: featureSelector, Limit: 1})
+	cancel()
+	switch {
+	case apierrors.IsNotFound(err):
+		log.Printf("NFD NodeFeature CRD is not installed, watching node labels only")
+	case err != nil:
+		log.Printf("Not watching NFD NodeFeatures: %v", err)
+	default:
+		informer := cache.NewSharedInformer(&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = featureSelector
+				return features.List(daemonCtx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = featureSelector
+				return features.Watch(daemonCtx, options)
+			},
+		}, &unstructured.Unstructured{}, 0)
+		set := func(obj interface{}) {
+			if key, labels, ok := nodeFeatureLabels(obj); ok {
+				w.setFeature(key, labels)
+			}
+		}
+		if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    set,
+			UpdateFunc: func(_, obj interface{}) { set(obj) },
+			DeleteFunc: func(obj interface{}) {
+				if key, _, ok := nodeFeatureLabels(obj); ok {
+					w.setFeature(key, nil)
+				}
+			},
+		}); err != nil {
+			return err
+		}
+		go informer.Run(stop)
+		synced = append(synced, informer.HasSynced)
+	}
+
+	if !cache.WaitForCacheSync(stop, synced...) {
+		return fmt.Errorf("node %s was not listed before stopping", nodeName)
+	}
+	return nil
+}
+
+// watchedNodeLabels returns the labels of the node and its NodeFeatures from
+// the shared watcher
+func watchedNodeLabels(nodeName string) (map[string]string, error) {
+	w, err := watchNode(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	labels, _ := w.labels()
+	return labels, nil
+}
+
+var (
+	sharedNodeWatcher     *nodeWatcher
+	sharedNodeWatcherErr  error
+	sharedNodeWatcherOnce sync.Once
+)
+
+// watchNode returns the watcher of the node shared by all users, starting it
+// on first use. It runs until the daemon context is canceled.
+func watchNode(nodeName string) (*nodeWatcher, error) {
+	sharedNodeWatcherOnce.Do(func() {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			sharedNodeWatcherErr = fmt.Errorf("error obtaining cluster credentials: %w", err)
+			return
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			sharedNodeWatcherErr = fmt.Errorf("error obtaining clientset: %w", err)
+			return
+		}
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			sharedNodeWatcherErr = fmt.Errorf("error obtaining dynamic client: %w", err)
+			return
+		}
+		w := newNodeWatcher()
+		if err := w.start(clientset, client, nodeName, daemonCtx.Done()); err != nil {
+			sharedNodeWatcherErr = err
+			return
+		}
+		sharedNodeWatcher = w
+	})
+	return sharedNodeWatcher, sharedNodeWatcherErr
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// numaNodesAnnotation lists the NUMA nodes of the devices allocated to a
+// container so that the sandbox runtime can pin the VM's vCPUs and memory
+const numaNodesAnnotation = "io.katacontainers.nvidia.com/numa-nodes"
+
+// numaHintsEnabled controls whether allocate responses carry NUMA annotations.
+// It should only be enabled for runtimes that understand the annotation.
+var numaHintsEnabled = getEnvBool("NUMA_HINTS", false)
+
+// numaAnnotations returns the annotations describing the NUMA placement of
+// devs, or nil if NUMA hints are disabled or no device has a known NUMA node
+func numaAnnotations(devs []NvidiaPCIDevice) map[string]string {
+	if !numaHintsEnabled {
+		return nil
+	}
+	seen := make(map[int]bool)
+	var nodes []int
+	for _, dev := range devs {
+		// The kernel reports -1 when the platform does not expose NUMA affinity
+		if dev.NumaNode < 0 || seen[dev.NumaNode] {
+			continue
+		}
+		seen[dev.NumaNode] = true
+		nodes = append(nodes, dev.NumaNode)
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	sort.Ints(nodes)
+	values := make([]string, len(nodes))
+	for i, node := range nodes {
+		values[i] = strconv.Itoa(node)
+	}
+	return map[string]string{numaNodesAnnotation: strings.Join(values, ",")}
+}
+
+// numaNodeForIommuKey returns the NUMA node of the device with the IOMMU key,
+// or -1 if it is unknown
+func numaNodeForIommuKey(iommuKey string) int {
+	for _, dev := range iommuMap[iommuKey] {
+		if dev.NumaNode >= 0 {
+			return dev.NumaNode
+		}
+	}
+	return -1
+}
+
+// topologyForIommuKey returns the topology advertised to the kubelet for the
+// device with the IOMMU key, so that the Topology Manager can generate NUMA
+// hints, or nil if its NUMA node is unknown
+func topologyForIommuKey(iommuKey string) *pluginapi.TopologyInfo {
+	node := numaNodeForIommuKey(iommuKey)
+	if node < 0 {
+		return nil
+	}
+	return &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(node)}}}
+}
+
+// orderByNUMANode orders the available devices so that picking them in order
+// fills a request from a single NUMA node when possible. The node of the
+// devices that must be included comes first, then the smallest nodes that can
+// satisfy the need, so that larger nodes stay whole, then the other nodes from
+// largest to smallest, then the devices of unknown NUMA affinity. Within a
+// node the devices are ordered by P2P group.
+func orderByNUMANode(available, mustInclude []string, need int) []string {
+	nodes := make(map[int][]string)
+	var unknown []string
+	for _, id := range available {
+		if node := numaNodeForIommuKey(iommuKeyForDeviceID(id)); node >= 0 {
+			nodes[node] = append(nodes[node], id)
+		} else {
+			unknown = append(unknown, id)
+		}
+	}
+
+	preferred := make(map[int]bool)
+	for _, id := range mustInclude {
+		if node := numaNodeForIommuKey(iommuKeyForDeviceID(id)); node >= 0 {
+			preferred[node] = true
+		}
+	}
+
+	ids := make([]int, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := len(nodes[ids[i]]), len(nodes[ids[j]])
+		fitsA, fitsB := a >= need, b >= need
+		switch {
+		case preferred[ids[i]] != preferred[ids[j]]:
+			return preferred[ids[i]]
+		case fitsA != fitsB:
+			return fitsA
+		case fitsA && a != b:
+			return a < b
+		case !fitsA && a != b:
+			return a > b
+		}
+		return ids[i] < ids[j]
+	})
+
+	var ordered []string
+	for _, id := range ids {
+		ordered = append(ordered, orderByP2PGroup(nodes[id], mustInclude, need-len(ordered))...)
+	}
+	return append(ordered, orderByP2PGroup(unknown, mustInclude, need-len(ordered))...)
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultNVSwitchHealthInterval = 30 * time.Second
+)
+
+// nvSwitchHealthInterval is the interval of fabric health evaluations
+var nvSwitchHealthInterval = newDurationSetting(defaultNVSwitchHealthInterval)
+
+// nvSwitchProbe checks the health of a single NVSwitch (injectable for testing)
+var nvSwitchProbe = probeNVSwitch
+
+// expectedNVSwitchesPerBaseboard is the number of NVSwitches of a baseboard.
+// When 0 missing NVSwitches are not detected, only unhealthy ones.
+var expectedNVSwitchesPerBaseboard = int(getEnvUint("EXPECTED_NVSWITCHES_PER_BASEBOARD", 0))
+
+// fabricDegradedSet holds the IOMMU keys the NVSwitch health monitor reports
+// unhealthy because their NVLink fabric is degraded
+type fabricDegradedSet struct {
+	lock sync.RWMutex
+	keys map[string]bool
+}
+
+var fabricDegraded = &fabricDegradedSet{keys: make(map[string]bool)}
+
+// contains returns true if the device with the IOMMU key is on a degraded
+// fabric
+func (f *fabricDegradedSet) contains(iommuKey string) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.keys[iommuKey]
+}
+
+// update replaces the degraded devices with the unhealthy keys of a fabric
+// health evaluation
+func (f *fabricDegradedSet) update(health map[string]string) {
+	keys := make(map[string]bool)
+	for iommuKey, h := range health {
+		if h == pluginapi.Unhealthy {
+			keys[iommuKey] = true
+		}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.keys = keys
+}
+
+// getBaseboardID identifies the baseboard a device sits on by the topmost PCIe
+// switch or bridge above it, e.g. "0000:01:00.0". The GPUs and NVSwitches of an
+// HGX baseboard hang off the switches of the board and do not share a root bus,
+// while the boards of a system may share a root complex. A device attached
+// directly to a root port falls back to its PCI root complex (e.g. "pci0000:00"),
+// and to the PCI domain when the sysfs topology cannot be resolved.
+func getBaseboardID(address, devPath string) string {
+	if devPath != "" {
+		// the topmost bridge is the root port, the one below it the upstream
+		// port of the switch of the board
+		if bridges := upstreamBridges(devPath); len(bridges) >= 2 {
+			return bridges[len(bridges)-2]
+		}
+		if resolved, err := filepath.EvalSymlinks(devPath); err == nil {
+			for _, part := range strings.Split(resolved, string(filepath.Separator)) {
+				if strings.HasPrefix(part, "pci") {
+					return part
+				}
+			}
+		}
+	}
+	if domain, _, found := strings.Cut(address, ":"); found {
+		return "pci" + domain
+	}
+	return ""
+}
+
+// probeNVSwitch verifies that the NVSwitch is still present on the PCI bus and
+// that its PCIe link is up
+func probeNVSwitch(dev NvidiaPCIDevice) error {
+	devPath := filepath.Join(rootPath, pciDevicesPath, dev.Address)
+	if _, err := fsys.Stat(devPath); err != nil {
+		return fmt.Errorf("device not present: %w", err)
+	}
+	width, err := fsys.ReadFile(filepath.Join(devPath, "current_link_width"))
+	if err != nil {
+		return fmt.Errorf("unable to read link width: %w", err)
+	}
+	if w := strings.TrimSpace(string(width)); w == "" || w == "0" {
+		return fmt.Errorf("PCIe link is down")
+	}
+	speed, err := fsys.ReadFile(filepath.Join(devPath, "current_link_speed"))
+	if err != nil {
+		return fmt.Errorf("unable to read link speed: %w", err)
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(speed)), "Unknown") {
+		return fmt.Errorf("PCIe link speed unknown")
+	}
+	return nil
+}
+
+// evaluateFabricHealth probes every NVSwitch and returns the resulting health
+// of each IOMMU key. A GPU is reported unhealthy when any NVSwitch on its
+// baseboard is unhealthy, or when its baseboard has fewer NVSwitches than
+// EXPECTED_NVSWITCHES_PER_BASEBOARD, since its NVLink fabric is degraded.
+func evaluateFabricHealth() map[string]string {
+	health := make(map[string]string)
+	degradedBoards := make(map[string]bool)
+	found := make(map[string]int)
+
+	for iommuKey, devs := range iommuMap {
+		for _, dev := range devs {
+			// a board whose NVSwitches are all missing only shows its GPUs
+			if _, ok := found[dev.Baseboard]; !ok {
+				found[dev.Baseboard] = 0
+			}
+			if !dev.IsNVSwitch {
+				continue
+			}
+			found[dev.Baseboard]++
+			if err := nvSwitchProbe(dev); err != nil {
+				log.Printf("NVSwitch %s on %s is unhealthy: %v", dev.Address, dev.Baseboard, err)
+				health[iommuKey] = pluginapi.Unhealthy
+				degradedBoards[dev.Baseboard] = true
+			} else if health[iommuKey] == "" {
+				health[iommuKey] = pluginapi.Healthy
+			}
+		}
+	}
+
+	if expectedNVSwitchesPerBaseboard > 0 {
+		for board, n := range found {
+			if n < expectedNVSwitchesPerBaseboard {
+				log.Printf("Baseboard %s has %d of %d NVSwitches", board, n, expectedNVSwitchesPerBaseboard)
+				degradedBoards[board] = true
+			}
+		}
+	}
+
+	for iommuKey, devs := range iommuMap {
+		for _, dev := range devs {
+			if dev.IsNVSwitch {
+				continue
+			}
+			if degradedBoards[dev.Baseboard] {
+				health[iommuKey] = pluginapi.Unhealthy
+			} else if health[iommuKey] == "" {
+				health[iommuKey] = pluginapi.Healthy
+			}
+		}
+	}
+	return health
+}
+
+// fabricMonitor pushes the health transitions of fabric health evaluations to
+// the device plugins advertising the affected devices
+type fabricMonitor struct {
+	// last is the last health of each IOMMU key, devices start out healthy
+	// when first advertised
+	last map[string]string
+	// held are the IDs of the devices that were healthy until the monitor
+	// reported them unhealthy
+	held map[string]bool
+}
+
+func newFabricMonitor() *fabricMonitor {
+	return &fabricMonitor{
+		last: make(map[string]string),
+		held: make(map[string]bool),
+	}
+}
+
+// evaluate evaluates the fabric health once. A recovered device is only
+// reported healthy again if the monitor made it unhealthy and it passes the
+// recovery probe, other devices are left to the health checks that failed them.
+func (f *fabricMonitor) evaluate(plugins []*GenericDevicePlugin) {
+	health := evaluateFabricHealth()
+	fabricDegraded.update(health)
+	for _, dp := range plugins {
+		unhealthy := make(map[string]bool)
+		for _, id := range dp.unhealthyDevices() {
+			unhealthy[id] = true
+		}
+		for _, dev := range dp.devs {
+			iommuKey := iommuKeyForDeviceID(dev.ID)
+			h, ok := health[iommuKey]
+			if !ok {
+				continue
+			}
+			prev, seen := f.last[iommuKey]
+			if (!seen && h == pluginapi.Healthy) || prev == h {
+				continue
+			}
+			f.last[iommuKey] = h
+			if h == pluginapi.Unhealthy {
+				f.held[dev.ID] = !unhealthy[dev.ID]
+				dp.setHealth(dev.ID, h)
+				continue
+			}
+			if f.held[dev.ID] {
+				dp.reprobeHealth(dev.ID)
+			}
+			delete(f.held, dev.ID)
+		}
+	}
+}
+
+// runNVSwitchHealthMonitor periodically evaluates fabric health
+func runNVSwitchHealthMonitor(m *DevicePluginManager) {
+	if len(nvSwitchDeviceIDs) == 0 {
+		return
+	}
+	log.Printf("Starting NVSwitch health monitor")
+	if expectedNVSwitchesPerBaseboard == 0 {
+		log.Printf("EXPECTED_NVSWITCHES_PER_BASEBOARD is not set, baseboards missing NVSwitches are not detected")
+	}
+	interval := nvSwitchHealthInterval.get()
+	ticker := clk.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+
+	monitor := newFabricMonitor()
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-ticker.C():
+			monitor.evaluate(m.Plugins())
+			if d := nvSwitchHealthInterval.get(); d != interval {
+				ticker.Stop()
+				interval = d
+				ticker = clk.NewTicker(interval)
+			}
+		}
+	}
+}
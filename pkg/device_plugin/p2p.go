@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// pciExtCapStart is the offset of the PCIe extended capability list
+	pciExtCapStart = 0x100
+	pciExtCapIDACS = 0x000d
+	// ACS control bits that force peer-to-peer traffic through the root complex
+	pciACSCtrlRR = 0x0004 // P2P Request Redirect
+	pciACSCtrlCR = 0x0008 // P2P Completion Redirect
+	pciACSCtrlEC = 0x0020 // P2P Egress Control
+)
+
+// acsRedirects reports whether a PCI bridge redirects peer-to-peer traffic
+// upstream (injectable for testing)
+var acsRedirects = readACSRedirects
+
+// readACSRedirects reads the ACS control register from the config space of
+// a PCI bridge. The extended config space is only readable with privileges,
+// so a truncated config space is an error rather than a missing capability.
+func readACSRedirects(address string) (bool, error) {
+	config, err := fsys.ReadFile(filepath.Join(rootPath, pciDevicesPath, address, "config"))
+	if err != nil {
+		return false, err
+	}
+	if len(config) <= pciExtCapStart {
+		return false, fmt.Errorf("extended config space of %s is not readable", address)
+	}
+	ctrl, found := acsControl(config)
+	if !found {
+		return false, nil
+	}
+	return ctrl&(pciACSCtrlRR|pciACSCtrlCR|pciACSCtrlEC) != 0, nil
+}
+
+// acsControl walks the PCIe extended capability list and returns the ACS
+// control register, if the device has an ACS capability
+func acsControl(config []byte) (uint16, bool) {
+	offset := pciExtCapStart
+	// the capability list has at most (4096-256)/4 entries, bound the walk
+	// in case of a looping list
+	for i := 0; i < 960 && offset >= pciExtCapStart && offset+8 <= len(config); i++ {
+		header := binary.LittleEndian.Uint32(config[offset:])
+		if header == 0 || header == 0xffffffff {
+			break
+		}
+		if header&0xffff == pciExtCapIDACS {
+			return binary.LittleEndian.Uint16(config[offset+6:]), true
+		}
+		offset = int(header>>20) & 0xffc
+	}
+	return 0, false
+}
+
+// upstreamBridges returns the PCI addresses of the bridges above the device
+// at devPath, nearest first
+func upstreamBridges(devPath string) []string {
+	resolved, err := filepath.EvalSymlinks(devPath)
+	if err != nil {
+		return nil
+	}
+	var addresses []string
+	for _, part := range strings.Split(resolved, string(filepath.Separator)) {
+		if pciAddressRegexp.MatchString(part) {
+			addresses = append(addresses, part)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	// the last address is the device itself
+	bridges := addresses[:len(addresses)-1]
+	for i, j := 0, len(bridges)-1; i < j; i, j = i+1, j-1 {
+		bridges[i], bridges[j] = bridges[j], bridges[i]
+	}
+	return bridges
+}
+
+// getP2PGroup returns the PCIe switch under which the device can exchange
+// peer-to-peer traffic with other devices of the switch, named after the
+// switch upstream port. Devices attached directly to a root port, and
+// devices behind a port whose ACS settings redirect peer-to-peer traffic to
+// the root complex, belong to no group.
+func getP2PGroup(devPath string) string {
+	bridges := upstreamBridges(devPath)
+	if len(bridges) < 2 {
+		return ""
+	}
+	// the topmost bridge is the root port, the one below it the upstream
+	// port of the switch
+	switchPort := bridges[len(bridges)-2]
+	for _, bridge := range bridges[:len(bridges)-2] {
+		redirect, err := acsRedirects(bridge)
+		if err != nil || redirect {
+			return ""
+		}
+	}
+	return switchPort
+}
+
+// p2pGroupForDeviceID returns the P2P group of an advertised device
+func p2pGroupForDeviceID(id string) string {
+	for _, dev := range iommuMap[iommuKeyForDeviceID(id)] {
+		if dev.P2PGroup != "" {
+			return dev.P2PGroup
+		}
+	}
+	return ""
+}
+
+// orderByP2PGroup orders the available devices so that picking them in
+// order fills a multi-device request from a single P2P group when possible.
+// The group of the devices that must be included comes first, then the
+// smallest groups that can satisfy the remaining need, so that larger sets
+// stay available, then the other groups from largest to smallest, then the
+// devices without a group. A single device is taken from outside the groups
+// first.
+func orderByP2PGroup(available, mustInclude []string, need int) []string {
+	groups := make(map[string][]string)
+	var ungrouped []string
+	for _, id := range available {
+		if group := p2pGroupForDeviceID(id); group != "" {
+			groups[group] = append(groups[group], id)
+		} else {
+			ungrouped = append(ungrouped, id)
+		}
+	}
+
+	var ordered []string
+	for _, id := range mustInclude {
+		group := p2pGroupForDeviceID(id)
+		if ids, ok := groups[group]; ok {
+			ordered = append(ordered, ids...)
+			need -= len(ids)
+			delete(groups, group)
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := len(groups[names[i]]), len(groups[names[j]])
+		fitsA, fitsB := a >= need, b >= need
+		switch {
+		case fitsA != fitsB:
+			return fitsA
+		case fitsA && a != b:
+			return a < b
+		case !fitsA && a != b:
+			return a > b
+		}
+		return names[i] < names[j]
+	})
+	if need <= 1 {
+		ordered = append(ordered, ungrouped...)
+		ungrouped = nil
+	}
+	for _, name := range names {
+		ordered = append(ordered, groups[name]...)
+	}
+	return append(ordered, ungrouped...)
+}
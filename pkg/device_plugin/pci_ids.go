@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+	"github.com/NVIDIA/go-nvlib/pkg/pciids"
+)
+
+const defaultPCIIDsPath = "/etc/sandbox-device-plugin/pci.ids"
+
+var (
+	// pciIDsPath is an optional pci.ids file, typically mounted from a
+	// ConfigMap, consulted for device IDs the PCI database does not name
+	pciIDsPath = getEnvString("PCI_IDS_PATH", defaultPCIIDsPath)
+
+	pciDBLock    sync.Mutex
+	pciDB        pciids.Interface
+	pciDBModTime time.Time
+)
+
+// lookupDeviceName returns the name of an NVIDIA device ID from the pci.ids
+// file at pciIDsPath, or "" if it is not listed. The file is parsed again
+// whenever it changes so that an updated ConfigMap is picked up.
+func lookupDeviceName(deviceID uint16) string {
+	info, err := os.Stat(pciIDsPath)
+	if err != nil {
+		return ""
+	}
+
+	pciDBLock.Lock()
+	defer pciDBLock.Unlock()
+	if pciDB == nil || !info.ModTime().Equal(pciDBModTime) {
+		pciDB = pciids.NewDB(pciids.WithFilePath(pciIDsPath))
+		pciDBModTime = info.ModTime()
+	}
+	name, err := pciDB.GetDeviceName(nvpci.PCINvidiaVendorID, deviceID)
+	if err != nil {
+		return ""
+	}
+	return name
+}
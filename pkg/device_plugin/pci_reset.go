@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Reset scopes of a PCI function. A function scoped reset only affects the
+// function, a bus (hot) reset every function behind the same bridge, which
+// the IOMMU groups every function of.
+const (
+	resetScopeFunction = "function"
+	resetScopeGroup    = "group"
+	resetScopeNone     = "none"
+
+	// resetMethodUnknown stands for the methods of kernels before 5.15,
+	// which have no reset_method attribute
+	resetMethodUnknown = "unknown"
+)
+
+// functionResetMethods are the kernel reset methods that only reset the
+// function itself
+var functionResetMethods = map[string]bool{
+	"device_specific": true,
+	"acpi":            true,
+	"flr":             true,
+	"af_flr":          true,
+	"pm":              true,
+}
+
+// readResetMethods returns the reset methods of a function in the order the
+// kernel tries them, or nil if the function cannot be reset
+func readResetMethods(address string) []string {
+	devPath := filepath.Join(rootPath, pciDevicesPath, address)
+	if _, err := fsys.Stat(filepath.Join(devPath, "reset")); err != nil {
+		return nil
+	}
+	data, err := fsys.ReadFile(filepath.Join(devPath, "reset_method"))
+	if err != nil {
+		return []string{resetMethodUnknown}
+	}
+	return strings.Fields(string(data))
+}
+
+// resetScope returns the scope of the reset the kernel performs with the
+// methods. Unknown methods are assumed to reset the bus.
+func resetScope(methods []string) string {
+	if len(methods) == 0 {
+		return resetScopeNone
+	}
+	for _, method := range methods {
+		if functionResetMethods[method] {
+			return resetScopeFunction
+		}
+	}
+	return resetScopeGroup
+}
+
+// checkGroupReset returns an error unless every function of the IOMMU group
+// other than bridges is being reset, since a bus reset would reset functions
+// owned by others
+func checkGroupReset(group int, resetting map[string]bool) error {
+	members, err := getIommuGroupMembers(group)
+	if err != nil {
+		return fmt.Errorf("unable to verify IOMMU group %d for a bus reset: %w", group, err)
+	}
+	var others []string
+	for _, member := range members {
+		if !resetting[member.Address] && member.Driver != "pcieport" {
+			others = append(others, member.Address)
+		}
+	}
+	if len(others) > 0 {
+		sort.Strings(others)
+		return fmt.Errorf("a bus reset of IOMMU group %d would also reset %s", group, strings.Join(others, ", "))
+	}
+	return nil
+}
+
+// resetFunctions resets every function of a device through sysfs. Functions
+// with a function scoped method, such as FLR, are reset on their own;
+// functions only reset with their bus are reset when the device holds their
+// whole IOMMU group, and fail the reset otherwise. Functions without a reset
+// method are skipped.
+func resetFunctions(devs []NvidiaPCIDevice) error {
+	resetting := make(map[string]bool, len(devs))
+	for _, dev := range devs {
+		resetting[dev.Address] = true
+	}
+	for _, dev := range devs {
+		methods := readResetMethods(dev.Address)
+		switch resetScope(methods) {
+		case resetScopeNone:
+			log.Printf("%s has no reset method, not resetting it", dev.Address)
+			continue
+		case resetScopeGroup:
+			if err := checkGroupReset(dev.IommuGroup, resetting); err != nil {
+				return fmt.Errorf("not resetting %s (%s): %w", dev.Address, strings.Join(methods, " "), err)
+			}
+		}
+		path := filepath.Join(rootPath, pciDevicesPath, dev.Address, "reset")
+		if err := fsys.WriteFile(path, []byte("1"), 0200); err != nil {
+			return fmt.Errorf("failed to reset %s: %w", dev.Address, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"strings"
+
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+var (
+	// podResourcesSocket can be set for testing
+	podResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+)
+
+// deviceOwner identifies the pod container a device is allocated to
+type deviceOwner struct {
+	Namespace string
+	Pod       string
+	Container string
+}
+
+func (o deviceOwner) String() string {
+	return fmt.Sprintf("%s/%s/%s", o.Namespace, o.Pod, o.Container)
+}
+
+// listDeviceOwners queries the kubelet PodResources API and returns the owner
+// of every device of our namespace, keyed by "<resource name>/<device ID>"
+func listDeviceOwners() (map[string]deviceOwner, error) {
+	conn, err := connect(podResourcesSocket, connectionTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to pod resources socket: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := apiContext()
+	defer cancel()
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pod resources: %w", err)
+	}
+
+	owners := make(map[string]deviceOwner)
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devs := range container.GetDevices() {
+				if !strings.HasPrefix(devs.GetResourceName(), DeviceNamespace+"/") {
+					continue
+				}
+				for _, id := range devs.GetDeviceIds() {
+					owners[devs.GetResourceName()+"/"+id] = deviceOwner{
+						Namespace: pod.GetNamespace(),
+						Pod:       pod.GetName(),
+						Container: container.GetName(),
+					}
+				}
+			}
+		}
+	}
+	return owners, nil
+}
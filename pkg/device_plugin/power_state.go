@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	pciPowerStateD0 = "D0"
+
+	defaultDeviceWakeTimeout = 5 * time.Second
+	deviceWakePollInterval   = 100 * time.Millisecond
+)
+
+// deviceWakeTimeout bounds how long Allocate waits for a device in a low
+// power state to reach D0; zero disables waking devices
+var deviceWakeTimeout = getEnvDuration("DEVICE_WAKE_TIMEOUT", defaultDeviceWakeTimeout)
+
+// readPowerState returns the PCI power state of the device, e.g. D0 or
+// D3cold, or "" if the kernel does not report it
+func readPowerState(address string) (string, error) {
+	data, err := fsys.ReadFile(filepath.Join(rootPath, pciDevicesPath, address, "power_state"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// wakeDevice brings a device parked in a low power state such as D3cold back
+// to D0, since passthrough of a suspended device can fail until it is woken.
+// Runtime power management of the device is disabled so that it stays awake
+// while assigned to the sandbox.
+func wakeDevice(address string, timeout time.Duration) error {
+	state, err := readPowerState(address)
+	if err != nil {
+		return fmt.Errorf("unable to read power state of %s: %w", address, err)
+	}
+	if state == "" || state == pciPowerStateD0 {
+		return nil
+	}
+
+	log.Printf("Waking device %s from power state %s", address, state)
+	control := filepath.Join(rootPath, pciDevicesPath, address, "power", "control")
+	if err := fsys.WriteFile(control, []byte("on"), 0644); err != nil {
+		return fmt.Errorf("unable to disable runtime power management of %s: %w", address, err)
+	}
+	start := clk.Now()
+	for {
+		state, err = readPowerState(address)
+		if err != nil {
+			return fmt.Errorf("unable to read power state of %s: %w", address, err)
+		}
+		if state == pciPowerStateD0 {
+			log.Printf("Device %s woke up in %s", address, clk.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		if clk.Since(start) >= timeout {
+			return fmt.Errorf("device %s did not leave power state %s within %s", address, state, timeout)
+		}
+		clk.Sleep(deviceWakePollInterval)
+	}
+}
+
+// wakeDevices wakes the functions of an allocated device, unless waking is
+// disabled or allocations are only simulated
+func (dpi *GenericDevicePlugin) wakeDevices(devs []NvidiaPCIDevice) error {
+	if dpi.dryRun || deviceWakeTimeout == 0 {
+		return nil
+	}
+	for _, dev := range devs {
+		if err := wakeDevice(dev.Address, deviceWakeTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	iommuGroupsPath   = "sys/kernel/iommu_groups"
+	vfioPCIModulePath = "sys/module/vfio_pci"
+	pciDriversPath    = "sys/bus/pci/drivers"
+)
+
+// preflightSeverity decides whether a failed check blocks device advertisement
+type preflightSeverity int
+
+const (
+	severityWarning preflightSeverity = iota
+	severityCritical
+)
+
+func (s preflightSeverity) String() string {
+	if s == severityCritical {
+		return "critical"
+	}
+	return "warning"
+}
+
+// errPreflightSkipped is returned by checks that do not apply to this deployment
+var errPreflightSkipped = errors.New("skipped")
+
+// preflightCheck is a single environment validation run before serving devices
+type preflightCheck struct {
+	name      string
+	severity  preflightSeverity
+	remedy    string
+	serveOnly bool // only relevant when serving devices to kubelet
+	run       func() error
+}
+
+// preflightResult holds the outcome of a preflight check
+type preflightResult struct {
+	check preflightCheck
+	err   error
+}
+
+// kubeletSocket can be set for testing
+var kubeletSocket = pluginapi.KubeletSocket
+
+// preflightChecks is the list of checks run at startup (injectable for testing)
+var preflightChecks = []preflightCheck{
+	{
+		name:     "iommu-enabled",
+		severity: severityCritical,
+		remedy:   "enable the IOMMU on the kernel command line (intel_iommu=on or amd_iommu=on) and reboot",
+		run:      checkIommuEnabled,
+	},
+	{
+		name:     "iommu-translation",
+		severity: iommuTranslationSeverity(),
+		remedy:   "remove iommu=pt and iommu.passthrough=1 from the kernel command line and reboot, or set REQUIRE_IOMMU_TRANSLATION=false",
+		run:      checkIommuTranslation,
+	},
+	{
+		name:     "vfio-modules",
+		severity: severityCritical,
+		remedy:   "load the vfio-pci module (modprobe vfio-pci) and persist it in /etc/modules-load.d",
+		run:      checkVfioModules,
+	},
+	{
+		name:      "kubelet-socket",
+		severity:  severityCritical,
+		remedy:    fmt.Sprintf("ensure kubelet is running and %s is mounted into the pod", pluginapi.DevicePluginPath),
+		serveOnly: true,
+		run:       checkKubeletSocket,
+	},
+	{
+		name:     "cdi-root-writable",
+		severity: severityCritical,
+		remedy:   "mount the CDI spec directory read-write into the pod",
+		run:      checkCdiRootWritable,
+	},
+	{
+		name:      "rbac",
+		severity:  severityWarning,
+		remedy:    "grant the plugin service account the missing permissions in its ClusterRole, or the Role of the GFD namespace for namespaced resources",
+		serveOnly: true,
+		run:       checkRBAC,
+	},
+}
+
+// oneShotPreflightChecks returns the checks relevant when not serving devices
+func oneShotPreflightChecks() []preflightCheck {
+	var checks []preflightCheck
+	for _, check := range preflightChecks {
+		if !check.serveOnly {
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+// runPreflightChecks runs the given checks and returns their results, along
+// with false if any critical check failed
+func runPreflightChecks(checks []preflightCheck) ([]preflightResult, bool) {
+	ok := true
+	results := make([]preflightResult, 0, len(checks))
+	for _, check := range checks {
+		err := check.run()
+		if err != nil && !errors.Is(err, errPreflightSkipped) && check.severity == severityCritical {
+			ok = false
+		}
+		results = append(results, preflightResult{check: check, err: err})
+	}
+	return results, ok
+}
+
+// formatPreflightReport renders the results as a consolidated, human readable report
+func formatPreflightReport(results []preflightResult) string {
+	var b strings.Builder
+	b.WriteString("Preflight check report:")
+	for _, r := range results {
+		switch {
+		case r.err == nil:
+			fmt.Fprintf(&b, "\n  [PASS] %s", r.check.name)
+		case errors.Is(r.err, errPreflightSkipped):
+			fmt.Fprintf(&b, "\n  [SKIP] %s: %v", r.check.name, r.err)
+		default:
+			fmt.Fprintf(&b, "\n  [FAIL] %s (%s): %v\n         remedy: %s",
+				r.check.name, r.check.severity, r.err, r.check.remedy)
+		}
+	}
+	return b.String()
+}
+
+// checkIommuEnabled verifies that the kernel has populated IOMMU groups
+func checkIommuEnabled() error {
+	groupsPath := filepath.Join(rootPath, iommuGroupsPath)
+	entries, err := os.ReadDir(groupsPath)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", groupsPath, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no IOMMU groups found in %s", groupsPath)
+	}
+	return nil
+}
+
+// checkVfioModules verifies that the vfio-pci driver or one of the
+// configured variant drivers is available
+func checkVfioModules() error {
+	paths := []string{filepath.Join(rootPath, vfioPCIModulePath)}
+	for _, driver := range vfioDrivers {
+		paths = append(paths, filepath.Join(rootPath, pciDriversPath, driver))
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no vfio driver found in %s", strings.Join(paths, ", "))
+}
+
+// checkKubeletSocket verifies that the kubelet registration socket accepts connections
+func checkKubeletSocket() error {
+	conn, err := connect(kubeletSocket, connectionTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %w", kubeletSocket, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// checkCdiRootWritable verifies that CDI specs can be written to every CDI
+// spec directory
+func checkCdiRootWritable() error {
+	for _, root := range cdiRoots() {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return fmt.Errorf("cannot create %s: %w", root, err)
+		}
+		f, err := os.CreateTemp(root, ".preflight-")
+		if err != nil {
+			return fmt.Errorf("cannot write to %s: %w", root, err)
+		}
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRBAC verifies that the service account is granted the permissions
+// needed to launch and reap the GFD pod and to label, taint and cordon the node
+func checkRBAC() error {
+	if os.Getenv("NODE_NAME") == "" || os.Getenv("POD_NAMESPACE") == "" {
+		return fmt.Errorf("%w: NODE_NAME or POD_NAMESPACE not set, GFD will not run and the node will not be labeled", errPreflightSkipped)
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		return err
+	}
+	missing, err := missingRBAC(selfAccessReviewer(clientset), append(gfdRBACRequirements(), nodeRBACRequirements()...))
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions: %s", formatMissingRBAC(missing))
+	}
+	return nil
+}
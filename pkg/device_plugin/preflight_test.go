@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+var _ = Describe("Preflight", func() {
+	var workDir string
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = os.MkdirTemp("", "preflight-test")
+		Expect(err).ToNot(HaveOccurred())
+		rootPath = workDir
+	})
+
+	AfterEach(func() {
+		rootPath = "/"
+		os.RemoveAll(workDir)
+	})
+
+	It("fails the IOMMU check when no groups exist", func() {
+		Expect(checkIommuEnabled()).ToNot(Succeed())
+
+		Expect(os.MkdirAll(filepath.Join(workDir, iommuGroupsPath), 0755)).To(Succeed())
+		Expect(checkIommuEnabled()).ToNot(Succeed())
+
+		Expect(os.MkdirAll(filepath.Join(workDir, iommuGroupsPath, "0"), 0755)).To(Succeed())
+		Expect(checkIommuEnabled()).To(Succeed())
+	})
+
+	It("detects the vfio-pci driver", func() {
+		Expect(checkVfioModules()).ToNot(Succeed())
+
+		Expect(os.MkdirAll(filepath.Join(workDir, pciDriversPath, "vfio-pci"), 0755)).To(Succeed())
+		Expect(checkVfioModules()).To(Succeed())
+	})
+
+	It("detects the configured vfio variant drivers", func() {
+		oldDrivers := vfioDrivers
+		DeferCleanup(func() { vfioDrivers = oldDrivers })
+		vfioDrivers = parseVfioDrivers(" vfio-pci, nvgrace-gpu-vfio-pci ,")
+		Expect(vfioDrivers).To(Equal([]string{"vfio-pci", "nvgrace-gpu-vfio-pci"}))
+		Expect(parseVfioDrivers("")).To(Equal([]string{"vfio-pci"}))
+		Expect(checkVfioModules()).ToNot(Succeed())
+
+		Expect(os.MkdirAll(filepath.Join(workDir, pciDriversPath, "nvgrace-gpu-vfio-pci"), 0755)).To(Succeed())
+		Expect(checkVfioModules()).To(Succeed())
+		Expect(isVfioDriver("nvgrace-gpu-vfio-pci")).To(BeTrue())
+		Expect(isVfioDriver("nvidia")).To(BeFalse())
+	})
+
+	It("verifies the CDI root is writable", func() {
+		oldCdiRoot := cdiRoot
+		defer setCdiRoot(oldCdiRoot)
+		setCdiRoot(filepath.Join(workDir, "cdi"))
+
+		Expect(checkCdiRootWritable()).To(Succeed())
+		entries, err := os.ReadDir(cdiRoot)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("detects the IOMMU mode", func() {
+		mode := func() iommuMode {
+			m, _ := detectIommuMode()
+			return m
+		}
+		Expect(mode()).To(Equal(iommuDisabled))
+		Expect(checkIommuTranslation()).To(MatchError(errPreflightSkipped))
+
+		Expect(os.MkdirAll(filepath.Join(workDir, iommuClassPath, "dmar0"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(workDir, "proc"), 0755)).To(Succeed())
+		cmdline := filepath.Join(workDir, kernelCmdlinePath)
+		Expect(os.WriteFile(cmdline, []byte("ro intel_iommu=on iommu=pt\n"), 0644)).To(Succeed())
+		Expect(mode()).To(Equal(iommuPassthrough))
+		Expect(checkIommuTranslation()).To(MatchError(ContainSubstring("passthrough mode")))
+
+		// the default domain type overrides the command line
+		group := filepath.Join(workDir, iommuGroupsPath, "3")
+		Expect(os.MkdirAll(group, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(group, iommuGroupTypeFile), []byte("DMA-FQ\n"), 0644)).To(Succeed())
+		Expect(mode()).To(Equal(iommuTranslated))
+		Expect(checkIommuTranslation()).To(Succeed())
+	})
+
+	It("parses the IOMMU kernel parameters", func() {
+		Expect(parseIommuCmdline("intel_iommu=on")).To(Equal(iommuTranslated))
+		Expect(parseIommuCmdline("amd_iommu=on iommu=pt")).To(Equal(iommuPassthrough))
+		Expect(parseIommuCmdline("iommu.passthrough=1 iommu.passthrough=0")).To(Equal(iommuTranslated))
+		Expect(parseIommuCmdline("intel_iommu=igfx_off,off")).To(Equal(iommuDisabled))
+		Expect(parseIommuCmdline("amd_iommu=pt")).To(Equal(iommuPassthrough))
+	})
+
+	It("only blocks on critical failures", func() {
+		failing := func() error { return errors.New("broken") }
+		passing := func() error { return nil }
+		skipped := func() error { return errPreflightSkipped }
+
+		results, ok := runPreflightChecks([]preflightCheck{
+			{name: "a", severity: severityCritical, run: passing},
+			{name: "b", severity: severityWarning, run: failing},
+			{name: "c", severity: severityCritical, run: skipped},
+		})
+		Expect(ok).To(BeTrue())
+		Expect(results).To(HaveLen(3))
+
+		results, ok = runPreflightChecks([]preflightCheck{
+			{name: "a", severity: severityCritical, run: failing, remedy: "fix it"},
+		})
+		Expect(ok).To(BeFalse())
+		report := formatPreflightReport(results)
+		Expect(report).To(ContainSubstring("[FAIL] a (critical): broken"))
+		Expect(report).To(ContainSubstring("remedy: fix it"))
+	})
+
+	It("excludes serve-only checks in one-shot mode", func() {
+		for _, check := range oneShotPreflightChecks() {
+			Expect(check.serveOnly).To(BeFalse())
+			Expect(check.name).ToNot(Equal("kubelet-socket"))
+		}
+	})
+
+	It("reports the permissions missing for GFD and node patching", func() {
+		for k, v := range map[string]string{"POD_NAMESPACE": "plugin", "GFD_NAMESPACE": "gfd", "GFD_IMAGE": "", "GFD_FALLBACK_MODE": ""} {
+			GinkgoT().Setenv(k, v)
+		}
+		origTaint, origAction := removeStartupTaintEnabled, nodeFailureAction
+		DeferCleanup(func() { removeStartupTaintEnabled, nodeFailureAction = origTaint, origAction })
+		removeStartupTaintEnabled, nodeFailureAction = true, nodeFailureActionCordon
+
+		granted := map[string]bool{"get pods in namespace plugin": true, "get nodes": true, "patch nodes": true, "list nodes": true}
+		var reviewed []string
+		review := func(attrs authorizationv1.ResourceAttributes) (bool, error) {
+			req := rbacRequirement{attrs: attrs}.String()
+			reviewed = append(reviewed, req)
+			return granted[req], nil
+		}
+		missing, err := missingRBAC(review, append(gfdRBACRequirements(), nodeRBACRequirements()...))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reviewed).To(ContainElements("create pods in namespace gfd", "get runtimeclasses.node.k8s.io", "update nodes"))
+		Expect(formatMissingRBAC(missing)).To(Equal("gfd needs get runtimeclasses.node.k8s.io, " +
+			"list runtimeclasses.node.k8s.io, watch runtimeclasses.node.k8s.io, " +
+			"get serviceaccounts in namespace gfd, create pods in namespace gfd, get pods in namespace gfd, " +
+			"delete pods in namespace gfd; node-watch needs watch nodes; startup-taint needs update nodes"))
+
+		_, err = missingRBAC(func(authorizationv1.ResourceAttributes) (bool, error) {
+			return false, errors.New("forbidden")
+		}, nodeRBACRequirements())
+		Expect(err).To(MatchError("forbidden"))
+	})
+})
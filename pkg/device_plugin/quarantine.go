@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultRecoveryProbeInterval = 30 * time.Second
+	// recoveryPasses is the number of consecutive passing probes required
+	// before a quarantined device is reported healthy again
+	recoveryPasses = 3
+)
+
+var (
+	recoveryProbeInterval = newDurationSetting(getEnvDuration("RECOVERY_PROBE_INTERVAL", defaultRecoveryProbeInterval))
+	// recoveryProbe checks an unhealthy device (injectable for testing)
+	recoveryProbe = probeDeviceRecovery
+)
+
+// quarantineState tracks the recovery of an unhealthy device
+type quarantineState struct {
+	passes   int
+	aer      uint64
+	aerKnown bool
+}
+
+// probeDeviceRecovery verifies that the VFIO device node of an IOMMU key is
+// present and that all its functions are bound to a vfio driver again. It returns
+// the total of the AER error counters of the functions.
+func probeDeviceRecovery(devicePath, iommuKey string) (uint64, error) {
+	if _, err := fsys.Stat(healthNodePath(devicePath, iommuKey)); err != nil {
+		return 0, fmt.Errorf("device node not present: %w", err)
+	}
+	var total uint64
+	for _, dev := range returnIommuMap()[iommuKey] {
+		devPath := filepath.Join(rootPath, pciDevicesPath, dev.Address)
+		link, err := fsys.Readlink(filepath.Join(devPath, "driver"))
+		if err != nil || !isVfioDriver(filepath.Base(link)) {
+			return 0, fmt.Errorf("%s is not bound to a vfio driver", dev.Address)
+		}
+		for _, name := range []string{"aer_dev_fatal", "aer_dev_nonfatal"} {
+			total += readAERTotal(filepath.Join(devPath, name))
+		}
+	}
+	return total, nil
+}
+
+// readAERTotal returns the TOTAL_ERR_* counter of a sysfs AER statistics
+// file, or 0 when AER is not reported for the device
+func readAERTotal(path string) uint64 {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.HasPrefix(fields[0], "TOTAL_ERR_") {
+			n, err := strconv.ParseUint(fields[1], 10, 64)
+			if err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// unhealthyDevices returns the IDs of the devices currently reported unhealthy
+func (dpi *GenericDevicePlugin) unhealthyDevices() []string {
+	dpi.healthLock.Lock()
+	defer dpi.healthLock.Unlock()
+	var ids []string
+	for _, dev := range dpi.devs {
+		if dev.Health == pluginapi.Unhealthy {
+			ids = append(ids, dev.ID)
+		}
+	}
+	return ids
+}
+
+// runRecoveryProbes periodically probes unhealthy devices until done is
+// closed. A changed probe interval takes effect after the next probe.
+func (dpi *GenericDevicePlugin) runRecoveryProbes(done <-chan struct{}) {
+	interval := recoveryProbeInterval.get()
+	ticker := clk.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+	states := make(map[string]*quarantineState)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+			dpi.probeQuarantined(states)
+			if d := recoveryProbeInterval.get(); d != interval {
+				ticker.Stop()
+				interval = d
+				ticker = clk.NewTicker(interval)
+			}
+		}
+	}
+}
+
+// probeQuarantined probes every unhealthy device once. A device transitions
+// back to healthy after recoveryPasses consecutive passing probes during
+// which its AER error counters did not change.
+func (dpi *GenericDevicePlugin) probeQuarantined(states map[string]*quarantineState) {
+	unhealthy := dpi.unhealthyDevices()
+	quarantined := make(map[string]bool, len(unhealthy))
+	for _, id := range unhealthy {
+		quarantined[id] = true
+	}
+	for id := range states {
+		if !quarantined[id] {
+			delete(states, id)
+		}
+	}
+	if len(unhealthy) == 0 {
+		return
+	}
+
+	for _, id := range unhealthy {
+		iommuKey := iommuKeyForDeviceID(id)
+		if outOfService(iommuKey) || runtimeGated() || fabricGated(iommuKey) || fabricDegraded.contains(iommuKey) {
+			// disabled devices are only re-enabled by the administrator,
+			// devices under maintenance once released, gated devices once
+			// the kata runtime or fabric manager is ready and devices on a
+			// degraded NVLink fabric once it recovers
+			delete(states, id)
+			continue
+		}
+		state, ok := states[id]
+		if !ok {
+			state = &quarantineState{}
+			states[id] = state
+		}
+		aer, err := recoveryProbe(dpi.devicePath, iommuKey)
+		if err != nil {
+			state.passes = 0
+			state.aerKnown = false
+			continue
+		}
+		if state.aerKnown && aer != state.aer {
+			state.passes = 0
+		}
+		state.passes++
+		state.aer = aer
+		state.aerKnown = true
+		if state.passes >= recoveryPasses {
+			log.Printf("[%s] Device %s recovered after %d probes, marking healthy", dpi.deviceName, id, state.passes)
+			delete(states, id)
+			dpi.setHealth(id, pluginapi.Healthy)
+		}
+	}
+}
+
+// reprobeHealth reports a device healthy again once the source that held it
+// unhealthy released it, unless it fails the recovery probe. A failing device
+// stays unhealthy and recovers through the recovery probes.
+func (dpi *GenericDevicePlugin) reprobeHealth(id string) {
+	if _, err := recoveryProbe(dpi.devicePath, iommuKeyForDeviceID(id)); err != nil {
+		log.Printf("[%s] Device %s failed its probe, keeping it unhealthy: %v", dpi.deviceName, id, err)
+		return
+	}
+	dpi.setHealth(id, pluginapi.Healthy)
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rbacRequirement is a permission of the service account needed by a feature
+type rbacRequirement struct {
+	feature string
+	attrs   authorizationv1.ResourceAttributes
+}
+
+func (r rbacRequirement) String() string {
+	resource := r.attrs.Resource
+	if r.attrs.Subresource != "" {
+		resource += "/" + r.attrs.Subresource
+	}
+	if r.attrs.Group != "" {
+		resource += "." + r.attrs.Group
+	}
+	if r.attrs.Namespace != "" {
+		return fmt.Sprintf("%s %s in namespace %s", r.attrs.Verb, resource, r.attrs.Namespace)
+	}
+	return fmt.Sprintf("%s %s", r.attrs.Verb, resource)
+}
+
+// accessReviewer returns whether the service account is allowed the access
+type accessReviewer func(attrs authorizationv1.ResourceAttributes) (bool, error)
+
+// selfAccessReviewer reviews access with SelfSubjectAccessReviews, which every
+// authenticated service account may create
+func selfAccessReviewer(clientset kubernetes.Interface) accessReviewer {
+	return func(attrs authorizationv1.ResourceAttributes) (bool, error) {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attrs},
+		}
+		ctx, cancel := apiContext()
+		defer cancel()
+		result, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return false, fmt.Errorf("cannot review access: %w", err)
+		}
+		return result.Status.Allowed, nil
+	}
+}
+
+// require appends the verbs on a resource needed by a feature
+func require(reqs []rbacRequirement, feature, namespace, group, resource string, verbs ...string) []rbacRequirement {
+	for _, verb := range verbs {
+		reqs = append(reqs, rbacRequirement{feature: feature, attrs: authorizationv1.ResourceAttributes{
+			Namespace: namespace, Verb: verb, Group: group, Resource: resource,
+		}})
+	}
+	return reqs
+}
+
+// gfdRBACRequirements returns the permissions needed to launch and reap the
+// GFD pod, or to label the node natively in GFD_FALLBACK_MODE
+func gfdRBACRequirements() []rbacRequirement {
+	var reqs []rbacRequirement
+	if !gfdEnabled {
+		return nil
+	}
+	if os.Getenv("GFD_FALLBACK_MODE") == nativeLabelsNodeLabels {
+		return require(reqs, "gfd", "", "", "nodes", "patch")
+	}
+	if os.Getenv("GFD_FALLBACK_MODE") != "" {
+		return nil
+	}
+	cfg := loadGFDPodConfig()
+	if os.Getenv("GFD_IMAGE") == "" {
+		// the image of the plugin pod is reused
+		reqs = require(reqs, "gfd", os.Getenv("POD_NAMESPACE"), "", "pods", "get")
+	}
+	reqs = require(reqs, "gfd", "", "", "nodes", "patch")
+	reqs = require(reqs, "gfd", "", "node.k8s.io", "runtimeclasses", "get", "list", "watch")
+	reqs = require(reqs, "gfd", cfg.namespace, "", "serviceaccounts", "get")
+	reqs = require(reqs, "gfd", cfg.namespace, "", "pods", "create", "get", "delete")
+	if gfdMaxConcurrent > 0 {
+		reqs = require(reqs, "gfd", cfg.namespace, "coordination.k8s.io", "leases", "get", "create", "update")
+	}
+	return reqs
+}
+
+// nodeRBACRequirements returns the permissions needed to watch, label, taint
+// and cordon the node
+func nodeRBACRequirements() []rbacRequirement {
+	reqs := require(nil, "node-watch", "", "", "nodes", "list", "watch")
+	reqs = require(reqs, "iommu-mode-label", "", "", "nodes", "patch")
+	if removeStartupTaintEnabled {
+		reqs = require(reqs, "startup-taint", "", "", "nodes", "get", "update")
+	}
+	switch nodeFailureAction {
+	case nodeFailureActionTaint:
+		reqs = require(reqs, "node-failure-action", "", "", "nodes", "get", "update")
+	case nodeFailureActionCordon:
+		reqs = require(reqs, "node-failure-action", "", "", "nodes", "get", "patch")
+	}
+	if requireKataRuntime {
+		reqs = require(reqs, "kata-runtime-gate", "", "node.k8s.io", "runtimeclasses", "list", "watch")
+		reqs = append(reqs, rbacRequirement{feature: "kata-runtime-gate", attrs: authorizationv1.ResourceAttributes{
+			Verb: "patch", Resource: "nodes", Subresource: "status",
+		}})
+	}
+	return reqs
+}
+
+// missingRBAC returns the requirements the service account is not granted
+func missingRBAC(review accessReviewer, reqs []rbacRequirement) ([]rbacRequirement, error) {
+	var missing []rbacRequirement
+	for _, req := range reqs {
+		allowed, err := review(req.attrs)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			missing = append(missing, req)
+		}
+	}
+	return missing, nil
+}
+
+// formatMissingRBAC lists the missing permissions by the feature needing them
+func formatMissingRBAC(missing []rbacRequirement) string {
+	var features []string
+	byFeature := make(map[string][]string)
+	for _, req := range missing {
+		if _, ok := byFeature[req.feature]; !ok {
+			features = append(features, req.feature)
+		}
+		byFeature[req.feature] = append(byFeature[req.feature], req.String())
+	}
+	parts := make([]string, 0, len(features))
+	for _, feature := range features {
+		parts = append(parts, fmt.Sprintf("%s needs %s", feature, strings.Join(byFeature[feature], ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
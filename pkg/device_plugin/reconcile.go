@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
+	"tags.cncf.io/container-device-interface/pkg/parser"
+	"tags.cncf.io/container-device-interface/specs-go"
+)
+
+// generatedCDIKinds tracks the CDI kinds written by the current run
+var generatedCDIKinds = make(map[string]bool)
+
+// generatedCDIDevices maps the IOMMU keys to the CDI device names written by
+// the current run
+var generatedCDIDevices = make(map[string]string)
+
+// reconcileCDISpecs removes CDI specs written by a previous run (e.g. before a
+// node reboot) for kinds that were not regenerated from the current discovery.
+// Such specs can reference vfio nodes that no longer exist. Only specs of our
+// vendor that exclusively reference vfio nodes are considered, so specs written
+// by other components for the same vendor are left untouched. Every CDI spec
+// directory is reconciled.
+//
+// The specs of regenerated kinds are validated against the current discovery:
+// copies of a kind under another file name are removed, since the CDI cache
+// rejects conflicting devices, and specs naming other devices than discovered
+// or device nodes missing on the host are reported.
+func reconcileCDISpecs() error {
+	var errs []error
+	var invalid []string
+	for _, root := range cdiRoots() {
+		rootInvalid, err := reconcileCDIRoot(root)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		invalid = append(invalid, rootInvalid...)
+	}
+	if len(invalid) > 0 {
+		msg := fmt.Sprintf("CDI spec validation found %d problem(s): %s", len(invalid), strings.Join(invalid, "; "))
+		log.Print(msg)
+		events.warning("CDISpecInvalid", msg)
+	} else if len(generatedCDIKinds) > 0 {
+		log.Printf("Validated the CDI specs of %d kind(s)", len(generatedCDIKinds))
+	}
+	return errors.Join(errs...)
+}
+
+// reconcileCDIRoot removes the stale CDI specs of a single spec directory and
+// returns the problems found in the specs of regenerated kinds
+func reconcileCDIRoot(root string) ([]string, error) {
+	entries, err := fsys.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read CDI directory %s: %w", root, err)
+	}
+
+	var invalid []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".json") {
+			continue
+		}
+		specPath := filepath.Join(root, entry.Name())
+		data, err := fsys.ReadFile(specPath)
+		if err != nil {
+			log.Printf("Unable to read CDI spec %s: %v", specPath, err)
+			continue
+		}
+		spec, err := cdiapi.ParseSpec(data)
+		if err != nil {
+			log.Printf("Unable to parse CDI spec %s: %v", specPath, err)
+			continue
+		}
+		vendor, class := parser.ParseQualifier(spec.Kind)
+		if vendor != cdiVendor || !isVfioSpec(spec) {
+			continue
+		}
+		if generatedCDIKinds[spec.Kind] {
+			if entry.Name() == cdiapi.GenerateSpecName(vendor, class)+".yaml" {
+				invalid = append(invalid, validateCDISpec(specPath, spec)...)
+				continue
+			}
+			log.Printf("Removing CDI spec %s duplicating kind %s", specPath, spec.Kind)
+		} else {
+			log.Printf("Removing stale CDI spec %s for kind %s", specPath, spec.Kind)
+		}
+		if err := fsys.Remove(specPath); err != nil && !os.IsNotExist(err) {
+			return invalid, fmt.Errorf("failed to remove stale CDI spec %s: %w", specPath, err)
+		}
+	}
+	return invalid, nil
+}
+
+// validateCDISpec returns the problems of a spec generated by the current run:
+// devices that differ from the discovered ones and device nodes that do not
+// exist on the host
+func validateCDISpec(specPath string, spec *specs.Spec) []string {
+	var problems []string
+	expected := make(map[string]bool)
+	for _, name := range generatedCDIDevices {
+		if vendorClass, device, _ := strings.Cut(name, "="); vendorClass == spec.Kind {
+			expected[device] = true
+		}
+	}
+	nodes := append([]*specs.DeviceNode(nil), spec.ContainerEdits.DeviceNodes...)
+	for _, dev := range spec.Devices {
+		if !expected[dev.Name] {
+			problems = append(problems, fmt.Sprintf("%s: device %s was not discovered", specPath, dev.Name))
+		}
+		delete(expected, dev.Name)
+		nodes = append(nodes, dev.ContainerEdits.DeviceNodes...)
+	}
+	for device := range expected {
+		problems = append(problems, fmt.Sprintf("%s: discovered device %s is missing", specPath, device))
+	}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		path := node.Path
+		if node.HostPath != "" {
+			path = node.HostPath
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if _, err := fsys.Stat(filepath.Join(rootPath, path)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: device node %s does not exist", specPath, path))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// isVfioSpec returns true if every device node in the spec is a vfio node or
+// a CC companion node, and there is at least one vfio node
+func isVfioSpec(spec *specs.Spec) bool {
+	var nodes []*specs.DeviceNode
+	nodes = append(nodes, spec.ContainerEdits.DeviceNodes...)
+	for _, dev := range spec.Devices {
+		nodes = append(nodes, dev.ContainerEdits.DeviceNodes...)
+	}
+	vfio := false
+	for _, node := range nodes {
+		// nodes mounted at another container path name the vfio node in
+		// their host path
+		path := node.Path
+		if node.HostPath != "" {
+			path = node.HostPath
+		}
+		if strings.HasPrefix(path, vfioDevicePath+"/") {
+			vfio = true
+		} else if !isCCCompanionNode(path) {
+			return false
+		}
+	}
+	return vfio
+}
+
+// cleanupStaleSockets removes device plugin sockets left over from a previous
+// run, including those of resources that are no longer discovered
+func cleanupStaleSockets() error {
+	sockets, err := filepath.Glob(filepath.Join(devicePluginDir, "sandbox-*.sock"))
+	if err != nil {
+		return err
+	}
+	for _, sock := range sockets {
+		if socketInUse(sock) {
+			log.Printf("Not removing device plugin socket %s: it is served by another process", sock)
+			continue
+		}
+		log.Printf("Removing stale device plugin socket %s", sock)
+		if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale socket %s: %w", sock, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"tags.cncf.io/container-device-interface/specs-go"
+)
+
+// romResources lists the resources whose allocations expose the expansion
+// ROM of their functions, for guests that execute the ROM to initialize the
+// GPU. ROM_RESOURCES sets it unless the config file does.
+var romResources = parseResourceList(os.Getenv("ROM_RESOURCES"))
+
+// parseResourceList parses a comma separated list of resource names
+func parseResourceList(value string) []string {
+	var resources []string
+	for _, resource := range strings.Split(value, ",") {
+		if resource = strings.TrimSpace(resource); resource != "" {
+			resources = append(resources, resource)
+		}
+	}
+	return resources
+}
+
+// romExposed returns whether the allocations of the resource expose the ROM
+// of their functions
+func romExposed(resource string) bool {
+	deviceFilterLock.RLock()
+	defer deviceFilterLock.RUnlock()
+	for _, r := range romResources {
+		if r == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// romPaths returns the sysfs rom files of the functions that have an
+// expansion ROM. The file is mounted writable, since reading it requires
+// enabling the ROM BAR by writing "1" to it first.
+func romPaths(devs []NvidiaPCIDevice) []string {
+	var paths []string
+	for _, dev := range devs {
+		path := filepath.Join("/", pciDevicesPath, dev.Address, "rom")
+		if _, err := fsys.Stat(filepath.Join(rootPath, path)); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// romMounts returns the mounts of the ROM files of the functions
+func romMounts(devs []NvidiaPCIDevice) []*pluginapi.Mount {
+	var mounts []*pluginapi.Mount
+	for _, path := range romPaths(devs) {
+		mounts = append(mounts, &pluginapi.Mount{ContainerPath: path, HostPath: path})
+	}
+	return mounts
+}
+
+// cdiROMMounts returns the CDI mounts of the ROM files of the functions
+func cdiROMMounts(devs []NvidiaPCIDevice) []*specs.Mount {
+	var mounts []*specs.Mount
+	for _, path := range romPaths(devs) {
+		mounts = append(mounts, &specs.Mount{HostPath: path, ContainerPath: path, Options: []string{"rw", "bind"}})
+	}
+	return mounts
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultRuntimeClass = "kata-qemu-nvidia-gpu"
+	snpRuntimeClass     = "kata-qemu-nvidia-gpu-snp"
+	tdxRuntimeClass     = "kata-qemu-nvidia-gpu-tdx"
+
+	// runtimeClassAnnotation publishes the resolved runtime class on the node
+	runtimeClassAnnotation = "nvidia.com/sandbox-device-plugin.runtime-class"
+
+	ccReadyLabel = "nvidia.com/cc.ready.state"
+	snpLabel     = "amd.feature.node.kubernetes.io/snp"
+	tdxLabel     = "intel.feature.node.kubernetes.io/tdx"
+)
+
+// RuntimeClassResolver selects the kata runtime class that sandboxes using
+// the node's devices must run with, based on the node's confidential
+// computing labels and the RuntimeClasses present in the cluster
+type RuntimeClassResolver struct {
+	clientset kubernetes.Interface
+	nodeName  string
+	// labels returns the labels of the node
+	labels func() (map[string]string, error)
+	// classExists returns true if the RuntimeClass exists in the cluster
+	classExists func(name string) (bool, error)
+}
+
+// NewRuntimeClassResolver returns a resolver for the given node
+func NewRuntimeClassResolver(clientset kubernetes.Interface, nodeName string) *RuntimeClassResolver {
+	return &RuntimeClassResolver{
+		clientset: clientset,
+		nodeName:  nodeName,
+		labels: func() (map[string]string, error) {
+			return watchedNodeLabels(nodeName)
+		},
+		classExists: func(name string) (bool, error) {
+			ctx, cancel := apiContext()
+			defer cancel()
+			_, err := clientset.NodeV1().RuntimeClasses().Get(ctx, name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			}
+			return err == nil, err
+		},
+	}
+}
+
+// Resolve returns the runtime class for the node. A confidential runtime
+// class is only selected if its RuntimeClass object exists, otherwise the
+// default class is used.
+func (r *RuntimeClassResolver) Resolve() (string, error) {
+	labels, err := r.labels()
+	if err != nil {
+		return "", fmt.Errorf("error watching node %s: %w", r.nodeName, err)
+	}
+
+	class := runtimeClassForLabels(labels)
+	if class == defaultRuntimeClass {
+		return class, nil
+	}
+	exists, err := r.classExists(class)
+	if err != nil {
+		return "", fmt.Errorf("error fetching RuntimeClass %s: %w", class, err)
+	}
+	if !exists {
+		log.Printf("RuntimeClass %s does not exist, using %s", class, defaultRuntimeClass)
+		return defaultRuntimeClass, nil
+	}
+	return class, nil
+}
+
+// Publish records the runtime class in an annotation on the node
+func (r *RuntimeClassResolver) Publish(class string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{runtimeClassAnnotation: class},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding node annotation patch: %w", err)
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+	_, err = r.clientset.CoreV1().Nodes().Patch(ctx, r.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("error annotating node %s: %w", r.nodeName, err)
+	}
+	return nil
+}
+
+// runtimeClassForLabels returns the runtime class matching the confidential
+// computing features advertised in the node labels
+func runtimeClassForLabels(labels map[string]string) string {
+	switch ccPlatformForLabels(labels) {
+	case ccPlatformSNP:
+		return snpRuntimeClass
+	case ccPlatformTDX:
+		return tdxRuntimeClass
+	}
+	return defaultRuntimeClass
+}
+
+// ccPlatformForRuntimeClass returns the CC platform sandboxes of the runtime
+// class run on
+func ccPlatformForRuntimeClass(class string) ccPlatform {
+	switch class {
+	case snpRuntimeClass:
+		return ccPlatformSNP
+	case tdxRuntimeClass:
+		return ccPlatformTDX
+	}
+	return ccPlatformNone
+}
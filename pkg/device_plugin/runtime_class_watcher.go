@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"sync"
+
+	nodev1 "k8s.io/api/node/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// runtimeClassWatcher caches the names of the RuntimeClasses of the cluster
+// from an informer, so that the kata runtime readiness follows classes being
+// created and removed without polling the API server
+type runtimeClassWatcher struct {
+	lock    sync.Mutex
+	classes map[string]bool
+	changed chan struct{} // closed and replaced on every change
+}
+
+func newRuntimeClassWatcher() *runtimeClassWatcher {
+	return &runtimeClassWatcher{classes: make(map[string]bool), changed: make(chan struct{})}
+}
+
+func (w *runtimeClassWatcher) set(name string, exists bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if exists {
+		w.classes[name] = true
+	} else {
+		delete(w.classes, name)
+	}
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// current returns the names of the existing RuntimeClasses and a channel
+// closed on the next change
+func (w *runtimeClassWatcher) current() (map[string]bool, <-chan struct{}) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	classes := make(map[string]bool, len(w.classes))
+	for name := range w.classes {
+		classes[name] = true
+	}
+	return classes, w.changed
+}
+
+// runtimeClassName returns the name of a RuntimeClass object
+func runtimeClassName(obj interface{}) (string, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	class, ok := obj.(*nodev1.RuntimeClass)
+	if !ok {
+		return "", false
+	}
+	return class.Name, true
+}
+
+// start runs the RuntimeClass informer until stop is closed and waits for its
+// initial list
+func (w *runtimeClassWatcher) start(clientset kubernetes.Interface, stop <-chan struct{}) error {
+	classes := clientset.NodeV1().RuntimeClasses()
+	informer := cache.NewSharedInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return classes.List(daemonCtx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return classes.Watch(daemonCtx, options)
+		},
+	}, &nodev1.RuntimeClass{}, 0)
+	add := func(obj interface{}) {
+		if name, ok := runtimeClassName(obj); ok {
+			w.set(name, true)
+		}
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    add,
+		UpdateFunc: func(_, obj interface{}) { add(obj) },
+		DeleteFunc: func(obj interface{}) {
+			if name, ok := runtimeClassName(obj); ok {
+				w.set(name, false)
+			}
+		},
+	}); err != nil {
+		return err
+	}
+	go informer.Run(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		return fmt.Errorf("RuntimeClasses were not listed before stopping")
+	}
+	return nil
+}
+
+var (
+	sharedRuntimeClassWatcher     *runtimeClassWatcher
+	sharedRuntimeClassWatcherErr  error
+	sharedRuntimeClassWatcherOnce sync.Once
+)
+
+// watchRuntimeClasses returns the RuntimeClass watcher shared by all users,
+// starting it on first use. It runs until the daemon context is canceled.
+func watchRuntimeClasses() (*runtimeClassWatcher, error) {
+	sharedRuntimeClassWatcherOnce.Do(func() {
+		clientset, err := newInClusterClientset()
+		if err != nil {
+			sharedRuntimeClassWatcherErr = err
+			return
+		}
+		w := newRuntimeClassWatcher()
+		if err := w.start(clientset, daemonCtx.Done()); err != nil {
+			sharedRuntimeClassWatcherErr = err
+			return
+		}
+		sharedRuntimeClassWatcher = w
+	})
+	return sharedRuntimeClassWatcher, sharedRuntimeClassWatcherErr
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// kataRuntimeDegradedCondition is the node condition set while the kata
+// runtime is not ready after it was
+const kataRuntimeDegradedCondition corev1.NodeConditionType = "KataRuntimeDegraded"
+
+// requireKataRuntime keeps all devices unhealthy until the node is labeled
+// as running kata and its runtime class exists, so that pods are not
+// scheduled onto nodes that cannot run them
+var requireKataRuntime = getEnvBool("REQUIRE_KATA_RUNTIME", false)
+
+// kataRuntimeReady records whether the kata runtime was found on the node
+var kataRuntimeReady atomic.Bool
+
+// runtimeGated returns true while devices must be held unhealthy because the
+// kata runtime is not ready
+func runtimeGated() bool {
+	return requireKataRuntime && !kataRuntimeReady.Load()
+}
+
+// kataRuntimeError returns nil if the labels carry the kata runtime label and
+// the RuntimeClass sandboxes on the node must use is among the existing
+// classes. As with RuntimeClassResolver.Resolve, a confidential class that
+// does not exist falls back to the default class.
+func kataRuntimeError(labels map[string]string, classes map[string]bool) error {
+	if labels[kataRuntimeLabelKey] != kataRuntimeLabelValue {
+		return fmt.Errorf("node label %s=%s not found", kataRuntimeLabelKey, kataRuntimeLabelValue)
+	}
+	class := runtimeClassForLabels(labels)
+	if !classes[class] {
+		class = defaultRuntimeClass
+	}
+	if !classes[class] {
+		return fmt.Errorf("RuntimeClass %s does not exist", class)
+	}
+	return nil
+}
+
+// kataRuntimeWatch follows the node labels and the RuntimeClasses the kata
+// runtime readiness of the node depends on
+type kataRuntimeWatch struct {
+	node    *nodeWatcher
+	classes *runtimeClassWatcher
+}
+
+// watchKataRuntime returns a watch of the kata runtime readiness of the node
+// from the shared node and RuntimeClass watchers
+func watchKataRuntime(nodeName string) (*kataRuntimeWatch, error) {
+	node, err := watchNode(nodeName)
+	if err != nil {
+		return nil, fmt.Errorf("error watching node %s: %w", nodeName, err)
+	}
+	classes, err := watchRuntimeClasses()
+	if err != nil {
+		return nil, fmt.Errorf("error watching RuntimeClasses: %w", err)
+	}
+	return &kataRuntimeWatch{node: node, classes: classes}, nil
+}
+
+// status returns why the kata runtime is not ready, nil once it is, along
+// with channels closed on the next change of the node labels and of the
+// RuntimeClasses
+func (k *kataRuntimeWatch) status() (notReady error, nodeChanged, classesChanged <-chan struct{}) {
+	labels, nodeChanged := k.node.labels()
+	classes, classesChanged := k.classes.current()
+	return kataRuntimeError(labels, classes), nodeChanged, classesChanged
+}
+
+// wait blocks until the kata runtime is ready or the context is done
+func (k *kataRuntimeWatch) wait(ctx context.Context) error {
+	for {
+		notReady, nodeChanged, classesChanged := k.status()
+		if notReady == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ctx.Err(), notReady)
+		case <-nodeChanged:
+		case <-classesChanged:
+		}
+	}
+}
+
+// kataRuntimeCondition returns the KataRuntimeDegraded node condition,
+// true with the reason the kata runtime stopped being ready
+func kataRuntimeCondition(notReady error, now time.Time) corev1.NodeCondition {
+	cond := corev1.NodeCondition{
+		Type:               kataRuntimeDegradedCondition,
+		Status:             corev1.ConditionFalse,
+		Reason:             "KataRuntimeReady",
+		Message:            "Kata runtime is ready",
+		LastHeartbeatTime:  metav1.NewTime(now),
+		LastTransitionTime: metav1.NewTime(now),
+	}
+	if notReady != nil {
+		cond.Status = corev1.ConditionTrue
+		cond.Reason = "KataRuntimeNotReady"
+		cond.Message = fmt.Sprintf("Devices are held unhealthy: %v", notReady)
+	}
+	return cond
+}
+
+// setNodeCondition sets the condition in the status of the node
+func setNodeCondition(clientset kubernetes.Interface, nodeName string, cond corev1.NodeCondition) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []corev1.NodeCondition{cond},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding node condition patch: %w", err)
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+	_, err = clientset.CoreV1().Nodes().Patch(ctx, nodeName, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		return fmt.Errorf("error setting condition %s of node %s: %w", cond.Type, nodeName, err)
+	}
+	return nil
+}
+
+// applyRuntimeGate records the kata runtime readiness and, when it changed,
+// marks all devices healthy or unhealthy accordingly. It returns true if the
+// readiness changed.
+func applyRuntimeGate(plugins []*GenericDevicePlugin, ready bool) bool {
+	if kataRuntimeReady.Swap(ready) == ready {
+		return false
+	}
+	health := pluginapi.Unhealthy
+	if ready {
+		health = pluginapi.Healthy
+	}
+	for _, dp := range plugins {
+		for _, dev := range dp.devs {
+			dp.setHealth(dev.ID, health)
+		}
+	}
+	return true
+}
+
+// runRuntimeGate opens or closes the gate on the devices of the manager with
+// REQUIRE_KATA_RUNTIME as the watched node labels and RuntimeClasses change,
+// until the daemon context is canceled. Devices stay unhealthy if readiness
+// cannot be determined. A runtime that stops being ready, e.g. because its
+// RuntimeClass was removed, sets the KataRuntimeDegraded node condition until
+// it is ready again.
+func runRuntimeGate(m *DevicePluginManager) {
+	if !requireKataRuntime {
+		return
+	}
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		log.Printf("NODE_NAME is not set, devices stay unhealthy with REQUIRE_KATA_RUNTIME")
+		return
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		log.Printf("Error authenticating for the kata runtime gate, devices stay unhealthy: %v", err)
+		return
+	}
+	k, err := watchKataRuntime(nodeName)
+	if err != nil {
+		log.Printf("Error watching the kata runtime, devices stay unhealthy: %v", err)
+		return
+	}
+
+	wasReady := false
+	for {
+		notReady, nodeChanged, classesChanged := k.status()
+		if applyRuntimeGate(m.Plugins(), notReady == nil) {
+			if notReady == nil {
+				log.Printf("Kata runtime is ready, advertising devices as healthy")
+				events.normal("KataRuntimeReady", "Kata runtime is ready, devices are advertised")
+			} else {
+				log.Printf("Kata runtime is not ready, advertising devices as unhealthy: %v", notReady)
+				events.warning("KataRuntimeNotReady", fmt.Sprintf("Devices are held unhealthy: %v", notReady))
+			}
+			// a node whose runtime is still being set up is not degraded
+			if notReady == nil || wasReady {
+				if err := setNodeCondition(clientset, nodeName, kataRuntimeCondition(notReady, clk.Now())); err != nil {
+					log.Printf("Error reporting the kata runtime condition: %v", err)
+				}
+			}
+			if notReady == nil {
+				wasReady = true
+			}
+		} else if notReady != nil {
+			log.Printf("Waiting for the kata runtime: %v", notReady)
+		}
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-nodeChanged:
+		case <-classesChanged:
+		}
+	}
+}
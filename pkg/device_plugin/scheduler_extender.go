@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// maxExtenderPriority is the highest score a scheduler extender may return
+const maxExtenderPriority = 10
+
+// ExtenderArgs is the request of the scheduler to a prioritize extender. Its
+// wire format matches k8s.io/kube-scheduler/extender/v1.
+type ExtenderArgs struct {
+	Pod       *corev1.Pod      `json:"pod"`
+	Nodes     *corev1.NodeList `json:"nodes,omitempty"`
+	NodeNames *[]string        `json:"nodenames,omitempty"`
+}
+
+// HostPriority is the score of a node returned to the scheduler
+type HostPriority struct {
+	Host  string `json:"host"`
+	Score int64  `json:"score"`
+}
+
+// schedulerExtender scores nodes for pods requesting passthrough devices by
+// the NodeVfioInventory published by the plugin of each node:
+//
+//	POST /prioritize   ExtenderArgs in, []HostPriority out
+type schedulerExtender struct {
+	// inventories returns the published inventory of each node by node name
+	inventories func() (map[string]InventoryStatus, error)
+}
+
+// podDeviceRequests returns the number of devices of each of our resources
+// requested by the containers of the pod
+func podDeviceRequests(pod *corev1.Pod) map[string]int {
+	requests := make(map[string]int)
+	if pod == nil {
+		return requests
+	}
+	for _, c := range pod.Spec.Containers {
+		for name, quantity := range c.Resources.Limits {
+			if strings.HasPrefix(string(name), DeviceNamespace+"/") {
+				requests[string(name)] += int(quantity.Value())
+			}
+		}
+	}
+	return requests
+}
+
+// scoreNode scores the free devices of a node for the requests. For each
+// resource the share of the request that fits in a single P2P group, where
+// the devices are fabric connected, weighs twice the share that fits in a
+// single NUMA node. Nodes without enough free devices score 0.
+func scoreNode(inventory InventoryStatus, requests map[string]int) int64 {
+	if len(requests) == 0 {
+		return 0
+	}
+	var total float64
+	for resource, count := range requests {
+		if count <= 0 {
+			continue
+		}
+		free := 0
+		p2p := make(map[string]int)
+		numa := make(map[int]int)
+		for _, dev := range inventory.Devices {
+			if dev.ResourceName != resource || dev.AllocatedTo != "" || dev.Reserved || dev.Spare {
+				continue
+			}
+			free++
+			if dev.P2PGroup != "" {
+				p2p[dev.P2PGroup]++
+			}
+			numa[dev.NumaNode]++
+		}
+		if free < count {
+			return 0
+		}
+		fabric, local := 0, 0
+		for _, n := range p2p {
+			fabric = max(fabric, n)
+		}
+		for _, n := range numa {
+			local = max(local, n)
+		}
+		fabricShare := float64(min(fabric, count)) / float64(count)
+		numaShare := float64(min(local, count)) / float64(count)
+		total += (2*fabricShare + numaShare) / 3
+	}
+	return int64(math.Round(maxExtenderPriority * total / float64(len(requests))))
+}
+
+func (e *schedulerExtender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/prioritize" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var args ExtenderArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, fmt.Sprintf("invalid extender args: %v", err), http.StatusBadRequest)
+		return
+	}
+	var nodeNames []string
+	switch {
+	case args.NodeNames != nil:
+		nodeNames = *args.NodeNames
+	case args.Nodes != nil:
+		for _, node := range args.Nodes.Items {
+			nodeNames = append(nodeNames, node.Name)
+		}
+	}
+
+	requests := podDeviceRequests(args.Pod)
+	inventories := map[string]InventoryStatus{}
+	if len(requests) > 0 {
+		var err error
+		if inventories, err = e.inventories(); err != nil {
+			// scoring every node 0 leaves the placement to the scheduler
+			log.Printf("Unable to list the node inventories: %v", err)
+		}
+	}
+	priorities := make([]HostPriority, 0, len(nodeNames))
+	for _, name := range nodeNames {
+		priorities = append(priorities, HostPriority{Host: name, Score: scoreNode(inventories[name], requests)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(priorities); err != nil {
+		log.Printf("Error encoding extender priorities: %v", err)
+	}
+}
+
+// listInventories returns the NodeVfioInventory status of every node
+func listInventories(client dynamic.Interface) (map[string]InventoryStatus, error) {
+	ctx, cancel := apiContext()
+	defer cancel()
+	list, err := client.Resource(inventoryGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	inventories := make(map[string]InventoryStatus, len(list.Items))
+	for _, item := range list.Items {
+		statusObj, ok := item.Object["status"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var status InventoryStatus
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(statusObj, &status); err != nil {
+			log.Printf("Skipping invalid inventory of node %s: %v", item.GetName(), err)
+			continue
+		}
+		inventories[item.GetName()] = status
+	}
+	return inventories, nil
+}
+
+// ServeSchedulerExtender serves the prioritize scheduler extender on addr,
+// scoring nodes by the inventories published with PUBLISH_INVENTORY=true.
+// It requires list permission on nodevfioinventories.
+func ServeSchedulerExtender(addr string) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("error obtaining cluster credentials: %w", err)
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("error obtaining dynamic client: %w", err)
+	}
+	extender := &schedulerExtender{inventories: func() (map[string]InventoryStatus, error) {
+		return listInventories(client)
+	}}
+	if err := auxTLS.reload(); err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: extender, ReadHeaderTimeout: connectionTimeout}
+	log.Printf("Serving the scheduler extender on %s/prioritize", addr)
+	return serveAuxHTTP(server, listener, tls.RequireAndVerifyClientCert)
+}
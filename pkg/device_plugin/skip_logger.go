@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultSkipLogInterval = 10 * time.Minute
+
+// skipKey identifies a skipped device and the reason it was skipped
+type skipKey struct {
+	address string
+	reason  string
+}
+
+// skipLogger deduplicates the per-device messages logged when discovery skips
+// a device. A message is logged the first time a device is skipped for a
+// reason and then at most once per interval; every scan ends with a summary.
+type skipLogger struct {
+	lock     sync.Mutex
+	interval time.Duration
+	now      func() time.Time
+	lastLog  map[skipKey]time.Time
+	pending  map[skipKey]string
+}
+
+var discoverySkips = newSkipLogger(getEnvDuration("DISCOVERY_SKIP_LOG_INTERVAL", defaultSkipLogInterval))
+
+func newSkipLogger(interval time.Duration) *skipLogger {
+	return &skipLogger{
+		interval: interval,
+		now:      time.Now,
+		lastLog:  make(map[skipKey]time.Time),
+		pending:  make(map[skipKey]string),
+	}
+}
+
+// skip records that the device at address was skipped during the current scan
+func (s *skipLogger) skip(address, reason, message string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending[skipKey{address: address, reason: reason}] = message
+}
+
+// flush logs the messages recorded during the scan that are not rate limited,
+// followed by a single summary line, and returns the number of messages logged
+func (s *skipLogger) flush() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := make([]skipKey, 0, len(s.pending))
+	for key := range s.pending {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].address != keys[j].address {
+			return keys[i].address < keys[j].address
+		}
+		return keys[i].reason < keys[j].reason
+	})
+
+	now := s.now()
+	logged := 0
+	for _, key := range keys {
+		if last, ok := s.lastLog[key]; ok && now.Sub(last) < s.interval {
+			continue
+		}
+		log.Print(s.pending[key])
+		s.lastLog[key] = now
+		logged++
+	}
+
+	// Forget devices that are no longer skipped so they are logged again if
+	// they are skipped in a later scan
+	for key := range s.lastLog {
+		if _, ok := s.pending[key]; !ok {
+			delete(s.lastLog, key)
+		}
+	}
+
+	if len(keys) > 0 {
+		log.Printf("Discovery skipped %d device(s) (%d logged, %d suppressed)",
+			len(keys), logged, len(keys)-logged)
+	}
+	s.pending = make(map[skipKey]string)
+	return logged
+}
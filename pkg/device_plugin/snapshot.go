@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// snapshotFile is the file SIGUSR1 snapshots are written to; empty logs them
+var snapshotFile = getEnvString("SNAPSHOT_FILE", "")
+
+// PendingHealth is a health transition not yet delivered to the kubelet
+type PendingHealth struct {
+	Device string `json:"device"`
+	Health string `json:"health"`
+}
+
+// Snapshot is the state of the plugin dumped for field debugging
+type Snapshot struct {
+	Time    time.Time        `json:"time"`
+	Devices []DeviceMetadata `json:"devices"`
+	// OwnersError is set when the allocations could not be determined
+	OwnersError string `json:"ownersError,omitempty"`
+	// PendingHealth are the queued health transitions per resource
+	PendingHealth map[string][]PendingHealth `json:"pendingHealth,omitempty"`
+	// PendingEvents is the number of node events waiting to be sent
+	PendingEvents int `json:"pendingEvents"`
+	// CDISpecs maps the path of each CDI spec to its content
+	CDISpecs map[string]string `json:"cdiSpecs"`
+}
+
+// snapshot returns the current devices, their health and the allocations
+// reported by owners, the pending health transitions and events, and the CDI
+// specs
+func (m *DevicePluginManager) snapshot(owners func() (map[string]deviceOwner, error)) Snapshot {
+	var ownersErr error
+	handler := &metadataHandler{manager: m, owners: func() (map[string]deviceOwner, error) {
+		o, err := owners()
+		ownersErr = err
+		return o, err
+	}}
+	s := Snapshot{
+		Time:          clk.Now(),
+		Devices:       handler.deviceMetadata(),
+		PendingHealth: make(map[string][]PendingHealth),
+		PendingEvents: len(events.queue),
+		CDISpecs:      make(map[string]string),
+	}
+	if ownersErr != nil {
+		s.OwnersError = ownersErr.Error()
+	}
+	for _, dp := range m.Plugins() {
+		for _, u := range dp.queue.pendingUpdates() {
+			s.PendingHealth[dp.deviceName] = append(s.PendingHealth[dp.deviceName], PendingHealth{Device: u.id, Health: u.health})
+		}
+	}
+	for _, root := range cdiRoots() {
+		entries, err := fsys.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || (ext != ".yaml" && ext != ".json") {
+				continue
+			}
+			specPath := filepath.Join(root, entry.Name())
+			data, err := fsys.ReadFile(specPath)
+			if err != nil {
+				s.CDISpecs[specPath] = fmt.Sprintf("<unreadable: %v>", err)
+				continue
+			}
+			s.CDISpecs[specPath] = string(data)
+		}
+	}
+	return s
+}
+
+// DumpSnapshot writes a snapshot of the plugin state to SNAPSHOT_FILE, or to
+// the log when it is not set. It is triggered by SIGUSR1.
+func (m *DevicePluginManager) DumpSnapshot() {
+	data, err := json.MarshalIndent(m.snapshot(listDeviceOwners), "", "  ")
+	if err != nil {
+		log.Printf("Error encoding snapshot: %v", err)
+		return
+	}
+	if snapshotFile == "" {
+		log.Printf("Snapshot: %s", data)
+		return
+	}
+	if err := writeSnapshotFile(data); err != nil {
+		log.Printf("Error writing snapshot to %s: %v", snapshotFile, err)
+		return
+	}
+	log.Printf("Wrote snapshot to %s", snapshotFile)
+}
+
+// writeSnapshotFile atomically replaces the snapshot file
+func writeSnapshotFile(data []byte) error {
+	if err := fsys.MkdirAll(filepath.Dir(snapshotFile), 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	tmp := snapshotFile + ".tmp"
+	if err := fsys.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, snapshotFile); err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+	return nil
+}
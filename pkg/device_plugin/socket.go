@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	socketProbeTimeout = time.Second
+
+	// maxSocketPathLength is the longest path a unix socket can be bound to
+	maxSocketPathLength = len(syscall.RawSockaddrUnix{}.Path) - 1
+)
+
+// ownedSockets holds the sockets this process listens on
+var ownedSockets = struct {
+	lock  sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// setSocketOwned records whether this process listens on the socket
+func setSocketOwned(socketPath string, owned bool) {
+	ownedSockets.lock.Lock()
+	defer ownedSockets.lock.Unlock()
+	if owned {
+		ownedSockets.paths[socketPath] = true
+	} else {
+		delete(ownedSockets.paths, socketPath)
+	}
+}
+
+// socketOwned returns true if this process listens on the socket
+func socketOwned(socketPath string) bool {
+	ownedSockets.lock.Lock()
+	defer ownedSockets.lock.Unlock()
+	return ownedSockets.paths[socketPath]
+}
+
+// socketPermissions is the owner and mode applied to the device plugin
+// sockets, for kubelets whose device manager runs with restricted permissions
+type socketPermissions struct {
+	uid  int // -1 leaves the owner unchanged
+	gid  int // -1 leaves the group unchanged
+	mode os.FileMode
+}
+
+var socketPerms = loadSocketPermissions()
+
+// loadSocketPermissions reads PLUGIN_SOCKET_UID, PLUGIN_SOCKET_GID and the
+// octal PLUGIN_SOCKET_MODE. Unset values leave the socket as created.
+func loadSocketPermissions() socketPermissions {
+	p := socketPermissions{uid: -1, gid: -1}
+	if value := os.Getenv("PLUGIN_SOCKET_UID"); value != "" {
+		if uid, err := strconv.Atoi(value); err == nil && uid >= 0 {
+			p.uid = uid
+		} else {
+			log.Printf("Invalid PLUGIN_SOCKET_UID %q, not changing socket owner", value)
+		}
+	}
+	if value := os.Getenv("PLUGIN_SOCKET_GID"); value != "" {
+		if gid, err := strconv.Atoi(value); err == nil && gid >= 0 {
+			p.gid = gid
+		} else {
+			log.Printf("Invalid PLUGIN_SOCKET_GID %q, not changing socket group", value)
+		}
+	}
+	if value := os.Getenv("PLUGIN_SOCKET_MODE"); value != "" {
+		if mode, err := strconv.ParseUint(value, 8, 32); err == nil && mode <= 0777 {
+			p.mode = os.FileMode(mode)
+		} else {
+			log.Printf("Invalid PLUGIN_SOCKET_MODE %q, not changing socket mode", value)
+		}
+	}
+	return p
+}
+
+// apply sets the configured owner and mode on the socket and verifies that
+// they took effect
+func (p socketPermissions) apply(socketPath string) error {
+	if p.uid >= 0 || p.gid >= 0 {
+		if err := os.Chown(socketPath, p.uid, p.gid); err != nil {
+			return fmt.Errorf("cannot change the owner of socket %s to %d:%d: %w; "+
+				"the plugin needs to run as root or with CAP_CHOWN", socketPath, p.uid, p.gid, err)
+		}
+	}
+	if p.mode != 0 {
+		if err := os.Chmod(socketPath, p.mode); err != nil {
+			return fmt.Errorf("cannot change the mode of socket %s to %04o: %w", socketPath, p.mode, err)
+		}
+		info, err := os.Stat(socketPath)
+		if err != nil {
+			return fmt.Errorf("cannot stat socket %s: %w", socketPath, err)
+		}
+		if info.Mode().Perm() != p.mode {
+			return fmt.Errorf("socket %s has mode %04o instead of PLUGIN_SOCKET_MODE %04o; "+
+				"check that the device plugin directory is on a filesystem that keeps socket modes",
+				socketPath, info.Mode().Perm(), p.mode)
+		}
+	}
+	return nil
+}
+
+// listenSocket creates the unix socket of a device plugin with the configured
+// owner and mode. Failures are explained, since the kubelet only reports that
+// the plugin is missing.
+func listenSocket(socketPath string) (net.Listener, error) {
+	if len(socketPath) > maxSocketPathLength {
+		return nil, fmt.Errorf("cannot create socket %s: the path is longer than the %d characters "+
+			"allowed for unix sockets; use shorter P_GPU_ALIAS/NVSWITCH_ALIAS values", socketPath, maxSocketPathLength)
+	}
+	sock, err := net.Listen("unix", socketPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return nil, fmt.Errorf("cannot create socket %s: %w; the plugin needs write access to %s, "+
+				"check the hostPath mount, its SELinux label and the user the plugin runs as",
+				socketPath, err, filepath.Dir(socketPath))
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("cannot create socket %s: %w; mount the kubelet device plugin directory into the pod",
+				socketPath, err)
+		}
+		return nil, fmt.Errorf("cannot create socket %s: %w", socketPath, err)
+	}
+	if err := socketPerms.apply(socketPath); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	setSocketOwned(socketPath, true)
+	return sock, nil
+}
+
+// socketPathForResource returns the device plugin socket of a resource. The
+// name carries a hash of the full resource name, so resource names that only
+// differ in characters dropped from file names do not share a socket.
+func socketPathForResource(deviceName string) string {
+	h := fnv.New32a()
+	h.Write([]byte(fmt.Sprintf("%s/%s", DeviceNamespace, deviceName)))
+	return filepath.Join(devicePluginDir, fmt.Sprintf("sandbox-%s-%08x.sock", deviceName, h.Sum32()))
+}
+
+// socketInUse returns true if another process accepts connections on the socket
+func socketInUse(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, socketProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// checkSocketAvailable fails if another process already serves the socket,
+// which would otherwise silently take over our registration. Sockets this
+// process listens on are not checked, a plugin that left its listener behind
+// replaces it.
+func checkSocketAvailable(socketPath string) error {
+	if socketOwned(socketPath) {
+		return nil
+	}
+	if socketInUse(socketPath) {
+		return fmt.Errorf("socket %s was not created by this plugin but accepts connections: "+
+			"make sure only one sandbox device plugin runs on the node and that "+
+			"P_GPU_ALIAS/NVSWITCH_ALIAS do not clash with resources of other device plugins", socketPath)
+	}
+	return nil
+}
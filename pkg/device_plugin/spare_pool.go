@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// sparePromotionInterval is how often failed devices without a replacement
+// are checked again, e.g. when no spare was left or the kata runtime was not
+// ready at the time of the failure
+const sparePromotionInterval = time.Minute
+
+// sparePool tracks the hot spares promoted into the advertised devices to
+// replace failed ones. A promoted spare stays advertised when the device it
+// replaces recovers, since it may be allocated by then.
+type sparePool struct {
+	lock sync.Mutex
+	// promoted maps the IOMMU key of each promoted spare to the IOMMU key
+	// of the failed device it replaces
+	promoted map[string]string
+	notify   chan struct{}
+}
+
+var spares = newSparePool()
+
+func newSparePool() *sparePool {
+	return &sparePool{
+		promoted: make(map[string]string),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// isPromoted returns whether the spare with the IOMMU key was promoted
+func (p *sparePool) isPromoted(iommuKey string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.promoted[iommuKey]
+	return ok
+}
+
+// deviceFailed wakes up the promoter after an advertised device failed
+func (p *sparePool) deviceFailed() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// promote picks a spare of the same model for every failed device that has
+// no replacement yet, and returns a message for each promotion
+func (p *sparePool) promote(failed []string) []string {
+	spareKeys := spareIommuKeys()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	replaced := make(map[string]bool, len(p.promoted))
+	for _, failedKey := range p.promoted {
+		replaced[failedKey] = true
+	}
+
+	var messages []string
+	sort.Slice(failed, func(i, j int) bool { return extractNumber(failed[i]) < extractNumber(failed[j]) })
+	for _, failedKey := range failed {
+		if replaced[failedKey] {
+			continue
+		}
+		deviceID, ok := deviceIDForIommuKey(failedKey)
+		if !ok {
+			continue
+		}
+		candidates := append([]string(nil), deviceMap[deviceID]...)
+		sort.Slice(candidates, func(i, j int) bool { return extractNumber(candidates[i]) < extractNumber(candidates[j]) })
+		for _, key := range candidates {
+			if _, promoted := p.promoted[key]; !spareKeys[key] || promoted || outOfService(key) {
+				continue
+			}
+			p.promoted[key] = failedKey
+			replaced[failedKey] = true
+			messages = append(messages, fmt.Sprintf("Promoted spare device %s to replace failed device %s of %s/%s",
+				stableIDForIommuKey(key), stableIDForIommuKey(failedKey), DeviceNamespace,
+				resourceNameForIommuKey(deviceID, failedKey)))
+			break
+		}
+		if !replaced[failedKey] {
+			log.Printf("No spare device left to replace failed device %s", stableIDForIommuKey(failedKey))
+		}
+	}
+	return messages
+}
+
+// deviceIDForIommuKey returns the PCI device ID of the discovered device
+// with the IOMMU key
+func deviceIDForIommuKey(iommuKey string) (string, bool) {
+	for deviceID, keys := range deviceMap {
+		for _, key := range keys {
+			if key == iommuKey {
+				return deviceID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// failedIommuKeys returns the IOMMU keys of the advertised devices that are
+// unhealthy, leaving out administratively disabled devices
+func failedIommuKeys(plugins []*GenericDevicePlugin) []string {
+	var failed []string
+	for _, dp := range plugins {
+		for _, dev := range dp.devices() {
+			iommuKey := iommuKeyForDeviceID(dev.ID)
+			if dev.Health == pluginapi.Unhealthy && !outOfService(iommuKey) {
+				failed = append(failed, iommuKey)
+			}
+		}
+	}
+	return failed
+}
+
+// runSparePromoter promotes spares when advertised devices fail and restarts
+// the device plugins of the affected resources until the daemon context is
+// canceled. The CDI specs already describe the spares, since they are
+// generated for every discovered device.
+func runSparePromoter(m *DevicePluginManager) {
+	ticker := time.NewTicker(sparePromotionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-spares.notify:
+		case <-ticker.C:
+		}
+		// every device is unhealthy while the kata runtime is not ready
+		if runtimeGated() {
+			continue
+		}
+		messages := spares.promote(failedIommuKeys(m.Plugins()))
+		if len(messages) == 0 {
+			continue
+		}
+		for _, msg := range messages {
+			log.Print(msg)
+			events.normal("SparePromoted", msg)
+		}
+		m.start()
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// startupTaintKey is the NoSchedule taint nodes can be provisioned with to
+// keep GPU pods off the node until the device plugin is initialized
+const startupTaintKey = "nvidia.com/sandbox-device-plugin"
+
+// removeStartupTaintEnabled removes the startup taint once initialization
+// succeeds
+var removeStartupTaintEnabled = getEnvBool("REMOVE_STARTUP_TAINT", false)
+
+// withoutStartupTaint returns taints without the startup taint, and whether
+// it was present
+func withoutStartupTaint(taints []corev1.Taint) ([]corev1.Taint, bool) {
+	var result []corev1.Taint
+	found := false
+	for _, taint := range taints {
+		if taint.Key == startupTaintKey && taint.Effect == corev1.TaintEffectNoSchedule {
+			found = true
+			continue
+		}
+		result = append(result, taint)
+	}
+	return result, found
+}
+
+// removeStartupTaint removes the startup taint from the node
+func removeStartupTaint(clientset kubernetes.Interface, nodeName string) error {
+	ctx, cancel := apiContext()
+	defer cancel()
+	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error fetching node %s: %w", nodeName, err)
+	}
+	taints, found := withoutStartupTaint(node.Spec.Taints)
+	if !found {
+		return nil
+	}
+	node.Spec.Taints = taints
+	if _, err := clientset.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("error updating taints of node %s: %w", nodeName, err)
+	}
+	log.Printf("Removed startup taint %s from node %s", startupTaintKey, nodeName)
+	events.normal("StartupTaintRemoved", fmt.Sprintf("Removed startup taint %s:NoSchedule", startupTaintKey))
+	return nil
+}
+
+// initializationError returns why initialization did not succeed: device
+// discovery and CDI generation failed, or a device plugin did not register
+func initializationError(m *DevicePluginManager, discoveryErr error) error {
+	if discoveryErr != nil {
+		return discoveryErr
+	}
+	if !m.Ready() {
+		var pending []string
+		for name, ready := range m.Status() {
+			if !ready {
+				pending = append(pending, name)
+			}
+		}
+		if len(pending) == 0 {
+			return fmt.Errorf("device plugins were not started")
+		}
+		return fmt.Errorf("device plugins not registered: %v", pending)
+	}
+	return nil
+}
+
+// liftStartupTaint removes the startup taint when REMOVE_STARTUP_TAINT is
+// set and initialization succeeded. The taint is kept otherwise, so that GPU
+// pods do not land on a node whose devices are not served yet; a later
+// successful reload removes it.
+func liftStartupTaint(m *DevicePluginManager, discoveryErr error) {
+	if !removeStartupTaintEnabled {
+		return
+	}
+	if err := initializationError(m, discoveryErr); err != nil {
+		log.Printf("Keeping startup taint %s: %v", startupTaintKey, err)
+		return
+	}
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		log.Printf("NODE_NAME environment variable is required for REMOVE_STARTUP_TAINT")
+		return
+	}
+	clientset, err := newInClusterClientset()
+	if err != nil {
+		log.Printf("Error authenticating for startup taint removal: %v", err)
+		return
+	}
+	if err := removeStartupTaint(clientset, nodeName); err != nil {
+		log.Printf("Error removing startup taint: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// stateFile is the hostPath file the device state is persisted to, so that a
+// new pod of an upgraded DaemonSet resumes with the same device health;
+// empty disables persistence
+var stateFile = getEnvString("STATE_FILE", "")
+
+// deviceState is the persisted state of an advertised device
+type deviceState struct {
+	ID     string    `json:"id"`
+	Health string    `json:"health"`
+	Since  time.Time `json:"since,omitempty"`
+}
+
+// pluginState is the content of the state file
+type pluginState struct {
+	Resources map[string][]deviceState `json:"resources"`
+	// Migrations are the renamed resources by their previous name
+	Migrations map[string]resourceMigration `json:"migrations,omitempty"`
+}
+
+// stateStore holds the state of the resources and writes it to the state file
+type stateStore struct {
+	lock      sync.Mutex
+	resources map[string][]deviceState
+	// restored is the state read at startup
+	restored map[string]map[string]deviceState
+	// migrations are the renamed resources by their previous name
+	migrations map[string]resourceMigration
+}
+
+var deviceStates = &stateStore{resources: make(map[string][]deviceState)}
+
+// load reads the state file written by a previous run
+func (s *stateStore) load() error {
+	if stateFile == "" {
+		return nil
+	}
+	data, err := fsys.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read state file %s: %w", stateFile, err)
+	}
+	state := pluginState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %w", stateFile, err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.restored = make(map[string]map[string]deviceState)
+	for resource, devs := range state.Resources {
+		s.restored[resource] = make(map[string]deviceState)
+		for _, dev := range devs {
+			s.restored[resource][dev.ID] = dev
+		}
+	}
+	s.migrations = state.Migrations
+	log.Printf("Restored the state of %d resource(s) from %s", len(s.restored), stateFile)
+	return nil
+}
+
+// restoreHealth applies the persisted health of the devices of a new plugin.
+// A device that was unhealthy stays unhealthy until a probe finds it healthy
+// again, instead of being advertised healthy while the pod restarts.
+func (s *stateStore) restoreHealth(dpi *GenericDevicePlugin) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	restored := s.restored[dpi.deviceName]
+	if restored == nil {
+		return
+	}
+	current := make(map[string]bool, len(dpi.devs))
+	for _, dev := range dpi.devs {
+		current[dev.ID] = true
+		state, ok := restored[dev.ID]
+		if !ok || state.Health != pluginapi.Unhealthy || dev.Health == pluginapi.Unhealthy {
+			continue
+		}
+		log.Printf("Restoring unhealthy state of device %s of %q", dev.ID, dpi.deviceName)
+		dev.Health = pluginapi.Unhealthy
+		dpi.reported[dev.ID] = pluginapi.Unhealthy
+		if !state.Since.IsZero() {
+			dpi.transitions[dev.ID] = healthTransition{health: state.Health, at: state.Since}
+		}
+	}
+	for id := range restored {
+		if !current[id] {
+			log.Printf("Device %s of %q was advertised before the restart but is no longer discovered", id, dpi.deviceName)
+		}
+	}
+}
+
+// record stores the current state of the devices of the plugin and writes
+// the state file
+func (s *stateStore) record(dpi *GenericDevicePlugin) {
+	if stateFile == "" {
+		return
+	}
+	dpi.healthLock.Lock()
+	devs := make([]deviceState, 0, len(dpi.devs))
+	for _, dev := range dpi.devs {
+		state := deviceState{ID: dev.ID, Health: dev.Health}
+		if t, ok := dpi.transitions[dev.ID]; ok {
+			state.Since = t.at
+		}
+		devs = append(devs, state)
+	}
+	dpi.healthLock.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.resources[dpi.deviceName] = devs
+	if err := s.write(); err != nil {
+		log.Printf("Error writing state file: %v", err)
+	}
+}
+
+// prune drops the state of the resources that are no longer served
+func (s *stateStore) prune(resources map[string]bool) {
+	if stateFile == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for resource := range s.resources {
+		if !resources[resource] {
+			delete(s.resources, resource)
+		}
+	}
+	if err := s.write(); err != nil {
+		log.Printf("Error writing state file: %v", err)
+	}
+}
+
+// write atomically replaces the state file; the caller holds the lock
+func (s *stateStore) write() error {
+	state := pluginState{Resources: make(map[string][]deviceState, len(s.resources)), Migrations: s.migrations}
+	for resource, devs := range s.resources {
+		sorted := append([]deviceState(nil), devs...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+		state.Resources[resource] = sorted
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	if err := fsys.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp := stateFile + ".tmp"
+	if err := fsys.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, stateFile); err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Causes of the end of a ListAndWatch stream
+const (
+	streamEndStop       = "stop"        // the plugin was stopped
+	streamEndTerm       = "term"        // the plugin server is restarting
+	streamEndSuperseded = "superseded"  // the kubelet opened a newer stream
+	streamEndKubeletEOF = "kubelet-eof" // the kubelet closed the stream
+)
+
+var (
+	streamConnectedDesc = prometheus.NewDesc(
+		"sandbox_device_plugin_stream_connected_seconds",
+		"Time the current ListAndWatch stream of the kubelet has been connected per resource.",
+		[]string{"resource"}, nil)
+
+	streamTerminations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sandbox_device_plugin_stream_terminations_total",
+		Help: "ListAndWatch streams ended per resource and cause (stop, term, superseded, kubelet-eof).",
+	}, []string{"resource", "cause"})
+
+	reregistrationDuration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "sandbox_device_plugin_reregistration_duration_seconds",
+		Help:       "Time from the removal of the plugin socket, e.g. by a kubelet restart, to the plugin being registered again per resource.",
+		Objectives: map[float64]float64{0.5: 0.05, 0.95: 0.01, 0.99: 0.001},
+	}, []string{"resource"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(streams, streamTerminations, reregistrationDuration)
+}
+
+// streamTracker tracks the connected ListAndWatch stream of each resource
+type streamTracker struct {
+	lock      sync.Mutex
+	connected map[string]time.Time
+}
+
+// streams tracks the ListAndWatch streams of all resources
+var streams = &streamTracker{connected: make(map[string]time.Time)}
+
+// connect records the start of a stream of the resource and returns its
+// start, identifying the stream to disconnect
+func (t *streamTracker) connect(resource string) time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	start := clk.Now()
+	t.connected[resource] = start
+	return start
+}
+
+// disconnect records the end of the stream of the resource started at start.
+// A superseded stream ends after its successor connected, which stays
+// tracked.
+func (t *streamTracker) disconnect(resource string, start time.Time, cause string) {
+	t.lock.Lock()
+	if t.connected[resource].Equal(start) {
+		delete(t.connected, resource)
+	}
+	t.lock.Unlock()
+	streamTerminations.WithLabelValues(resource, cause).Inc()
+	log.Printf("ListAndWatch stream of %s ended after %s: %s", resource, clk.Since(start).Round(time.Second), cause)
+}
+
+func (t *streamTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- streamConnectedDesc
+}
+
+func (t *streamTracker) Collect(ch chan<- prometheus.Metric) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for resource, start := range t.connected {
+		ch <- prometheus.MustNewConstMetric(streamConnectedDesc, prometheus.GaugeValue,
+			clk.Since(start).Seconds(), resource)
+	}
+}
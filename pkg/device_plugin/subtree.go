@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tags.cncf.io/container-device-interface/specs-go"
+)
+
+// subtreeKeyPrefix namespaces the keys of PCIe subtrees, which group every
+// vfio-pci bound function below a bridge into one device
+const subtreeKeyPrefix = "subtree:"
+
+// subtreeResources maps the resource name of each configured subtree to the
+// keys of its devices
+var subtreeResources map[string][]string
+
+// isSubtreeKey returns whether the key is the key of a PCIe subtree
+func isSubtreeKey(iommuKey string) bool {
+	return strings.HasPrefix(iommuKey, subtreeKeyPrefix)
+}
+
+// buildSubtrees moves the discovered devices below each configured bridge
+// into a single subtree device, along with the other vfio-pci bound
+// functions below the bridge, such as the ports of a PCIe switch
+func buildSubtrees() {
+	subtreeResources = make(map[string][]string)
+	deviceFilterLock.RLock()
+	bridges := make([]string, 0, len(subtreeBridges))
+	resources := make(map[string]string, len(subtreeBridges))
+	for bridge, resource := range subtreeBridges {
+		bridges = append(bridges, bridge)
+		resources[bridge] = resource
+	}
+	deviceFilterLock.RUnlock()
+	sort.Strings(bridges)
+
+	for _, bridge := range bridges {
+		var functions []NvidiaPCIDevice
+		seen := make(map[string]bool)
+		for iommuKey, devs := range iommuMap {
+			if isSubtreeKey(iommuKey) || !belowBridge(devs[0].Address, bridge) {
+				continue
+			}
+			for _, dev := range devs {
+				functions = append(functions, dev)
+				seen[dev.Address] = true
+			}
+			removeIommuKey(iommuKey)
+		}
+		for _, address := range functionsBelowBridge(bridge) {
+			if seen[address] {
+				continue
+			}
+			dev, err := readPCIDevice(address)
+			if err != nil {
+				log.Printf("Not passing %s with subtree %s: %v", address, bridge, err)
+				continue
+			}
+			functions = append(functions, dev)
+		}
+		if len(functions) == 0 {
+			log.Printf("No vfio-pci bound devices found below subtree bridge %s", bridge)
+			continue
+		}
+		sort.Slice(functions, func(i, j int) bool { return functions[i].Address < functions[j].Address })
+		iommuKey := subtreeKeyPrefix + bridge
+		iommuMap[iommuKey] = functions
+		subtreeResources[resources[bridge]] = append(subtreeResources[resources[bridge]], iommuKey)
+		log.Printf("Advertising %d function(s) below bridge %s as one %q device", len(functions), bridge, resources[bridge])
+	}
+}
+
+// belowBridge returns whether the device at address sits below the bridge
+func belowBridge(address, bridge string) bool {
+	for _, upstream := range upstreamBridges(filepath.Join(rootPath, pciDevicesPath, address)) {
+		if upstream == bridge {
+			return true
+		}
+	}
+	return false
+}
+
+// functionsBelowBridge lists the PCI addresses of all functions below the bridge
+func functionsBelowBridge(bridge string) []string {
+	entries, err := fsys.ReadDir(filepath.Join(rootPath, pciDevicesPath))
+	if err != nil {
+		log.Printf("Unable to list PCI devices: %v", err)
+		return nil
+	}
+	var addresses []string
+	for _, entry := range entries {
+		if belowBridge(entry.Name(), bridge) {
+			addresses = append(addresses, entry.Name())
+		}
+	}
+	return addresses
+}
+
+// removeIommuKey removes a key from the discovered devices
+func removeIommuKey(iommuKey string) {
+	delete(iommuMap, iommuKey)
+	delete(nicCompanions, iommuKey)
+	for deviceID, keys := range deviceMap {
+		for i, key := range keys {
+			if key == iommuKey {
+				keys = append(keys[:i:i], keys[i+1:]...)
+				break
+			}
+		}
+		if len(keys) == 0 {
+			delete(deviceMap, deviceID)
+		} else {
+			deviceMap[deviceID] = keys
+		}
+	}
+}
+
+// vfioGroupName returns the VFIO group node name of a function of a key:
+// the key's group, or the function's own group for a subtree
+func vfioGroupName(iommuKey string, dev NvidiaPCIDevice) string {
+	if isSubtreeKey(iommuKey) {
+		return strconv.Itoa(dev.IommuGroup)
+	}
+	return iommuKeyName(iommuKey)
+}
+
+// healthNodePath returns the VFIO node watched for the health of a key under
+// devicePath. A subtree is watched through its first function. Keys of
+// devices without an iommufd device are watched through their group node,
+// next to the iommufd devices directory, since hosts may mix both.
+func healthNodePath(devicePath, iommuKey string) string {
+	devicePath = filepath.Clean(devicePath)
+	groupPath := devicePath
+	if filepath.Base(devicePath) == "devices" {
+		groupPath = filepath.Dir(devicePath)
+	}
+	if isSubtreeKey(iommuKey) {
+		if devs := returnIommuMap()[iommuKey]; len(devs) > 0 {
+			if groupPath != devicePath && devs[0].IommuFD != "" {
+				return filepath.Join(devicePath, devs[0].IommuFD)
+			}
+			return filepath.Join(groupPath, strconv.Itoa(devs[0].IommuGroup))
+		}
+	}
+	if fd, ok := strings.CutPrefix(iommuKey, iommufdKeyPrefix); ok {
+		return filepath.Join(devicePath, fd)
+	}
+	if strings.HasPrefix(iommuKey, iommuGroupKeyPrefix) {
+		return filepath.Join(groupPath, iommuKeyName(iommuKey))
+	}
+	return filepath.Join(devicePath, iommuKeyName(iommuKey))
+}
+
+// appendCDIDeviceNodes appends the nodes whose path is not in nodes yet, since
+// the functions of a subtree share the VFIO control node and may share groups
+func appendCDIDeviceNodes(nodes, add []*specs.DeviceNode) []*specs.DeviceNode {
+	for _, node := range add {
+		seen := false
+		for _, existing := range nodes {
+			if existing.Path == node.Path {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+)
+
+// discoveryCache reuses what a discovery pass read from sysfs in the next
+// passes, as long as the PCI bus has not changed. Scanning the bus with nvpci
+// reads every function and parses the PCI ID database per NVIDIA function,
+// which dominates the rescan time on nodes with many GPUs, NVSwitches and VFs.
+var discoveryCache = getEnvBool("DISCOVERY_CACHE", true)
+
+// sysfsSnapshot holds the devices found by a scan of the PCI bus and the
+// attributes read for them from sysfs, for one state of the bus
+type sysfsSnapshot struct {
+	lock        sync.Mutex
+	fingerprint string
+	// lib and source are the scanner the devices were found with
+	lib     nvpci.Interface
+	source  string
+	scanned bool
+	devices []*nvpci.NvidiaPCIDevice
+	// attributes holds the discovered devices by PCI address
+	attributes map[string]NvidiaPCIDevice
+	// groupErrs holds the viability of the IOMMU groups by group number
+	groupErrs map[int]error
+}
+
+// sysfsSnapshots keeps the snapshot of the last discovery pass
+var sysfsSnapshots = &sysfsSnapshotCache{}
+
+// sysfsSnapshotCache hands out the snapshot of the current state of the PCI bus
+type sysfsSnapshotCache struct {
+	lock sync.Mutex
+	last *sysfsSnapshot
+}
+
+// current returns the snapshot of the last discovery pass if the PCI bus and
+// the scanner have not changed since, or a new empty snapshot. The snapshot
+// is not kept when the bus cannot be fingerprinted.
+func (c *sysfsSnapshotCache) current() *sysfsSnapshot {
+	snapshot := &sysfsSnapshot{
+		lib:        nvpciLib,
+		source:     discoverySource,
+		attributes: make(map[string]NvidiaPCIDevice),
+		groupErrs:  make(map[int]error),
+	}
+	if !discoveryCache {
+		return snapshot
+	}
+	fingerprint, err := pciBusFingerprint()
+	if err != nil {
+		return snapshot
+	}
+	snapshot.fingerprint = fingerprint
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if last := c.last; last != nil && last.fingerprint == fingerprint && last.lib == nvpciLib && last.source == discoverySource {
+		return last
+	}
+	c.last = snapshot
+	return snapshot
+}
+
+// reset drops the kept snapshot, so that the next pass reads sysfs again
+func (c *sysfsSnapshotCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.last = nil
+}
+
+// scan returns the NVIDIA PCI devices, scanning the bus unless a previous
+// scan of the snapshot succeeded
+func (s *sysfsSnapshot) scan() ([]*nvpci.NvidiaPCIDevice, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.scanned {
+		return s.devices, nil
+	}
+	devices, err := getAllDevices()
+	if err == nil {
+		s.devices, s.scanned = devices, true
+	}
+	return devices, err
+}
+
+// device returns the discovered device of the PCI function, reading its
+// attributes from sysfs unless the snapshot already holds them
+func (s *sysfsSnapshot) device(dev *nvpci.NvidiaPCIDevice) NvidiaPCIDevice {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d, ok := s.attributes[dev.Address]; ok {
+		return d
+	}
+	d := newNvidiaPCIDevice(dev)
+	s.attributes[dev.Address] = d
+	return d
+}
+
+// groupViable returns checkIommuGroupViable of the group, checking it unless
+// the snapshot already holds the result
+func (s *sysfsSnapshot) groupViable(group int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err, ok := s.groupErrs[group]; ok {
+		return err
+	}
+	err := checkIommuGroupViable(group)
+	s.groupErrs[group] = err
+	return err
+}
+
+// pciBusFingerprint identifies the state of the PCI bus that discovery
+// depends on: the functions present, their drivers and IOMMU groups, and the
+// device IDs and vfio cdevs of the functions bound to a vfio driver. Hot plug,
+// binding and unbinding drivers and reloading the vfio modules change it.
+// Only links and small attributes are read, so it is much cheaper than a scan.
+func pciBusFingerprint() (string, error) {
+	root := filepath.Join(rootPath, pciDevicesPath)
+	entries, err := fsys.ReadDir(root)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		devPath := filepath.Join(root, entry.Name())
+		driver, _ := os.Readlink(filepath.Join(devPath, "driver"))
+		group, _ := os.Readlink(filepath.Join(devPath, "iommu_group"))
+		fmt.Fprintf(&b, "%s %s %s", entry.Name(), filepath.Base(driver), filepath.Base(group))
+		if isVfioDriver(filepath.Base(driver)) {
+			id, _ := fsys.ReadFile(filepath.Join(devPath, "device"))
+			fmt.Fprintf(&b, " %s", strings.TrimSpace(string(id)))
+			cdevs, _ := fsys.ReadDir(filepath.Join(devPath, "vfio-dev"))
+			for _, cdev := range cdevs {
+				fmt.Fprintf(&b, " %s", cdev.Name())
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	defaultConnectionTimeout    = 5 * time.Second
+	defaultServerReadyTimeout   = 5 * time.Second
+	defaultRegistrationTimeout  = 10 * time.Second
+	defaultRegistrationAttempts = 5
+
+	// socketDirPollInterval is how often a removed device plugin socket
+	// directory is checked for being recreated
+	socketDirPollInterval = time.Second
+)
+
+var (
+	// connectionTimeout bounds dialing the kubelet and plugin sockets
+	connectionTimeout = getEnvDuration("CONNECTION_TIMEOUT", defaultConnectionTimeout)
+	// serverReadyTimeout bounds waiting for our own gRPC server to accept connections
+	serverReadyTimeout = getEnvDuration("SERVER_READY_TIMEOUT", defaultServerReadyTimeout)
+	// registrationTimeout bounds a single registration RPC to the kubelet
+	registrationTimeout = getEnvDuration("REGISTRATION_TIMEOUT", defaultRegistrationTimeout)
+	// registrationAttempts is the number of registration attempts before giving up
+	registrationAttempts = getEnvUint("REGISTRATION_ATTEMPTS", defaultRegistrationAttempts)
+)
+
+// registrationBackoff returns the jittered backoff between registration
+// attempts, so that plugins restarting together do not retry in lockstep
+func registrationBackoff() wait.Backoff {
+	steps := int(registrationAttempts)
+	if steps < 1 {
+		steps = 1
+	}
+	return wait.Backoff{
+		Duration: 1 * time.Second,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    steps,
+		Cap:      30 * time.Second,
+	}
+}
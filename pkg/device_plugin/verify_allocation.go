@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
+	"tags.cncf.io/container-device-interface/pkg/parser"
+)
+
+// VerifyAllocation discovers the devices and simulates an Allocate of the
+// given device IDs without changing the host. It writes the device nodes, CDI
+// devices, environment variables and annotations that would be returned per
+// resource, followed by any problems found, such as unknown or unhealthy
+// devices, missing device nodes or CDI devices absent from the CDI spec
+// directories. An error is returned if any problem was found. Allocation
+// policies are not evaluated, since there is no pod to match.
+func VerifyAllocation(w io.Writer, ids []string) error {
+	if nvpciLib == nil {
+		nvpciLib = nvpci.New()
+	}
+	discoveryState.set(createIommuDeviceMap())
+	if err := checkDiscoveryError(); err != nil {
+		return err
+	}
+	plugins, err := newDevicePlugins()
+	if err != nil {
+		return err
+	}
+	for _, dpi := range plugins {
+		dpi.dryRun = true
+	}
+	return verifyAllocation(w, plugins, ids)
+}
+
+// verifyAllocation simulates an Allocate of ids against the given plugins
+func verifyAllocation(w io.Writer, plugins []*GenericDevicePlugin, ids []string) error {
+	var problems []string
+	var order []*GenericDevicePlugin
+	requested := make(map[*GenericDevicePlugin][]string)
+	for _, id := range ids {
+		dpi, deviceID := pluginForDeviceID(plugins, id)
+		if dpi == nil {
+			problems = append(problems, fmt.Sprintf("unknown device id %s", id))
+			continue
+		}
+		if _, ok := requested[dpi]; !ok {
+			order = append(order, dpi)
+		}
+		requested[dpi] = append(requested[dpi], deviceID)
+	}
+
+	cache, err := cdiapi.NewCache(cdiapi.WithSpecDirs(cdiRoots()...), cdiapi.WithAutoRefresh(false))
+	if err != nil {
+		return fmt.Errorf("failed to load the CDI specs: %w", err)
+	}
+	// specs the runtime cannot load hide their devices
+	specErrors := cache.GetErrors()
+	paths := make([]string, 0, len(specErrors))
+	for path := range specErrors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for _, specErr := range specErrors[path] {
+			problems = append(problems, fmt.Sprintf("CDI spec %s: %v", path, specErr))
+		}
+	}
+	for _, dpi := range order {
+		deviceIDs := requested[dpi]
+		fmt.Fprintf(w, "Resource %s/%s, devices %s\n", DeviceNamespace, dpi.deviceName, strings.Join(deviceIDs, ", "))
+
+		var cdiNames []string
+		for _, deviceID := range deviceIDs {
+			cdiNames = append(cdiNames, parser.QualifiedName(cdiVendor, dpi.deviceName, cdiDeviceName(iommuKeyForDeviceID(deviceID))))
+		}
+		fmt.Fprintln(w, "  CDI devices:")
+		for _, name := range cdiNames {
+			fmt.Fprintf(w, "    %s\n", name)
+			if cache.GetDevice(name) == nil {
+				problems = append(problems, fmt.Sprintf("CDI device %s not found in %s", name, strings.Join(cdiRoots(), ", ")))
+			}
+		}
+
+		reqs := &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: deviceIDs}},
+		}
+		resp, err := dpi.Allocate(daemonCtx, reqs)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("allocating %s failed: %v", dpi.deviceName, err))
+			continue
+		}
+		for _, container := range resp.ContainerResponses {
+			fmt.Fprintln(w, "  Device nodes:")
+			for _, spec := range container.Devices {
+				fmt.Fprintf(w, "    %s -> %s (%s)\n", spec.HostPath, spec.ContainerPath, spec.Permissions)
+				if _, err := fsys.Stat(filepath.Join(rootPath, spec.HostPath)); err != nil {
+					problems = append(problems, fmt.Sprintf("device node %s: %v", spec.HostPath, err))
+				}
+			}
+			if len(container.CDIDevices) > 0 {
+				fmt.Fprintln(w, "  CDI devices returned:")
+				for _, dev := range container.CDIDevices {
+					fmt.Fprintf(w, "    %s\n", dev.Name)
+				}
+			}
+			fmt.Fprintln(w, "  Envs:")
+			for _, key := range sortedKeys(container.Envs) {
+				fmt.Fprintf(w, "    %s=%s\n", key, container.Envs[key])
+			}
+			fmt.Fprintln(w, "  Annotations:")
+			for _, key := range sortedKeys(container.Annotations) {
+				fmt.Fprintf(w, "    %s=%s\n", key, container.Annotations[key])
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "No problems found")
+		return nil
+	}
+	fmt.Fprintln(w, "Problems:")
+	for _, problem := range problems {
+		fmt.Fprintf(w, "  - %s\n", problem)
+	}
+	return fmt.Errorf("found %d problem(s)", len(problems))
+}
+
+// pluginForDeviceID returns the plugin serving the device with the
+// given ID, IOMMU key or IOMMU group/fd number, along with its advertised ID
+func pluginForDeviceID(plugins []*GenericDevicePlugin, id string) (*GenericDevicePlugin, string) {
+	deviceID := stableIDForIommuKey(iommuKeyForDeviceID(id))
+	for _, dpi := range plugins {
+		for _, dev := range dpi.devs {
+			if dev.ID == deviceID {
+				return dpi, deviceID
+			}
+		}
+	}
+	return nil, ""
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
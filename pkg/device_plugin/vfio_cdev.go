@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvpci"
+	"github.com/NVIDIA/go-nvlib/pkg/pciids"
+)
+
+const (
+	// discoverySourceNvpci scans the PCI bus with nvpci
+	discoverySourceNvpci = "nvpci"
+	// discoverySourceVfioCdev enumerates the vfio device cdevs
+	discoverySourceVfioCdev = "vfio-cdev"
+	// discoverySourceAuto scans with nvpci and enumerates the vfio device
+	// cdevs when the scan fails or finds no device
+	discoverySourceAuto = "auto"
+
+	vfioDevClassPath = "sys/class/vfio-dev"
+)
+
+// discoverySource selects how the NVIDIA devices are found
+var discoverySource = getEnvString("DISCOVERY_SOURCE", discoverySourceNvpci)
+
+// getVfioCdevDevices returns the NVIDIA functions that have a vfio device
+// cdev. Every entry of /sys/class/vfio-dev names a cdev in /dev/vfio/devices
+// and links to its PCI function, whose IDs, class, IOMMU group and NUMA node
+// are read from sysfs. Only functions bound to vfio-pci have cdevs, and only
+// on kernels with iommufd support.
+func getVfioCdevDevices() ([]*nvpci.NvidiaPCIDevice, error) {
+	entries, err := fsys.ReadDir(filepath.Join(rootPath, vfioDevClassPath))
+	if err != nil {
+		return nil, fmt.Errorf("unable to enumerate vfio device cdevs: %w", err)
+	}
+	var devices []*nvpci.NvidiaPCIDevice
+	var errs []error
+	for _, entry := range entries {
+		dev, err := readVfioCdevDevice(entry.Name())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vfio device %s: %w", entry.Name(), err))
+			continue
+		}
+		if dev != nil {
+			devices = append(devices, dev)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Address < devices[j].Address })
+	return devices, errors.Join(errs...)
+}
+
+// readVfioCdevDevice returns the PCI function of a vfio device cdev, or nil
+// if it is not an NVIDIA function
+func readVfioCdevDevice(name string) (*nvpci.NvidiaPCIDevice, error) {
+	link, err := filepath.EvalSymlinks(filepath.Join(rootPath, vfioDevClassPath, name, "device"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve its PCI function: %w", err)
+	}
+	address := filepath.Base(link)
+	devPath := filepath.Join(rootPath, pciDevicesPath, address)
+	vendor, err := readSysfsHex(filepath.Join(devPath, "vendor"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the vendor of %s: %w", address, err)
+	}
+	if vendor != uint64(nvpci.PCINvidiaVendorID) {
+		return nil, nil
+	}
+	if _, err := fsys.Stat(filepath.Join(rootPath, vfioDevicePath, "devices", name)); err != nil {
+		return nil, fmt.Errorf("cdev of %s missing: %w", address, err)
+	}
+	device, err := readSysfsHex(filepath.Join(devPath, "device"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the device ID of %s: %w", address, err)
+	}
+	class, err := readSysfsHex(filepath.Join(devPath, "class"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the class of %s: %w", address, err)
+	}
+	pci, err := readPCIDevice(address)
+	if err != nil {
+		return nil, err
+	}
+	numaNode := -1
+	if data, err := fsys.ReadFile(filepath.Join(devPath, "numa_node")); err == nil {
+		fmt.Sscan(string(data), &numaNode)
+	}
+
+	deviceName := lookupDeviceName(uint16(device))
+	if deviceName == "" {
+		if deviceName, err = pciids.NewDB().GetDeviceName(nvpci.PCINvidiaVendorID, uint16(device)); err != nil {
+			deviceName = nvpci.UnknownDeviceString
+		}
+	}
+	return &nvpci.NvidiaPCIDevice{
+		Path:       devPath,
+		Address:    address,
+		Vendor:     nvpci.PCINvidiaVendorID,
+		Class:      uint32(class),
+		Device:     uint16(device),
+		DeviceName: deviceName,
+		Driver:     pci.Driver,
+		IommuGroup: pci.IommuGroup,
+		IommuFD:    name,
+		NumaNode:   numaNode,
+	}, nil
+}
+
+// scanDevices returns the NVIDIA PCI devices found by DISCOVERY_SOURCE
+func scanDevices() ([]*nvpci.NvidiaPCIDevice, error) {
+	switch discoverySource {
+	case discoverySourceVfioCdev:
+		return getVfioCdevDevices()
+	case discoverySourceAuto:
+		devices, err := nvpciLib.GetAllDevices()
+		if err == nil && len(devices) > 0 {
+			return devices, nil
+		}
+		if err != nil {
+			log.Printf("Error scanning the PCI bus: %v, enumerating vfio device cdevs", err)
+		} else {
+			log.Printf("No NVIDIA device found on the PCI bus, enumerating vfio device cdevs")
+		}
+		return getVfioCdevDevices()
+	case discoverySourceNvpci:
+	default:
+		log.Printf("Unknown DISCOVERY_SOURCE %q, using %s", discoverySource, discoverySourceNvpci)
+	}
+	return nvpciLib.GetAllDevices()
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"strings"
+)
+
+const defaultVfioDrivers = "vfio-pci"
+
+// vfioDrivers are the drivers a device may be bound to in order to be
+// advertised: vfio-pci and the variant drivers built on vfio-pci-core, such as
+// nvgrace-gpu-vfio-pci or nvidia-vgpu-vfio, which expose the same VFIO
+// device interface
+var vfioDrivers = parseVfioDrivers(getEnvString("VFIO_DRIVERS", defaultVfioDrivers))
+
+// parseVfioDrivers parses a comma separated list of driver names, falling
+// back to vfio-pci when the list is empty
+func parseVfioDrivers(value string) []string {
+	var drivers []string
+	for _, driver := range strings.Split(value, ",") {
+		if driver = strings.TrimSpace(driver); driver != "" {
+			drivers = append(drivers, driver)
+		}
+	}
+	if len(drivers) == 0 {
+		return []string{defaultVfioDrivers}
+	}
+	return drivers
+}
+
+// isVfioDriver returns whether devices bound to the driver can be advertised
+func isVfioDriver(driver string) bool {
+	for _, d := range vfioDrivers {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultVfioPermissionInterval = time.Minute
+
+// vfioPermissions sets the owner and mode of allocated VFIO device nodes, for
+// runtimes whose shim does not run as root, and restores them if they drift
+type vfioPermissions struct {
+	uid  int // -1 leaves the owner unchanged
+	gid  int // -1 leaves the group unchanged
+	mode os.FileMode
+
+	lock      sync.Mutex
+	allocated map[string]bool
+}
+
+var vfioPerms = loadVfioPermissions()
+
+// loadVfioPermissions reads VFIO_DEVICE_UID, VFIO_DEVICE_GID and the octal
+// VFIO_DEVICE_MODE. Unset values are left alone on the device nodes.
+func loadVfioPermissions() *vfioPermissions {
+	p := &vfioPermissions{uid: -1, gid: -1, allocated: make(map[string]bool)}
+	if value := os.Getenv("VFIO_DEVICE_UID"); value != "" {
+		if uid, err := strconv.Atoi(value); err == nil && uid >= 0 {
+			p.uid = uid
+		} else {
+			log.Printf("Invalid VFIO_DEVICE_UID %q, not changing device owner", value)
+		}
+	}
+	if value := os.Getenv("VFIO_DEVICE_GID"); value != "" {
+		if gid, err := strconv.Atoi(value); err == nil && gid >= 0 {
+			p.gid = gid
+		} else {
+			log.Printf("Invalid VFIO_DEVICE_GID %q, not changing device group", value)
+		}
+	}
+	if value := os.Getenv("VFIO_DEVICE_MODE"); value != "" {
+		if mode, err := parseFileMode(value); err == nil {
+			p.mode = mode
+		} else {
+			log.Printf("Invalid VFIO_DEVICE_MODE %q, not changing device mode", value)
+		}
+	}
+	return p
+}
+
+// parseFileMode parses an octal permission mode, where empty is no mode
+func parseFileMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid octal mode %q", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// enabled returns true if any ownership or mode is configured
+func (p *vfioPermissions) enabled() bool {
+	return p.uid >= 0 || p.gid >= 0 || p.mode != 0
+}
+
+// apply sets the configured owner and mode on the device node at hostPath
+// and remembers it for drift reconciliation
+func (p *vfioPermissions) apply(hostPath string) error {
+	if !p.enabled() {
+		return nil
+	}
+	p.lock.Lock()
+	p.allocated[hostPath] = true
+	p.lock.Unlock()
+	_, err := p.reconcile(hostPath)
+	return err
+}
+
+// reconcile corrects the owner and mode of the device node if they differ
+// from the configuration, and reports whether anything was changed
+func (p *vfioPermissions) reconcile(hostPath string) (bool, error) {
+	path := filepath.Join(rootPath, hostPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("unable to stat %s: %w", path, err)
+	}
+	changed := false
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if (p.uid >= 0 && int(st.Uid) != p.uid) || (p.gid >= 0 && int(st.Gid) != p.gid) {
+			if err := os.Chown(path, p.uid, p.gid); err != nil {
+				return false, fmt.Errorf("unable to change owner of %s: %w", path, err)
+			}
+			changed = true
+		}
+	}
+	if p.mode != 0 && info.Mode().Perm() != p.mode {
+		if err := os.Chmod(path, p.mode); err != nil {
+			return false, fmt.Errorf("unable to change mode of %s: %w", path, err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// reconcileAll restores the owner and mode of all allocated device nodes.
+// Nodes that disappeared are forgotten.
+func (p *vfioPermissions) reconcileAll() {
+	p.lock.Lock()
+	paths := make([]string, 0, len(p.allocated))
+	for path := range p.allocated {
+		paths = append(paths, path)
+	}
+	p.lock.Unlock()
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		changed, err := p.reconcile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				p.lock.Lock()
+				delete(p.allocated, path)
+				p.lock.Unlock()
+				continue
+			}
+			log.Printf("Error reconciling permissions of %s: %v", path, err)
+			continue
+		}
+		if changed {
+			log.Printf("Restored owner and mode of %s", path)
+		}
+	}
+}
+
+// runVfioPermissionReconciler periodically corrects permission drift of
+// allocated device nodes until the daemon context is canceled
+func runVfioPermissionReconciler() {
+	if !vfioPerms.enabled() {
+		return
+	}
+	ticker := time.NewTicker(getEnvDuration("VFIO_PERMISSION_INTERVAL", defaultVfioPermissionInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-ticker.C:
+			vfioPerms.reconcileAll()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// vfioReloadCheckInterval is how often the vfio modules are checked for a
+// reload; zero disables the check
+var vfioReloadCheckInterval = getEnvDuration("VFIO_RELOAD_CHECK_INTERVAL", 10*time.Second)
+
+// vfioModulePaths are the sysfs directories of the modules whose reload
+// replaces every VFIO device node
+var vfioModulePaths = []string{"sys/module/vfio", vfioPCIModulePath}
+
+// vfioModulesFingerprint identifies the loaded instances of the vfio modules
+// by the inodes of their sysfs directories, which are recreated when a module
+// is loaded again. Missing modules are reported as "-".
+func vfioModulesFingerprint() string {
+	parts := make([]string, 0, len(vfioModulePaths))
+	for _, path := range vfioModulePaths {
+		info, err := os.Stat(filepath.Join(rootPath, path))
+		if err != nil {
+			parts = append(parts, "-")
+			continue
+		}
+		ino := uint64(0)
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			ino = st.Ino
+		}
+		parts = append(parts, fmt.Sprintf("%d", ino))
+	}
+	return strings.Join(parts, ",")
+}
+
+// vfioReloadMonitor pauses advertisement while the vfio modules are reloaded,
+// e.g. during node maintenance, and rediscovers the devices once they are
+// back. Otherwise the plugins would keep advertising every device unhealthy,
+// since all VFIO nodes vanish and reappear with a new state.
+type vfioReloadMonitor struct {
+	last      string
+	reloading bool
+	pause     func()
+	resume    func()
+}
+
+func newVfioReloadMonitor(m *DevicePluginManager) *vfioReloadMonitor {
+	return &vfioReloadMonitor{
+		last:   vfioModulesFingerprint(),
+		pause:  m.pause,
+		resume: m.resume,
+	}
+}
+
+// check compares the modules with the previous check. Advertisement is paused
+// when they changed, and resumed once they are loaded and unchanged for a
+// whole interval.
+func (r *vfioReloadMonitor) check() {
+	current := vfioModulesFingerprint()
+	changed := current != r.last
+	r.last = current
+	switch {
+	case changed && !r.reloading:
+		r.reloading = true
+		msg := "The vfio modules were reloaded, pausing device advertisement until they settle"
+		log.Print(msg)
+		events.warning("VfioReloadDetected", msg)
+		r.pause()
+	case r.reloading && !changed && !strings.Contains(current, "-"):
+		r.reloading = false
+		msg := "The vfio modules settled, rediscovering the devices"
+		log.Print(msg)
+		events.normal("VfioReloadReconciled", msg)
+		r.resume()
+	}
+}
+
+// runVfioReloadMonitor checks the vfio modules for reloads until the daemon
+// context is canceled
+func runVfioReloadMonitor(m *DevicePluginManager) {
+	if vfioReloadCheckInterval <= 0 {
+		return
+	}
+	r := newVfioReloadMonitor(m)
+	ticker := time.NewTicker(vfioReloadCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-daemonCtx.Done():
+			return
+		case <-ticker.C:
+			r.check()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *  * Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ *  * Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *  * Neither the name of NVIDIA CORPORATION nor the names of its
+ *    contributors may be used to endorse or promote products derived
+ *    from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS ``AS IS'' AND ANY
+ * EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY
+ * OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package device_plugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// vpdTagEnd is the small resource tag ending the VPD
+	vpdTagEnd = 0x0f
+	// vpdTagReadOnly is the large resource tag of the read-only VPD fields
+	vpdTagReadOnly = 0x10
+	// vpdKeywordSerial is the VPD keyword of the board serial number
+	vpdKeywordSerial = "SN"
+)
+
+// readBoardSerial returns the board serial number from the Vital Product
+// Data of the device, or an empty string if the device exposes none
+func readBoardSerial(address string) string {
+	data, err := fsys.ReadFile(filepath.Join(rootPath, pciDevicesPath, address, "vpd"))
+	if err != nil {
+		return ""
+	}
+	return parseVPDKeyword(data, vpdKeywordSerial)
+}
+
+// parseVPDKeyword returns the value of a keyword of the read-only VPD
+// fields. VPD is a list of resources: small ones have a one byte header
+// holding the tag and length, large ones a three byte header with a 16 bit
+// length. The read-only resource is a list of two character keywords, each
+// followed by a one byte length and the value.
+func parseVPDKeyword(data []byte, keyword string) string {
+	for len(data) > 0 {
+		var tag byte
+		var length, header int
+		if data[0]&0x80 == 0 {
+			tag, length, header = (data[0]>>3)&0x0f, int(data[0]&0x07), 1
+			if tag == vpdTagEnd {
+				return ""
+			}
+		} else {
+			if len(data) < 3 {
+				return ""
+			}
+			tag, length, header = data[0]&0x7f, int(binary.LittleEndian.Uint16(data[1:3])), 3
+		}
+		if len(data) < header+length {
+			return ""
+		}
+		if tag == vpdTagReadOnly {
+			if value, ok := vpdField(data[header:header+length], keyword); ok {
+				return value
+			}
+		}
+		data = data[header+length:]
+	}
+	return ""
+}
+
+// vpdField looks up a keyword in the fields of a VPD resource
+func vpdField(fields []byte, keyword string) (string, bool) {
+	for len(fields) >= 3 {
+		length := int(fields[2])
+		if len(fields) < 3+length {
+			return "", false
+		}
+		if string(fields[:2]) == keyword {
+			return strings.TrimSpace(strings.TrimRight(string(fields[3:3+length]), "\x00")), true
+		}
+		fields = fields[3+length:]
+	}
+	return "", false
+}
+
+// deviceSerials describes the serial numbers of a device for the allocation
+// log, so that physical cards can be tracked through allocations
+func deviceSerials(dev NvidiaPCIDevice) string {
+	var parts []string
+	if dev.BoardSerial != "" {
+		parts = append(parts, fmt.Sprintf("board serial: %s", dev.BoardSerial))
+	}
+	if dev.Serial != "" {
+		parts = append(parts, fmt.Sprintf("serial: %s", dev.Serial))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(parts, ", ")
+}